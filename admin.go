@@ -0,0 +1,350 @@
+package turn
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminAuthorizer decides if an HTTP request to the admin handler may proceed
+type AdminAuthorizer func(r *http.Request) bool
+
+// AdminBearerToken returns an AdminAuthorizer that admits requests carrying
+// an "Authorization: Bearer <token>" header with the given token
+func AdminBearerToken(token string) AdminAuthorizer {
+	return func(r *http.Request) bool {
+		got := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(got, "Bearer ") {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(got[len("Bearer "):]), []byte(token)) == 1
+	}
+}
+
+// String returns the identifier of the FiveTuple used by the admin handler
+func (f FiveTuple) String() string {
+	return fmt.Sprintf("%s_%s_%s", f.Protocol, addrString(f.SrcAddr), addrString(f.DstAddr))
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+type adminFiveTuple struct {
+	Protocol string `json:"protocol"`
+	SrcAddr  string `json:"srcAddr"`
+	DstAddr  string `json:"dstAddr"`
+}
+
+type adminTraffic struct {
+	PacketsToPeer   uint64 `json:"packetsToPeer"`
+	BytesToPeer     uint64 `json:"bytesToPeer"`
+	PacketsToClient uint64 `json:"packetsToClient"`
+	BytesToClient   uint64 `json:"bytesToClient"`
+	DroppedPackets  uint64 `json:"droppedPackets"`
+	DroppedBytes    uint64 `json:"droppedBytes"`
+}
+
+type adminPermission struct {
+	PeerAddr  string       `json:"peerAddr"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+	Traffic   adminTraffic `json:"traffic"`
+}
+
+type adminChannel struct {
+	Number    uint16       `json:"number"`
+	PeerAddr  string       `json:"peerAddr"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+	Traffic   adminTraffic `json:"traffic"`
+}
+
+type adminAllocation struct {
+	ID                       string            `json:"id"`
+	FiveTuple                adminFiveTuple    `json:"fiveTuple"`
+	Username                 string            `json:"username"`
+	Realm                    string            `json:"realm"`
+	RelayAddr                string            `json:"relayAddr"`
+	CreatedAt                time.Time         `json:"createdAt"`
+	RemainingLifetimeSeconds int64             `json:"remainingLifetimeSeconds"`
+	PermissionCount          int               `json:"permissionCount"`
+	ChannelCount             int               `json:"channelCount"`
+	Traffic                  adminTraffic      `json:"traffic"`
+	Permissions              []adminPermission `json:"permissions,omitempty"`
+	Channels                 []adminChannel    `json:"channels,omitempty"`
+}
+
+type adminListener struct {
+	Network               string `json:"network"`
+	Address               string `json:"address"`
+	RelayAddressGenerator string `json:"relayAddressGenerator"`
+}
+
+type adminConfig struct {
+	Realm                     string          `json:"realm"`
+	ChannelBindTimeoutSeconds int64           `json:"channelBindTimeoutSeconds"`
+	PermissionTimeoutSeconds  int64           `json:"permissionTimeoutSeconds"`
+	NonceLifetimeSeconds      int64           `json:"nonceLifetimeSeconds"`
+	AllocationLifetime        adminLifetime   `json:"allocationLifetime"`
+	InboundMTU                int             `json:"inboundMTU"`
+	MetricsEnabled            bool            `json:"metricsEnabled"`
+	TenantIsolation           bool            `json:"tenantIsolation"`
+	RevokedUsers              []RevokedUser   `json:"revokedUsers"`
+	Listeners                 []adminListener `json:"listeners"`
+}
+
+type adminLifetime struct {
+	DefaultSeconds int64 `json:"defaultSeconds"`
+	MinSeconds     int64 `json:"minSeconds"`
+	MaxSeconds     int64 `json:"maxSeconds"`
+}
+
+type adminHealth struct {
+	Status      string `json:"status"`
+	Allocations int    `json:"allocations"`
+}
+
+type adminDeleted struct {
+	Deleted int `json:"deleted"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func newAdminTraffic(t TrafficCounters) adminTraffic {
+	return adminTraffic(t)
+}
+
+func newAdminAllocation(a AllocationInfo, details bool) adminAllocation {
+	out := adminAllocation{
+		ID: a.FiveTuple.String(),
+		FiveTuple: adminFiveTuple{
+			Protocol: a.FiveTuple.Protocol,
+			SrcAddr:  addrString(a.FiveTuple.SrcAddr),
+			DstAddr:  addrString(a.FiveTuple.DstAddr),
+		},
+		Username:                 a.Username,
+		Realm:                    a.Realm,
+		RelayAddr:                addrString(a.RelayAddr),
+		CreatedAt:                a.CreatedAt,
+		RemainingLifetimeSeconds: int64(a.RemainingLifetime / time.Second),
+		PermissionCount:          len(a.Permissions),
+		ChannelCount:             len(a.Channels),
+		Traffic:                  newAdminTraffic(a.Traffic),
+	}
+	if !details {
+		return out
+	}
+
+	for _, p := range a.Permissions {
+		out.Permissions = append(out.Permissions, adminPermission{
+			PeerAddr:  addrString(p.PeerAddr),
+			ExpiresAt: p.ExpiresAt,
+			Traffic:   newAdminTraffic(p.Traffic),
+		})
+	}
+	for _, c := range a.Channels {
+		out.Channels = append(out.Channels, adminChannel{
+			Number:    c.Number,
+			PeerAddr:  addrString(c.PeerAddr),
+			ExpiresAt: c.ExpiresAt,
+			Traffic:   newAdminTraffic(c.Traffic),
+		})
+	}
+	return out
+}
+
+// AdminHandler returns an http.Handler to inspect and operate the running server.
+// Every request must be admitted by authorize, a nil authorize rejects every request.
+// The handler is meant to be mounted on a loopback or otherwise private listener,
+// use http.StripPrefix to serve it below a path prefix. It serves:
+//
+//	GET    /health                     server status, ok or draining, and allocation count
+//	GET    /config                     effective configuration
+//	GET    /allocations                list allocations, filtered by the username, srcAddr and dstAddr query parameters
+//	DELETE /allocations                delete the allocations matching the filters, all=true is required without filters
+//	GET    /allocations/{id}           a single allocation with its permissions and channels
+//	DELETE /allocations/{id}           delete a single allocation
+//	POST   /users/{username}/revoke    reject the user from now on and delete their allocations
+//	DELETE /users/{username}/revoke    admit the user again
+//
+// Users are revoked in the realm of the realm query parameter, the Realm of the server
+// if it is empty.
+func (s *Server) AdminHandler(authorize AdminAuthorizer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.adminHealth)
+	mux.HandleFunc("/config", s.adminConfig)
+	mux.HandleFunc("/allocations", s.adminAllocations)
+	mux.HandleFunc("/allocations/", s.adminAllocation)
+	mux.HandleFunc("/users/", s.adminUser)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			writeAdminError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	health := adminHealth{
+		Status:      "ok",
+		Allocations: s.AllocationCount(),
+	}
+	if s.drainState() != nil {
+		health.Status = "draining"
+	}
+	writeAdminJSON(w, http.StatusOK, health)
+}
+
+func (s *Server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	lifetime := s.lifetimePolicy.WithDefaults()
+	cfg := adminConfig{
+		Realm:                     s.realm,
+		ChannelBindTimeoutSeconds: int64(s.channelBindTimeout / time.Second),
+		PermissionTimeoutSeconds:  int64(s.permissionTimeout / time.Second),
+		NonceLifetimeSeconds:      int64(s.nonceLifetime / time.Second),
+		AllocationLifetime: adminLifetime{
+			DefaultSeconds: int64(lifetime.Default / time.Second),
+			MinSeconds:     int64(lifetime.Min / time.Second),
+			MaxSeconds:     int64(lifetime.Max / time.Second),
+		},
+		InboundMTU:      s.inboundMTU,
+		MetricsEnabled:  s.metrics != nil,
+		TenantIsolation: s.isolatePeers != nil,
+		RevokedUsers:    s.RevokedUsers(),
+		Listeners:       []adminListener{},
+	}
+	for _, l := range s.listenersSnapshot() {
+		cfg.Listeners = append(cfg.Listeners, adminListener{
+			Network:               l.addr().Network(),
+			Address:               l.addr().String(),
+			RelayAddressGenerator: fmt.Sprintf("%T", l.relayAddressGenerator),
+		})
+	}
+
+	writeAdminJSON(w, http.StatusOK, cfg)
+}
+
+func (s *Server) adminAllocations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	username, srcAddr, dstAddr := query.Get("username"), query.Get("srcAddr"), query.Get("dstAddr")
+	filter := func(a AllocationInfo) bool {
+		return (username == "" || a.Username == username) &&
+			(srcAddr == "" || addrMatches(a.FiveTuple.SrcAddr, srcAddr)) &&
+			(dstAddr == "" || addrMatches(a.FiveTuple.DstAddr, dstAddr))
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		allocations := []adminAllocation{}
+		for _, a := range s.Allocations() {
+			if filter(a) {
+				allocations = append(allocations, newAdminAllocation(a, false))
+			}
+		}
+		writeAdminJSON(w, http.StatusOK, allocations)
+	case http.MethodDelete:
+		if username == "" && srcAddr == "" && dstAddr == "" && query.Get("all") != "true" {
+			writeAdminError(w, http.StatusBadRequest, "refusing to delete every allocation without all=true")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, adminDeleted{Deleted: s.DeleteAllocations(filter)})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) adminAllocation(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/allocations/")
+
+	var found *AllocationInfo
+	for _, a := range s.Allocations() {
+		if a.FiveTuple.String() == id {
+			a := a
+			found = &a
+			break
+		}
+	}
+	if found == nil {
+		writeAdminError(w, http.StatusNotFound, "no such allocation")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, newAdminAllocation(*found, true))
+	case http.MethodDelete:
+		if !s.DeleteAllocation(found.FiveTuple) {
+			writeAdminError(w, http.StatusNotFound, "no such allocation")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, adminDeleted{Deleted: 1})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) adminUser(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "revoke" {
+		writeAdminError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	realm := r.URL.Query().Get("realm")
+	if realm == "" {
+		realm = s.realm
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		writeAdminJSON(w, http.StatusOK, adminDeleted{Deleted: s.RevokeUser(realm, parts[0])})
+	case http.MethodDelete:
+		s.RestoreUser(realm, parts[0])
+		writeAdminJSON(w, http.StatusOK, adminDeleted{})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// addrMatches reports if addr is equal to filter, either as IP:port or as a bare IP
+func addrMatches(addr net.Addr, filter string) bool {
+	if addr == nil {
+		return false
+	}
+	if addr.String() == filter {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	return err == nil && host == filter
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, adminError{Error: msg})
+}
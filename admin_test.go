@@ -0,0 +1,189 @@
+//go:build !js
+// +build !js
+
+package turn
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandler(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: "127.0.0.1:3478",
+		TURNServerAddr: "127.0.0.1:3478",
+		Conn:           conn,
+		Username:       "alice",
+		Password:       "pass",
+		Realm:          "pion.ly",
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345}))
+
+	handler := server.AdminHandler(AdminBearerToken("secret"))
+	do := func(method, target string, v interface{}) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		if v != nil {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+		}
+		return rec.Code
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		// the token alone, without the Bearer scheme, is not accepted
+		for _, authorization := range []string{"secret", "Bearer other", "Basic secret"} {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.Header.Set("Authorization", authorization)
+			rec = httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusForbidden, rec.Code, authorization)
+		}
+
+		rec = httptest.NewRecorder()
+		server.AdminHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		var health adminHealth
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/health", &health))
+		assert.Equal(t, adminHealth{Status: "ok", Allocations: 1}, health)
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		var cfg map[string]interface{}
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/config", &cfg))
+		assert.Equal(t, "pion.ly", cfg["realm"])
+		assert.Equal(t, float64(600), cfg["channelBindTimeoutSeconds"])
+		assert.Equal(t, float64(300), cfg["permissionTimeoutSeconds"])
+		assert.Equal(t, float64(3600), cfg["nonceLifetimeSeconds"])
+		assert.Equal(t, false, cfg["tenantIsolation"])
+		assert.Equal(t, map[string]interface{}{
+			"defaultSeconds": float64(600),
+			"minSeconds":     float64(600),
+			"maxSeconds":     float64(3600),
+		}, cfg["allocationLifetime"])
+		assert.Equal(t, []interface{}{map[string]interface{}{
+			"network":               "udp",
+			"address":               "0.0.0.0:3478",
+			"relayAddressGenerator": "*turn.RelayAddressGeneratorStatic",
+		}}, cfg["listeners"])
+	})
+
+	var id string
+	t.Run("List allocations", func(t *testing.T) {
+		var allocations []adminAllocation
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/allocations?username=alice&srcAddr=127.0.0.1", &allocations))
+		assert.Len(t, allocations, 1)
+		assert.Equal(t, "alice", allocations[0].Username)
+		assert.Equal(t, conn.LocalAddr().String(), allocations[0].FiveTuple.SrcAddr)
+		assert.Equal(t, relayConn.LocalAddr().String(), allocations[0].RelayAddr)
+		assert.Equal(t, 1, allocations[0].PermissionCount)
+		assert.Nil(t, allocations[0].Permissions)
+		id = allocations[0].ID
+
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/allocations?username=bob", &allocations))
+		assert.Len(t, allocations, 0)
+	})
+
+	t.Run("Get allocation", func(t *testing.T) {
+		var allocation adminAllocation
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/allocations/"+url.PathEscape(id), &allocation))
+		assert.Equal(t, id, allocation.ID)
+		assert.Len(t, allocation.Permissions, 1)
+		assert.Equal(t, "127.0.0.4:12345", allocation.Permissions[0].PeerAddr)
+
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/allocations/udp_1.1.1.1:1_2.2.2.2:2", nil))
+	})
+
+	t.Run("Delete allocations", func(t *testing.T) {
+		var deleted adminDeleted
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/allocations", nil))
+		assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/allocations?username=bob", &deleted))
+		assert.Equal(t, 0, deleted.Deleted)
+		assert.Equal(t, 1, server.AllocationCount())
+	})
+
+	t.Run("Revoke user", func(t *testing.T) {
+		var deleted adminDeleted
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, "/users/alice/revoke", &deleted))
+		assert.Equal(t, 1, deleted.Deleted)
+		assert.Equal(t, 0, server.AllocationCount())
+		assert.Equal(t, []RevokedUser{{Realm: "pion.ly", Username: "alice"}}, server.RevokedUsers())
+
+		// the allocation is already gone on the server, closing only stops the client refresh timers
+		assert.NoError(t, relayConn.Close())
+
+		_, err = client.Allocate()
+		assert.Error(t, err)
+
+		assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/users/alice/revoke", nil))
+		assert.Empty(t, server.RevokedUsers())
+
+		relayConn, err = client.Allocate()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, server.AllocationCount())
+
+		assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/allocations?all=true", &deleted))
+		assert.Equal(t, 1, deleted.Deleted)
+		assert.NoError(t, relayConn.Close())
+	})
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
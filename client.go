@@ -14,6 +14,7 @@ import (
 	"github.com/pion/transport/v2/stdnet"
 	"github.com/pion/transport/v2/vnet"
 	"github.com/pion/turn/v2/internal/client"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/proto"
 )
 
@@ -45,6 +46,11 @@ type ClientConfig struct {
 	Conn           net.PacketConn // Listening socket (net.PacketConn)
 	LoggerFactory  logging.LoggerFactory
 	Net            transport.Net
+	Clock          Clock // Time source of the refresh timers, defaults to the system clock
+
+	// RequestRealm sends Realm in the first Allocate request, servers hosting several
+	// realms then answer with that realm instead of their default one
+	RequestRealm bool
 }
 
 // Client is a STUN server client
@@ -57,6 +63,7 @@ type Client struct {
 	username      stun.Username          // read-only
 	password      string                 // read-only
 	realm         stun.Realm             // read-only
+	requestRealm  bool                   // read-only
 	integrity     stun.MessageIntegrity  // read-only
 	software      stun.Software          // read-only
 	trMap         *client.TransactionMap // thread-safe
@@ -68,6 +75,7 @@ type Client struct {
 	mutex         sync.RWMutex           // thread-safe
 	mutexTrMap    sync.Mutex             // thread-safe
 	log           logging.LeveledLogger  // read-only
+	clock         clock.Clock            // read-only
 }
 
 // NewClient returns a new Client instance. listeningAddress is the address and port to listen on, default "0.0.0.0:0"
@@ -114,25 +122,32 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		log.Debugf("turnServ: %s", turnServStr)
 	}
 
+	clk := config.Clock
+	if clk == nil {
+		clk = clock.System
+	}
+
 	rto := defaultRTO
 	if config.RTO > 0 {
 		rto = config.RTO
 	}
 
 	c := &Client{
-		conn:        config.Conn,
-		stunServ:    stunServ,
-		turnServ:    turnServ,
-		stunServStr: stunServStr,
-		turnServStr: turnServStr,
-		username:    stun.NewUsername(config.Username),
-		password:    config.Password,
-		realm:       stun.NewRealm(config.Realm),
-		software:    stun.NewSoftware(config.Software),
-		net:         config.Net,
-		trMap:       client.NewTransactionMap(),
-		rto:         rto,
-		log:         log,
+		conn:         config.Conn,
+		stunServ:     stunServ,
+		turnServ:     turnServ,
+		stunServStr:  stunServStr,
+		turnServStr:  turnServStr,
+		username:     stun.NewUsername(config.Username),
+		password:     config.Password,
+		realm:        stun.NewRealm(config.Realm),
+		requestRealm: config.RequestRealm,
+		software:     stun.NewSoftware(config.Software),
+		net:          config.Net,
+		trMap:        client.NewTransactionMap(),
+		rto:          rto,
+		log:          log,
+		clock:        clk,
 	}
 
 	return c, nil
@@ -250,12 +265,16 @@ func (c *Client) Allocate() (net.PacketConn, error) {
 		return nil, fmt.Errorf("%w: %s", errAlreadyAllocated, relayedConn.LocalAddr().String())
 	}
 
-	msg, err := stun.Build(
+	setters := []stun.Setter{
 		stun.TransactionID,
 		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
 		proto.RequestedTransport{Protocol: proto.ProtoUDP},
-		stun.Fingerprint,
-	)
+	}
+	// servers hosting several realms answer with the one of the client
+	if c.requestRealm && len(c.realm) != 0 {
+		setters = append(setters, &c.realm)
+	}
+	msg, err := stun.Build(append(setters, stun.Fingerprint)...)
 	if err != nil {
 		return nil, err
 	}
@@ -331,6 +350,7 @@ func (c *Client) Allocate() (net.PacketConn, error) {
 		Nonce:       nonce,
 		Lifetime:    lifetime.Duration,
 		Log:         c.log,
+		Clock:       c.clock,
 	})
 
 	c.setRelayedUDPConn(relayedConn)
@@ -0,0 +1,23 @@
+package turn
+
+import (
+	"time"
+
+	"github.com/pion/turn/v2/internal/clock"
+)
+
+// Clock is the time source of the Server and the Client. Tests can pass a
+// FakeClock to simulate hours of lifetimes without waiting for them.
+type Clock = clock.Clock
+
+// ClockTimer is a timer created by Clock.AfterFunc, *time.Timer implements it
+type ClockTimer = clock.Timer
+
+// FakeClock is a Clock that only moves when it is advanced with Advance.
+// Timers run in the goroutine calling Advance in the order they are due.
+type FakeClock = clock.Fake
+
+// NewFakeClock creates a FakeClock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return clock.NewFake(now)
+}
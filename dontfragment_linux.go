@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package turn
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dontFragmentSupported reports if setDontFragment is implemented on this platform
+const dontFragmentSupported = true
+
+// setDontFragment makes the kernel send the datagrams of conn with the DF bit set
+// instead of fragmenting them
+func setDontFragment(conn net.PacketConn, network string) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errDontFragmentUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err = rc.Control(func(fd uintptr) {
+		if network == "udp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package turn
+
+import "net"
+
+// dontFragmentSupported reports if setDontFragment is implemented on this platform
+const dontFragmentSupported = false
+
+func setDontFragment(conn net.PacketConn, network string) error {
+	return errDontFragmentUnsupported
+}
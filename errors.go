@@ -12,10 +12,42 @@ var (
 	errMaxRetriesExceeded            = errors.New("turn: max retries exceeded")
 	errMaxPortNotZero                = errors.New("turn: MaxPort must be not 0")
 	errMinPortNotZero                = errors.New("turn: MaxPort must be not 0")
+	errPortRangeInvalid              = errors.New("turn: MinPort must not be greater than MaxPort")
+	errPoolSizeNegative              = errors.New("turn: PoolSize must not be negative")
+	errPortRangeExhausted            = errors.New("turn: every port of the relay port range is in use")
+	errPortInUse                     = errors.New("turn: relay port is in use")
+	errSyscallConnUnsupported        = errors.New("turn: relay socket does not support SyscallConn")
+	errRelayPoolEmpty                = errors.New("turn: RelayAddressGeneratorPool must have Members")
+	errRelayPoolStrategyInvalid      = errors.New("turn: RelayAddressGeneratorPool has an unknown Strategy")
+	errRelayPoolNoMember             = errors.New("turn: RelayAddressGeneratorPool has no member for network")
 	errNilConn                       = errors.New("turn: conn cannot not be nil")
 	errTODO                          = errors.New("turn: TODO")
 	errAlreadyListening              = errors.New("turn: already listening")
 	errFailedToClose                 = errors.New("turn: Server failed to close")
+	errServerClosed                  = errors.New("turn: Server is closed")
+	errListenerNotFound              = errors.New("turn: listener is not attached to the Server")
+	errHandoverInvalidFrame          = errors.New("turn: invalid handover frame")
+	errHandoverFrameTooLarge         = errors.New("turn: handover frame too large")
+	errHandoverShortWrite            = errors.New("turn: short write of handover frame")
+	errHandoverNotAcknowledged       = errors.New("turn: handover was not acknowledged")
+	errReusePortAddressUnset         = errors.New("turn: ReusePortConfig must have an Address")
+	errReusePortSocketsNegative      = errors.New("turn: ReusePortConfig Sockets must not be negative")
+	errReusePortUnsupported          = errors.New("turn: SO_REUSEPORT is not supported on this platform")
+	errDontFragmentUnsupported       = errors.New("turn: DONT-FRAGMENT is not supported for the relay socket")
+	errRequestWorkersNegative        = errors.New("turn: RequestWorkers and RequestQueueSize must not be negative")
+	errBatchSizeNegative             = errors.New("turn: BatchSize must not be negative")
+	errLifetimeNegative              = errors.New("turn: lifetimes and timeouts must not be negative")
+	errLifetimePolicyInvalid         = errors.New("turn: AllocationLifetime must satisfy Min <= Default <= Max")
+	errTenantRealmUnset              = errors.New("turn: Tenant must have a Realm")
+	errTenantAuthHandlerUnset        = errors.New("turn: Tenant must have an AuthHandler")
+	errTenantQuotaNegative           = errors.New("turn: Tenant allocation limits must not be negative")
+	errTenantRealmDuplicate          = errors.New("turn: Tenant realm is used twice")
+	errTenantServerNameDuplicate     = errors.New("turn: Tenant server name is used twice")
+	errTenantUnknown                 = errors.New("turn: listener refers to an unknown Tenant")
+	errTLSListenerUnset              = errors.New("turn: TLSListenerConfig must have a non-nil Listener")
+	errNoCertificates                = errors.New("turn: TLSListener has no certificates")
+	errNoTrustedProxies              = errors.New("turn: ProxyProtocolConfig must trust at least one network")
+	errInvalidAlternateServer        = errors.New("turn: alternate server must be a *net.UDPAddr or *net.TCPAddr")
 	errFailedToRetransmitTransaction = errors.New("turn: failed to retransmit transaction")
 	errAllRetransmissionsFailed      = errors.New("all retransmissions failed for")
 	errChannelBindNotFound           = errors.New("no binding found for channel")
@@ -0,0 +1,324 @@
+package turn
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/clock"
+)
+
+// FiveTuple is the combination of client address, server address and transport
+// protocol that uniquely identifies an allocation on the server
+type FiveTuple struct {
+	Protocol string
+	SrcAddr  net.Addr
+	DstAddr  net.Addr
+}
+
+func newFiveTuple(f *allocation.FiveTuple) FiveTuple {
+	return FiveTuple{
+		Protocol: f.Protocol.String(),
+		SrcAddr:  f.SrcAddr,
+		DstAddr:  f.DstAddr,
+	}
+}
+
+// AllocationDeleteReason describes why an allocation was deleted
+type AllocationDeleteReason int
+
+const (
+	// AllocationDeleteReasonExpired the client did not refresh the allocation before its lifetime elapsed
+	AllocationDeleteReasonExpired = AllocationDeleteReason(allocation.DeleteReasonExpired)
+	// AllocationDeleteReasonClientDeleted the client sent a Refresh request with a zero lifetime
+	AllocationDeleteReasonClientDeleted = AllocationDeleteReason(allocation.DeleteReasonClientDeleted)
+	// AllocationDeleteReasonSocketError the relay socket of the allocation failed
+	AllocationDeleteReasonSocketError = AllocationDeleteReason(allocation.DeleteReasonSocketError)
+	// AllocationDeleteReasonServerClosed the Server was closed
+	AllocationDeleteReasonServerClosed = AllocationDeleteReason(allocation.DeleteReasonServerClosed)
+	// AllocationDeleteReasonAdmin the allocation was deleted with Server.DeleteAllocation or Server.DeleteAllocations
+	AllocationDeleteReasonAdmin = AllocationDeleteReason(allocation.DeleteReasonAdmin)
+)
+
+// String returns a human readable description of the reason
+func (r AllocationDeleteReason) String() string {
+	switch r {
+	case AllocationDeleteReasonExpired:
+		return "expired"
+	case AllocationDeleteReasonClientDeleted:
+		return "client deleted"
+	case AllocationDeleteReasonSocketError:
+		return "socket error"
+	case AllocationDeleteReasonServerClosed:
+		return "server closed"
+	case AllocationDeleteReasonAdmin:
+		return "deleted by admin"
+	default:
+		return "unknown"
+	}
+}
+
+// AllocationEvent is passed to the allocation callbacks of EventHandlers
+type AllocationEvent struct {
+	FiveTuple FiveTuple
+	Username  string
+	RelayAddr net.Addr
+
+	// CreatedAt is when the allocation was created, Time is when the event occurred
+	CreatedAt time.Time
+	Time      time.Time
+
+	// Lifetime is the lifetime granted to the client, only set for created and refreshed events
+	Lifetime time.Duration
+
+	// Reason is only set for deleted events
+	Reason AllocationDeleteReason
+}
+
+// PermissionEvent is passed to the permission callbacks of EventHandlers
+type PermissionEvent struct {
+	FiveTuple FiveTuple
+	Username  string
+	RelayAddr net.Addr
+	PeerAddr  net.Addr
+	Time      time.Time
+}
+
+// ChannelEvent is passed to the channel binding callbacks of EventHandlers
+type ChannelEvent struct {
+	FiveTuple FiveTuple
+	Username  string
+	RelayAddr net.Addr
+	PeerAddr  net.Addr
+	Number    uint16
+	Time      time.Time
+}
+
+// AuthFailureEvent is passed to EventHandlers.OnAuthFailure
+type AuthFailureEvent struct {
+	FiveTuple FiveTuple
+	Username  string
+	Realm     string
+	Method    string
+	Time      time.Time
+	Err       error
+}
+
+// EventHandlers is a set of callbacks the Server calls during the lifecycle of
+// allocations, permissions and channel bindings. Every callback is optional.
+// Callbacks are called synchronously from the goroutine handling the traffic and must not block.
+// The callbacks of expiries, OnPermissionExpired, OnChannelExpired and OnAllocationDeleted
+// and OnUsageRecord of expired allocations, are called one after another from a goroutine
+// of the Server instead, so they do not hold up the lifetimes of other allocations.
+type EventHandlers struct {
+	OnAllocationCreated   func(AllocationEvent)
+	OnAllocationRefreshed func(AllocationEvent)
+	OnAllocationDeleted   func(AllocationEvent)
+
+	OnPermissionCreated func(PermissionEvent)
+	OnPermissionExpired func(PermissionEvent)
+
+	OnChannelBound   func(ChannelEvent)
+	OnChannelExpired func(ChannelEvent)
+
+	// OnAuthFailure is called when the AuthHandler rejects a user or the MESSAGE-INTEGRITY check fails
+	OnAuthFailure func(AuthFailureEvent)
+
+	// OnUsageRecord is called with the final traffic totals of an allocation once it is deleted
+	OnUsageRecord func(UsageRecord)
+}
+
+func newAllocationEvent(a *allocation.Allocation, now time.Time) AllocationEvent {
+	return AllocationEvent{
+		FiveTuple: newFiveTuple(a.FiveTuple()),
+		Username:  a.Username(),
+		RelayAddr: a.RelayAddr,
+		CreatedAt: a.CreatedAt(),
+		Time:      now,
+	}
+}
+
+func newPermissionEvent(a *allocation.Allocation, p *allocation.Permission, now time.Time) PermissionEvent {
+	return PermissionEvent{
+		FiveTuple: newFiveTuple(a.FiveTuple()),
+		Username:  a.Username(),
+		RelayAddr: a.RelayAddr,
+		PeerAddr:  p.Addr,
+		Time:      now,
+	}
+}
+
+func newChannelEvent(a *allocation.Allocation, c *allocation.ChannelBind, now time.Time) ChannelEvent {
+	return ChannelEvent{
+		FiveTuple: newFiveTuple(a.FiveTuple()),
+		Username:  a.Username(),
+		RelayAddr: a.RelayAddr,
+		PeerAddr:  c.Peer,
+		Number:    uint16(c.Number),
+		Time:      now,
+	}
+}
+
+// allocationEventHandler translates the public callbacks into the ones used by allocation.Manager,
+// the callbacks of expiries are passed to expired
+func (h EventHandlers) allocationEventHandler(c clock.Clock, expired func(func())) allocation.EventHandler {
+	var e allocation.EventHandler
+
+	if h.OnAllocationCreated != nil {
+		e.OnAllocationCreated = func(a *allocation.Allocation, lifetime time.Duration) {
+			ev := newAllocationEvent(a, c.Now())
+			ev.Lifetime = lifetime
+			h.OnAllocationCreated(ev)
+		}
+	}
+	if h.OnAllocationRefreshed != nil {
+		e.OnAllocationRefreshed = func(a *allocation.Allocation, lifetime time.Duration) {
+			ev := newAllocationEvent(a, c.Now())
+			ev.Lifetime = lifetime
+			h.OnAllocationRefreshed(ev)
+		}
+	}
+	if h.OnAllocationDeleted != nil || h.OnUsageRecord != nil {
+		e.OnAllocationDeleted = func(a *allocation.Allocation, reason allocation.DeleteReason) {
+			ev := newAllocationEvent(a, c.Now())
+			ev.Reason = AllocationDeleteReason(reason)
+			var record UsageRecord
+			if h.OnUsageRecord != nil {
+				record = newUsageRecord(a, c.Now())
+			}
+
+			call := func() {
+				if h.OnAllocationDeleted != nil {
+					h.OnAllocationDeleted(ev)
+				}
+				if h.OnUsageRecord != nil {
+					h.OnUsageRecord(record)
+				}
+			}
+			if reason == allocation.DeleteReasonExpired {
+				expired(call)
+			} else {
+				call()
+			}
+		}
+	}
+	if h.OnPermissionCreated != nil {
+		e.OnPermissionCreated = func(a *allocation.Allocation, p *allocation.Permission) {
+			h.OnPermissionCreated(newPermissionEvent(a, p, c.Now()))
+		}
+	}
+	if h.OnPermissionExpired != nil {
+		e.OnPermissionExpired = func(a *allocation.Allocation, p *allocation.Permission) {
+			ev := newPermissionEvent(a, p, c.Now())
+			expired(func() {
+				h.OnPermissionExpired(ev)
+			})
+		}
+	}
+	if h.OnChannelBound != nil {
+		e.OnChannelBound = func(a *allocation.Allocation, ch *allocation.ChannelBind) {
+			h.OnChannelBound(newChannelEvent(a, ch, c.Now()))
+		}
+	}
+	if h.OnChannelExpired != nil {
+		e.OnChannelExpired = func(a *allocation.Allocation, ch *allocation.ChannelBind) {
+			ev := newChannelEvent(a, ch, c.Now())
+			expired(func() {
+				h.OnChannelExpired(ev)
+			})
+		}
+	}
+
+	return e
+}
+
+// authFailureHandler translates OnAuthFailure into the callback used by the request handlers
+func (h EventHandlers) authFailureHandler(c clock.Clock) func(*allocation.FiveTuple, string, string, stun.Method, error) {
+	if h.OnAuthFailure == nil {
+		return nil
+	}
+
+	return func(fiveTuple *allocation.FiveTuple, username, realm string, method stun.Method, err error) {
+		h.OnAuthFailure(AuthFailureEvent{
+			FiveTuple: newFiveTuple(fiveTuple),
+			Username:  username,
+			Realm:     realm,
+			Method:    method.String(),
+			Time:      c.Now(),
+			Err:       err,
+		})
+	}
+}
+
+// eventQueue calls the callbacks of expiries one after another from a goroutine of
+// its own, the timers of the Server only queue them
+type eventQueue struct {
+	lock    sync.Mutex
+	pending []func()
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(q.done)
+		q.run()
+	}()
+	return q
+}
+
+// push queues f, callbacks queued after close are dropped
+func (q *eventQueue) push(f func()) {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return
+	}
+	q.pending = append(q.pending, f)
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) run() {
+	for {
+		q.lock.Lock()
+		pending, closed := q.pending, q.closed
+		q.pending = nil
+		q.lock.Unlock()
+
+		if len(pending) == 0 {
+			if closed {
+				return
+			}
+			<-q.wake
+			continue
+		}
+		for _, f := range pending {
+			f()
+		}
+	}
+}
+
+// close waits until the queued callbacks were called
+func (q *eventQueue) close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	<-q.done
+}
@@ -4,7 +4,6 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"log"
 	"net"
@@ -15,7 +14,6 @@ import (
 	"syscall"
 
 	"github.com/pion/turn/v2"
-	"golang.org/x/sys/unix"
 )
 
 func main() {
@@ -32,11 +30,6 @@ func main() {
 		log.Fatalf("'users' is required")
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+strconv.Itoa(*port))
-	if err != nil {
-		log.Fatalf("Failed to parse server address: %s", err)
-	}
-
 	// Cache -users flag for easy lookup later
 	// If passwords are stored they should be saved to your DB hashed using turn.GenerateAuthKey
 	usersMap := map[string][]byte{}
@@ -44,43 +37,20 @@ func main() {
 		usersMap[kv[1]] = turn.GenerateAuthKey(kv[1], *realm, kv[2])
 	}
 
-	// Create `numThreads` UDP listeners to pass into pion/turn
-	// pion/turn itself doesn't allocate any UDP sockets, but lets the user pass them in
-	// this allows us to add logging, storage or modify inbound/outbound traffic
-	// UDP listeners share the same local address:port with setting SO_REUSEPORT and the kernel
-	// will load-balance received packets per the IP 5-tuple
-	listenerConfig := &net.ListenConfig{
-		Control: func(network, address string, conn syscall.RawConn) error {
-			var operr error
-			if err = conn.Control(func(fd uintptr) {
-				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-			}); err != nil {
-				return err
-			}
-
-			return operr
+	// UDP sockets share the same local address:port with setting SO_REUSEPORT and the kernel
+	// will load-balance received packets per the IP 5-tuple. The sockets share one allocation
+	// table, so a client is still served if the kernel moves it to another socket.
+	reusePortConfig := turn.ReusePortConfig{
+		Network: "udp4",
+		Address: "0.0.0.0:" + strconv.Itoa(*port),
+		Sockets: *threadNum,
+		RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP(*publicIP), // Claim that we are listening on IP passed by user
+			Address:      "0.0.0.0",              // But actually be listening on every interface
 		},
 	}
 
-	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
-		RelayAddress: net.ParseIP(*publicIP), // Claim that we are listening on IP passed by user
-		Address:      "0.0.0.0",              // But actually be listening on every interface
-	}
-
-	packetConnConfigs := make([]turn.PacketConnConfig, *threadNum)
-	for i := 0; i < *threadNum; i++ {
-		conn, listErr := listenerConfig.ListenPacket(context.Background(), addr.Network(), addr.String())
-		if listErr != nil {
-			log.Fatalf("Failed to allocate UDP listener at %s:%s", addr.Network(), addr.String())
-		}
-
-		packetConnConfigs[i] = turn.PacketConnConfig{
-			PacketConn:            conn,
-			RelayAddressGenerator: relayAddressGenerator,
-		}
-
-		log.Printf("Server %d listening on %s\n", i, conn.LocalAddr().String())
-	}
+	log.Printf("Server listening on %s with %d sockets\n", reusePortConfig.Address, *threadNum)
 
 	s, err := turn.NewServer(turn.ServerConfig{
 		Realm: *realm,
@@ -93,8 +63,8 @@ func main() {
 			}
 			return nil, false
 		},
-		// PacketConnConfigs is a list of UDP Listeners and the configuration around them
-		PacketConnConfigs: packetConnConfigs,
+		// ReusePortConfigs opens the SO_REUSEPORT sockets and the configuration around them
+		ReusePortConfigs: []turn.ReusePortConfig{reusePortConfig},
 	})
 	if err != nil {
 		log.Panicf("Failed to create TURN server: %s", err)
@@ -0,0 +1,403 @@
+//go:build linux
+// +build linux
+
+package turn
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+const (
+	handoverFramePacketConn = "packetConn"
+	handoverFrameListener   = "listener"
+	handoverFrameAllocation = "allocation"
+	handoverFrameEnd        = "end"
+
+	handoverMaxFrameSize = 16 << 20
+)
+
+// Handover holds the sockets and allocations a Server passed to this process with
+// Server.Handover. Create a Server with PacketConns and Listeners, then call
+// Server.Restore to take over the allocations.
+type Handover struct {
+	PacketConns []net.PacketConn
+	Listeners   []net.Listener
+
+	conn         *net.UnixConn
+	allocations  []handoverAllocation
+	nonces       map[string]time.Time
+	revokedUsers []RevokedUser
+}
+
+type handoverAllocation struct {
+	snapshot    allocation.Snapshot
+	relaySocket net.PacketConn
+}
+
+// handoverFrame is sent length prefixed as JSON, the file descriptor of the socket
+// it describes is attached as SCM_RIGHTS to the same write
+type handoverFrame struct {
+	Kind         string               `json:"kind"`
+	Allocation   *allocation.Snapshot `json:"allocation,omitempty"`
+	Nonces       map[string]time.Time `json:"nonces,omitempty"`
+	RevokedUsers []RevokedUser        `json:"revokedUsers,omitempty"`
+}
+
+// Handover passes the listening sockets and the UDP allocations of the Server to another
+// process over conn, which calls ReceiveHandover and Server.Restore. The handed over
+// PacketConns are not read anymore and their allocations are taken from the Server before
+// they are sent, so no request changes them meanwhile. Once the other process acknowledged,
+// the Server is closed without deleting the handed over allocations. If the handover fails
+// after the PacketConns stopped being read, the Server is closed along with them. Sockets
+// that do not expose a file descriptor, like TLS listeners, and allocations on TCP
+// connections are not handed over and are closed with the Server.
+func (s *Server) Handover(conn *net.UnixConn) error {
+	var packetListeners []*serverListener
+	for _, l := range s.listenersSnapshot() {
+		if l.listener == nil {
+			if handoverSupported(l.packetConns) {
+				packetListeners = append(packetListeners, l)
+			} else {
+				s.log.Warnf("Not handing over PacketConn %s, it does not expose a file descriptor", l.addr())
+			}
+			continue
+		}
+
+		listener, ok := l.listener.(syscall.Conn)
+		if !ok {
+			s.log.Warnf("Not handing over listener %s, it does not expose a file descriptor", l.addr())
+			continue
+		}
+		if err := sendHandoverFrame(conn, handoverFrame{Kind: handoverFrameListener}, listener); err != nil {
+			return err
+		}
+	}
+
+	handovers := s.stopPacketListeners(packetListeners)
+	fail := func(err error) error {
+		closeHandedOver(handovers)
+		if closeErr := s.Close(); closeErr != nil {
+			s.log.Errorf("Failed to close server: %s", closeErr)
+		}
+		return err
+	}
+
+	for i, l := range packetListeners {
+		for _, packetConn := range l.packetConns {
+			if err := sendHandoverFrame(conn, handoverFrame{Kind: handoverFramePacketConn}, packetConn.(syscall.Conn)); err != nil { //nolint:forcetypeassert
+				return fail(err)
+			}
+		}
+
+		for _, a := range handovers[i].allocations {
+			snapshot := a.Snapshot()
+			if err := sendHandoverFrame(conn, handoverFrame{Kind: handoverFrameAllocation, Allocation: &snapshot}, a.RelaySocket.(syscall.Conn)); err != nil { //nolint:forcetypeassert
+				return fail(err)
+			}
+		}
+	}
+
+	end := handoverFrame{
+		Kind:         handoverFrameEnd,
+		Nonces:       map[string]time.Time{},
+		RevokedUsers: s.RevokedUsers(),
+	}
+	s.nonces.Range(func(key, value interface{}) bool {
+		nonce, nonceOK := key.(string)
+		created, createdOK := value.(time.Time)
+		if nonceOK && createdOK {
+			end.Nonces[nonce] = created
+		}
+		return true
+	})
+	if err := sendHandoverFrame(conn, end, nil); err != nil {
+		return fail(err)
+	}
+
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fail(fmt.Errorf("%w: %v", errHandoverNotAcknowledged, err))
+	}
+
+	closeHandedOver(handovers)
+	return s.Close()
+}
+
+// stopPacketListeners stops the read loops of listeners and waits until the requests
+// they received were handled. Their UDP allocations are then detached from their
+// managers instead of being deleted and returned in the listenerHandover of each listener,
+// with their relay sockets no longer read so their snapshots are final.
+func (s *Server) stopPacketListeners(listeners []*serverListener) []*listenerHandover {
+	handovers := make([]*listenerHandover, len(listeners))
+	for i, l := range listeners {
+		handovers[i] = &listenerHandover{detach: func(a *allocation.Allocation) bool {
+			if _, ok := a.RelaySocket.(syscall.Conn); !ok {
+				s.log.Warnf("Not handing over allocation for %s, its relay socket does not expose a file descriptor", a.FiveTuple().SrcAddr)
+				return false
+			}
+			return true
+		}}
+
+		s.lock.Lock()
+		l.handover = handovers[i]
+		s.lock.Unlock()
+
+		// a deadline in the past makes pending and further reads fail, the sockets stay
+		// open. Sockets without deadlines are closed, which fails the handover.
+		for _, packetConn := range l.packetConns {
+			if err := packetConn.SetReadDeadline(time.Unix(1, 0)); err != nil {
+				s.log.Warnf("Failed to stop reading %s: %s", packetConn.LocalAddr(), err)
+				_ = l.close()
+			}
+		}
+	}
+
+	for _, l := range listeners {
+		<-l.done
+	}
+	return handovers
+}
+
+// closeHandedOver closes the allocations taken from the Server, their relay sockets
+// were duplicated for the other process
+func closeHandedOver(handovers []*listenerHandover) {
+	for _, h := range handovers {
+		for _, a := range h.allocations {
+			_ = a.Close()
+		}
+	}
+}
+
+// ReceiveHandover receives the sockets and allocations of a Server calling Server.Handover
+// on the other end of conn
+func ReceiveHandover(conn *net.UnixConn) (*Handover, error) {
+	h := &Handover{conn: conn}
+	for {
+		frame, f, err := receiveHandoverFrame(conn)
+		if err != nil {
+			h.close()
+			return nil, err
+		}
+
+		if frame.Kind == handoverFrameEnd {
+			h.nonces = frame.Nonces
+			h.revokedUsers = frame.RevokedUsers
+			return h, nil
+		}
+
+		if err = h.add(frame, f); err != nil {
+			h.close()
+			return nil, err
+		}
+	}
+}
+
+func (h *Handover) add(frame handoverFrame, f *os.File) error {
+	if f == nil {
+		return fmt.Errorf("%w: %s frame without file descriptor", errHandoverInvalidFrame, frame.Kind)
+	}
+	defer f.Close() //nolint:errcheck,gosec
+
+	switch frame.Kind {
+	case handoverFramePacketConn:
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		h.PacketConns = append(h.PacketConns, conn)
+	case handoverFrameListener:
+		listener, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		h.Listeners = append(h.Listeners, listener)
+	case handoverFrameAllocation:
+		if frame.Allocation == nil {
+			return fmt.Errorf("%w: allocation frame without snapshot", errHandoverInvalidFrame)
+		}
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		h.allocations = append(h.allocations, handoverAllocation{snapshot: *frame.Allocation, relaySocket: conn})
+	default:
+		return fmt.Errorf("%w: unknown kind %q", errHandoverInvalidFrame, frame.Kind)
+	}
+	return nil
+}
+
+func (h *Handover) close() {
+	for _, c := range h.PacketConns {
+		_ = c.Close()
+	}
+	for _, l := range h.Listeners {
+		_ = l.Close()
+	}
+	for _, a := range h.allocations {
+		_ = a.relaySocket.Close()
+	}
+}
+
+// Restore takes over the allocations of h on the PacketConns of h the Server was created
+// with, and acknowledges the handover to the previous process. Allocations whose PacketConn
+// is not served by the Server are dropped.
+func (s *Server) Restore(h *Handover) error {
+	for _, a := range h.allocations {
+		l := s.findListener(func(l *serverListener) bool {
+			return l.listener == nil && l.addr().String() == a.snapshot.DstAddr
+		})
+		if l == nil {
+			s.log.Warnf("Dropping handed over allocation for %s, %s is not served", a.snapshot.SrcAddr, a.snapshot.DstAddr)
+			_ = a.relaySocket.Close()
+			continue
+		}
+
+		// snapshots of processes that did not record realms are in the realm of the server
+		if a.snapshot.Realm == "" {
+			a.snapshot.Realm = s.realm
+		}
+
+		restored, err := l.allocationManager.RestoreAllocation(a.snapshot, l.packetConns[0], a.relaySocket)
+		if err != nil {
+			s.log.Warnf("Failed to restore allocation for %s: %s", a.snapshot.SrcAddr, err)
+			_ = a.relaySocket.Close()
+			continue
+		}
+		s.tenants.allocationCreated(restored)
+	}
+	h.allocations = nil
+
+	for nonce, created := range h.nonces {
+		s.nonces.Store(nonce, created)
+	}
+	for _, user := range h.revokedUsers {
+		s.revokedUsers.Store(user, struct{}{})
+	}
+
+	_, err := h.conn.Write([]byte{1})
+	return err
+}
+
+func handoverSupported(conns []net.PacketConn) bool {
+	for _, conn := range conns {
+		if _, ok := conn.(syscall.Conn); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sendHandoverFrame(conn *net.UnixConn, frame handoverFrame, socket syscall.Conn) error {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+
+	write := func(oob []byte) error {
+		n, _, err := conn.WriteMsgUnix(buf, oob, nil)
+		if err == nil && n != len(buf) {
+			err = errHandoverShortWrite
+		}
+		return err
+	}
+
+	if socket == nil {
+		return write(nil)
+	}
+
+	rc, err := socket.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// the descriptor is only borrowed while sending, the kernel duplicates it for the receiver
+	var writeErr error
+	if err = rc.Control(func(fd uintptr) {
+		writeErr = write(syscall.UnixRights(int(fd)))
+	}); err != nil {
+		return err
+	}
+	return writeErr
+}
+
+func receiveHandoverFrame(conn *net.UnixConn) (handoverFrame, *os.File, error) {
+	var frame handoverFrame
+
+	// reads never go past the current frame, the descriptor attached to the
+	// next frame is received together with its first bytes
+	header := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return frame, nil, err
+	}
+
+	var f *os.File
+	if oobn > 0 {
+		if f, err = parseHandoverRights(oob[:oobn]); err != nil {
+			return frame, nil, err
+		}
+	}
+
+	if _, err = io.ReadFull(conn, header[n:]); err != nil {
+		return frame, nil, closeOnError(f, err)
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > handoverMaxFrameSize {
+		return frame, nil, closeOnError(f, errHandoverFrameTooLarge)
+	}
+
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(conn, payload); err != nil {
+		return frame, nil, closeOnError(f, err)
+	}
+	if err = json.Unmarshal(payload, &frame); err != nil {
+		return frame, nil, closeOnError(f, err)
+	}
+
+	return frame, f, nil
+}
+
+func parseHandoverRights(oob []byte) (*os.File, error) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	for i := range messages {
+		rights, err := syscall.ParseUnixRights(&messages[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("%w: %d file descriptors", errHandoverInvalidFrame, len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), "handover"), nil
+}
+
+func closeOnError(f *os.File, err error) error {
+	if f != nil {
+		_ = f.Close()
+	}
+	return err
+}
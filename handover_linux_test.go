@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package turn
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func unixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	assert.NoError(t, err)
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+
+		unixConn, ok := conn.(*net.UnixConn)
+		assert.True(t, ok)
+		conns[i] = unixConn
+	}
+	return conns[0], conns[1]
+}
+
+func TestServerHandover(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	authHandler := func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+		return GenerateAuthKey(username, realm, "pass"), true
+	}
+	relayAddressGenerator := &RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP("127.0.0.1"),
+		Address:      "0.0.0.0",
+	}
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:3478")
+	assert.NoError(t, err)
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:3478")
+	assert.NoError(t, err)
+
+	var deleted int32
+	oldServer, err := NewServer(ServerConfig{
+		AuthHandler:       authHandler,
+		PacketConnConfigs: []PacketConnConfig{{PacketConn: udpListener, RelayAddressGenerator: relayAddressGenerator}},
+		ListenerConfigs:   []ListenerConfig{{Listener: tcpListener, RelayAddressGenerator: relayAddressGenerator}},
+		EventHandlers: EventHandlers{
+			OnAllocationDeleted: func(AllocationEvent) { atomic.AddInt32(&deleted, 1) },
+		},
+		RequestWorkers: 2,
+		Realm:          "pion.ly",
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: "127.0.0.1:3478",
+		TURNServerAddr: "127.0.0.1:3478",
+		Conn:           conn,
+		Username:       "user",
+		Password:       "pass",
+		Realm:          "pion.ly",
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	buf := make([]byte, 1500)
+	relay := func() {
+		_, err = relayConn.WriteTo([]byte("Hello"), peer.LocalAddr())
+		assert.NoError(t, err)
+		n, from, readErr := peer.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "Hello", string(buf[:n]))
+
+		_, err = peer.WriteTo([]byte("World"), from)
+		assert.NoError(t, err)
+		n, _, readErr = relayConn.ReadFrom(buf)
+		assert.NoError(t, readErr)
+		assert.Equal(t, "World", string(buf[:n]))
+	}
+	relay()
+
+	oldConn, newConn := unixConnPair(t)
+	handedOver := make(chan error)
+	go func() {
+		handedOver <- oldServer.Handover(oldConn)
+	}()
+
+	h, err := ReceiveHandover(newConn)
+	assert.NoError(t, err)
+	assert.Len(t, h.PacketConns, 1)
+	assert.Len(t, h.Listeners, 1)
+	assert.Equal(t, udpListener.LocalAddr().String(), h.PacketConns[0].LocalAddr().String())
+	assert.Equal(t, tcpListener.Addr().String(), h.Listeners[0].Addr().String())
+
+	newServer, err := NewServer(ServerConfig{
+		AuthHandler:       authHandler,
+		PacketConnConfigs: []PacketConnConfig{{PacketConn: h.PacketConns[0], RelayAddressGenerator: relayAddressGenerator}},
+		ListenerConfigs:   []ListenerConfig{{Listener: h.Listeners[0], RelayAddressGenerator: relayAddressGenerator}},
+		Realm:             "pion.ly",
+		LoggerFactory:     loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, newServer.Restore(h))
+	assert.NoError(t, <-handedOver)
+
+	// the old server did not delete the allocation it handed over
+	assert.Equal(t, 0, oldServer.AllocationCount())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&deleted))
+	allocations := newServer.Allocations()
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "user", allocations[0].Username)
+	assert.Equal(t, relayConn.LocalAddr().String(), allocations[0].RelayAddr.String())
+	assert.Len(t, allocations[0].Permissions, 1)
+	assert.Equal(t, uint64(1), allocations[0].Traffic.PacketsToPeer)
+
+	// the new server keeps relaying and accepts the nonce issued by the old one
+	relay()
+	assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345}))
+	assert.NoError(t, relayConn.Close())
+	assert.Eventually(t, func() bool {
+		return newServer.AllocationCount() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, peer.Close())
+	assert.NoError(t, oldConn.Close())
+	assert.NoError(t, newConn.Close())
+	assert.NoError(t, newServer.Close())
+}
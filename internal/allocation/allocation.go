@@ -9,8 +9,10 @@ import (
 
 	"github.com/pion/logging"
 	"github.com/pion/stun"
-	"github.com/pion/turn/v2/internal/ipnet"
+	"github.com/pion/turn/v2/internal/batchconn"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/proto"
+	"github.com/pion/turn/v2/internal/timingwheel"
 )
 
 type allocationResponse struct {
@@ -21,18 +23,35 @@ type allocationResponse struct {
 // Allocation is tied to a FiveTuple and relays traffic
 // use CreateAllocation and GetAllocation to operate
 type Allocation struct {
+	traffic             trafficCounters
 	RelayAddr           net.Addr
 	Protocol            Protocol
 	TurnSocket          net.PacketConn
 	RelaySocket         net.PacketConn
 	fiveTuple           *FiveTuple
+	username            string
+	realm               string
+	createdAt           time.Time
 	permissionsLock     sync.RWMutex
-	permissions         map[string]*Permission
+	permissions         map[[net.IPv6len]byte]*Permission
 	channelBindingsLock sync.RWMutex
-	channelBindings     []*ChannelBind
-	lifetimeTimer       *time.Timer
+	channelsByNumber    map[proto.ChannelNumber]*ChannelBind
+	channelsByPeer      map[peerFingerprint]*ChannelBind
+	removedTrafficLock  sync.Mutex
+	removedTraffic      []PeerTraffic
+	permissionTimeout   time.Duration
+	relays              *RelayIndex
+	isolatePeers        func(a, peer *Allocation) bool
+	clock               clock.Clock
+	timers              *timingwheel.Wheel
+	lifetimeLock        sync.Mutex
+	lifetimeTimer       *timingwheel.Timer
+	expiresAt           atomic.Value // time.Time
+	expired             bool
 	closed              chan interface{}
+	handlerDone         chan struct{} // closed once packetHandler exited, nil if it never ran
 	log                 logging.LeveledLogger
+	events              *EventHandler
 
 	// some clients (Firefox or others using resiprocate's nICE lib) may retry allocation
 	// with same 5 tuple when received 413, for compatible with these clients,
@@ -41,25 +60,171 @@ type Allocation struct {
 	responseCache atomic.Value // *allocationResponse
 }
 
-func addr2IPFingerprint(addr net.Addr) string {
+// addr2IPFingerprint is the key of the permission for addr, it does not allocate
+func addr2IPFingerprint(addr net.Addr) [net.IPv6len]byte {
 	switch a := addr.(type) {
 	case *net.UDPAddr:
-		return a.IP.String()
+		return ipFingerprint(a.IP)
 	case *net.TCPAddr: // Do we really need this case?
-		return a.IP.String()
+		return ipFingerprint(a.IP)
 	}
-	return "" // should never happen
+	return [net.IPv6len]byte{} // should never happen
+}
+
+// peerFingerprint is the key of the channel bound to a peer, only UDP peers
+// can be bound
+type peerFingerprint struct {
+	ip   [net.IPv6len]byte
+	port uint16
+}
+
+func peerFingerprintOf(addr net.Addr) peerFingerprint {
+	ip, port, _ := addrFingerprint(addr)
+	return peerFingerprint{ip, port}
 }
 
 // NewAllocation creates a new instance of NewAllocation.
 func NewAllocation(turnSocket net.PacketConn, fiveTuple *FiveTuple, log logging.LeveledLogger) *Allocation {
 	return &Allocation{
-		TurnSocket:  turnSocket,
-		fiveTuple:   fiveTuple,
-		permissions: make(map[string]*Permission, 64),
-		closed:      make(chan interface{}),
-		log:         log,
+		TurnSocket:        turnSocket,
+		fiveTuple:         fiveTuple,
+		permissions:       make(map[[net.IPv6len]byte]*Permission, 64),
+		channelsByNumber:  make(map[proto.ChannelNumber]*ChannelBind),
+		channelsByPeer:    make(map[peerFingerprint]*ChannelBind),
+		permissionTimeout: DefaultPermissionTimeout,
+		clock:             clock.System,
+		createdAt:         time.Now(),
+		closed:            make(chan interface{}),
+		log:               log,
+	}
+}
+
+// FiveTuple returns the FiveTuple that identifies the allocation
+func (a *Allocation) FiveTuple() *FiveTuple {
+	return a.fiveTuple
+}
+
+// Username returns the username the allocation was authenticated with
+func (a *Allocation) Username() string {
+	return a.username
+}
+
+// Realm returns the realm the allocation was created in
+func (a *Allocation) Realm() string {
+	return a.realm
+}
+
+// CreatedAt returns the time the allocation was created
+func (a *Allocation) CreatedAt() time.Time {
+	return a.createdAt
+}
+
+// ExpiresAt returns the time the allocation expires unless it is refreshed
+func (a *Allocation) ExpiresAt() time.Time {
+	expiresAt, _ := a.expiresAt.Load().(time.Time)
+	return expiresAt
+}
+
+// Traffic returns the traffic counters of the allocation
+func (a *Allocation) Traffic() Traffic {
+	return a.traffic.snapshot()
+}
+
+// Permissions returns the currently installed permissions
+func (a *Allocation) Permissions() []*Permission {
+	a.permissionsLock.RLock()
+	defer a.permissionsLock.RUnlock()
+
+	permissions := make([]*Permission, 0, len(a.permissions))
+	for _, p := range a.permissions {
+		permissions = append(permissions, p)
+	}
+	return permissions
+}
+
+// ChannelBinds returns the currently bound channels
+func (a *Allocation) ChannelBinds() []*ChannelBind {
+	a.channelBindingsLock.RLock()
+	defer a.channelBindingsLock.RUnlock()
+
+	channels := make([]*ChannelBind, 0, len(a.channelsByNumber))
+	for _, c := range a.channelsByNumber {
+		channels = append(channels, c)
+	}
+	return channels
+}
+
+// RemovedTraffic returns the traffic of the permissions and channel bindings that expired
+// or were removed, summed up per peer
+func (a *Allocation) RemovedTraffic() []PeerTraffic {
+	a.removedTrafficLock.Lock()
+	defer a.removedTrafficLock.Unlock()
+
+	return append([]PeerTraffic{}, a.removedTraffic...)
+}
+
+// keepTraffic adds the traffic of a removed permission or channel binding to the
+// removed traffic of its peer
+func (a *Allocation) keepTraffic(peer net.Addr, number proto.ChannelNumber, traffic Traffic) {
+	a.removedTrafficLock.Lock()
+	defer a.removedTrafficLock.Unlock()
+
+	for i := range a.removedTraffic {
+		if r := &a.removedTraffic[i]; r.Number == number && samePeer(r.Peer, peer, number) {
+			r.Traffic.Add(traffic)
+			return
+		}
+	}
+	a.removedTraffic = append(a.removedTraffic, PeerTraffic{Peer: peer, Number: number, Traffic: traffic})
+}
+
+// samePeer compares permissions by IP and channel bindings by IP and port
+func samePeer(a, b net.Addr, number proto.ChannelNumber) bool {
+	if number == 0 {
+		return addr2IPFingerprint(a) == addr2IPFingerprint(b)
 	}
+	return peerFingerprintOf(a) == peerFingerprintOf(b)
+}
+
+// WriteToPeer relays data received from the client to peer and accounts it to
+// the allocation, the permission p of the peer and the channel if one was used.
+// The permission is looked up if p is nil.
+func (a *Allocation) WriteToPeer(data []byte, peer net.Addr, p *Permission, channel *ChannelBind) (int, error) {
+	var n int
+	var err error
+	b := a.relays.lookup(peer)
+	switch {
+	case a.isolatePeers != nil && (b == nil || b == a || !a.isolatePeers(a, b)):
+		// the relayed address may have been handed to another allocation since the
+		// permission was granted
+		a.traffic.addDropped(len(data))
+		return len(data), nil
+	case b != nil && b != a:
+		n, err = b.deliver(data, a.RelayAddr)
+	default:
+		n, err = a.RelaySocket.WriteTo(data, peer)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	a.traffic.addToPeer(n)
+	if p == nil {
+		p = a.GetPermission(peer)
+	}
+	if p != nil {
+		p.traffic.addToPeer(n)
+	}
+	if channel != nil {
+		channel.traffic.addToPeer(n)
+	}
+	return n, nil
+}
+
+// CountDropped accounts a packet of n bytes that was dropped because no
+// permission or channel binding existed for it
+func (a *Allocation) CountDropped(n int) {
+	a.traffic.addDropped(n)
 }
 
 // GetPermission gets the Permission from the allocation
@@ -70,61 +235,68 @@ func (a *Allocation) GetPermission(addr net.Addr) *Permission {
 	return a.permissions[addr2IPFingerprint(addr)]
 }
 
-// AddPermission adds a new permission to the allocation
+// AddPermission adds a new permission to the allocation or refreshes the
+// permission that exists for the IP of p
 func (a *Allocation) AddPermission(p *Permission) {
 	fingerprint := addr2IPFingerprint(p.Addr)
 
-	a.permissionsLock.RLock()
-	existedPermission, ok := a.permissions[fingerprint]
-	a.permissionsLock.RUnlock()
-
-	if ok {
-		existedPermission.refresh(permissionTimeout)
+	a.permissionsLock.Lock()
+	if existedPermission, ok := a.permissions[fingerprint]; ok {
+		existedPermission.refresh(a.permissionTimeout)
+		a.permissionsLock.Unlock()
 		return
 	}
 
 	p.allocation = a
-	a.permissionsLock.Lock()
 	a.permissions[fingerprint] = p
+	p.start(a.permissionTimeout)
 	a.permissionsLock.Unlock()
 
-	p.start(permissionTimeout)
+	a.events.permissionCreated(a, p)
 }
 
 // RemovePermission removes the net.Addr's fingerprint from the allocation's permissions
 func (a *Allocation) RemovePermission(addr net.Addr) {
 	a.permissionsLock.Lock()
-	defer a.permissionsLock.Unlock()
-	delete(a.permissions, addr2IPFingerprint(addr))
+	fingerprint := addr2IPFingerprint(addr)
+	p, ok := a.permissions[fingerprint]
+	if ok {
+		p.stop()
+		delete(a.permissions, fingerprint)
+	}
+	a.permissionsLock.Unlock()
+
+	if ok {
+		a.keepTraffic(p.Addr, 0, p.Traffic())
+	}
 }
 
 // AddChannelBind adds a new ChannelBind to the allocation, it also updates the
 // permissions needed for this ChannelBind
 func (a *Allocation) AddChannelBind(c *ChannelBind, lifetime time.Duration) error {
+	a.channelBindingsLock.Lock()
+
 	// Check that this channel id isn't bound to another transport address, and
 	// that this transport address isn't bound to another channel number.
-	channelByNumber := a.GetChannelByNumber(c.Number)
-
-	if channelByNumber != a.GetChannelByAddr(c.Peer) {
+	channelByNumber := a.channelsByNumber[c.Number]
+	if channelByNumber != a.channelsByPeer[peerFingerprintOf(c.Peer)] {
+		a.channelBindingsLock.Unlock()
 		return errSameChannelDifferentPeer
 	}
 
 	// Add or refresh this channel.
 	if channelByNumber == nil {
-		a.channelBindingsLock.Lock()
-		defer a.channelBindingsLock.Unlock()
-
-		c.allocation = a
-		a.channelBindings = append(a.channelBindings, c)
+		a.addChannel(c)
 		c.start(lifetime)
-
-		// Channel binds also refresh permissions.
-		a.AddPermission(NewPermission(c.Peer, a.log))
 	} else {
 		channelByNumber.refresh(lifetime)
+	}
+	a.channelBindingsLock.Unlock()
 
-		// Channel binds also refresh permissions.
-		a.AddPermission(NewPermission(channelByNumber.Peer, a.log))
+	// Channel binds also refresh permissions.
+	a.AddPermission(NewPermission(c.Peer, a.log))
+	if channelByNumber == nil {
+		a.events.channelBound(a, c)
 	}
 
 	return nil
@@ -133,47 +305,90 @@ func (a *Allocation) AddChannelBind(c *ChannelBind, lifetime time.Duration) erro
 // RemoveChannelBind removes the ChannelBind from this allocation by id
 func (a *Allocation) RemoveChannelBind(number proto.ChannelNumber) bool {
 	a.channelBindingsLock.Lock()
-	defer a.channelBindingsLock.Unlock()
-
-	for i := len(a.channelBindings) - 1; i >= 0; i-- {
-		if a.channelBindings[i].Number == number {
-			a.channelBindings = append(a.channelBindings[:i], a.channelBindings[i+1:]...)
-			return true
-		}
+	c, ok := a.channelsByNumber[number]
+	if !ok {
+		a.channelBindingsLock.Unlock()
+		return false
 	}
+	c.stop()
+	a.removeChannel(c)
+	a.channelBindingsLock.Unlock()
+
+	a.keepTraffic(c.Peer, c.Number, c.Traffic())
+	return true
+}
+
+// addChannel indexes c by number and peer, channelBindingsLock must be held
+func (a *Allocation) addChannel(c *ChannelBind) {
+	c.allocation = a
+	a.channelsByNumber[c.Number] = c
+	a.channelsByPeer[peerFingerprintOf(c.Peer)] = c
+}
 
-	return false
+// removeChannel drops c from the indexes, channelBindingsLock must be held
+func (a *Allocation) removeChannel(c *ChannelBind) {
+	delete(a.channelsByNumber, c.Number)
+	delete(a.channelsByPeer, peerFingerprintOf(c.Peer))
 }
 
 // GetChannelByNumber gets the ChannelBind from this allocation by id
 func (a *Allocation) GetChannelByNumber(number proto.ChannelNumber) *ChannelBind {
 	a.channelBindingsLock.RLock()
 	defer a.channelBindingsLock.RUnlock()
-	for _, cb := range a.channelBindings {
-		if cb.Number == number {
-			return cb
-		}
-	}
-	return nil
+	return a.channelsByNumber[number]
 }
 
 // GetChannelByAddr gets the ChannelBind from this allocation by net.Addr
 func (a *Allocation) GetChannelByAddr(addr net.Addr) *ChannelBind {
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return nil
+	}
+
 	a.channelBindingsLock.RLock()
 	defer a.channelBindingsLock.RUnlock()
-	for _, cb := range a.channelBindings {
-		if ipnet.AddrEqual(cb.Peer, addr) {
-			return cb
-		}
+	return a.channelsByPeer[peerFingerprintOf(addr)]
+}
+
+// Refresh updates the allocations lifetime, it reports false if the allocation
+// already expired
+func (a *Allocation) Refresh(lifetime time.Duration) bool {
+	a.lifetimeLock.Lock()
+	if a.expired {
+		a.lifetimeLock.Unlock()
+		return false
 	}
-	return nil
+	a.expiresAt.Store(a.clock.Now().Add(lifetime))
+	a.lifetimeTimer.Reset(lifetime)
+	a.lifetimeLock.Unlock()
+
+	a.events.allocationRefreshed(a, lifetime)
+	return true
 }
 
-// Refresh updates the allocations lifetime
-func (a *Allocation) Refresh(lifetime time.Duration) {
-	if !a.lifetimeTimer.Reset(lifetime) {
-		a.log.Errorf("Failed to reset allocation timer for %v", a.fiveTuple)
+// startLifetime calls expired once the allocation was not refreshed for lifetime
+func (a *Allocation) startLifetime(lifetime time.Duration, expired func()) {
+	a.lifetimeLock.Lock()
+	defer a.lifetimeLock.Unlock()
+
+	a.expiresAt.Store(a.clock.Now().Add(lifetime))
+	a.lifetimeTimer = a.timers.AfterFunc(lifetime, func() {
+		if a.expire() {
+			expired()
+		}
+	})
+}
+
+// expire marks the allocation as expired unless it was refreshed after the
+// lifetime timer fired
+func (a *Allocation) expire() bool {
+	a.lifetimeLock.Lock()
+	defer a.lifetimeLock.Unlock()
+
+	if a.expired || a.clock.Now().Before(a.ExpiresAt()) {
+		return false
 	}
+	a.expired = true
+	return true
 }
 
 // SetResponseCache cache allocation response for retransmit allocation request
@@ -201,21 +416,43 @@ func (a *Allocation) Close() error {
 	}
 	close(a.closed)
 
-	a.lifetimeTimer.Stop()
+	a.stopTimers()
+	a.relays.remove(a)
+	return a.RelaySocket.Close()
+}
+
+// stopReading makes the packet handler fail its read and waits until it exited, the
+// relay socket stays open
+func (a *Allocation) stopReading() error {
+	if a.handlerDone == nil {
+		return nil
+	}
+	if err := a.RelaySocket.SetReadDeadline(time.Unix(1, 0)); err != nil {
+		return err
+	}
+	<-a.handlerDone
+	return nil
+}
+
+// stopTimers stops the lifetime timers of the allocation, its permissions and channel bindings
+func (a *Allocation) stopTimers() {
+	a.lifetimeLock.Lock()
+	if a.lifetimeTimer != nil {
+		a.lifetimeTimer.Stop()
+	}
+	a.lifetimeLock.Unlock()
 
 	a.permissionsLock.RLock()
 	for _, p := range a.permissions {
-		p.lifetimeTimer.Stop()
+		p.stop()
 	}
 	a.permissionsLock.RUnlock()
 
 	a.channelBindingsLock.RLock()
-	for _, c := range a.channelBindings {
-		c.lifetimeTimer.Stop()
+	for _, c := range a.channelsByNumber {
+		c.stop()
 	}
 	a.channelBindingsLock.RUnlock()
-
-	return a.RelaySocket.Close()
 }
 
 //  https://tools.ietf.org/html/rfc5766#section-10.3
@@ -238,56 +475,195 @@ func (a *Allocation) Close() error {
 //  transport address of the received UDP datagram.  The Data indication
 //  is then sent on the 5-tuple associated with the allocation.
 
-const rtpMTU = 1600
+const (
+	rtpMTU = 1600
+
+	// channelDataOverhead is the ChannelData header and the padding to 4 bytes
+	channelDataOverhead = 4 + 3
+	// dataIndicationOverhead is the STUN header, an IPv6 XOR-PEER-ADDRESS and the
+	// DATA attribute header and padding
+	dataIndicationOverhead = 20 + 4 + 20 + 4 + 3
+)
+
+// clientPacket is a datagram received on the relay socket wrapped for the client
+type clientPacket struct {
+	raw        []byte
+	size       int
+	channel    *ChannelBind
+	permission *Permission
+}
+
+// clientBuffer is reused to wrap datagrams for the client without allocating
+type clientBuffer struct {
+	channelData proto.ChannelData
+	msg         stun.Message
+}
+
+func newClientBuffer() *clientBuffer {
+	return &clientBuffer{
+		channelData: proto.ChannelData{Raw: make([]byte, 0, rtpMTU+channelDataOverhead)},
+		msg: stun.Message{
+			Raw:        make([]byte, 0, rtpMTU+dataIndicationOverhead),
+			Attributes: make(stun.Attributes, 0, 2),
+		},
+	}
+}
 
 func (a *Allocation) packetHandler(m *Manager) {
+	defer close(a.handlerDone)
+
+	if m.batchSize > 1 {
+		a.batchPacketHandler(m)
+		return
+	}
+
 	buffer := make([]byte, rtpMTU)
+	out := newClientBuffer()
 
 	for {
 		n, srcAddr, err := a.RelaySocket.ReadFrom(buffer)
 		if err != nil {
-			m.DeleteAllocation(a.fiveTuple)
+			m.DeleteAllocation(a.fiveTuple, DeleteReasonSocketError)
 			return
 		}
 
-		a.log.Debugf("relay socket %s received %d bytes from %s",
-			a.RelaySocket.LocalAddr().String(),
-			n,
-			srcAddr.String())
+		packet, ok := a.wrapForClient(out, buffer[:n], srcAddr)
+		if !ok {
+			continue
+		}
 
-		if channel := a.GetChannelByAddr(srcAddr); channel != nil {
-			channelData := &proto.ChannelData{
-				Data:   buffer[:n],
-				Number: channel.Number,
-			}
-			channelData.Encode()
+		if _, err = a.TurnSocket.WriteTo(packet.raw, a.fiveTuple.SrcAddr); err != nil {
+			a.log.Errorf("Failed to relay packet from %v to client: %v", srcAddr, err)
+			continue
+		}
+		a.countToClient(packet)
+	}
+}
 
-			if _, err = a.TurnSocket.WriteTo(channelData.Raw, a.fiveTuple.SrcAddr); err != nil {
-				a.log.Errorf("Failed to send ChannelData from allocation %v %v", srcAddr, err)
-			}
-		} else if p := a.GetPermission(srcAddr); p != nil {
-			udpAddr, ok := srcAddr.(*net.UDPAddr)
-			if !ok {
-				a.log.Errorf("Failed to send DataIndication from allocation %v %v", srcAddr, err)
-				return
-			}
+// batchPacketHandler relays like packetHandler, reading up to batchSize datagrams
+// from the relay socket and writing them to the client with one syscall each
+func (a *Allocation) batchPacketHandler(m *Manager) {
+	relayConn := batchconn.New(a.RelaySocket, batchconn.Offload{GRO: m.udpOffload})
+	turnConn := batchconn.New(a.TurnSocket, batchconn.Offload{GSO: m.udpOffload})
+
+	in := make([]batchconn.Message, m.batchSize)
+	out := make([]batchconn.Message, 0, m.batchSize)
+	outBuffers := make([]*clientBuffer, m.batchSize)
+	packets := make([]clientPacket, 0, m.batchSize)
+	for i := range in {
+		in[i].Buffer = make([]byte, rtpMTU)
+		outBuffers[i] = newClientBuffer()
+	}
 
-			peerAddressAttr := proto.PeerAddress{IP: udpAddr.IP, Port: udpAddr.Port}
-			dataAttr := proto.Data(buffer[:n])
+	for {
+		n, err := relayConn.ReadBatch(in)
+		if err != nil {
+			m.DeleteAllocation(a.fiveTuple, DeleteReasonSocketError)
+			return
+		}
 
-			msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodData, stun.ClassIndication), peerAddressAttr, dataAttr)
-			if err != nil {
-				a.log.Errorf("Failed to send DataIndication from allocation %v %v", srcAddr, err)
-				return
-			}
-			a.log.Debugf("relaying message from %s to client at %s",
-				srcAddr.String(),
-				a.fiveTuple.SrcAddr.String())
-			if _, err = a.TurnSocket.WriteTo(msg.Raw, a.fiveTuple.SrcAddr); err != nil {
-				a.log.Errorf("Failed to send DataIndication from allocation %v %v", srcAddr, err)
+		out, packets = out[:0], packets[:0]
+		for _, msg := range in[:n] {
+			packet, ok := a.wrapForClient(outBuffers[len(out)], msg.Buffer[:msg.N], msg.Addr)
+			if !ok {
+				continue
 			}
-		} else {
-			a.log.Infof("No Permission or Channel exists for %v on allocation %v", srcAddr, a.RelayAddr.String())
+			out = append(out, batchconn.Message{Buffer: packet.raw, Addr: a.fiveTuple.SrcAddr})
+			packets = append(packets, packet)
+		}
+
+		sent, err := turnConn.WriteBatch(out)
+		if err != nil {
+			a.log.Errorf("Failed to relay %d packets to client: %v", len(out)-sent, err)
 		}
+		for _, packet := range packets[:sent] {
+			a.countToClient(packet)
+		}
+	}
+}
+
+// wrapForClient wraps data received from srcAddr in a ChannelData message or in a
+// Data indication encoded into buf. It reports false if the data is dropped.
+func (a *Allocation) wrapForClient(buf *clientBuffer, data []byte, srcAddr net.Addr) (clientPacket, bool) {
+	if channel := a.GetChannelByAddr(srcAddr); channel != nil {
+		buf.channelData.Data = data
+		buf.channelData.Number = channel.Number
+		buf.channelData.Encode()
+
+		return clientPacket{
+			raw:        buf.channelData.Raw,
+			size:       len(data),
+			channel:    channel,
+			permission: a.GetPermission(srcAddr),
+		}, true
+	}
+
+	p := a.GetPermission(srcAddr)
+	if p == nil {
+		a.log.Infof("No Permission or Channel exists for %v on allocation %v", srcAddr, a.RelayAddr)
+		a.traffic.addDropped(len(data))
+		return clientPacket{}, false
+	}
+
+	udpAddr, ok := srcAddr.(*net.UDPAddr)
+	if !ok {
+		a.log.Errorf("Failed to send DataIndication from allocation %v: %v", srcAddr, errFailedToCastUDPAddr)
+		return clientPacket{}, false
+	}
+
+	if err := buildDataIndication(&buf.msg, udpAddr, data); err != nil {
+		a.log.Errorf("Failed to send DataIndication from allocation %v %v", srcAddr, err)
+		return clientPacket{}, false
+	}
+	return clientPacket{raw: buf.msg.Raw, size: len(data), permission: p}, true
+}
+
+// buildDataIndication encodes a Data indication into msg like stun.Build, but
+// without the allocations of passing the attributes as stun.Setters
+func buildDataIndication(msg *stun.Message, peer *net.UDPAddr, data []byte) error {
+	msg.Reset()
+	msg.Type = stun.NewType(stun.MethodData, stun.ClassIndication)
+	msg.WriteHeader()
+	if err := msg.NewTransactionID(); err != nil {
+		return err
+	}
+
+	if err := (proto.PeerAddress{IP: peer.IP, Port: peer.Port}).AddTo(msg); err != nil {
+		return err
+	}
+	return proto.Data(data).AddTo(msg)
+}
+
+var hairpinBuffers = sync.Pool{ //nolint:gochecknoglobals
+	New: func() interface{} { return newClientBuffer() },
+}
+
+// deliver relays data another allocation of the server sent from srcAddr to the
+// relayed transport address of a, as if it was received on the relay socket. The
+// permissions of a still apply, dropped data counts as written like it would on
+// the network.
+func (a *Allocation) deliver(data []byte, srcAddr net.Addr) (int, error) {
+	buf := hairpinBuffers.Get().(*clientBuffer) //nolint:forcetypeassert
+	defer hairpinBuffers.Put(buf)
+
+	packet, ok := a.wrapForClient(buf, data, srcAddr)
+	if !ok {
+		return len(data), nil
+	}
+	if _, err := a.TurnSocket.WriteTo(packet.raw, a.fiveTuple.SrcAddr); err != nil {
+		a.log.Errorf("Failed to send hairpinned data from %v to %v: %v", srcAddr, a.fiveTuple.SrcAddr, err)
+		return len(data), nil
+	}
+	a.countToClient(packet)
+	return len(data), nil
+}
+
+func (a *Allocation) countToClient(packet clientPacket) {
+	a.traffic.addToClient(packet.size)
+	if packet.channel != nil {
+		packet.channel.traffic.addToClient(packet.size)
+	}
+	if packet.permission != nil {
+		packet.permission.traffic.addToClient(packet.size)
 	}
 }
@@ -7,14 +7,75 @@ import (
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/clock"
+	"github.com/pion/turn/v2/internal/timingwheel"
+)
+
+const (
+	reservationTimeout = 30 * time.Second
+
+	// TimerTick is the resolution of the lifetimes of allocations, permissions,
+	// channel bindings and reservations
+	TimerTick = 100 * time.Millisecond
 )
 
 // ManagerConfig a bag of config params for Manager.
 type ManagerConfig struct {
 	LeveledLogger      logging.LeveledLogger
-	AllocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
+	AllocatePacketConn func(req RelayRequest) (net.PacketConn, net.Addr, error)
 	AllocateConn       func(network string, requestedPort int) (net.Conn, net.Addr, error)
 	PermissionHandler  func(sourceAddr net.Addr, peerIP net.IP) bool
+	EventHandler       EventHandler
+
+	// BatchSize is the number of datagrams relayed to the client with a single
+	// syscall, see package batchconn. Values up to 1 relay one datagram per syscall.
+	BatchSize int
+
+	// UDPOffload relays batches with UDP GSO and reads relay sockets with UDP GRO
+	// where the kernel supports them
+	UDPOffload bool
+
+	// PermissionTimeout is the lifetime of permissions, DefaultPermissionTimeout if 0
+	PermissionTimeout time.Duration
+
+	// NetworkSupported reports if relays of network, udp4 or udp6, can be allocated.
+	// Every network is assumed to be supported if it is nil.
+	NetworkSupported func(network string) bool
+
+	// DontFragment is set if AllocatePacketConn sends the datagrams of relays with the
+	// DF bit set for requests with DontFragment
+	DontFragment bool
+
+	// Clock is the time source of the lifetimes, clock.System if nil
+	Clock clock.Clock
+
+	// Timers expires allocations, permissions, channel bindings and reservations,
+	// it can be shared by several managers. Without Timers the manager creates a
+	// wheel on Clock with a resolution of TimerTick and closes it in Close.
+	Timers *timingwheel.Wheel
+
+	// Relays finds the allocations data to relayed transport addresses of the server
+	// is handed over to in memory, it can be shared by several managers. Without
+	// Relays the manager only hairpins between its own allocations.
+	Relays *RelayIndex
+
+	// IsolatePeers restricts peers to the relayed transport addresses of other allocations
+	// of Relays it permits, see PeerPermitted. Data to other peers is dropped. Peers are
+	// not restricted if IsolatePeers is nil.
+	IsolatePeers func(a, peer *Allocation) bool
+}
+
+// RelayRequest describes the allocation a relay socket is created for
+type RelayRequest struct {
+	FiveTuple *FiveTuple
+	// Network is udp4, or udp6 if the client asked for an IPv6 relay
+	Network       string
+	RequestedPort int
+	Username      string
+	Realm         string
+	EvenPort      bool
+	ReservePort   bool
+	DontFragment  bool
 }
 
 type reservation struct {
@@ -24,15 +85,31 @@ type reservation struct {
 
 // Manager is used to hold active allocations
 type Manager struct {
-	lock sync.RWMutex
-	log  logging.LeveledLogger
+	allocations *allocationShards
+	log         logging.LeveledLogger
 
-	allocations  map[string]*Allocation
+	lock         sync.Mutex
 	reservations []*reservation
 
-	allocatePacketConn func(network string, requestedPort int) (net.PacketConn, net.Addr, error)
+	// trafficLock is held while allocations are removed and their traffic is moved
+	// to deletedTraffic, so Traffic counts every allocation exactly once
+	trafficLock    sync.Mutex
+	deletedTraffic Traffic
+
+	allocatePacketConn func(req RelayRequest) (net.PacketConn, net.Addr, error)
 	allocateConn       func(network string, requestedPort int) (net.Conn, net.Addr, error)
 	permissionHandler  func(sourceAddr net.Addr, peerIP net.IP) bool
+	networkSupported   func(network string) bool
+	dontFragment       bool
+	events             EventHandler
+	batchSize          int
+	udpOffload         bool
+	permissionTimeout  time.Duration
+	relays             *RelayIndex
+	isolatePeers       func(a, peer *Allocation) bool
+	clock              clock.Clock
+	timers             *timingwheel.Wheel
+	ownsTimers         bool
 }
 
 // NewManager creates a new instance of Manager.
@@ -46,44 +123,121 @@ func NewManager(config ManagerConfig) (*Manager, error) {
 		return nil, errLeveledLoggerMustBeSet
 	}
 
+	c := config.Clock
+	if c == nil {
+		c = clock.System
+	}
+
+	permissionTimeout := config.PermissionTimeout
+	if permissionTimeout == 0 {
+		permissionTimeout = DefaultPermissionTimeout
+	}
+
+	relays := config.Relays
+	if relays == nil {
+		relays = NewRelayIndex()
+	}
+
+	timers, ownsTimers := config.Timers, false
+	if timers == nil {
+		timers, ownsTimers = timingwheel.New(TimerTick, c), true
+	}
+
 	return &Manager{
 		log:                config.LeveledLogger,
-		allocations:        make(map[string]*Allocation, 64),
+		allocations:        newAllocationShards(),
 		allocatePacketConn: config.AllocatePacketConn,
 		allocateConn:       config.AllocateConn,
 		permissionHandler:  config.PermissionHandler,
+		networkSupported:   config.NetworkSupported,
+		dontFragment:       config.DontFragment,
+		events:             config.EventHandler,
+		batchSize:          config.BatchSize,
+		udpOffload:         config.UDPOffload,
+		permissionTimeout:  permissionTimeout,
+		relays:             relays,
+		isolatePeers:       config.IsolatePeers,
+		clock:              c,
+		timers:             timers,
+		ownsTimers:         ownsTimers,
 	}, nil
 }
 
 // GetAllocation fetches the allocation matching the passed FiveTuple
 func (m *Manager) GetAllocation(fiveTuple *FiveTuple) *Allocation {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	return m.allocations[fiveTuple.Fingerprint()]
+	return m.allocations.get(fiveTuple.Fingerprint())
 }
 
 // AllocationCount returns the number of existing allocations
 func (m *Manager) AllocationCount() int {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	return len(m.allocations)
+	return m.allocations.len()
+}
+
+// Allocations returns all existing allocations
+func (m *Manager) Allocations() []*Allocation {
+	return m.allocations.all()
+}
+
+// Traffic returns the total traffic relayed by every allocation the manager has held
+func (m *Manager) Traffic() Traffic {
+	m.trafficLock.Lock()
+	defer m.trafficLock.Unlock()
+
+	t := m.deletedTraffic
+	for _, a := range m.allocations.all() {
+		t.Add(a.Traffic())
+	}
+	return t
+}
+
+// removeAllocation removes the allocation of fiveTuple and keeps its traffic in Traffic
+func (m *Manager) removeAllocation(fiveTuple *FiveTuple) *Allocation {
+	m.trafficLock.Lock()
+	defer m.trafficLock.Unlock()
+
+	a := m.allocations.remove(fiveTuple.Fingerprint())
+	if a != nil {
+		m.deletedTraffic.Add(a.Traffic())
+	}
+	return a
 }
 
 // Close closes the manager and closes all allocations it manages
 func (m *Manager) Close() error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	if m.ownsTimers {
+		defer m.timers.Close()
+	}
 
-	for _, a := range m.allocations {
+	m.trafficLock.Lock()
+	allocations := m.allocations.clear()
+	for _, a := range allocations {
+		m.deletedTraffic.Add(a.Traffic())
+	}
+	m.trafficLock.Unlock()
+
+	for _, a := range allocations {
 		if err := a.Close(); err != nil {
 			return err
 		}
+		m.events.allocationDeleted(a, DeleteReasonServerClosed)
 	}
 	return nil
 }
 
-// CreateAllocation creates a new allocation and starts relaying
-func (m *Manager) CreateAllocation(fiveTuple *FiveTuple, turnSocket net.PacketConn, requestedPort int, lifetime time.Duration) (*Allocation, error) {
+// CreateAllocation creates a new allocation with a udp4 relay and starts relaying
+func (m *Manager) CreateAllocation(fiveTuple *FiveTuple, turnSocket net.PacketConn, requestedPort int, lifetime time.Duration, username string) (*Allocation, error) {
+	return m.CreateAllocationForRequest(turnSocket, lifetime, RelayRequest{
+		FiveTuple:     fiveTuple,
+		Network:       "udp4",
+		RequestedPort: requestedPort,
+		Username:      username,
+	})
+}
+
+// CreateAllocationForRequest creates a new allocation with the relay socket allocated
+// for req and starts relaying
+func (m *Manager) CreateAllocationForRequest(turnSocket net.PacketConn, lifetime time.Duration, req RelayRequest) (*Allocation, error) {
+	fiveTuple := req.FiveTuple
 	switch {
 	case fiveTuple == nil:
 		return nil, errNilFiveTuple
@@ -101,8 +255,18 @@ func (m *Manager) CreateAllocation(fiveTuple *FiveTuple, turnSocket net.PacketCo
 		return nil, fmt.Errorf("%w: %v", errDupeFiveTuple, fiveTuple)
 	}
 	a := NewAllocation(turnSocket, fiveTuple, m.log)
-
-	conn, relayAddr, err := m.allocatePacketConn("udp4", requestedPort)
+	a.username = req.Username
+	a.realm = req.Realm
+	a.createdAt = m.clock.Now()
+	a.events = &m.events
+	a.clock = m.clock
+	a.timers = m.timers
+	a.permissionTimeout = m.permissionTimeout
+	a.relays = m.relays
+	a.isolatePeers = m.isolatePeers
+	a.handlerDone = make(chan struct{})
+
+	conn, relayAddr, err := m.allocatePacketConn(req)
 	if err != nil {
 		return nil, err
 	}
@@ -112,39 +276,44 @@ func (m *Manager) CreateAllocation(fiveTuple *FiveTuple, turnSocket net.PacketCo
 
 	m.log.Debugf("listening on relay addr: %s", a.RelayAddr.String())
 
-	a.lifetimeTimer = time.AfterFunc(lifetime, func() {
-		m.DeleteAllocation(a.fiveTuple)
+	a.startLifetime(lifetime, func() {
+		m.DeleteAllocation(a.fiveTuple, DeleteReasonExpired)
 	})
 
-	m.lock.Lock()
-	m.allocations[fiveTuple.Fingerprint()] = a
-	m.lock.Unlock()
+	if !m.allocations.insert(fiveTuple.Fingerprint(), a) {
+		a.lifetimeTimer.Stop()
+		if err := conn.Close(); err != nil {
+			m.log.Errorf("Failed to close relay socket: %v", err)
+		}
+		return nil, fmt.Errorf("%w: %v", errDupeFiveTuple, fiveTuple)
+	}
+
+	m.relays.add(a)
+	m.events.allocationCreated(a, lifetime)
 
 	go a.packetHandler(m)
 	return a, nil
 }
 
-// DeleteAllocation removes an allocation
-func (m *Manager) DeleteAllocation(fiveTuple *FiveTuple) {
-	fingerprint := fiveTuple.Fingerprint()
-
-	m.lock.Lock()
-	allocation := m.allocations[fingerprint]
-	delete(m.allocations, fingerprint)
-	m.lock.Unlock()
-
+// DeleteAllocation removes an allocation, the reason is passed to the EventHandler.
+// It returns false if the allocation was already gone.
+func (m *Manager) DeleteAllocation(fiveTuple *FiveTuple, reason DeleteReason) bool {
+	allocation := m.removeAllocation(fiveTuple)
 	if allocation == nil {
-		return
+		return false
 	}
 
 	if err := allocation.Close(); err != nil {
 		m.log.Errorf("Failed to close allocation: %v", err)
 	}
+
+	m.events.allocationDeleted(allocation, reason)
+	return true
 }
 
 // CreateReservation stores the reservation for the token+port
 func (m *Manager) CreateReservation(reservationToken string, port int) {
-	time.AfterFunc(30*time.Second, func() {
+	m.timers.AfterFunc(reservationTimeout, func() {
 		m.lock.Lock()
 		defer m.lock.Unlock()
 		for i := len(m.reservations) - 1; i >= 0; i-- {
@@ -165,8 +334,8 @@ func (m *Manager) CreateReservation(reservationToken string, port int) {
 
 // GetReservation returns the port for a given reservation if it exists
 func (m *Manager) GetReservation(reservationToken string) (int, bool) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	for _, r := range m.reservations {
 		if r.token == reservationToken {
@@ -176,10 +345,11 @@ func (m *Manager) GetReservation(reservationToken string) (int, bool) {
 	return 0, false
 }
 
-// GetRandomEvenPort returns a random un-allocated udp4 port
-func (m *Manager) GetRandomEvenPort() (int, error) {
+// GetRandomEvenPort returns a random un-allocated even port of the relays of req
+func (m *Manager) GetRandomEvenPort(req RelayRequest) (int, error) {
+	req.RequestedPort = 0
 	for i := 0; i < 128; i++ {
-		conn, addr, err := m.allocatePacketConn("udp4", 0)
+		conn, addr, err := m.allocatePacketConn(req)
 		if err != nil {
 			return 0, err
 		}
@@ -199,6 +369,16 @@ func (m *Manager) GetRandomEvenPort() (int, error) {
 	return 0, errFailedToAllocateEvenPort
 }
 
+// NetworkSupported reports if relays of network can be allocated
+func (m *Manager) NetworkSupported(network string) bool {
+	return m.networkSupported == nil || m.networkSupported(network)
+}
+
+// DontFragmentSupported reports if relays can be allocated for requests with DontFragment
+func (m *Manager) DontFragmentSupported() bool {
+	return m.dontFragment
+}
+
 // GrantPermission handles permission requests by calling the permission handler callback
 // associated with the TURN server listener socket
 func (m *Manager) GrantPermission(sourceAddr net.Addr, peerIP net.IP) error {
@@ -213,3 +393,15 @@ func (m *Manager) GrantPermission(sourceAddr net.Addr, peerIP net.IP) error {
 
 	return errAdminProhibited
 }
+
+// PeerPermitted reports whether a may relay to peer. Without IsolatePeers every peer
+// is permitted, otherwise peer must be the relayed transport address of another live
+// allocation IsolatePeers permits.
+func (m *Manager) PeerPermitted(a *Allocation, peer net.Addr) bool {
+	if m.isolatePeers == nil {
+		return true
+	}
+
+	b := m.relays.lookup(peer)
+	return b != nil && b != a && m.isolatePeers(a, b)
+}
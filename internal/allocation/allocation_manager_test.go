@@ -4,6 +4,7 @@
 package allocation
 
 import (
+	"encoding/json"
 	"io"
 	"math/rand"
 	"net"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/proto"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,6 +30,11 @@ func TestManager(t *testing.T) {
 		{"AllocationTimeout", subTestAllocationTimeout},
 		{"Close", subTestManagerClose},
 		{"GetRandomEvenPort", subTestGetRandomEvenPort},
+		{"EventHandler", subTestManagerEventHandler},
+		{"SnapshotRestore", subTestSnapshotRestore},
+		{"FakeClock", subTestManagerFakeClock},
+		{"IsolatePeers", subTestManagerIsolatePeers},
+		{"Traffic", subTestManagerTraffic},
 	}
 
 	network := "udp4"
@@ -49,13 +56,13 @@ func subTestCreateInvalidAllocation(t *testing.T, turnSocket net.PacketConn) {
 	m, err := newTestManager()
 	assert.NoError(t, err)
 
-	if a, err := m.CreateAllocation(nil, turnSocket, 0, proto.DefaultLifetime); a != nil || err == nil {
+	if a, err := m.CreateAllocation(nil, turnSocket, 0, proto.DefaultLifetime, ""); a != nil || err == nil {
 		t.Errorf("Illegally created allocation with nil FiveTuple")
 	}
-	if a, err := m.CreateAllocation(randomFiveTuple(), nil, 0, proto.DefaultLifetime); a != nil || err == nil {
+	if a, err := m.CreateAllocation(randomFiveTuple(), nil, 0, proto.DefaultLifetime, ""); a != nil || err == nil {
 		t.Errorf("Illegally created allocation with nil turnSocket")
 	}
-	if a, err := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 0); a != nil || err == nil {
+	if a, err := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 0, ""); a != nil || err == nil {
 		t.Errorf("Illegally created allocation with 0 lifetime")
 	}
 }
@@ -66,7 +73,7 @@ func subTestCreateAllocation(t *testing.T, turnSocket net.PacketConn) {
 	assert.NoError(t, err)
 
 	fiveTuple := randomFiveTuple()
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a == nil || err != nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, ""); a == nil || err != nil {
 		t.Errorf("Failed to create allocation %v %v", a, err)
 	}
 
@@ -81,11 +88,11 @@ func subTestCreateAllocationDuplicateFiveTuple(t *testing.T, turnSocket net.Pack
 	assert.NoError(t, err)
 
 	fiveTuple := randomFiveTuple()
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a == nil || err != nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, ""); a == nil || err != nil {
 		t.Errorf("Failed to create allocation %v %v", a, err)
 	}
 
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a != nil || err == nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, ""); a != nil || err == nil {
 		t.Errorf("Was able to create allocation with same FiveTuple twice")
 	}
 }
@@ -95,7 +102,7 @@ func subTestDeleteAllocation(t *testing.T, turnSocket net.PacketConn) {
 	assert.NoError(t, err)
 
 	fiveTuple := randomFiveTuple()
-	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime); a == nil || err != nil {
+	if a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, ""); a == nil || err != nil {
 		t.Errorf("Failed to create allocation %v %v", a, err)
 	}
 
@@ -103,7 +110,7 @@ func subTestDeleteAllocation(t *testing.T, turnSocket net.PacketConn) {
 		t.Errorf("Failed to get allocation right after creation")
 	}
 
-	m.DeleteAllocation(fiveTuple)
+	m.DeleteAllocation(fiveTuple, DeleteReasonClientDeleted)
 	if a := m.GetAllocation(fiveTuple); a != nil {
 		t.Errorf("Get allocation with %v should be nil after delete", fiveTuple)
 	}
@@ -120,7 +127,7 @@ func subTestAllocationTimeout(t *testing.T, turnSocket net.PacketConn) {
 	for index := range allocations {
 		fiveTuple := randomFiveTuple()
 
-		a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, lifetime)
+		a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, lifetime, "")
 		if err != nil {
 			t.Errorf("Failed to create allocation with %v", fiveTuple)
 		}
@@ -144,9 +151,9 @@ func subTestManagerClose(t *testing.T, turnSocket net.PacketConn) {
 
 	allocations := make([]*Allocation, 2)
 
-	a1, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Second)
+	a1, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Second, "")
 	allocations[0] = a1
-	a2, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Minute)
+	a2, _ := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, time.Minute, "")
 	allocations[1] = a2
 
 	// make a1 timeout
@@ -172,11 +179,16 @@ func randomFiveTuple() *FiveTuple {
 }
 
 func newTestManager() (*Manager, error) {
+	return newTestManagerWithClock(clock.System)
+}
+
+func newTestManagerWithClock(c clock.Clock) (*Manager, error) {
 	loggerFactory := logging.NewDefaultLoggerFactory()
 
 	config := ManagerConfig{
 		LeveledLogger: loggerFactory.NewLogger("test"),
-		AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+		Clock:         c,
+		AllocatePacketConn: func(req RelayRequest) (net.PacketConn, net.Addr, error) {
 			conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
 			if err != nil {
 				return nil, nil, err
@@ -198,8 +210,278 @@ func subTestGetRandomEvenPort(t *testing.T, turnSocket net.PacketConn) {
 	m, err := newTestManager()
 	assert.NoError(t, err)
 
-	port, err := m.GetRandomEvenPort()
+	port, err := m.GetRandomEvenPort(RelayRequest{Network: "udp4", EvenPort: true})
 	assert.NoError(t, err)
 	assert.True(t, port > 0)
 	assert.True(t, port%2 == 0)
 }
+
+func subTestManagerEventHandler(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+
+	created := make(chan *Allocation, 1)
+	deleted := make(chan DeleteReason, 1)
+	m.events = EventHandler{
+		OnAllocationCreated: func(a *Allocation, lifetime time.Duration) {
+			assert.Equal(t, "user", a.Username())
+			assert.Equal(t, 50*time.Millisecond, lifetime)
+			created <- a
+		},
+		OnAllocationDeleted: func(a *Allocation, reason DeleteReason) {
+			deleted <- reason
+		},
+	}
+
+	// expired
+	a, err := m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 50*time.Millisecond, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, a, <-created)
+	assert.Equal(t, DeleteReasonExpired, <-deleted)
+
+	// client deleted
+	a, err = m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 50*time.Millisecond, "user")
+	assert.NoError(t, err)
+	<-created
+	m.DeleteAllocation(a.FiveTuple(), DeleteReasonClientDeleted)
+	assert.Equal(t, DeleteReasonClientDeleted, <-deleted)
+
+	// server closed
+	_, err = m.CreateAllocation(randomFiveTuple(), turnSocket, 0, 50*time.Millisecond, "user")
+	assert.NoError(t, err)
+	<-created
+	assert.NoError(t, m.Close())
+	assert.Equal(t, DeleteReasonServerClosed, <-deleted)
+}
+
+// hours of refreshes and expiries are simulated with a fake clock
+func subTestManagerIsolatePeers(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+	m.isolatePeers = func(a, peer *Allocation) bool {
+		return a.Realm() == peer.Realm()
+	}
+
+	create := func(realm string) *Allocation {
+		a, err := m.CreateAllocationForRequest(turnSocket, proto.DefaultLifetime, RelayRequest{
+			FiveTuple: randomFiveTuple(),
+			Network:   "udp4",
+			Realm:     realm,
+		})
+		assert.NoError(t, err)
+		return a
+	}
+	a, b, other := create("pion.ly"), create("pion.ly"), create("example.org")
+	assert.Equal(t, "pion.ly", a.Realm())
+
+	assert.True(t, m.PeerPermitted(a, b.RelayAddr))
+	assert.False(t, m.PeerPermitted(a, a.RelayAddr))
+	assert.False(t, m.PeerPermitted(a, other.RelayAddr))
+	assert.False(t, m.PeerPermitted(a, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}))
+
+	// data to peers that are not permitted allocations is dropped, even with a permission
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+	a.AddPermission(NewPermission(peer, m.log))
+	n, err := a.WriteToPeer([]byte("dropped"), peer, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, uint64(1), a.Traffic().DroppedPackets)
+	assert.Equal(t, uint64(0), a.Traffic().PacketsToPeer)
+
+	// a deleted allocation is not a peer anymore
+	m.DeleteAllocation(b.fiveTuple, DeleteReasonClientDeleted)
+	assert.False(t, m.PeerPermitted(a, b.RelayAddr))
+
+	assert.NoError(t, m.Close())
+}
+
+func subTestManagerFakeClock(t *testing.T, turnSocket net.PacketConn) {
+	c := clock.NewFake(time.Now())
+	m, err := newTestManagerWithClock(c)
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, m.Close())
+	}()
+
+	var expiredPermissions, expiredChannels int
+	m.events = EventHandler{
+		OnPermissionExpired: func(*Allocation, *Permission) { expiredPermissions++ },
+		OnChannelExpired:    func(*Allocation, *ChannelBind) { expiredChannels++ },
+	}
+
+	fiveTuple := randomFiveTuple()
+	a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, "user")
+	assert.NoError(t, err)
+
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6000}
+	assert.NoError(t, a.AddChannelBind(NewChannelBind(proto.MinChannelNumber, peer, m.log), proto.DefaultLifetime))
+
+	// refreshing every 4 minutes keeps the allocation, the channel binding and its
+	// permission alive for hours
+	for i := 0; i < 30; i++ {
+		c.Advance(4 * time.Minute)
+		assert.True(t, a.Refresh(proto.DefaultLifetime))
+		assert.NoError(t, a.AddChannelBind(NewChannelBind(proto.MinChannelNumber, peer, m.log), proto.DefaultLifetime))
+	}
+	assert.NotNil(t, a.GetChannelByNumber(proto.MinChannelNumber))
+	assert.Equal(t, 0, expiredPermissions+expiredChannels)
+
+	// the permission expires after 5 minutes, the channel binding after 10
+	c.Advance(5 * time.Minute)
+	assert.Nil(t, a.GetPermission(peer))
+	assert.Equal(t, 1, expiredPermissions)
+	assert.NotNil(t, a.GetChannelByNumber(proto.MinChannelNumber))
+
+	c.Advance(5 * time.Minute)
+	assert.Nil(t, a.GetChannelByNumber(proto.MinChannelNumber))
+	assert.Equal(t, 1, expiredChannels)
+	assert.Nil(t, m.GetAllocation(fiveTuple))
+	assert.False(t, a.Refresh(proto.DefaultLifetime))
+}
+
+func subTestManagerTraffic(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+
+	var fiveTuples []*FiveTuple
+	for i := 0; i < 20; i++ {
+		fiveTuple := randomFiveTuple()
+		a, createErr := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, "user")
+		assert.NoError(t, createErr)
+		a.traffic.addToPeer(100)
+		fiveTuples = append(fiveTuples, fiveTuple)
+	}
+
+	// deleted allocations move to the deleted traffic without being missed or
+	// counted twice by concurrent calls
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, fiveTuple := range fiveTuples {
+			m.DeleteAllocation(fiveTuple, DeleteReasonAdmin)
+		}
+	}()
+	for deleting := true; deleting; {
+		select {
+		case <-done:
+			deleting = false
+		default:
+		}
+		assert.Equal(t, uint64(2000), m.Traffic().BytesToPeer)
+	}
+
+	assert.Equal(t, Traffic{PacketsToPeer: 20, BytesToPeer: 2000}, m.Traffic())
+	assert.NoError(t, m.Close())
+}
+
+func subTestSnapshotRestore(t *testing.T, turnSocket net.PacketConn) {
+	m, err := newTestManager()
+	assert.NoError(t, err)
+
+	fiveTuple := &FiveTuple{
+		SrcAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
+		DstAddr: turnSocket.LocalAddr(),
+	}
+	a, err := m.CreateAllocation(fiveTuple, turnSocket, 0, proto.DefaultLifetime, "user")
+	assert.NoError(t, err)
+
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6000}
+	assert.NoError(t, a.AddChannelBind(NewChannelBind(proto.MinChannelNumber, peer, m.log), proto.DefaultLifetime))
+	a.AddPermission(NewPermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.3"), Port: 7000}, m.log))
+	a.CountDropped(10)
+
+	// the snapshot survives serialization
+	raw, err := json.Marshal(a.Snapshot())
+	assert.NoError(t, err)
+	var snapshot Snapshot
+	assert.NoError(t, json.Unmarshal(raw, &snapshot))
+
+	relaySocket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	restored, err := newTestManager()
+	assert.NoError(t, err)
+	b, err := restored.RestoreAllocation(snapshot, turnSocket, relaySocket)
+	assert.NoError(t, err)
+	assert.Equal(t, b, restored.GetAllocation(fiveTuple))
+	assert.Equal(t, "user", b.Username())
+	assert.True(t, a.CreatedAt().Equal(b.CreatedAt()))
+	assert.Equal(t, a.RelayAddr.String(), b.RelayAddr.String())
+	assert.Equal(t, a.Traffic(), b.Traffic())
+	assert.Len(t, b.Permissions(), 2)
+	assert.NotNil(t, b.GetPermission(peer))
+	assert.Equal(t, peer.String(), b.GetChannelByNumber(proto.MinChannelNumber).Peer.String())
+	assert.True(t, b.ExpiresAt().After(time.Now()))
+
+	_, err = restored.RestoreAllocation(snapshot, turnSocket, relaySocket)
+	assert.Error(t, err)
+
+	assert.Equal(t, a, m.DetachAllocation(fiveTuple))
+	assert.Nil(t, m.GetAllocation(fiveTuple))
+	assert.Nil(t, m.DetachAllocation(fiveTuple))
+
+	// the detached allocation does not read its relay socket anymore
+	select {
+	case <-a.handlerDone:
+	default:
+		t.Fatal("packet handler of detached allocation still running")
+	}
+
+	// closing the manager leaves detached allocations alone, their relay socket is
+	// still open
+	assert.NoError(t, m.Close())
+	assert.NoError(t, a.Close())
+	assert.True(t, isClose(a.RelaySocket))
+
+	assert.NoError(t, restored.Close())
+}
+
+// BenchmarkManagerGetAllocation looks up allocations from parallel goroutines like the
+// read loops of a server, run it with -cpu 1,2,4,8 to see the lookups scale
+func BenchmarkManagerGetAllocation(b *testing.B) {
+	const allocationCount = 10000
+
+	m, err := newTestManager()
+	assert.NoError(b, err)
+
+	fiveTuples := make([]*FiveTuple, allocationCount)
+	for i := range fiveTuples {
+		fiveTuples[i] = &FiveTuple{
+			SrcAddr: &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 5000 + i%1000},
+			DstAddr: &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 3478},
+		}
+		m.allocations.insert(fiveTuples[i].Fingerprint(), NewAllocation(nil, fiveTuples[i], m.log))
+	}
+
+	b.Run("Lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.Intn(allocationCount) //nolint:gosec
+			for pb.Next() {
+				if m.GetAllocation(fiveTuples[i%allocationCount]) == nil {
+					b.Error("allocation not found")
+				}
+				i++
+			}
+		})
+	})
+
+	// one in a hundred operations deletes and recreates an allocation
+	b.Run("LookupWithChurn", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.Intn(allocationCount) //nolint:gosec
+			for pb.Next() {
+				fiveTuple := fiveTuples[i%allocationCount]
+				if i%100 == 0 {
+					if a := m.allocations.remove(fiveTuple.Fingerprint()); a != nil {
+						m.allocations.insert(fiveTuple.Fingerprint(), a)
+					}
+				} else {
+					m.GetAllocation(fiveTuple)
+				}
+				i++
+			}
+		})
+	})
+}
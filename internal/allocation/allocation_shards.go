@@ -0,0 +1,117 @@
+package allocation
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// allocationShardCount spreads the allocations over enough locks that lookups
+// from the read loops of several cores rarely meet on the same one
+const allocationShardCount = 64
+
+// allocationShards is a map of allocations split into shards with a lock each,
+// lookups only take the read lock of the shard of the FiveTuple
+type allocationShards struct {
+	count  int64 // accessed atomically
+	shards [allocationShardCount]allocationShard
+}
+
+type allocationShard struct {
+	lock        sync.RWMutex
+	allocations map[FiveTupleFingerprint]*Allocation
+
+	// keeps the locks of neighbouring shards on separate cache lines
+	_ [64]byte
+}
+
+func newAllocationShards() *allocationShards {
+	s := &allocationShards{}
+	for i := range s.shards {
+		s.shards[i].allocations = make(map[FiveTupleFingerprint]*Allocation)
+	}
+	return s
+}
+
+// shard picks the shard of fp with FNV-1a over the client address, which is
+// what differs between the allocations of a listener
+func (s *allocationShards) shard(fp *FiveTupleFingerprint) *allocationShard {
+	h := uint32(2166136261)
+	for _, b := range fp.SrcIP[12:] {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	h = (h ^ uint32(fp.SrcPort>>8)) * 16777619
+	h = (h ^ uint32(fp.SrcPort&0xff)) * 16777619
+	return &s.shards[h%allocationShardCount]
+}
+
+func (s *allocationShards) get(fp FiveTupleFingerprint) *Allocation {
+	shard := s.shard(&fp)
+	shard.lock.RLock()
+	a := shard.allocations[fp]
+	shard.lock.RUnlock()
+	return a
+}
+
+// insert adds a unless an allocation for fp exists
+func (s *allocationShards) insert(fp FiveTupleFingerprint, a *Allocation) bool {
+	shard := s.shard(&fp)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if _, ok := shard.allocations[fp]; ok {
+		return false
+	}
+	shard.allocations[fp] = a
+	atomic.AddInt64(&s.count, 1)
+	return true
+}
+
+// remove deletes and returns the allocation for fp if it exists
+func (s *allocationShards) remove(fp FiveTupleFingerprint) *Allocation {
+	shard := s.shard(&fp)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	a, ok := shard.allocations[fp]
+	if !ok {
+		return nil
+	}
+	delete(shard.allocations, fp)
+	atomic.AddInt64(&s.count, -1)
+	return a
+}
+
+func (s *allocationShards) len() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// all returns the allocations of every shard, allocations created or deleted
+// while collecting them may be missing or included
+func (s *allocationShards) all() []*Allocation {
+	allocations := make([]*Allocation, 0, s.len())
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		for _, a := range shard.allocations {
+			allocations = append(allocations, a)
+		}
+		shard.lock.RUnlock()
+	}
+	return allocations
+}
+
+// clear removes and returns all allocations
+func (s *allocationShards) clear() []*Allocation {
+	var allocations []*Allocation
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		for _, a := range shard.allocations {
+			allocations = append(allocations, a)
+		}
+		atomic.AddInt64(&s.count, -int64(len(shard.allocations)))
+		shard.allocations = make(map[FiveTupleFingerprint]*Allocation)
+		shard.lock.Unlock()
+	}
+	return allocations
+}
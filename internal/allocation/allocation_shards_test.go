@@ -0,0 +1,51 @@
+package allocation
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocationShards(t *testing.T) {
+	s := newAllocationShards()
+
+	fiveTuples := make([]*FiveTuple, 200)
+	allocations := make([]*Allocation, len(fiveTuples))
+	for i := range fiveTuples {
+		fiveTuples[i] = &FiveTuple{
+			SrcAddr: &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 5000 + i},
+			DstAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478},
+		}
+		allocations[i] = newTestAllocation()
+		assert.True(t, s.insert(fiveTuples[i].Fingerprint(), allocations[i]))
+	}
+	assert.Equal(t, len(fiveTuples), s.len())
+	assert.ElementsMatch(t, allocations, s.all())
+
+	// a second allocation of a five-tuple is not inserted
+	assert.False(t, s.insert(fiveTuples[0].Fingerprint(), newTestAllocation()))
+	assert.Equal(t, allocations[0], s.get(fiveTuples[0].Fingerprint()))
+	assert.Equal(t, len(fiveTuples), s.len())
+
+	// five-tuples only differing in the destination are different allocations
+	other := &FiveTuple{SrcAddr: fiveTuples[0].SrcAddr, DstAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3479}}
+	assert.Nil(t, s.get(other.Fingerprint()))
+
+	for i, fiveTuple := range fiveTuples[:100] {
+		assert.Equal(t, allocations[i], s.remove(fiveTuple.Fingerprint()))
+		assert.Nil(t, s.get(fiveTuple.Fingerprint()))
+		assert.Nil(t, s.remove(fiveTuple.Fingerprint()))
+	}
+	assert.Equal(t, 100, s.len())
+	assert.ElementsMatch(t, allocations[100:], s.all())
+
+	// removed five-tuples can be inserted again
+	assert.True(t, s.insert(fiveTuples[0].Fingerprint(), allocations[0]))
+	assert.Equal(t, 101, s.len())
+
+	assert.ElementsMatch(t, append([]*Allocation{allocations[0]}, allocations[100:]...), s.clear())
+	assert.Equal(t, 0, s.len())
+	assert.Empty(t, s.all())
+	assert.Nil(t, s.get(fiveTuples[150].Fingerprint()))
+}
@@ -11,8 +11,10 @@ import (
 	"time"
 
 	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/ipnet"
 	"github.com/pion/turn/v2/internal/proto"
+	"github.com/pion/turn/v2/internal/timingwheel"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,9 +30,12 @@ func TestAllocation(t *testing.T) {
 		{"GetChannelByNumber", subTestGetChannelByNumber},
 		{"GetChannelByAddr", subTestGetChannelByAddr},
 		{"RemoveChannelBind", subTestRemoveChannelBind},
+		{"RemovedTraffic", subTestRemovedTraffic},
+		{"ChannelIndexes", subTestChannelIndexes},
 		{"Refresh", subTestAllocationRefresh},
 		{"Close", subTestAllocationClose},
 		{"packetHandler", subTestPacketHandler},
+		{"Hairpin", subTestHairpin},
 		{"ResponseCache", subTestResponseCache},
 	}
 
@@ -43,7 +48,7 @@ func TestAllocation(t *testing.T) {
 }
 
 func subTestGetPermission(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
 	if err != nil {
@@ -85,7 +90,7 @@ func subTestGetPermission(t *testing.T) {
 }
 
 func subTestAddPermission(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
 	if err != nil {
@@ -104,7 +109,7 @@ func subTestAddPermission(t *testing.T) {
 }
 
 func subTestRemovePermission(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
 	if err != nil {
@@ -127,7 +132,7 @@ func subTestRemovePermission(t *testing.T) {
 }
 
 func subTestAddChannelBind(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
 	if err != nil {
@@ -151,7 +156,7 @@ func subTestAddChannelBind(t *testing.T) {
 }
 
 func subTestGetChannelByNumber(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
 	if err != nil {
@@ -170,7 +175,7 @@ func subTestGetChannelByNumber(t *testing.T) {
 }
 
 func subTestGetChannelByAddr(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
 	if err != nil {
@@ -190,7 +195,7 @@ func subTestGetChannelByAddr(t *testing.T) {
 }
 
 func subTestRemoveChannelBind(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:3478")
 	if err != nil {
@@ -210,19 +215,81 @@ func subTestRemoveChannelBind(t *testing.T) {
 	assert.Nil(t, channelByAddr)
 }
 
+func subTestChannelIndexes(t *testing.T) {
+	a := newTestAllocation()
+
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}
+	otherPeer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3479}
+
+	removed := NewChannelBind(proto.MinChannelNumber, peer, nil)
+	assert.NoError(t, a.AddChannelBind(removed, proto.DefaultLifetime))
+	assert.True(t, a.RemoveChannelBind(removed.Number))
+	assert.False(t, a.RemoveChannelBind(removed.Number))
+	assert.Nil(t, a.GetChannelByNumber(removed.Number))
+	assert.Nil(t, a.GetChannelByAddr(peer))
+
+	// the number and the peer of a removed channel can be bound to others
+	c := NewChannelBind(proto.MinChannelNumber, otherPeer, nil)
+	assert.NoError(t, a.AddChannelBind(c, proto.DefaultLifetime))
+	assert.Equal(t, c, a.GetChannelByNumber(c.Number))
+	assert.Equal(t, c, a.GetChannelByAddr(otherPeer))
+	assert.Nil(t, a.GetChannelByAddr(peer))
+
+	expired := NewChannelBind(proto.MinChannelNumber+1, peer, nil)
+	assert.NoError(t, a.AddChannelBind(expired, proto.DefaultLifetime))
+	assert.Equal(t, expired, a.GetChannelByAddr(peer))
+
+	// an expired channel leaves both indexes, the others stay
+	expired.expiresAt.Store(time.Now().Add(-time.Second))
+	expired.expire()
+	assert.Nil(t, a.GetChannelByNumber(expired.Number))
+	assert.Nil(t, a.GetChannelByAddr(peer))
+	assert.Equal(t, c, a.GetChannelByNumber(c.Number))
+	assert.Equal(t, c, a.GetChannelByAddr(otherPeer))
+	assert.Len(t, a.ChannelBinds(), 1)
+
+	// a binding of another number to a bound peer is rejected and not indexed
+	assert.Error(t, a.AddChannelBind(NewChannelBind(proto.MinChannelNumber+2, otherPeer, nil), proto.DefaultLifetime))
+	assert.Nil(t, a.GetChannelByNumber(proto.MinChannelNumber+2))
+}
+
+func subTestRemovedTraffic(t *testing.T) {
+	a := newTestAllocation()
+
+	// permissions of the same IP are kept together, whatever their port
+	for _, port := range []int{3478, 3479} {
+		p := NewPermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}, nil)
+		a.AddPermission(p)
+		p.traffic.addToPeer(100)
+		a.RemovePermission(p.Addr)
+	}
+
+	c := NewChannelBind(proto.MinChannelNumber, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}, nil)
+	assert.NoError(t, a.AddChannelBind(c, proto.DefaultLifetime))
+	c.traffic.addToClient(50)
+	a.RemoveChannelBind(c.Number)
+
+	removed := a.RemovedTraffic()
+	assert.Len(t, removed, 2)
+	assert.Equal(t, Traffic{PacketsToPeer: 2, BytesToPeer: 200}, removed[0].Traffic)
+	assert.Equal(t, proto.ChannelNumber(proto.MinChannelNumber), removed[1].Number)
+	assert.Equal(t, Traffic{PacketsToClient: 1, BytesToClient: 50}, removed[1].Traffic)
+}
+
 func subTestAllocationRefresh(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	a.lifetimeTimer = time.AfterFunc(proto.DefaultLifetime, func() {
+	a.startLifetime(proto.DefaultLifetime, func() {
 		wg.Done()
 	})
-	a.Refresh(0)
+	assert.True(t, a.Refresh(0))
 	wg.Wait()
 
 	// lifetimeTimer has expired
 	assert.False(t, a.lifetimeTimer.Stop())
+	assert.False(t, a.Refresh(proto.DefaultLifetime), "expired allocations can not be refreshed")
 }
 
 func subTestAllocationClose(t *testing.T) {
@@ -233,10 +300,10 @@ func subTestAllocationClose(t *testing.T) {
 		panic(err)
 	}
 
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 	a.RelaySocket = l
 	// add mock lifetimeTimer
-	a.lifetimeTimer = time.AfterFunc(proto.DefaultLifetime, func() {})
+	a.startLifetime(proto.DefaultLifetime, func() {})
 
 	// add channel
 	addr, err := net.ResolveUDPAddr(network, "127.0.0.1:3478")
@@ -255,6 +322,15 @@ func subTestAllocationClose(t *testing.T) {
 	assert.True(t, isClose(a.RelaySocket), "should be closed")
 }
 
+// testTimers expires the allocations of newTestAllocation
+var testTimers = timingwheel.New(TimerTick, clock.System) //nolint:gochecknoglobals
+
+func newTestAllocation() *Allocation {
+	a := NewAllocation(nil, nil, nil)
+	a.timers = testTimers
+	return a
+}
+
 func subTestPacketHandler(t *testing.T) {
 	network := "udp"
 
@@ -289,7 +365,7 @@ func subTestPacketHandler(t *testing.T) {
 	a, err := m.CreateAllocation(&FiveTuple{
 		SrcAddr: clientListener.LocalAddr(),
 		DstAddr: turnSocket.LocalAddr(),
-	}, turnSocket, 0, proto.DefaultLifetime)
+	}, turnSocket, 0, proto.DefaultLifetime, "")
 
 	assert.Nil(t, err, "should succeed")
 
@@ -346,15 +422,97 @@ func subTestPacketHandler(t *testing.T) {
 	assert.Equal(t, channelBind.Number, channelData.Number, "get channel data's number is invalid")
 	assert.Equal(t, targetText2, string(channelData.Data), "get data doesn't equal the target text.")
 
+	// test for traffic counters
+	traffic := a.Traffic()
+	assert.Equal(t, uint64(2), traffic.PacketsToClient)
+	assert.Equal(t, uint64(len(targetText)+len(targetText2)), traffic.BytesToClient)
+	assert.Equal(t, uint64(len(targetText2)), channelBind.Traffic().BytesToClient)
+
+	// packets from peers without a permission are dropped
+	peerListener3, err := net.ListenPacket(network, "127.0.0.2:0")
+	if err != nil {
+		panic(err)
+	}
+	_, _ = peerListener3.WriteTo([]byte("dropped"), relayAddrWithHost)
+	assert.Eventually(t, func() bool {
+		return a.Traffic().DroppedPackets == 1
+	}, time.Second, 10*time.Millisecond)
+
 	// listeners close
 	_ = m.Close()
 	_ = clientListener.Close()
 	_ = peerListener1.Close()
 	_ = peerListener2.Close()
+	_ = peerListener3.Close()
+}
+
+// data to the relayed address of another allocation is handed over in memory
+func subTestHairpin(t *testing.T) {
+	m, _ := newTestManager()
+
+	turnSocket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	var allocations []*Allocation
+	var clients []net.PacketConn
+	for i := 0; i < 2; i++ {
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		clients = append(clients, client)
+
+		a, err := m.CreateAllocation(&FiveTuple{
+			SrcAddr: client.LocalAddr(),
+			DstAddr: turnSocket.LocalAddr(),
+		}, turnSocket, 0, proto.DefaultLifetime, "")
+		assert.NoError(t, err)
+		allocations = append(allocations, a)
+	}
+	a, b := allocations[0], allocations[1]
+	assert.Equal(t, b, m.relays.lookup(b.RelayAddr))
+
+	// the permissions of the receiving allocation apply, dropping is not an error
+	a.AddPermission(NewPermission(b.RelayAddr, m.log))
+	n, err := a.WriteToPeer([]byte("dropped"), b.RelayAddr, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, uint64(1), b.Traffic().DroppedPackets)
+
+	b.AddPermission(NewPermission(a.RelayAddr, m.log))
+	_, err = a.WriteToPeer([]byte("hairpin"), b.RelayAddr, nil, nil)
+	assert.NoError(t, err)
+
+	buffer := make([]byte, rtpMTU)
+	assert.NoError(t, clients[1].SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err = clients[1].ReadFrom(buffer)
+	assert.NoError(t, err)
+
+	var msg stun.Message
+	assert.NoError(t, stun.Decode(buffer[:n], &msg))
+	var peer proto.PeerAddress
+	assert.NoError(t, peer.GetFrom(&msg))
+	assert.Equal(t, a.RelayAddr.(*net.UDPAddr).Port, peer.Port) //nolint:forcetypeassert
+	var data proto.Data
+	assert.NoError(t, data.GetFrom(&msg))
+	assert.Equal(t, "hairpin", string(data))
+
+	// both sides count the traffic
+	assert.Equal(t, uint64(2), a.Traffic().PacketsToPeer)
+	assert.Equal(t, uint64(2), a.GetPermission(b.RelayAddr).Traffic().PacketsToPeer)
+	assert.Equal(t, uint64(1), b.Traffic().PacketsToClient)
+	assert.Equal(t, uint64(1), b.GetPermission(a.RelayAddr).Traffic().PacketsToClient)
+
+	m.DeleteAllocation(b.fiveTuple, DeleteReasonClientDeleted)
+	assert.Nil(t, m.relays.lookup(b.RelayAddr))
+
+	assert.NoError(t, m.Close())
+	for _, client := range clients {
+		assert.NoError(t, client.Close())
+	}
+	assert.NoError(t, turnSocket.Close())
 }
 
 func subTestResponseCache(t *testing.T) {
-	a := NewAllocation(nil, nil, nil)
+	a := newTestAllocation()
 	transactionID := [stun.TransactionIDSize]byte{1, 2, 3}
 	responseAttrs := []stun.Setter{
 		&proto.Lifetime{
@@ -367,3 +525,91 @@ func subTestResponseCache(t *testing.T) {
 	assert.Equal(t, transactionID, cacheID)
 	assert.Equal(t, responseAttrs, cacheAttr)
 }
+
+// BenchmarkRelayToClient benchmarks wrapping a datagram from a peer and writing it to the client
+func BenchmarkRelayToClient(b *testing.B) {
+	turnSocket, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer turnSocket.Close() //nolint:errcheck
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close() //nolint:errcheck
+
+	a := NewAllocation(turnSocket, &FiveTuple{SrcAddr: client.LocalAddr(), DstAddr: turnSocket.LocalAddr()}, nil)
+	a.events = &EventHandler{}
+
+	channelPeer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5000}
+	indicationPeer := &net.UDPAddr{IP: net.ParseIP("127.0.0.3"), Port: 5000}
+	for _, peer := range []*net.UDPAddr{channelPeer, indicationPeer} {
+		p := NewPermission(peer, nil)
+		p.allocation = a
+		a.permissions[addr2IPFingerprint(peer)] = p
+	}
+	a.addChannel(NewChannelBind(proto.MinChannelNumber, channelPeer, nil))
+
+	data := make([]byte, 160)
+	for _, bench := range []struct {
+		name string
+		peer net.Addr
+	}{{"ChannelData", channelPeer}, {"DataIndication", indicationPeer}} {
+		peer := bench.peer
+		b.Run(bench.name, func(b *testing.B) {
+			buf := newClientBuffer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				packet, ok := a.wrapForClient(buf, data, peer)
+				if !ok {
+					b.Fatal("packet dropped")
+				}
+				if _, err := a.TurnSocket.WriteTo(packet.raw, a.fiveTuple.SrcAddr); err != nil {
+					b.Fatal(err)
+				}
+				a.countToClient(packet)
+			}
+		})
+	}
+}
+
+// BenchmarkAllocationGetChannel looks up the channels of an allocation with many
+// channel bindings from parallel goroutines
+func BenchmarkAllocationGetChannel(b *testing.B) {
+	const channelCount = 1000
+
+	a := newTestAllocation()
+	peers := make([]net.Addr, channelCount)
+	for i := range peers {
+		peers[i] = &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 5000}
+		a.addChannel(NewChannelBind(proto.MinChannelNumber+proto.ChannelNumber(i), peers[i], nil))
+	}
+
+	b.Run("ByNumber", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				if a.GetChannelByNumber(proto.MinChannelNumber+proto.ChannelNumber(i%channelCount)) == nil {
+					b.Error("channel not found")
+				}
+				i++
+			}
+		})
+	})
+
+	b.Run("ByAddr", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				if a.GetChannelByAddr(peers[i%channelCount]) == nil {
+					b.Error("channel not found")
+				}
+				i++
+			}
+		})
+	})
+}
@@ -2,20 +2,24 @@ package allocation
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
 	"github.com/pion/turn/v2/internal/proto"
+	"github.com/pion/turn/v2/internal/timingwheel"
 )
 
 // ChannelBind represents a TURN Channel
 // https://tools.ietf.org/html/rfc5766#section-2.5
 type ChannelBind struct {
-	Peer   net.Addr
-	Number proto.ChannelNumber
+	traffic trafficCounters
+	Peer    net.Addr
+	Number  proto.ChannelNumber
 
 	allocation    *Allocation
-	lifetimeTimer *time.Timer
+	lifetimeTimer *timingwheel.Timer
+	expiresAt     atomic.Value // time.Time
 	log           logging.LeveledLogger
 }
 
@@ -28,16 +32,47 @@ func NewChannelBind(number proto.ChannelNumber, peer net.Addr, log logging.Level
 	}
 }
 
+// start, refresh and stop are called with the channelBindingsLock of the allocation held
 func (c *ChannelBind) start(lifetime time.Duration) {
-	c.lifetimeTimer = time.AfterFunc(lifetime, func() {
-		if !c.allocation.RemoveChannelBind(c.Number) {
-			c.log.Errorf("Failed to remove ChannelBind for %v %x %v", c.Number, c.Peer, c.allocation.fiveTuple)
-		}
-	})
+	c.expiresAt.Store(c.allocation.clock.Now().Add(lifetime))
+	c.lifetimeTimer = c.allocation.timers.AfterFunc(lifetime, c.expire)
 }
 
 func (c *ChannelBind) refresh(lifetime time.Duration) {
-	if !c.lifetimeTimer.Reset(lifetime) {
-		c.log.Errorf("Failed to reset ChannelBind timer for %v %x %v", c.Number, c.Peer, c.allocation.fiveTuple)
+	c.expiresAt.Store(c.allocation.clock.Now().Add(lifetime))
+	c.lifetimeTimer.Reset(lifetime)
+}
+
+func (c *ChannelBind) stop() {
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+	}
+}
+
+// expire removes the channel binding unless it was refreshed or removed after
+// the lifetime timer fired
+func (c *ChannelBind) expire() {
+	a := c.allocation
+
+	a.channelBindingsLock.Lock()
+	if a.channelsByNumber[c.Number] != c || a.clock.Now().Before(c.ExpiresAt()) {
+		a.channelBindingsLock.Unlock()
+		return
 	}
+	a.removeChannel(c)
+	a.channelBindingsLock.Unlock()
+
+	a.keepTraffic(c.Peer, c.Number, c.Traffic())
+	a.events.channelExpired(a, c)
+}
+
+// ExpiresAt returns the time the channel binding expires unless it is refreshed
+func (c *ChannelBind) ExpiresAt() time.Time {
+	expiresAt, _ := c.expiresAt.Load().(time.Time)
+	return expiresAt
+}
+
+// Traffic returns the traffic relayed over the channel
+func (c *ChannelBind) Traffic() Traffic {
+	return c.traffic.snapshot()
 }
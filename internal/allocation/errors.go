@@ -11,6 +11,7 @@ var (
 	errNilFiveTupleSrcAddr         = errors.New("allocations must not be created with nil FiveTuple.SrcAddr")
 	errNilFiveTupleDstAddr         = errors.New("allocations must not be created with nil FiveTuple.DstAddr")
 	errNilTurnSocket               = errors.New("allocations must not be created with nil turnSocket")
+	errNilRelaySocket              = errors.New("allocations must not be restored with nil relaySocket")
 	errLifetimeZero                = errors.New("allocations must not be created with a lifetime of 0")
 	errDupeFiveTuple               = errors.New("allocation attempt created with duplicate FiveTuple")
 	errFailedToCastUDPAddr         = errors.New("failed to cast net.Addr to *net.UDPAddr")
@@ -0,0 +1,74 @@
+package allocation
+
+import "time"
+
+// DeleteReason describes why an allocation was removed from the Manager
+type DeleteReason int
+
+const (
+	// DeleteReasonExpired the allocation was not refreshed before its lifetime elapsed
+	DeleteReasonExpired DeleteReason = iota + 1
+	// DeleteReasonClientDeleted the client sent a Refresh request with a zero lifetime
+	DeleteReasonClientDeleted
+	// DeleteReasonSocketError reading from the relay socket failed
+	DeleteReasonSocketError
+	// DeleteReasonServerClosed the Manager was closed
+	DeleteReasonServerClosed
+	// DeleteReasonAdmin the allocation was deleted by the operator of the server
+	DeleteReasonAdmin
+)
+
+// EventHandler is a set of callbacks fired during the lifecycle of allocations,
+// permissions and channel bindings. Every callback is optional. Callbacks are
+// called synchronously and must not block.
+type EventHandler struct {
+	OnAllocationCreated   func(a *Allocation, lifetime time.Duration)
+	OnAllocationRefreshed func(a *Allocation, lifetime time.Duration)
+	OnAllocationDeleted   func(a *Allocation, reason DeleteReason)
+	OnPermissionCreated   func(a *Allocation, p *Permission)
+	OnPermissionExpired   func(a *Allocation, p *Permission)
+	OnChannelBound        func(a *Allocation, c *ChannelBind)
+	OnChannelExpired      func(a *Allocation, c *ChannelBind)
+}
+
+func (h *EventHandler) allocationCreated(a *Allocation, lifetime time.Duration) {
+	if h != nil && h.OnAllocationCreated != nil {
+		h.OnAllocationCreated(a, lifetime)
+	}
+}
+
+func (h *EventHandler) allocationRefreshed(a *Allocation, lifetime time.Duration) {
+	if h != nil && h.OnAllocationRefreshed != nil {
+		h.OnAllocationRefreshed(a, lifetime)
+	}
+}
+
+func (h *EventHandler) allocationDeleted(a *Allocation, reason DeleteReason) {
+	if h != nil && h.OnAllocationDeleted != nil {
+		h.OnAllocationDeleted(a, reason)
+	}
+}
+
+func (h *EventHandler) permissionCreated(a *Allocation, p *Permission) {
+	if h != nil && h.OnPermissionCreated != nil {
+		h.OnPermissionCreated(a, p)
+	}
+}
+
+func (h *EventHandler) permissionExpired(a *Allocation, p *Permission) {
+	if h != nil && h.OnPermissionExpired != nil {
+		h.OnPermissionExpired(a, p)
+	}
+}
+
+func (h *EventHandler) channelBound(a *Allocation, c *ChannelBind) {
+	if h != nil && h.OnChannelBound != nil {
+		h.OnChannelBound(a, c)
+	}
+}
+
+func (h *EventHandler) channelExpired(a *Allocation, c *ChannelBind) {
+	if h != nil && h.OnChannelExpired != nil {
+		h.OnChannelExpired(a, c)
+	}
+}
@@ -1,7 +1,6 @@
 package allocation
 
 import (
-	"fmt"
 	"net"
 )
 
@@ -14,6 +13,18 @@ const (
 	TCP
 )
 
+// String returns the name of the transport protocol
+func (p Protocol) String() string {
+	switch p {
+	case UDP:
+		return "udp"
+	case TCP:
+		return "tcp"
+	default:
+		return "unknown"
+	}
+}
+
 // FiveTuple is the combination (client IP address and port, server IP
 // address and port, and transport protocol (currently one of UDP,
 // TCP, or TLS)) used to communicate between the client and the
@@ -25,12 +36,49 @@ type FiveTuple struct {
 	SrcAddr, DstAddr net.Addr
 }
 
+// FiveTupleFingerprint is the comparable identity of a FiveTuple, computing it
+// does not allocate for UDP and TCP addresses
+type FiveTupleFingerprint struct {
+	Protocol         Protocol
+	SrcIP, DstIP     [net.IPv6len]byte
+	SrcPort, DstPort uint16
+	// SrcOther and DstOther hold the String of addresses that are neither
+	// UDP nor TCP addresses
+	SrcOther, DstOther string
+}
+
 // Equal asserts if two FiveTuples are equal
 func (f *FiveTuple) Equal(b *FiveTuple) bool {
 	return f.Fingerprint() == b.Fingerprint()
 }
 
 // Fingerprint is the identity of a FiveTuple
-func (f *FiveTuple) Fingerprint() string {
-	return fmt.Sprintf("%d_%s_%s", f.Protocol, f.SrcAddr.String(), f.DstAddr.String())
+func (f *FiveTuple) Fingerprint() FiveTupleFingerprint {
+	fp := FiveTupleFingerprint{Protocol: f.Protocol}
+	fp.SrcIP, fp.SrcPort, fp.SrcOther = addrFingerprint(f.SrcAddr)
+	fp.DstIP, fp.DstPort, fp.DstOther = addrFingerprint(f.DstAddr)
+	return fp
+}
+
+func addrFingerprint(addr net.Addr) (ip [net.IPv6len]byte, port uint16, other string) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return ipFingerprint(a.IP), uint16(a.Port), a.Zone
+	case *net.TCPAddr:
+		return ipFingerprint(a.IP), uint16(a.Port), a.Zone
+	case nil:
+		return ip, 0, ""
+	}
+	return ip, 0, addr.String()
+}
+
+// ipFingerprint is the comparable form of ip, IPv4 addresses are IPv4-mapped
+func ipFingerprint(ip net.IP) (fp [net.IPv6len]byte) {
+	if len(ip) == net.IPv4len {
+		fp[10], fp[11] = 0xff, 0xff
+		copy(fp[12:], ip)
+		return fp
+	}
+	copy(fp[:], ip)
+	return fp
 }
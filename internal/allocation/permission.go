@@ -2,20 +2,26 @@ package allocation
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/timingwheel"
 )
 
-const permissionTimeout = time.Duration(5) * time.Minute
+// DefaultPermissionTimeout is the lifetime of permissions of RFC 5766 Section 8
+const DefaultPermissionTimeout = time.Duration(5) * time.Minute
 
 // Permission represents a TURN permission. TURN permissions mimic the address-restricted
 // filtering mechanism of NATs that comply with [RFC4787].
 // https://tools.ietf.org/html/rfc5766#section-2.3
 type Permission struct {
+	traffic       trafficCounters
 	Addr          net.Addr
 	allocation    *Allocation
-	lifetimeTimer *time.Timer
+	lifetimeTimer *timingwheel.Timer
+	expiresAt     atomic.Value // time.Time
+	peerAddr      atomic.Value // *net.UDPAddr
 	log           logging.LeveledLogger
 }
 
@@ -27,14 +33,61 @@ func NewPermission(addr net.Addr, log logging.LeveledLogger) *Permission {
 	}
 }
 
+// start, refresh and stop are called with the permissionsLock of the allocation held
 func (p *Permission) start(lifetime time.Duration) {
-	p.lifetimeTimer = time.AfterFunc(lifetime, func() {
-		p.allocation.RemovePermission(p.Addr)
-	})
+	p.expiresAt.Store(p.allocation.clock.Now().Add(lifetime))
+	p.lifetimeTimer = p.allocation.timers.AfterFunc(lifetime, p.expire)
 }
 
 func (p *Permission) refresh(lifetime time.Duration) {
-	if !p.lifetimeTimer.Reset(lifetime) {
-		p.log.Errorf("Failed to reset permission timer for %v %v", p.Addr, p.allocation.fiveTuple)
+	p.expiresAt.Store(p.allocation.clock.Now().Add(lifetime))
+	p.lifetimeTimer.Reset(lifetime)
+}
+
+func (p *Permission) stop() {
+	if p.lifetimeTimer != nil {
+		p.lifetimeTimer.Stop()
+	}
+}
+
+// expire removes the permission unless it was refreshed or removed after the
+// lifetime timer fired
+func (p *Permission) expire() {
+	a := p.allocation
+	fingerprint := addr2IPFingerprint(p.Addr)
+
+	a.permissionsLock.Lock()
+	if a.permissions[fingerprint] != p || a.clock.Now().Before(p.ExpiresAt()) {
+		a.permissionsLock.Unlock()
+		return
 	}
+	delete(a.permissions, fingerprint)
+	a.permissionsLock.Unlock()
+
+	a.keepTraffic(p.Addr, 0, p.Traffic())
+	a.events.permissionExpired(a, p)
+}
+
+// ExpiresAt returns the time the permission expires unless it is refreshed
+func (p *Permission) ExpiresAt() time.Time {
+	expiresAt, _ := p.expiresAt.Load().(time.Time)
+	return expiresAt
+}
+
+// Traffic returns the traffic exchanged with the peer of the permission
+func (p *Permission) Traffic() Traffic {
+	return p.traffic.snapshot()
+}
+
+// PeerAddr returns a *net.UDPAddr of ip and port, which must be covered by the permission.
+// The address is reused while peers keep sending to the same port, so relaying Send
+// indications does not allocate.
+func (p *Permission) PeerAddr(ip net.IP, port int) *net.UDPAddr {
+	if addr, ok := p.peerAddr.Load().(*net.UDPAddr); ok && addr.Port == port && addr.IP.Equal(ip) {
+		return addr
+	}
+
+	addr := &net.UDPAddr{IP: append(net.IP{}, ip...), Port: port}
+	p.peerAddr.Store(addr)
+	return addr
 }
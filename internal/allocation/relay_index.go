@@ -0,0 +1,75 @@
+package allocation
+
+import (
+	"net"
+	"sync"
+)
+
+const relayIndexShardCount = 64
+
+// RelayIndex finds allocations by their relayed transport address, so datagrams one
+// allocation sends to the relayed address of another are handed over in memory. It
+// can be shared by the managers of a server.
+type RelayIndex struct {
+	shards [relayIndexShardCount]relayIndexShard
+}
+
+type relayIndexShard struct {
+	lock        sync.RWMutex
+	allocations map[peerFingerprint]*Allocation
+
+	// keeps the locks of neighbouring shards on separate cache lines
+	_ [64]byte
+}
+
+// NewRelayIndex creates an empty RelayIndex
+func NewRelayIndex() *RelayIndex {
+	r := &RelayIndex{}
+	for i := range r.shards {
+		r.shards[i].allocations = make(map[peerFingerprint]*Allocation)
+	}
+	return r
+}
+
+// the relay ports of a server differ, which spreads the relays over the shards
+func (r *RelayIndex) shard(fp *peerFingerprint) *relayIndexShard {
+	return &r.shards[fp.port%relayIndexShardCount]
+}
+
+func (r *RelayIndex) add(a *Allocation) {
+	if r == nil || a.RelayAddr == nil {
+		return
+	}
+	fp := peerFingerprintOf(a.RelayAddr)
+	shard := r.shard(&fp)
+	shard.lock.Lock()
+	shard.allocations[fp] = a
+	shard.lock.Unlock()
+}
+
+// remove deletes a unless another allocation took over its relayed address
+func (r *RelayIndex) remove(a *Allocation) {
+	if r == nil || a.RelayAddr == nil {
+		return
+	}
+	fp := peerFingerprintOf(a.RelayAddr)
+	shard := r.shard(&fp)
+	shard.lock.Lock()
+	if shard.allocations[fp] == a {
+		delete(shard.allocations, fp)
+	}
+	shard.lock.Unlock()
+}
+
+// lookup returns the allocation relaying on addr, it does not allocate
+func (r *RelayIndex) lookup(addr net.Addr) *Allocation {
+	if r == nil {
+		return nil
+	}
+	fp := peerFingerprintOf(addr)
+	shard := r.shard(&fp)
+	shard.lock.RLock()
+	a := shard.allocations[fp]
+	shard.lock.RUnlock()
+	return a
+}
@@ -0,0 +1,227 @@
+package allocation
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/turn/v2/internal/proto"
+)
+
+// Snapshot is the serializable state of an Allocation, it is used to hand
+// allocations over to another process. Lifetimes are the remaining lifetimes
+// at the time the snapshot was taken.
+type Snapshot struct {
+	Protocol    Protocol              `json:"protocol"`
+	SrcAddr     string                `json:"srcAddr"`
+	DstAddr     string                `json:"dstAddr"`
+	RelayAddr   string                `json:"relayAddr"`
+	Username    string                `json:"username"`
+	Realm       string                `json:"realm,omitempty"`
+	CreatedAt   time.Time             `json:"createdAt"`
+	Lifetime    time.Duration         `json:"lifetime"`
+	Traffic     Traffic               `json:"traffic"`
+	Permissions []PermissionSnapshot  `json:"permissions,omitempty"`
+	Channels    []ChannelBindSnapshot `json:"channels,omitempty"`
+	Removed     []PeerTrafficSnapshot `json:"removed,omitempty"`
+}
+
+// PermissionSnapshot is the serializable state of a Permission
+type PermissionSnapshot struct {
+	Addr     string        `json:"addr"`
+	Lifetime time.Duration `json:"lifetime"`
+	Traffic  Traffic       `json:"traffic"`
+}
+
+// ChannelBindSnapshot is the serializable state of a ChannelBind
+type ChannelBindSnapshot struct {
+	Number   proto.ChannelNumber `json:"number"`
+	Peer     string              `json:"peer"`
+	Lifetime time.Duration       `json:"lifetime"`
+	Traffic  Traffic             `json:"traffic"`
+}
+
+// PeerTrafficSnapshot is the serializable state of a PeerTraffic
+type PeerTrafficSnapshot struct {
+	Peer    string              `json:"peer"`
+	Number  proto.ChannelNumber `json:"number,omitempty"`
+	Traffic Traffic             `json:"traffic"`
+}
+
+// Snapshot returns the current state of the allocation
+func (a *Allocation) Snapshot() Snapshot {
+	now := a.clock.Now()
+	s := Snapshot{
+		Protocol:  a.fiveTuple.Protocol,
+		SrcAddr:   a.fiveTuple.SrcAddr.String(),
+		DstAddr:   a.fiveTuple.DstAddr.String(),
+		RelayAddr: a.RelayAddr.String(),
+		Username:  a.username,
+		Realm:     a.realm,
+		CreatedAt: a.createdAt,
+		Lifetime:  a.ExpiresAt().Sub(now),
+		Traffic:   a.Traffic(),
+	}
+
+	for _, p := range a.Permissions() {
+		s.Permissions = append(s.Permissions, PermissionSnapshot{
+			Addr:     p.Addr.String(),
+			Lifetime: p.ExpiresAt().Sub(now),
+			Traffic:  p.Traffic(),
+		})
+	}
+
+	for _, c := range a.ChannelBinds() {
+		s.Channels = append(s.Channels, ChannelBindSnapshot{
+			Number:   c.Number,
+			Peer:     c.Peer.String(),
+			Lifetime: c.ExpiresAt().Sub(now),
+			Traffic:  c.Traffic(),
+		})
+	}
+
+	for _, r := range a.RemovedTraffic() {
+		s.Removed = append(s.Removed, PeerTrafficSnapshot{
+			Peer:    r.Peer.String(),
+			Number:  r.Number,
+			Traffic: r.Traffic,
+		})
+	}
+
+	return s
+}
+
+// RestoreAllocation recreates an allocation from a Snapshot taken by another process and
+// starts relaying on relaySocket. Permissions and channel bindings that expired in the
+// meantime are dropped. No events are fired for the restored state.
+func (m *Manager) RestoreAllocation(s Snapshot, turnSocket, relaySocket net.PacketConn) (*Allocation, error) {
+	switch {
+	case turnSocket == nil:
+		return nil, errNilTurnSocket
+	case relaySocket == nil:
+		return nil, errNilRelaySocket
+	case s.Lifetime <= 0:
+		return nil, errLifetimeZero
+	}
+
+	fiveTuple := &FiveTuple{Protocol: s.Protocol}
+	var err error
+	if fiveTuple.SrcAddr, err = resolveAddr(s.Protocol, s.SrcAddr); err != nil {
+		return nil, err
+	}
+	if fiveTuple.DstAddr, err = resolveAddr(s.Protocol, s.DstAddr); err != nil {
+		return nil, err
+	}
+
+	if a := m.GetAllocation(fiveTuple); a != nil {
+		return nil, fmt.Errorf("%w: %v", errDupeFiveTuple, fiveTuple)
+	}
+
+	a := NewAllocation(turnSocket, fiveTuple, m.log)
+	a.username = s.Username
+	a.realm = s.Realm
+	a.createdAt = s.CreatedAt
+	a.events = &m.events
+	a.clock = m.clock
+	a.timers = m.timers
+	a.permissionTimeout = m.permissionTimeout
+	a.relays = m.relays
+	a.isolatePeers = m.isolatePeers
+	a.RelaySocket = relaySocket
+	if a.RelayAddr, err = net.ResolveUDPAddr("udp", s.RelayAddr); err != nil {
+		return nil, err
+	}
+	a.traffic.restore(s.Traffic)
+
+	var permissions []*Permission
+	var channels []*ChannelBind
+	var permissionLifetimes, channelLifetimes []time.Duration
+	for _, rs := range s.Removed {
+		peer, err := net.ResolveUDPAddr("udp", rs.Peer)
+		if err != nil {
+			return nil, err
+		}
+		a.keepTraffic(peer, rs.Number, rs.Traffic)
+	}
+
+	for _, ps := range s.Permissions {
+		addr, err := net.ResolveUDPAddr("udp", ps.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if ps.Lifetime <= 0 {
+			a.keepTraffic(addr, 0, ps.Traffic)
+			continue
+		}
+
+		p := NewPermission(addr, m.log)
+		p.allocation = a
+		p.traffic.restore(ps.Traffic)
+		permissions = append(permissions, p)
+		permissionLifetimes = append(permissionLifetimes, ps.Lifetime)
+	}
+
+	for _, cs := range s.Channels {
+		peer, err := net.ResolveUDPAddr("udp", cs.Peer)
+		if err != nil {
+			return nil, err
+		}
+		if cs.Lifetime <= 0 {
+			a.keepTraffic(peer, cs.Number, cs.Traffic)
+			continue
+		}
+
+		c := NewChannelBind(cs.Number, peer, m.log)
+		c.traffic.restore(cs.Traffic)
+		channels = append(channels, c)
+		channelLifetimes = append(channelLifetimes, cs.Lifetime)
+	}
+
+	// timers are only started once the whole snapshot was parsed
+	for i, p := range permissions {
+		a.permissions[addr2IPFingerprint(p.Addr)] = p
+		p.start(permissionLifetimes[i])
+	}
+	for i, c := range channels {
+		a.addChannel(c)
+		c.start(channelLifetimes[i])
+	}
+
+	a.startLifetime(s.Lifetime, func() {
+		m.DeleteAllocation(a.fiveTuple, DeleteReasonExpired)
+	})
+
+	a.handlerDone = make(chan struct{})
+	if !m.allocations.insert(fiveTuple.Fingerprint(), a) {
+		_ = a.Close()
+		return nil, fmt.Errorf("%w: %v", errDupeFiveTuple, fiveTuple)
+	}
+	m.relays.add(a)
+
+	go a.packetHandler(m)
+	return a, nil
+}
+
+// DetachAllocation removes an allocation that is handed over to another process, so
+// closing the manager does not delete it. Its timers are stopped and its relay socket
+// is not read anymore, so its Snapshot counts all the traffic it relayed. No events
+// are fired.
+func (m *Manager) DetachAllocation(fiveTuple *FiveTuple) *Allocation {
+	allocation := m.removeAllocation(fiveTuple)
+	if allocation == nil {
+		return nil
+	}
+
+	allocation.stopTimers()
+	if err := allocation.stopReading(); err != nil {
+		m.log.Warnf("Failed to stop reading relay socket of %v: %v", fiveTuple, err)
+	}
+	return allocation
+}
+
+func resolveAddr(protocol Protocol, addr string) (net.Addr, error) {
+	if protocol == TCP {
+		return net.ResolveTCPAddr("tcp", addr)
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
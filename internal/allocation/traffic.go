@@ -0,0 +1,83 @@
+package allocation
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/pion/turn/v2/internal/proto"
+)
+
+// Traffic is a snapshot of the traffic relayed through an allocation,
+// permission or channel binding. Dropped counters are only kept per allocation.
+type Traffic struct {
+	PacketsToPeer   uint64
+	BytesToPeer     uint64
+	PacketsToClient uint64
+	BytesToClient   uint64
+	DroppedPackets  uint64
+	DroppedBytes    uint64
+}
+
+// Add adds the counters of o to t
+func (t *Traffic) Add(o Traffic) {
+	t.PacketsToPeer += o.PacketsToPeer
+	t.BytesToPeer += o.BytesToPeer
+	t.PacketsToClient += o.PacketsToClient
+	t.BytesToClient += o.BytesToClient
+	t.DroppedPackets += o.DroppedPackets
+	t.DroppedBytes += o.DroppedBytes
+}
+
+// trafficCounters are updated atomically from the relay goroutines, it must be
+// the first field of the struct embedding it to keep 64-bit alignment on 32-bit platforms
+type trafficCounters struct {
+	packetsToPeer   uint64
+	bytesToPeer     uint64
+	packetsToClient uint64
+	bytesToClient   uint64
+	droppedPackets  uint64
+	droppedBytes    uint64
+}
+
+func (t *trafficCounters) addToPeer(n int) {
+	atomic.AddUint64(&t.packetsToPeer, 1)
+	atomic.AddUint64(&t.bytesToPeer, uint64(n))
+}
+
+func (t *trafficCounters) addToClient(n int) {
+	atomic.AddUint64(&t.packetsToClient, 1)
+	atomic.AddUint64(&t.bytesToClient, uint64(n))
+}
+
+func (t *trafficCounters) addDropped(n int) {
+	atomic.AddUint64(&t.droppedPackets, 1)
+	atomic.AddUint64(&t.droppedBytes, uint64(n))
+}
+
+func (t *trafficCounters) snapshot() Traffic {
+	return Traffic{
+		PacketsToPeer:   atomic.LoadUint64(&t.packetsToPeer),
+		BytesToPeer:     atomic.LoadUint64(&t.bytesToPeer),
+		PacketsToClient: atomic.LoadUint64(&t.packetsToClient),
+		BytesToClient:   atomic.LoadUint64(&t.bytesToClient),
+		DroppedPackets:  atomic.LoadUint64(&t.droppedPackets),
+		DroppedBytes:    atomic.LoadUint64(&t.droppedBytes),
+	}
+}
+
+func (t *trafficCounters) restore(s Traffic) {
+	atomic.StoreUint64(&t.packetsToPeer, s.PacketsToPeer)
+	atomic.StoreUint64(&t.bytesToPeer, s.BytesToPeer)
+	atomic.StoreUint64(&t.packetsToClient, s.PacketsToClient)
+	atomic.StoreUint64(&t.bytesToClient, s.BytesToClient)
+	atomic.StoreUint64(&t.droppedPackets, s.DroppedPackets)
+	atomic.StoreUint64(&t.droppedBytes, s.DroppedBytes)
+}
+
+// PeerTraffic is the traffic of the permissions or channel bindings of a peer that were
+// removed from their allocation, Number is zero for permissions
+type PeerTraffic struct {
+	Peer    net.Addr
+	Number  proto.ChannelNumber
+	Traffic Traffic
+}
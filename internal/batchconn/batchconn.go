@@ -0,0 +1,74 @@
+// Package batchconn reads and writes batches of datagrams, with a single recvmmsg
+// or sendmmsg syscall per batch on Linux
+package batchconn
+
+import "net"
+
+// Message is a datagram read or written by a Conn
+type Message struct {
+	// Buffer receives the datagram on reads and holds the datagram on writes
+	Buffer []byte
+	// N is the number of bytes read into Buffer
+	N int
+	// Addr is the source address on reads and the destination address on writes
+	Addr net.Addr
+}
+
+// Conn reads and writes several datagrams per call. A Conn keeps scratch space
+// between calls, so it must not be used by several goroutines at once. Create
+// one Conn per goroutine instead, they can share the same socket.
+type Conn interface {
+	// ReadBatch reads at least one datagram into msgs and returns the number of
+	// messages read
+	ReadBatch(msgs []Message) (int, error)
+	// WriteBatch writes msgs and returns the number of messages written
+	WriteBatch(msgs []Message) (int, error)
+}
+
+// Offload selects the UDP offloads a Conn uses if the kernel supports them
+type Offload struct {
+	// GSO sends consecutive datagrams of the same size to the same address as one
+	// buffer the kernel segments, using UDP_SEGMENT
+	GSO bool
+	// GRO lets the kernel coalesce datagrams of the same flow into one buffer that
+	// is split again by ReadBatch, using UDP_GRO. It changes an option of the socket,
+	// which affects every reader of the socket, and takes a 64 KiB read buffer.
+	GRO bool
+}
+
+// New returns a Conn batching reads and writes on conn. On Linux a *net.UDPConn
+// uses recvmmsg and sendmmsg, and the offloads the kernel supports. Other
+// PacketConns read and write one datagram per syscall.
+func New(conn net.PacketConn, offload Offload) Conn {
+	if c := newMmsgConn(conn, offload); c != nil {
+		return c
+	}
+	return &packetConn{conn}
+}
+
+// packetConn is the Conn of PacketConns without batching support
+type packetConn struct {
+	net.PacketConn
+}
+
+func (c *packetConn) ReadBatch(msgs []Message) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	n, addr, err := c.ReadFrom(msgs[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N, msgs[0].Addr = n, addr
+	return 1, nil
+}
+
+func (c *packetConn) WriteBatch(msgs []Message) (int, error) {
+	for i := range msgs {
+		if _, err := c.WriteTo(msgs[i].Buffer, msgs[i].Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
@@ -0,0 +1,412 @@
+//go:build linux
+// +build linux
+
+package batchconn
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2), Go pads it to the alignment of Msghdr like C
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgConn is the Conn of a UDP socket, every batch is a single recvmmsg or
+// sendmmsg syscall
+type mmsgConn struct {
+	rc    syscall.RawConn
+	inet6 bool
+	gso   bool
+	gro   bool
+
+	readHdrs  []mmsghdr
+	readIovs  []unix.Iovec
+	readNames []unix.RawSockaddrAny
+	// readAddrs are the source addresses last returned for each message, they are
+	// returned again while the source does not change
+	readAddrs  []*net.UDPAddr
+	writeHdrs  []mmsghdr
+	writeIovs  []unix.Iovec
+	writeNames []unix.RawSockaddrInet6
+	writeOob   []byte
+	// writeCounts is the number of messages sent by each of writeHdrs
+	writeCounts []int
+
+	// groBuffer holds the datagrams coalesced by the kernel, the segments from
+	// groNext on did not fit into the messages of the previous ReadBatch
+	groBuffer   []byte
+	groOob      []byte
+	groSegments [][]byte
+	groNext     int
+	groAddr     net.Addr
+
+	// op holds the arguments and results of mmsgFunc, which is only created once
+	// as every closure passed to the RawConn would be allocated
+	op struct {
+		trap  uintptr
+		hdrs  []mmsghdr
+		n     int
+		errno syscall.Errno
+	}
+	mmsgFunc func(fd uintptr) bool
+}
+
+func newMmsgConn(conn net.PacketConn, offload Offload) Conn {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var sa unix.Sockaddr
+	var sockErr error
+	if err = rc.Control(func(fd uintptr) {
+		sa, sockErr = unix.Getsockname(int(fd))
+	}); err != nil || sockErr != nil {
+		return nil
+	}
+
+	c := &mmsgConn{rc: rc}
+	c.mmsgFunc = c.runMmsg
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+	case *unix.SockaddrInet6:
+		c.inet6 = true
+	default:
+		return nil
+	}
+
+	if offload.GSO {
+		c.gso = gsoSupported(rc)
+	}
+	if offload.GRO && enableGRO(rc) {
+		c.gro = true
+		c.groBuffer = make([]byte, groBufferSize)
+		c.groOob = make([]byte, unix.CmsgSpace(4))
+	}
+	return c
+}
+
+func (c *mmsgConn) ReadBatch(msgs []Message) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	if c.gro {
+		return c.readGRO(msgs)
+	}
+
+	if len(c.readHdrs) < len(msgs) {
+		c.readHdrs = make([]mmsghdr, len(msgs))
+		c.readIovs = make([]unix.Iovec, len(msgs))
+		c.readNames = make([]unix.RawSockaddrAny, len(msgs))
+		c.readAddrs = make([]*net.UDPAddr, len(msgs))
+	}
+
+	for i := range msgs {
+		c.setReadHdr(i, msgs[i].Buffer, nil)
+	}
+
+	n, err := c.mmsg(true, c.readHdrs[:len(msgs)])
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		msgs[i].N = int(c.readHdrs[i].len)
+		msgs[i].Addr = c.readAddr(i)
+	}
+	return n, nil
+}
+
+// readGRO reads one buffer of coalesced datagrams and splits it into msgs
+func (c *mmsgConn) readGRO(msgs []Message) (int, error) {
+	if c.groNext == len(c.groSegments) {
+		if len(c.readHdrs) == 0 {
+			c.readHdrs = make([]mmsghdr, 1)
+			c.readIovs = make([]unix.Iovec, 1)
+			c.readNames = make([]unix.RawSockaddrAny, 1)
+			c.readAddrs = make([]*net.UDPAddr, 1)
+		}
+		c.setReadHdr(0, c.groBuffer, c.groOob)
+
+		if _, err := c.mmsg(true, c.readHdrs[:1]); err != nil {
+			return 0, err
+		}
+
+		hdr := &c.readHdrs[0]
+		n := int(hdr.len)
+		segmentSize := groSegmentSize(c.groOob[:hdr.hdr.Controllen])
+		if segmentSize <= 0 {
+			segmentSize = n
+		}
+
+		c.groAddr = c.readAddr(0)
+		c.groSegments, c.groNext = c.groSegments[:0], 0
+		for start := 0; start < n || start == 0; start += segmentSize {
+			end := start + segmentSize
+			if end > n {
+				end = n
+			}
+			c.groSegments = append(c.groSegments, c.groBuffer[start:end])
+			if end == n {
+				break
+			}
+		}
+	}
+
+	i := 0
+	for ; i < len(msgs) && c.groNext < len(c.groSegments); i++ {
+		msgs[i].N = copy(msgs[i].Buffer, c.groSegments[c.groNext])
+		msgs[i].Addr = c.groAddr
+		c.groNext++
+	}
+	return i, nil
+}
+
+func (c *mmsgConn) setReadHdr(i int, buf, oob []byte) {
+	c.readIovs[i] = unix.Iovec{}
+	if len(buf) > 0 {
+		c.readIovs[i].Base = &buf[0]
+		c.readIovs[i].SetLen(len(buf))
+	}
+
+	c.readHdrs[i] = mmsghdr{}
+	c.readHdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&c.readNames[i]))
+	c.readHdrs[i].hdr.Namelen = unix.SizeofSockaddrAny
+	c.readHdrs[i].hdr.Iov = &c.readIovs[i]
+	c.readHdrs[i].hdr.SetIovlen(1)
+	if len(oob) > 0 {
+		c.readHdrs[i].hdr.Control = &oob[0]
+		c.readHdrs[i].hdr.SetControllen(len(oob))
+	}
+}
+
+// readAddr returns the source address of the message i was read into, reusing the
+// previous address of the message if it is the same so reads do not allocate
+func (c *mmsgConn) readAddr(i int) *net.UDPAddr {
+	raw := &c.readNames[i]
+	if addr := c.readAddrs[i]; addr != nil && sockaddrEqual(raw, addr) {
+		return addr
+	}
+
+	addr := sockaddrToUDPAddr(raw)
+	c.readAddrs[i] = addr
+	return addr
+}
+
+func (c *mmsgConn) WriteBatch(msgs []Message) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	if len(c.writeHdrs) < len(msgs) {
+		c.writeHdrs = make([]mmsghdr, len(msgs))
+		c.writeIovs = make([]unix.Iovec, len(msgs))
+		c.writeNames = make([]unix.RawSockaddrInet6, len(msgs))
+		c.writeOob = make([]byte, len(msgs)*unix.CmsgSpace(2))
+		c.writeCounts = make([]int, len(msgs))
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		n, err := c.write(msgs[sent:])
+		sent += n
+		if errors.Is(err, unix.EIO) && c.gso {
+			// the device does not support the segmentation, resend the datagrams
+			// that were not sent without it
+			c.gso = false
+			continue
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// write sends msgs with one sendmmsg, grouping them for GSO if enabled, and
+// returns the number of messages sent
+func (c *mmsgConn) write(msgs []Message) (int, error) {
+	hdrs := 0
+	for i := 0; i < len(msgs); {
+		count := 1
+		if c.gso {
+			count = gsoGroup(msgs[i:])
+		}
+
+		for j := i; j < i+count; j++ {
+			c.writeIovs[j] = unix.Iovec{}
+			if len(msgs[j].Buffer) > 0 {
+				c.writeIovs[j].Base = &msgs[j].Buffer[0]
+				c.writeIovs[j].SetLen(len(msgs[j].Buffer))
+			}
+		}
+
+		namelen, err := c.putSockaddr(&c.writeNames[hdrs], msgs[i].Addr)
+		if err != nil {
+			return 0, err
+		}
+
+		hdr := &c.writeHdrs[hdrs]
+		*hdr = mmsghdr{}
+		hdr.hdr.Name = (*byte)(unsafe.Pointer(&c.writeNames[hdrs]))
+		hdr.hdr.Namelen = namelen
+		hdr.hdr.Iov = &c.writeIovs[i]
+		hdr.hdr.SetIovlen(count)
+		if count > 1 {
+			oob := c.writeOob[hdrs*unix.CmsgSpace(2) : (hdrs+1)*unix.CmsgSpace(2)]
+			putSegmentSize(oob, len(msgs[i].Buffer))
+			hdr.hdr.Control = &oob[0]
+			hdr.hdr.SetControllen(len(oob))
+		}
+
+		c.writeCounts[hdrs] = count
+		hdrs++
+		i += count
+	}
+
+	// sendmmsg stops at the first datagram it fails to send
+	sentHdrs := 0
+	for sentHdrs < hdrs {
+		n, err := c.mmsg(false, c.writeHdrs[sentHdrs:hdrs])
+		if err != nil {
+			return c.countWritten(sentHdrs), err
+		}
+		sentHdrs += n
+	}
+	return c.countWritten(sentHdrs), nil
+}
+
+func (c *mmsgConn) countWritten(hdrs int) int {
+	n := 0
+	for _, count := range c.writeCounts[:hdrs] {
+		n += count
+	}
+	return n
+}
+
+// mmsg runs recvmmsg or sendmmsg on hdrs, waiting for the socket to be ready
+// like the reads and writes of the *net.UDPConn
+func (c *mmsgConn) mmsg(read bool, hdrs []mmsghdr) (int, error) {
+	trap, name, wait := uintptr(unix.SYS_SENDMMSG), "sendmmsg", c.rc.Write
+	if read {
+		trap, name, wait = unix.SYS_RECVMMSG, "recvmmsg", c.rc.Read
+	}
+
+	c.op.trap, c.op.hdrs = trap, hdrs
+	err := wait(c.mmsgFunc)
+	n, errno := c.op.n, c.op.errno
+	c.op.hdrs, c.op.n, c.op.errno = nil, 0, 0
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError(name, errno)
+	}
+	return n, nil
+}
+
+func (c *mmsgConn) runMmsg(fd uintptr) bool {
+	for {
+		r, _, e := unix.Syscall6(c.op.trap, fd, uintptr(unsafe.Pointer(&c.op.hdrs[0])), uintptr(len(c.op.hdrs)), 0, 0, 0)
+		switch e {
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return false
+		}
+		c.op.n, c.op.errno = int(r), e
+		return true
+	}
+}
+
+func (c *mmsgConn) putSockaddr(sa *unix.RawSockaddrInet6, addr net.Addr) (uint32, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errUnsupportedAddr
+	}
+
+	if !c.inet6 {
+		ip := udpAddr.IP.To4()
+		if ip == nil {
+			return 0, errAddressFamily
+		}
+
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		putPort(&sa4.Port, udpAddr.Port)
+		copy(sa4.Addr[:], ip)
+		return unix.SizeofSockaddrInet4, nil
+	}
+
+	*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	putPort(&sa.Port, udpAddr.Port)
+	copy(sa.Addr[:], udpAddr.IP.To16())
+	if udpAddr.Zone != "" {
+		if ifi, err := net.InterfaceByName(udpAddr.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return unix.SizeofSockaddrInet6, nil
+}
+
+func sockaddrToUDPAddr(raw *unix.RawSockaddrAny) *net.UDPAddr {
+	switch raw.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(raw))
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: port(&sa.Port),
+		}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(raw))
+		addr := &net.UDPAddr{
+			IP:   append(net.IP{}, sa.Addr[:]...),
+			Port: port(&sa.Port),
+		}
+		if sa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+func sockaddrEqual(raw *unix.RawSockaddrAny, addr *net.UDPAddr) bool {
+	switch raw.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(raw))
+		ip := addr.IP.To4()
+		return ip != nil && port(&sa.Port) == addr.Port && string(ip) == string(sa.Addr[:])
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(raw))
+		return sa.Scope_id == 0 && addr.Zone == "" && len(addr.IP) == net.IPv6len &&
+			port(&sa.Port) == addr.Port && string(addr.IP) == string(sa.Addr[:])
+	}
+	return false
+}
+
+// port reads a port in network byte order
+func port(p *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	return int(b[0])<<8 | int(b[1])
+}
+
+func putPort(p *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
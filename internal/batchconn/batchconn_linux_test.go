@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package batchconn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteBatchGSOFallback(t *testing.T) {
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	first, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	second, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	c, ok := New(sender, Offload{}).(*mmsgConn)
+	assert.True(t, ok)
+
+	// the datagram to first is sent on its own, then the device rejects the
+	// segmented datagrams to second like one without GSO support
+	c.gso = true
+	sendmmsg := 0
+	c.mmsgFunc = func(fd uintptr) bool {
+		if c.op.trap == unix.SYS_SENDMMSG && c.gso {
+			sendmmsg++
+			if sendmmsg > 1 {
+				c.op.n, c.op.errno = 0, unix.EIO
+				return true
+			}
+			c.op.hdrs = c.op.hdrs[:1]
+		}
+		return c.runMmsg(fd)
+	}
+
+	n, err := c.WriteBatch([]Message{
+		{Buffer: []byte{0}, Addr: first.LocalAddr()},
+		{Buffer: []byte{1, 1}, Addr: second.LocalAddr()},
+		{Buffer: []byte{2, 2}, Addr: second.LocalAddr()},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.False(t, c.gso)
+
+	buf := make([]byte, 1500)
+	for _, expected := range [][]byte{{1, 1}, {2, 2}} {
+		n, _, err = second.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, buf[:n])
+	}
+
+	// the datagram sent before the fallback is not sent again
+	n, _, err = first.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0}, buf[:n])
+	assert.NoError(t, first.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = first.ReadFrom(buf)
+	assert.Error(t, err)
+
+	assert.NoError(t, sender.Close())
+	assert.NoError(t, first.Close())
+	assert.NoError(t, second.Close())
+}
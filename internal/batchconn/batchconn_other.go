@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package batchconn
+
+import "net"
+
+func newMmsgConn(net.PacketConn, Offload) Conn {
+	return nil
+}
@@ -0,0 +1,127 @@
+package batchconn
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// plainConn hides the *net.UDPConn from New
+type plainConn struct {
+	net.PacketConn
+}
+
+var testModes = []string{"plain", "batched", "offload"}
+
+func newTestConn(mode string, conn net.PacketConn) Conn {
+	switch mode {
+	case "plain":
+		return New(plainConn{conn}, Offload{})
+	case "offload":
+		return New(conn, Offload{GSO: true, GRO: true})
+	default:
+		return New(conn, Offload{})
+	}
+}
+
+func TestConn(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		for _, mode := range testModes {
+			network, mode := network, mode
+			t.Run(network+" "+mode, func(t *testing.T) {
+				host := "127.0.0.1"
+				if network == "udp6" {
+					host = "::1"
+				}
+
+				receiver, err := net.ListenPacket(network, net.JoinHostPort(host, "0"))
+				if err != nil {
+					t.Skipf("%s is not available: %s", network, err)
+				}
+				sender, err := net.ListenPacket(network, net.JoinHostPort(host, "0"))
+				assert.NoError(t, err)
+
+				r, s := newTestConn(mode, receiver), newTestConn(mode, sender)
+
+				// same sized datagrams followed by a shorter one can be sent with GSO
+				out := make([]Message, 5)
+				for i := range out {
+					out[i] = Message{Buffer: []byte{byte(i), 1, 2}, Addr: receiver.LocalAddr()}
+				}
+				out[4].Buffer = out[4].Buffer[:2]
+				n, err := s.WriteBatch(out)
+				assert.NoError(t, err)
+				assert.Equal(t, len(out), n)
+
+				in := make([]Message, 8)
+				for i := range in {
+					in[i].Buffer = make([]byte, 1500)
+				}
+
+				received := 0
+				for received < len(out) {
+					n, err = r.ReadBatch(in)
+					assert.NoError(t, err)
+					for _, msg := range in[:n] {
+						assert.Equal(t, out[received].Buffer, msg.Buffer[:msg.N])
+						assert.Equal(t, sender.LocalAddr().String(), msg.Addr.String())
+						received++
+					}
+				}
+
+				assert.NoError(t, receiver.Close())
+				assert.NoError(t, sender.Close())
+			})
+		}
+	}
+}
+
+func BenchmarkConn(b *testing.B) {
+	for _, batchSize := range []int{1, 8, 32} {
+		for _, mode := range testModes {
+			batchSize, mode := batchSize, mode
+			b.Run(fmt.Sprintf("batch_size_%d_%s", batchSize, mode), func(b *testing.B) {
+				receiver, err := net.ListenPacket("udp4", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer receiver.Close() //nolint:errcheck
+
+				sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer sender.Close() //nolint:errcheck
+
+				r, s := newTestConn(mode, receiver), newTestConn(mode, sender)
+
+				out := make([]Message, batchSize)
+				in := make([]Message, batchSize)
+				for i := range out {
+					out[i] = Message{Buffer: make([]byte, 160), Addr: receiver.LocalAddr()}
+					in[i].Buffer = make([]byte, 1500)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					if _, err := s.WriteBatch(out); err != nil {
+						b.Fatal(err)
+					}
+					for received := 0; received < batchSize; {
+						n, err := r.ReadBatch(in[:batchSize-received])
+						if err != nil {
+							b.Fatal(err)
+						}
+						received += n
+					}
+				}
+				b.ReportMetric(float64(b.N*batchSize)/time.Since(start).Seconds(), "packets/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package batchconn
+
+import "errors"
+
+var (
+	errUnsupportedAddr = errors.New("batchconn: destination must be a *net.UDPAddr")
+	errAddressFamily   = errors.New("batchconn: IPv6 destination on an IPv4 socket")
+)
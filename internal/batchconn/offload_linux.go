@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package batchconn
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// socket options of udp(7) missing from x/sys
+const (
+	udpSegment = 103 // UDP_SEGMENT
+	udpGRO     = 104 // UDP_GRO
+
+	// gsoMaxSegments is UDP_MAX_SEGMENTS of the kernel
+	gsoMaxSegments = 64
+	// gsoMaxSize is the largest UDP payload
+	gsoMaxSize = 65507
+	// groBufferSize fits the largest buffer the kernel coalesces
+	groBufferSize = 1 << 16
+)
+
+// gsoSupported reports if the kernel knows UDP_SEGMENT
+func gsoSupported(rc syscall.RawConn) bool {
+	var err error
+	if controlErr := rc.Control(func(fd uintptr) {
+		_, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, udpSegment)
+	}); controlErr != nil {
+		return false
+	}
+	return err == nil
+}
+
+// enableGRO sets UDP_GRO and reports if the kernel accepted it
+func enableGRO(rc syscall.RawConn) bool {
+	var err error
+	if controlErr := rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, udpGRO, 1)
+	}); controlErr != nil {
+		return false
+	}
+	return err == nil
+}
+
+// gsoGroup returns the number of messages at the start of msgs the kernel can
+// segment from one buffer: they go to the same address and have the same size,
+// only the last one may be shorter
+func gsoGroup(msgs []Message) int {
+	size := len(msgs[0].Buffer)
+	if size == 0 {
+		return 1
+	}
+
+	total := size
+	n := 1
+	for n < len(msgs) && n < gsoMaxSegments {
+		next := len(msgs[n].Buffer)
+		if next == 0 || next > size || total+next > gsoMaxSize || !sameUDPAddr(msgs[0].Addr, msgs[n].Addr) {
+			break
+		}
+		total += next
+		n++
+		if next < size {
+			break
+		}
+	}
+	return n
+}
+
+func sameUDPAddr(a, b net.Addr) bool {
+	if a == b {
+		return true
+	}
+	ua, okA := a.(*net.UDPAddr)
+	ub, okB := b.(*net.UDPAddr)
+	return okA && okB && ua.Port == ub.Port && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+}
+
+// putSegmentSize writes the UDP_SEGMENT control message into oob, which is
+// CmsgSpace(2) long
+func putSegmentSize(oob []byte, size int) {
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(size)
+}
+
+// groSegmentSize returns the size of the datagrams coalesced into a buffer read
+// with the control messages oob, or 0 if the buffer is a single datagram
+func groSegmentSize(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.IPPROTO_UDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+		}
+	}
+	return 0
+}
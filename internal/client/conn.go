@@ -12,6 +12,7 @@ import (
 
 	"github.com/pion/logging"
 	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/proto"
 )
 
@@ -53,6 +54,7 @@ type UDPConnConfig struct {
 	Nonce       stun.Nonce
 	Lifetime    time.Duration
 	Log         logging.LeveledLogger
+	Clock       clock.Clock
 }
 
 // UDPConn is the implementation of the Conn and PacketConn interfaces for UDP network connections.
@@ -70,6 +72,7 @@ type UDPConn struct {
 	readTimer         *time.Timer           // thread-safe
 	refreshAllocTimer *PeriodicTimer        // thread-safe
 	refreshPermsTimer *PeriodicTimer        // thread-safe
+	clock             clock.Clock           // read-only
 	mutex             sync.RWMutex          // thread-safe
 	log               logging.LeveledLogger // read-only
 }
@@ -88,6 +91,7 @@ func NewUDPConn(config *UDPConnConfig) *UDPConn {
 		closeCh:     make(chan struct{}),
 		readTimer:   time.NewTimer(time.Duration(math.MaxInt64)),
 		log:         config.Log,
+		clock:       config.Clock,
 	}
 
 	c.log.Debugf("initial lifetime: %d seconds", int(c.lifetime().Seconds()))
@@ -96,12 +100,14 @@ func NewUDPConn(config *UDPConnConfig) *UDPConn {
 		timerIDRefreshAlloc,
 		c.onRefreshTimers,
 		c.lifetime()/2,
+		c.clock,
 	)
 
 	c.refreshPermsTimer = NewPeriodicTimer(
 		timerIDRefreshPerms,
 		c.onRefreshTimers,
 		permRefreshInterval,
+		c.clock,
 	)
 
 	if c.refreshAllocTimer.Start() {
@@ -207,6 +213,7 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) { //nolint: goco
 	b, ok := c.bindingMgr.findByAddr(addr)
 	if !ok {
 		b = c.bindingMgr.create(addr)
+		b.setRefreshedAt(c.clock.Now())
 	}
 
 	bindSt := b.state()
@@ -260,7 +267,7 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) { //nolint: goco
 		b.muBind.Lock()
 		defer b.muBind.Unlock()
 
-		if b.state() == bindingStateReady && time.Since(b.refreshedAt()) > 5*time.Minute {
+		if b.state() == bindingStateReady && c.clock.Now().Sub(b.refreshedAt()) > 5*time.Minute {
 			b.setState(bindingStateRefresh)
 			go func() {
 				err = c.bind(b)
@@ -269,7 +276,7 @@ func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) { //nolint: goco
 					b.setState(bindingStateFailed)
 					// keep going...
 				} else {
-					b.setRefreshedAt(time.Now())
+					b.setRefreshedAt(c.clock.Now())
 					b.setState(bindingStateReady)
 				}
 			}()
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -102,6 +103,7 @@ func TestUDPConn(t *testing.T) {
 			obs:        obs,
 			permMap:    pm,
 			bindingMgr: bm,
+			clock:      clock.System,
 		}
 
 		buf := []byte("Hello")
@@ -3,6 +3,8 @@ package client
 import (
 	"sync"
 	"time"
+
+	"github.com/pion/turn/v2/internal/clock"
 )
 
 // PeriodicTimerTimeoutHandler is a handler called on timeout
@@ -13,16 +15,24 @@ type PeriodicTimer struct {
 	id             int
 	interval       time.Duration
 	timeoutHandler PeriodicTimerTimeoutHandler
-	stopFunc       func()
+	clock          clock.Clock
+	run            *periodicTimerRun // nil unless running
 	mutex          sync.RWMutex
 }
 
+// periodicTimerRun is the timer of one Start, so a timeout racing with Stop
+// does not reschedule the timer of the next Start
+type periodicTimerRun struct {
+	timer clock.Timer
+}
+
 // NewPeriodicTimer create a new timer
-func NewPeriodicTimer(id int, timeoutHandler PeriodicTimerTimeoutHandler, interval time.Duration) *PeriodicTimer {
+func NewPeriodicTimer(id int, timeoutHandler PeriodicTimerTimeoutHandler, interval time.Duration, c clock.Clock) *PeriodicTimer {
 	return &PeriodicTimer{
 		id:             id,
 		interval:       interval,
 		timeoutHandler: timeoutHandler,
+		clock:          c,
 	}
 }
 
@@ -32,33 +42,38 @@ func (t *PeriodicTimer) Start() bool {
 	defer t.mutex.Unlock()
 
 	// this is a noop if the timer is always running
-	if t.stopFunc != nil {
+	if t.run != nil {
 		return false
 	}
 
-	cancelCh := make(chan struct{})
+	run := &periodicTimerRun{}
+	run.timer = t.clock.AfterFunc(t.interval, func() {
+		t.timeout(run)
+	})
+	t.run = run
 
-	go func() {
-		canceling := false
+	return true
+}
 
-		for !canceling {
-			timer := time.NewTimer(t.interval)
+func (t *PeriodicTimer) timeout(run *periodicTimerRun) {
+	if !t.isRun(run) {
+		return
+	}
 
-			select {
-			case <-timer.C:
-				t.timeoutHandler(t.id)
-			case <-cancelCh:
-				canceling = true
-				timer.Stop()
-			}
-		}
-	}()
+	t.timeoutHandler(t.id)
 
-	t.stopFunc = func() {
-		close(cancelCh)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.run == run {
+		run.timer.Reset(t.interval)
 	}
+}
 
-	return true
+func (t *PeriodicTimer) isRun(run *periodicTimerRun) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.run == run
 }
 
 // Stop stops the timer.
@@ -66,9 +81,9 @@ func (t *PeriodicTimer) Stop() {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	if t.stopFunc != nil {
-		t.stopFunc()
-		t.stopFunc = nil
+	if t.run != nil {
+		t.run.timer.Stop()
+		t.run = nil
 	}
 }
 
@@ -78,5 +93,5 @@ func (t *PeriodicTimer) IsRunning() bool {
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
 
-	return (t.stopFunc != nil)
+	return (t.run != nil)
 }
@@ -1,21 +1,22 @@
 package client
 
 import (
-	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestPeriodicTimer(t *testing.T) {
 	t.Run("basic", func(t *testing.T) {
+		c := clock.NewFake(time.Now())
 		timerID := 3
-		var nCbs uint64
+		nCbs := 0
 		rt := NewPeriodicTimer(timerID, func(id int) {
-			atomic.AddUint64(&nCbs, 1)
+			nCbs++
 			assert.Equal(t, timerID, id)
-		}, 50*time.Millisecond)
+		}, 50*time.Millisecond, c)
 
 		assert.False(t, rt.IsRunning(), "should not be running yet")
 
@@ -23,31 +24,47 @@ func TestPeriodicTimer(t *testing.T) {
 		assert.True(t, ok, "should be true")
 		assert.True(t, rt.IsRunning(), "should be running")
 
-		time.Sleep(100 * time.Millisecond)
+		c.Advance(100 * time.Millisecond)
 
 		ok = rt.Start()
 		assert.False(t, ok, "start again is noop")
 
-		time.Sleep(120 * time.Millisecond)
+		c.Advance(120 * time.Millisecond)
 		rt.Stop()
 		assert.False(t, rt.IsRunning(), "should not be running")
-		assert.Equal(t, 4, int(atomic.LoadUint64(&nCbs)), "should be called 4 times (actual: %d)", atomic.LoadUint64(&nCbs))
+		assert.Equal(t, 4, nCbs, "should be called 4 times (actual: %d)", nCbs)
+
+		c.Advance(time.Hour)
+		assert.Equal(t, 4, nCbs, "should not be called once stopped")
 	})
 
 	t.Run("stop inside handler", func(t *testing.T) {
+		c := clock.NewFake(time.Now())
 		timerID := 4
 		var rt *PeriodicTimer
 		rt = NewPeriodicTimer(timerID, func(id int) {
 			assert.Equal(t, timerID, id)
 			rt.Stop()
-		}, 20*time.Millisecond)
+		}, 20*time.Millisecond, c)
 
 		assert.False(t, rt.IsRunning(), "should not be running yet")
 
 		ok := rt.Start()
 		assert.True(t, ok, "should be true")
 		assert.True(t, rt.IsRunning(), "should be running")
-		time.Sleep(30 * time.Millisecond)
+		c.Advance(30 * time.Millisecond)
 		assert.False(t, rt.IsRunning(), "should not be running")
 	})
+
+	t.Run("system clock", func(t *testing.T) {
+		fired := make(chan int, 2)
+		rt := NewPeriodicTimer(5, func(id int) {
+			fired <- id
+		}, 20*time.Millisecond, clock.System)
+
+		assert.True(t, rt.Start())
+		assert.Equal(t, 5, <-fired)
+		assert.Equal(t, 5, <-fired)
+		rt.Stop()
+	})
 }
@@ -0,0 +1,148 @@
+// Package clock abstracts the time source of the server and the client, so
+// tests can simulate long lifetimes without waiting for them
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and calls functions after a duration
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f once d elapsed, like time.AfterFunc
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by Clock.AfterFunc, *time.Timer implements it
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// System is the Clock of the time package
+var System Clock = systemClock{} //nolint:gochecknoglobals
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Fake is a Clock that only moves when it is advanced. The functions of its
+// timers run in the goroutine calling Advance, in the order they are due.
+type Fake struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	seq    uint64
+}
+
+type fakeTimer struct {
+	clock *Fake
+	f     func()
+	at    time.Time
+	seq   uint64 // orders timers that are due at the same time
+	index int    // position in clock.timers, -1 unless scheduled
+}
+
+// NewFake creates a Fake clock starting at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time the clock was advanced to
+func (c *Fake) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once the clock was advanced by d
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{clock: c, f: f, index: -1}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the timers that become due,
+// including timers that are created or reset by them
+func (c *Fake) Advance(d time.Duration) {
+	c.lock.Lock()
+	target := c.now.Add(d)
+	for {
+		t := c.next(target)
+		if t == nil {
+			break
+		}
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.remove(t)
+
+		c.lock.Unlock()
+		t.f()
+		c.lock.Lock()
+	}
+	c.now = target
+	c.lock.Unlock()
+}
+
+// next returns the earliest timer that is due at target
+func (c *Fake) next(target time.Time) *fakeTimer {
+	if len(c.timers) == 0 {
+		return nil
+	}
+	sort.Slice(c.timers, func(i, j int) bool {
+		a, b := c.timers[i], c.timers[j]
+		return a.at.Before(b.at) || (a.at.Equal(b.at) && a.seq < b.seq)
+	})
+	for i, t := range c.timers {
+		t.index = i
+	}
+
+	if t := c.timers[0]; !t.at.After(target) {
+		return t
+	}
+	return nil
+}
+
+func (c *Fake) remove(t *fakeTimer) {
+	last := len(c.timers) - 1
+	c.timers[t.index] = c.timers[last]
+	c.timers[t.index].index = t.index
+	c.timers[last] = nil
+	c.timers = c.timers[:last]
+	t.index = -1
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+	t.clock.remove(t)
+	return true
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	scheduled := t.index >= 0
+	if !scheduled {
+		t.index = len(c.timers)
+		c.timers = append(c.timers, t)
+	}
+	c.seq++
+	t.at, t.seq = c.now.Add(d), c.seq
+	return scheduled
+}
@@ -0,0 +1,43 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+
+	var fired []string
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name+" "+c.Now().Sub(start).String())
+		}
+	}
+
+	c.AfterFunc(2*time.Second, record("b"))
+	c.AfterFunc(time.Second, record("a"))
+	stopped := c.AfterFunc(time.Second, record("stopped"))
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	// timers that reschedule themselves run again within the same Advance
+	var periodic Timer
+	periodic = c.AfterFunc(1500*time.Millisecond, func() {
+		record("periodic")()
+		periodic.Reset(1500 * time.Millisecond)
+	})
+
+	c.Advance(3 * time.Second)
+	assert.Equal(t, []string{"a 1s", "periodic 1.5s", "b 2s", "periodic 3s"}, fired)
+	assert.Equal(t, start.Add(3*time.Second), c.Now())
+
+	assert.True(t, periodic.Reset(time.Hour))
+	c.Advance(time.Hour - time.Nanosecond)
+	assert.Len(t, fired, 4)
+	c.Advance(time.Nanosecond)
+	assert.Len(t, fired, 5)
+}
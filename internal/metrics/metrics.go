@@ -0,0 +1,216 @@
+// Package metrics implements a minimal registry of counters and gauges
+// that can be exported in the Prometheus text exposition format
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Labels are constant key/value pairs attached to a single series
+type Labels map[string]string
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+type series interface {
+	labels() Labels
+	value() string
+}
+
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series []series
+	vecs   []*CounterVec
+}
+
+// Registry holds every registered metric family. The zero value is not usable, use NewRegistry.
+type Registry struct {
+	lock     sync.RWMutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+func (r *Registry) family(name, help, typ string) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		r.families[name] = f
+	}
+	return f
+}
+
+func (r *Registry) add(name, help, typ string, s series) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f := r.family(name, help, typ)
+	f.series = append(f.series, s)
+}
+
+// Unregister removes every series of the family name whose labels equal labels
+func (r *Registry) Unregister(name string, labels Labels) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		return
+	}
+
+	for i := len(f.series) - 1; i >= 0; i-- {
+		if labelsEqual(f.series[i].labels(), labels) {
+			f.series = append(f.series[:i], f.series[i+1:]...)
+		}
+	}
+}
+
+// NewCounter registers a counter that is incremented by the caller
+func (r *Registry) NewCounter(name, help string, labels Labels) *Counter {
+	c := &Counter{constLabels: labels}
+	r.add(name, help, typeCounter, c)
+	return c
+}
+
+// NewCounterFunc registers a counter whose value is read from fn on every scrape
+func (r *Registry) NewCounterFunc(name, help string, labels Labels, fn func() uint64) {
+	r.add(name, help, typeCounter, &counterFunc{constLabels: labels, fn: fn})
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, labels Labels, fn func() int64) {
+	r.add(name, help, typeGauge, &gaugeFunc{constLabels: labels, fn: fn})
+}
+
+// NewCounterVec registers a family of counters partitioned by labelNames
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{labelNames: labelNames, counters: map[string]*Counter{}}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f := r.family(name, help, typeCounter)
+	f.vecs = append(f.vecs, v)
+	return v
+}
+
+// Counter is a monotonically increasing value, safe for concurrent use
+type Counter struct {
+	v           uint64
+	constLabels Labels
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) labels() Labels { return c.constLabels }
+func (c *Counter) value() string  { return formatUint(c.Value()) }
+
+type counterFunc struct {
+	constLabels Labels
+	fn          func() uint64
+}
+
+func (c *counterFunc) labels() Labels { return c.constLabels }
+func (c *counterFunc) value() string  { return formatUint(c.fn()) }
+
+type gaugeFunc struct {
+	constLabels Labels
+	fn          func() int64
+}
+
+func (g *gaugeFunc) labels() Labels { return g.constLabels }
+func (g *gaugeFunc) value() string  { return formatInt(g.fn()) }
+
+// CounterVec is a set of counters sharing a name and partitioned by label values
+type CounterVec struct {
+	lock       sync.RWMutex
+	labelNames []string
+	counters   map[string]*Counter
+}
+
+// With returns the counter for the given label values, creating it if needed.
+// The values must be passed in the same order as the label names.
+func (v *CounterVec) With(values ...string) *Counter {
+	key := strings.Join(values, "\xff")
+
+	v.lock.RLock()
+	c, ok := v.counters[key]
+	v.lock.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if c, ok = v.counters[key]; ok {
+		return c
+	}
+
+	labels := Labels{}
+	for i, name := range v.labelNames {
+		if i < len(values) {
+			labels[name] = values[i]
+		}
+	}
+	c = &Counter{constLabels: labels}
+	v.counters[key] = c
+	return c
+}
+
+func (v *CounterVec) series() []series {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	s := make([]series, 0, len(v.counters))
+	for _, c := range v.counters {
+		s = append(s, c)
+	}
+	return s
+}
+
+func labelsEqual(a, b Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedFamilies(families map[string]*family) []*family {
+	sorted := make([]*family, 0, len(families))
+	for _, f := range families {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+	return sorted
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounter("test_packets_total", "Packets seen.", nil)
+	c.Inc()
+	c.Add(2)
+
+	v := r.NewCounterVec("test_requests_total", "Requests by method.", "method", "code")
+	v.With("Allocate", "200").Inc()
+	v.With("Allocate", "401").Add(2)
+	v.With("Allocate", "200").Inc()
+
+	r.NewGaugeFunc("test_active", "Active things.", Labels{"listener": "0.0.0.0:3478"}, func() int64 { return 3 })
+	r.NewGaugeFunc("test_active", "Active things.", Labels{"listener": `a"b\c`}, func() int64 { return -1 })
+	r.NewCounterFunc("test_bytes_total", "Bytes seen.", Labels{"direction": "in"}, func() uint64 { return 42 })
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.WriteText(&buf))
+	assert.Equal(t, `# HELP test_active Active things.
+# TYPE test_active gauge
+test_active{listener="0.0.0.0:3478"} 3
+test_active{listener="a\"b\\c"} -1
+# HELP test_bytes_total Bytes seen.
+# TYPE test_bytes_total counter
+test_bytes_total{direction="in"} 42
+# HELP test_packets_total Packets seen.
+# TYPE test_packets_total counter
+test_packets_total 3
+# HELP test_requests_total Requests by method.
+# TYPE test_requests_total counter
+test_requests_total{code="200",method="Allocate"} 2
+test_requests_total{code="401",method="Allocate"} 2
+`, buf.String())
+
+	r.Unregister("test_active", Labels{"listener": "0.0.0.0:3478"})
+	buf.Reset()
+	assert.NoError(t, r.WriteText(&buf))
+	assert.NotContains(t, buf.String(), "0.0.0.0:3478")
+	assert.Contains(t, buf.String(), `test_active{listener="a\"b\\c"} -1`)
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.", nil).Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n", rec.Body.String())
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteText encodes every registered metric in the Prometheus text exposition format.
+// Families and series are sorted so the output is stable between scrapes.
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.RLock()
+	families := sortedFamilies(r.families)
+	r.lock.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		r.lock.RLock()
+		all := append([]series{}, f.series...)
+		vecs := append([]*CounterVec{}, f.vecs...)
+		r.lock.RUnlock()
+
+		for _, v := range vecs {
+			all = append(all, v.series()...)
+		}
+		if len(all) == 0 {
+			continue
+		}
+
+		lines := make([]string, 0, len(all))
+		for _, s := range all {
+			lines = append(lines, f.name+formatLabels(s.labels())+" "+s.value())
+		}
+		sort.Strings(lines)
+
+		if _, err := bw.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n# TYPE " + f.name + " " + f.typ + "\n"); err != nil {
+			return err
+		}
+		for _, l := range lines {
+			if _, err := bw.WriteString(l + "\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP implements http.Handler by writing the registry in the text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.WriteText(w)
+}
+
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v)
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+func formatInt(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
@@ -40,8 +40,10 @@ func (c *ChannelData) Equal(b *ChannelData) bool {
 // Similar to stun.Message.grow method.
 func (c *ChannelData) grow(v int) {
 	n := len(c.Raw) + v
-	for cap(c.Raw) < n {
-		c.Raw = append(c.Raw, 0)
+	if cap(c.Raw) < n {
+		raw := make([]byte, len(c.Raw), n)
+		copy(raw, c.Raw)
+		c.Raw = raw
 	}
 	c.Raw = c.Raw[:n]
 }
@@ -53,16 +55,16 @@ func (c *ChannelData) Reset() {
 	c.Data = c.Data[:0]
 }
 
-// Encode encodes ChannelData Message to Raw.
+// Encode encodes ChannelData Message to Raw. Raw is reused if it has the
+// capacity for the message.
 func (c *ChannelData) Encode() {
 	c.Raw = c.Raw[:0]
 	c.WriteHeader()
-	c.Raw = append(c.Raw, c.Data...)
-	padded := nearestPaddedValueLength(len(c.Raw))
-	if bytesToAdd := padded - len(c.Raw); bytesToAdd > 0 {
-		for i := 0; i < bytesToAdd; i++ {
-			c.Raw = append(c.Raw, 0)
-		}
+	padded := nearestPaddedValueLength(channelDataHeaderSize + len(c.Data))
+	c.grow(padded - channelDataHeaderSize)
+	n := channelDataHeaderSize + copy(c.Raw[channelDataHeaderSize:], c.Data)
+	for i := n; i < padded; i++ {
+		c.Raw[i] = 0
 	}
 }
 
@@ -1,11 +1,19 @@
 package proto
 
 import (
+	"encoding/binary"
 	"net"
 
 	"github.com/pion/stun"
 )
 
+const (
+	magicCookie = 0x2112A442
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
 // PeerAddress implements XOR-PEER-ADDRESS attribute.
 //
 // The XOR-PEER-ADDRESS specifies the address and port of the peer as
@@ -27,9 +35,46 @@ func (a PeerAddress) AddTo(m *stun.Message) error {
 	return stun.XORMappedAddress(a).AddToAs(m, stun.AttrXORPeerAddress)
 }
 
-// GetFrom decodes XOR-PEER-ADDRESS from message.
+// GetFrom decodes XOR-PEER-ADDRESS from message. a.IP is reused if it has the
+// capacity for the address, then decoding does not allocate and a.IP does not
+// escape to the heap.
 func (a *PeerAddress) GetFrom(m *stun.Message) error {
-	return (*stun.XORMappedAddress)(a).GetFromAs(m, stun.AttrXORPeerAddress)
+	v, err := m.Get(stun.AttrXORPeerAddress)
+	if err != nil {
+		return err
+	}
+
+	ipLen := 0
+	if len(v) > 4 {
+		switch binary.BigEndian.Uint16(v[0:2]) {
+		case familyIPv4:
+			ipLen = net.IPv4len
+		case familyIPv6:
+			ipLen = net.IPv6len
+		}
+	}
+	if ipLen == 0 || len(v) != 4+ipLen {
+		// stun decodes and reports malformed attributes
+		var addr stun.XORMappedAddress
+		if err = addr.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+			return err
+		}
+		a.resizeIP(len(addr.IP))
+		copy(a.IP, addr.IP)
+		a.Port = addr.Port
+		return nil
+	}
+
+	a.resizeIP(ipLen)
+
+	var key [4 + stun.TransactionIDSize]byte
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], m.TransactionID[:])
+	for i := range a.IP {
+		a.IP[i] = v[4+i] ^ key[i]
+	}
+	a.Port = int(binary.BigEndian.Uint16(v[2:4]) ^ magicCookie>>16)
+	return nil
 }
 
 // XORPeerAddress implements XOR-PEER-ADDRESS attribute.
@@ -40,3 +85,12 @@ func (a *PeerAddress) GetFrom(m *stun.Message) error {
 //
 // RFC 5766 Section 14.3
 type XORPeerAddress = PeerAddress
+
+// resizeIP sets the length of a.IP, only allocating if its capacity is too small.
+// a.IP is never appended to, which would make the escape analysis move it to the heap.
+func (a *PeerAddress) resizeIP(n int) {
+	if cap(a.IP) < n {
+		a.IP = make(net.IP, n)
+	}
+	a.IP = a.IP[:n]
+}
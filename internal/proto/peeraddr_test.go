@@ -31,4 +31,32 @@ func TestPeerAddress(t *testing.T) {
 
 	var aGot PeerAddress
 	assert.NoError(t, aGot.GetFrom(decoded))
+	assert.True(t, a.IP.Equal(aGot.IP))
+	assert.Equal(t, a.Port, aGot.Port)
+
+	t.Run("IPv6", func(t *testing.T) {
+		a6 := PeerAddress{IP: net.ParseIP("2001:db8::1"), Port: 4444}
+		m6 := new(stun.Message)
+		m6.TransactionID = stun.NewTransactionID()
+		m6.WriteHeader()
+		assert.NoError(t, a6.AddTo(m6))
+
+		// the capacity of IP is reused
+		ip := make(net.IP, 0, net.IPv6len)
+		got := PeerAddress{IP: ip}
+		assert.NoError(t, got.GetFrom(m6))
+		assert.Equal(t, a6.IP, got.IP)
+		assert.Equal(t, a6.Port, got.Port)
+		assert.Equal(t, &ip[:1][0], &got.IP[0])
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		m := new(stun.Message)
+		m.WriteHeader()
+		m.Add(stun.AttrXORPeerAddress, []byte{0, 3, 0, 0, 1, 2, 3, 4})
+
+		var got PeerAddress
+		assert.Error(t, got.GetFrom(m))
+		assert.ErrorIs(t, (&PeerAddress{}).GetFrom(new(stun.Message)), stun.ErrAttributeNotFound)
+	})
 }
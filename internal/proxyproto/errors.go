@@ -0,0 +1,8 @@
+package proxyproto
+
+import "errors"
+
+var (
+	errNoHeader      = errors.New("proxyproto: no PROXY protocol header")
+	errInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
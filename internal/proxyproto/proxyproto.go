@@ -0,0 +1,165 @@
+// Package proxyproto reads HAProxy PROXY protocol headers, which layer 4 load balancers
+// put in front of the connections and datagrams they forward to pass on the address of
+// the client, https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	v2HeaderLength = 16
+	v2Version      = 0x2
+	v2CommandLocal = 0x0
+	v2CommandProxy = 0x1
+	v2FamilyInet   = 0x1
+	v2FamilyInet6  = 0x2
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n") //nolint:gochecknoglobals
+
+// Header is a PROXY protocol header
+type Header struct {
+	// Local is set for headers without a client, like the ones of health checks of the
+	// balancer. The addresses of the connection or datagram apply to them.
+	Local bool
+
+	SourceIP        net.IP
+	SourcePort      int
+	DestinationIP   net.IP
+	DestinationPort int
+}
+
+// Read reads a version 1 or 2 header from r, the data following it stays in r
+func Read(r *bufio.Reader) (*Header, error) {
+	prefix, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(prefix, v2Signature):
+		header := make([]byte, v2HeaderLength)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		return parseV2(header, body)
+	case bytes.HasPrefix(prefix, []byte(v1Prefix)):
+		line := make([]byte, 0, v1MaxLength)
+		for len(line) < v1MaxLength {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if line = append(line, b); bytes.HasSuffix(line, []byte("\r\n")) {
+				return parseV1(string(line[:len(line)-2]))
+			}
+		}
+		return nil, errInvalidHeader
+	default:
+		return nil, errNoHeader
+	}
+}
+
+// Parse parses the version 2 header at the start of a datagram, it returns the header
+// and its length
+func Parse(b []byte) (*Header, int, error) {
+	if !bytes.HasPrefix(b, v2Signature) || len(b) < v2HeaderLength {
+		return nil, 0, errNoHeader
+	}
+
+	n := v2HeaderLength + int(binary.BigEndian.Uint16(b[14:]))
+	if len(b) < n {
+		return nil, 0, errInvalidHeader
+	}
+	header, err := parseV2(b[:v2HeaderLength], b[v2HeaderLength:n])
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, n, nil
+}
+
+// parseV1 parses a line like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 3478"
+func parseV1(line string) (*Header, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Local: true}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidHeader
+	}
+
+	h := &Header{
+		SourceIP:      net.ParseIP(fields[2]),
+		DestinationIP: net.ParseIP(fields[3]),
+	}
+	if h.SourceIP == nil || h.DestinationIP == nil || (h.SourceIP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errInvalidHeader
+	}
+
+	var err error
+	if h.SourcePort, err = parsePort(fields[4]); err != nil {
+		return nil, err
+	}
+	if h.DestinationPort, err = parsePort(fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, errInvalidHeader
+	}
+	return int(port), nil
+}
+
+// parseV2 parses the fixed part and the addresses of a header, TLVs are ignored. The
+// addresses are copied, so body can be reused.
+func parseV2(header, body []byte) (*Header, error) {
+	if header[12]>>4 != v2Version {
+		return nil, errInvalidHeader
+	}
+	switch header[12] & 0x0f {
+	case v2CommandLocal:
+		return &Header{Local: true}, nil
+	case v2CommandProxy:
+	default:
+		return nil, errInvalidHeader
+	}
+
+	var ipLength int
+	switch header[13] >> 4 {
+	case v2FamilyInet:
+		ipLength = net.IPv4len
+	case v2FamilyInet6:
+		ipLength = net.IPv6len
+	default:
+		// unspecified and unix addresses are no clients of the server
+		return &Header{Local: true}, nil
+	}
+	if len(body) < 2*ipLength+4 {
+		return nil, errInvalidHeader
+	}
+
+	return &Header{
+		SourceIP:        append(net.IP(nil), body[:ipLength]...),
+		DestinationIP:   append(net.IP(nil), body[ipLength:2*ipLength]...),
+		SourcePort:      int(binary.BigEndian.Uint16(body[2*ipLength:])),
+		DestinationPort: int(binary.BigEndian.Uint16(body[2*ipLength+2:])),
+	}, nil
+}
@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// v2 builds a version 2 header with the command and family of verCmd and fam
+func v2(verCmd, fam byte, addresses []byte) []byte {
+	b := append(append([]byte(nil), v2Signature...), verCmd, fam, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(b, addresses...)
+}
+
+func TestRead(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x0d, 0x96}
+	inet6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x0d, 0x96)
+
+	for name, test := range map[string]struct {
+		header []byte
+		want   *Header
+		err    error
+	}{
+		"v1 TCP4": {
+			header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 3478\r\n"),
+			want:   &Header{SourceIP: net.ParseIP("192.0.2.1"), SourcePort: 56324, DestinationIP: net.ParseIP("192.0.2.2"), DestinationPort: 3478},
+		},
+		"v1 TCP6": {
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 3478\r\n"),
+			want:   &Header{SourceIP: net.ParseIP("2001:db8::1"), SourcePort: 56324, DestinationIP: net.ParseIP("2001:db8::2"), DestinationPort: 3478},
+		},
+		"v1 UNKNOWN": {
+			header: []byte("PROXY UNKNOWN\r\n"),
+			want:   &Header{Local: true},
+		},
+		"v1 family mismatch": {
+			header: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 3478\r\n"),
+			err:    errInvalidHeader,
+		},
+		"v1 invalid port": {
+			header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 3478\r\n"),
+			err:    errInvalidHeader,
+		},
+		"v1 too long": {
+			header: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte{'1'}, 120)...),
+			err:    errInvalidHeader,
+		},
+		"v2 INET": {
+			header: v2(0x21, 0x11, inet),
+			want:   &Header{SourceIP: net.IP{192, 0, 2, 1}, SourcePort: 56324, DestinationIP: net.IP{192, 0, 2, 2}, DestinationPort: 3478},
+		},
+		"v2 INET6 with TLV": {
+			header: v2(0x21, 0x21, append(inet6, 0x04, 0x00, 0x01, 0xff)),
+			want:   &Header{SourceIP: net.ParseIP("2001:db8::1"), SourcePort: 56324, DestinationIP: net.ParseIP("2001:db8::2"), DestinationPort: 3478},
+		},
+		"v2 LOCAL": {
+			header: v2(0x20, 0x00, nil),
+			want:   &Header{Local: true},
+		},
+		"v2 short addresses": {
+			header: v2(0x21, 0x11, inet[:8]),
+			err:    errInvalidHeader,
+		},
+		"v2 invalid version": {
+			header: v2(0x11, 0x11, inet),
+			err:    errInvalidHeader,
+		},
+		"no header": {
+			header: []byte("GET / HTTP/1.1\r\n"),
+			err:    errNoHeader,
+		},
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(test.header, "payload"...)))
+			header, err := Read(r)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, header)
+
+			// the data after the header is left to the caller
+			rest := make([]byte, 16)
+			n, err := r.Read(rest)
+			assert.NoError(t, err)
+			assert.Equal(t, "payload", string(rest[:n]))
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	datagram := append(v2(0x21, 0x12, []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x0d, 0x96}), "payload"...)
+
+	header, n, err := Parse(datagram)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(datagram[n:]))
+	assert.Equal(t, &Header{SourceIP: net.IP{192, 0, 2, 1}, SourcePort: 56324, DestinationIP: net.IP{192, 0, 2, 2}, DestinationPort: 3478}, header)
+
+	// the addresses do not refer to the datagram
+	datagram[len(v2Signature)+4] = 0
+	assert.Equal(t, net.IP{192, 0, 2, 1}, header.SourceIP)
+
+	_, _, err = Parse(datagram[:20])
+	assert.ErrorIs(t, err, errInvalidHeader)
+	_, _, err = Parse([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 3478\r\n"))
+	assert.ErrorIs(t, err, errNoHeader)
+}
@@ -7,6 +7,7 @@ var (
 	errFailedToSendError                      = errors.New("failed to send error message")
 	errDuplicatedNonce                        = errors.New("duplicated Nonce generated, discarding request")
 	errNoSuchUser                             = errors.New("no such user exists")
+	errUnknownRealm                           = errors.New("no tenant serves the realm")
 	errUnexpectedClass                        = errors.New("unexpected class")
 	errUnexpectedMethod                       = errors.New("unexpected method")
 	errFailedToHandle                         = errors.New("failed to handle")
@@ -17,10 +18,16 @@ var (
 	errRelayAlreadyAllocatedForFiveTuple      = errors.New("relay already allocated for 5-TUPLE")
 	errRequestedTransportMustBeUDP            = errors.New("RequestedTransport must be UDP")
 	errNoDontFragmentSupport                  = errors.New("no support for DONT-FRAGMENT")
+	errAddressFamilyNotSupported              = errors.New("relays of the requested address family are not supported")
 	errRequestWithReservationTokenAndEvenPort = errors.New("Request must not contain RESERVATION-TOKEN and EVEN-PORT")
 	errNoAllocationFound                      = errors.New("no allocation found")
 	errNoPermission                           = errors.New("unable to handle send-indication, no permission added")
 	errShortWrite                             = errors.New("packet write smaller than packet")
 	errNoSuchChannelBind                      = errors.New("no such channel bind")
 	errFailedWriteSocket                      = errors.New("failed writing to socket")
+	errServerDraining                         = errors.New("server is draining, no new allocations accepted")
+	errPeerIsolated                           = errors.New("peer is not the relayed address of a permitted allocation")
+	errPermissionDenied                       = errors.New("permission request denied by the tenant")
+	errAllocationQuotaReached                 = errors.New("allocation quota reached")
+	errWrongRealm                             = errors.New("allocation belongs to another realm")
 )
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/proto"
+)
+
+const defaultMaxLifetime = time.Hour // https://tools.ietf.org/html/rfc5766#section-6.2 defines 3600 seconds recommendation
+
+// DefaultNonceLifetime is the lifetime of nonces if Request.NonceLifetime is 0
+const DefaultNonceLifetime = time.Hour // https://tools.ietf.org/html/rfc5766#section-4
+
+// LifetimePolicy bounds the lifetime of allocations. Zero values take the
+// defaults of WithDefaults.
+type LifetimePolicy struct {
+	// Default is the lifetime of allocations that do not request one
+	Default time.Duration
+	// Min is the shortest lifetime granted, shorter requests get Min
+	Min time.Duration
+	// Max is the longest lifetime granted, longer requests get Max
+	Max time.Duration
+}
+
+// WithDefaults fills the zero values of p, Default is 10 minutes, Max is an hour and
+// Min is Default, which grants lifetimes like RFC 8656 Section 7.2
+func (p LifetimePolicy) WithDefaults() LifetimePolicy {
+	if p.Default == 0 {
+		p.Default = proto.DefaultLifetime
+	}
+	if p.Max == 0 {
+		p.Max = defaultMaxLifetime
+	}
+	if p.Min == 0 {
+		p.Min = p.Default
+	}
+	return p
+}
+
+// Override returns p with the non-zero values of o
+func (p LifetimePolicy) Override(o LifetimePolicy) LifetimePolicy {
+	if o.Default != 0 {
+		p.Default = o.Default
+	}
+	if o.Min != 0 {
+		p.Min = o.Min
+	}
+	if o.Max != 0 {
+		p.Max = o.Max
+	}
+	return p
+}
+
+// Lifetime clamps requested to [Min, Max], Max wins if the bounds overlap
+func (p LifetimePolicy) Lifetime(requested time.Duration) time.Duration {
+	if requested < p.Min {
+		requested = p.Min
+	}
+	if requested > p.Max {
+		requested = p.Max
+	}
+	return requested
+}
+
+// allocationLifetime returns the lifetime granted to username for the LIFETIME
+// attribute of m, or the Default lifetime if m has none
+func allocationLifetime(r Request, m *stun.Message, username string) time.Duration {
+	policy := r.LifetimePolicy
+	if r.LifetimePolicyHandler != nil {
+		policy = policy.Override(r.LifetimePolicyHandler(username, r.Realm, r.SrcAddr))
+	}
+	policy = policy.WithDefaults()
+
+	var lifetime proto.Lifetime
+	if err := lifetime.GetFrom(m); err != nil {
+		return policy.Lifetime(policy.Default)
+	}
+	return policy.Lifetime(lifetime.Duration)
+}
+
+// deletesAllocation reports whether m is a Refresh with a LIFETIME of zero
+func deletesAllocation(m *stun.Message) bool {
+	var lifetime proto.Lifetime
+	return lifetime.GetFrom(m) == nil && lifetime.Duration == 0
+}
+
+func nonceLifetime(r Request) time.Duration {
+	if r.NonceLifetime == 0 {
+		return DefaultNonceLifetime
+	}
+	return r.NonceLifetime
+}
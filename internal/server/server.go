@@ -10,6 +10,7 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/proto"
 )
 
@@ -20,20 +21,68 @@ type Request struct {
 	SrcAddr net.Addr
 	Buff    []byte
 
+	// ServerName is the TLS server name (SNI) of the connection of the request
+	ServerName string
+
 	// Server State
 	AllocationManager *allocation.Manager
 	Nonces            *sync.Map
+	Clock             clock.Clock
 
 	// User Configuration
 	AuthHandler        func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool)
+	AuthRequestHandler func(r AuthRequest) (key []byte, ok bool) // used instead of AuthHandler if set
 	Log                logging.LeveledLogger
+	LogPackets         bool // logs every packet at debug level, which allocates
 	Realm              string
 	ChannelBindTimeout time.Duration
+	NonceLifetime      time.Duration
+
+	// LifetimePolicy bounds the lifetimes of allocations, LifetimePolicyHandler
+	// overrides it per user if set. Zero values take their defaults after the override,
+	// so a Min of Default follows the Default of the user.
+	LifetimePolicy        LifetimePolicy
+	LifetimePolicyHandler func(username, realm string, srcAddr net.Addr) LifetimePolicy
+
+	// PermissionHandler filters the peers of CreatePermission and ChannelBind requests
+	// in addition to the PermissionHandler of the AllocationManager if set
+	PermissionHandler func(clientAddr net.Addr, peerIP net.IP) bool
+
+	// AllocationQuotaReached rejects Allocate requests of a user with a 486
+	// (Allocation Quota Reached) error if it returns true
+	AllocationQuotaReached func(username string) bool
+
+	// TenantByRealm returns the Tenant of a realm or nil, it selects the settings of
+	// requests carrying a REALM if set, see UseTenant
+	TenantByRealm func(realm string) *Tenant
+
+	// Draining rejects new allocations with a 300 (Try Alternate) error carrying
+	// AlternateServer if it is set, or with a 508 (Insufficient Capacity) error otherwise
+	Draining        bool
+	AlternateServer *stun.AlternateServer
+
+	// OnAuthFailure is called when a request carries credentials that
+	// are rejected by the AuthHandler or fail the MESSAGE-INTEGRITY check
+	OnAuthFailure func(fiveTuple *allocation.FiveTuple, username, realm string, method stun.Method, err error)
+
+	// OnResponse is called for every response sent, code is zero for success responses
+	OnResponse func(msgType stun.MessageType, code stun.ErrorCode)
+}
+
+// messagePool holds the messages STUN packets are decoded into, the handlers
+// do not keep the message or its attributes once they returned
+var messagePool = sync.Pool{ //nolint:gochecknoglobals
+	New: func() interface{} {
+		return &stun.Message{Raw: make([]byte, 0, 1600)}
+	},
 }
 
-// HandleRequest processes the give Request
+// HandleRequest processes the give Request. ChannelData and Send indications are
+// relayed without allocating unless LogPackets is set.
 func HandleRequest(r Request) error {
-	r.Log.Debugf("received %d bytes of udp from %s on %s", len(r.Buff), r.SrcAddr.String(), r.Conn.LocalAddr().String())
+	if r.LogPackets {
+		r.Log.Debugf("received %d bytes of udp from %s on %s", len(r.Buff), r.SrcAddr.String(), r.Conn.LocalAddr().String())
+	}
 
 	if proto.IsChannelData(r.Buff) {
 		return handleDataPacket(r)
@@ -43,7 +92,9 @@ func HandleRequest(r Request) error {
 }
 
 func handleDataPacket(r Request) error {
-	r.Log.Debugf("received DataPacket from %s", r.SrcAddr.String())
+	if r.LogPackets {
+		r.Log.Debugf("received DataPacket from %s", r.SrcAddr.String())
+	}
 	c := proto.ChannelData{Raw: r.Buff}
 	if err := c.Decode(); err != nil {
 		return fmt.Errorf("%w: %v", errFailedToCreateChannelData, err)
@@ -59,11 +110,16 @@ func handleDataPacket(r Request) error {
 
 func handleTURNPacket(r Request) error {
 	r.Log.Debug("handleTURNPacket")
-	m := &stun.Message{Raw: append([]byte{}, r.Buff...)}
+	m, _ := messagePool.Get().(*stun.Message)
+	defer messagePool.Put(m)
+
+	m.Raw = append(m.Raw[:0], r.Buff...)
 	if err := m.Decode(); err != nil {
 		return fmt.Errorf("%w: %v", errFailedToCreateSTUNPacket, err)
 	}
 
+	selectTenant(&r, m)
+
 	h, err := getMessageHandler(m.Type.Class, m.Type.Method)
 	if err != nil {
 		return fmt.Errorf("%w %v-%v from %v: %v", errUnhandledSTUNPacket, m.Type.Method, m.Type.Class, r.SrcAddr, err)
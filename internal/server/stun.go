@@ -18,5 +18,5 @@ func handleBindingRequest(r Request, m *stun.Message) error {
 		Port: port,
 	}, stun.Fingerprint)
 
-	return buildAndSend(r.Conn, r.SrcAddr, attrs...)
+	return buildAndSend(r, attrs...)
 }
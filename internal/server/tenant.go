@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net"
+
+	"github.com/pion/stun"
+)
+
+// Tenant is a realm with its own credentials and policies, requests are handled
+// with the settings of the Tenant of their REALM if Request.TenantByRealm knows it
+type Tenant struct {
+	Realm                 string
+	AuthHandler           func(username string, realm string, srcAddr net.Addr) (key []byte, ok bool)
+	AuthRequestHandler    func(r AuthRequest) (key []byte, ok bool)
+	PermissionHandler     func(clientAddr net.Addr, peerIP net.IP) bool
+	LifetimePolicy        LifetimePolicy
+	LifetimePolicyHandler func(username, realm string, srcAddr net.Addr) LifetimePolicy
+
+	// AllocationQuotaReached rejects Allocate requests of a user with a 486
+	// (Allocation Quota Reached) error if it returns true
+	AllocationQuotaReached func(username string) bool
+}
+
+// UseTenant replaces the settings of r by the ones of t
+func (r *Request) UseTenant(t *Tenant) {
+	r.Realm = t.Realm
+	r.AuthHandler = t.AuthHandler
+	r.AuthRequestHandler = t.AuthRequestHandler
+	r.PermissionHandler = t.PermissionHandler
+	r.LifetimePolicy = t.LifetimePolicy
+	r.LifetimePolicyHandler = t.LifetimePolicyHandler
+	r.AllocationQuotaReached = t.AllocationQuotaReached
+}
+
+// selectTenant switches r to the Tenant of the REALM of m, requests without a REALM
+// or of a realm TenantByRealm does not know keep their settings
+func selectTenant(r *Request, m *stun.Message) {
+	if r.TenantByRealm == nil {
+		return
+	}
+
+	var realm stun.Realm
+	if err := realm.GetFrom(m); err != nil {
+		return
+	}
+	if t := r.TenantByRealm(realm.String()); t != nil {
+		r.UseTenant(t)
+	}
+}
+
+// grantPermission asks the listener and the tenant whether the client may reach peerIP
+func grantPermission(r Request, peerIP net.IP) error {
+	if err := r.AllocationManager.GrantPermission(r.SrcAddr, peerIP); err != nil {
+		return err
+	}
+	if r.PermissionHandler != nil && !r.PermissionHandler(r.SrcAddr, peerIP) {
+		return errPermissionDenied
+	}
+	return nil
+}
+
+// wrongCredentials rejects a request on an allocation of another realm with a 441
+// (Wrong Credentials) error, RFC 5766 Section 7.2. The credentials of one tenant
+// must not manage the allocations of another.
+func wrongCredentials(r Request, m *stun.Message, method stun.Method) error {
+	msg := buildMsg(m.TransactionID, stun.NewType(method, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeWrongCredentials})
+	return buildAndSendErr(r, errWrongRealm, msg...)
+}
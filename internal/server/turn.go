@@ -1,8 +1,10 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/pion/stun"
 	"github.com/pion/turn/v2/internal/allocation"
@@ -42,11 +44,11 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 		id, attrs := alloc.GetResponseCache()
 		if id != m.TransactionID {
 			msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocMismatch})
-			return buildAndSendErr(r.Conn, r.SrcAddr, errRelayAlreadyAllocatedForFiveTuple, msg...)
+			return buildAndSendErr(r, errRelayAlreadyAllocatedForFiveTuple, msg...)
 		}
 		// a retry allocation
 		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse), append(attrs, messageIntegrity)...)
-		return buildAndSend(r.Conn, r.SrcAddr, msg...)
+		return buildAndSend(r, msg...)
 	}
 
 	// 3. The server checks if the request contains a REQUESTED-TRANSPORT
@@ -57,10 +59,40 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	//    request with a 442 (Unsupported Transport Protocol) error.
 	var requestedTransport proto.RequestedTransport
 	if err = requestedTransport.GetFrom(m); err != nil {
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return buildAndSendErr(r, err, badRequestMsg...)
 	} else if requestedTransport.Protocol != proto.ProtoUDP {
 		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeUnsupportedTransProto})
-		return buildAndSendErr(r.Conn, r.SrcAddr, errRequestedTransportMustBeUDP, msg...)
+		return buildAndSendErr(r, errRequestedTransportMustBeUDP, msg...)
+	}
+
+	var username stun.Username
+	if err = username.GetFrom(m); err != nil {
+		return buildAndSendErr(r, err, badRequestMsg...)
+	}
+
+	relayRequest := allocation.RelayRequest{
+		FiveTuple: fiveTuple,
+		Network:   "udp4",
+		Username:  username.String(),
+		Realm:     r.Realm,
+	}
+
+	// The REQUESTED-ADDRESS-FAMILY attribute of RFC 8656 Section 7.2 asks for an
+	// IPv6 relayed address, unknown families and families the relays of the
+	// listener cannot be allocated in are rejected with a 440 (Address Family
+	// not Supported) error.
+	addrFamilyNotSupportedMsg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAddrFamilyNotSupported})
+	if m.Contains(stun.AttrRequestedAddressFamily) {
+		var family proto.RequestedAddressFamily
+		if err = family.GetFrom(m); err != nil {
+			return buildAndSendErr(r, err, addrFamilyNotSupportedMsg...)
+		}
+		if family == proto.RequestedFamilyIPv6 {
+			relayRequest.Network = "udp6"
+		}
+	}
+	if !r.AllocationManager.NetworkSupported(relayRequest.Network) {
+		return buildAndSendErr(r, fmt.Errorf("%w: %s", errAddressFamilyNotSupported, relayRequest.Network), addrFamilyNotSupportedMsg...)
 	}
 
 	// 4. The request may contain a DONT-FRAGMENT attribute.  If it does,
@@ -69,8 +101,11 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	//    FRAGMENT attribute in the Allocate request as an unknown
 	//    comprehension-required attribute.
 	if m.Contains(stun.AttrDontFragment) {
-		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeUnknownAttribute}, &stun.UnknownAttributes{stun.AttrDontFragment})
-		return buildAndSendErr(r.Conn, r.SrcAddr, errNoDontFragmentSupport, msg...)
+		if !r.AllocationManager.DontFragmentSupported() {
+			msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeUnknownAttribute}, &stun.UnknownAttributes{stun.AttrDontFragment})
+			return buildAndSendErr(r, errNoDontFragmentSupport, msg...)
+		}
+		relayRequest.DontFragment = true
 	}
 
 	// 5.  The server checks if the request contains a RESERVATION-TOKEN
@@ -85,7 +120,7 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	if err = reservationTokenAttr.GetFrom(m); err == nil {
 		var evenPort proto.EvenPort
 		if err = evenPort.GetFrom(m); err == nil {
-			return buildAndSendErr(r.Conn, r.SrcAddr, errRequestWithReservationTokenAndEvenPort, badRequestMsg...)
+			return buildAndSendErr(r, errRequestWithReservationTokenAndEvenPort, badRequestMsg...)
 		}
 	}
 
@@ -97,10 +132,12 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	//    error.
 	var evenPort proto.EvenPort
 	if err = evenPort.GetFrom(m); err == nil {
+		relayRequest.EvenPort, relayRequest.ReservePort = true, evenPort.ReservePort
+
 		var randomPort int
-		randomPort, err = r.AllocationManager.GetRandomEvenPort()
+		randomPort, err = r.AllocationManager.GetRandomEvenPort(relayRequest)
 		if err != nil {
-			return buildAndSendErr(r.Conn, r.SrcAddr, err, insufficientCapacityMsg...)
+			return buildAndSendErr(r, err, insufficientCapacityMsg...)
 		}
 		requestedPort = randomPort
 		reservationToken = randSeq(8)
@@ -113,18 +150,28 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 	//    but SHOULD define it based on the username used to authenticate
 	//    the request, and not on the client's transport address.
 
+	if r.AllocationQuotaReached != nil && r.AllocationQuotaReached(username.String()) {
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeAllocQuotaReached})
+		return buildAndSendErr(r, errAllocationQuotaReached, msg...)
+	}
+
 	// 8. Also at any point, the server MAY choose to reject the request
 	//    with a 300 (Try Alternate) error if it wishes to redirect the
 	//    client to a different server.  The use of this error code and
 	//    attribute follow the specification in [RFC5389].
-	lifetimeDuration := allocationLifeTime(m)
-	a, err := r.AllocationManager.CreateAllocation(
-		fiveTuple,
-		r.Conn,
-		requestedPort,
-		lifetimeDuration)
+	if r.Draining {
+		if r.AlternateServer == nil {
+			return buildAndSendErr(r, errServerDraining, insufficientCapacityMsg...)
+		}
+		msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeTryAlternate}, r.AlternateServer)
+		return buildAndSendErr(r, errServerDraining, msg...)
+	}
+
+	lifetimeDuration := allocationLifetime(r, m, username.String())
+	relayRequest.RequestedPort = requestedPort
+	a, err := r.AllocationManager.CreateAllocationForRequest(r.Conn, lifetimeDuration, relayRequest)
 	if err != nil {
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, insufficientCapacityMsg...)
+		return buildAndSendErr(r, err, insufficientCapacityMsg...)
 	}
 
 	// Once the allocation is created, the server replies with a success
@@ -140,12 +187,12 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 
 	srcIP, srcPort, err := ipnet.AddrIPPort(r.SrcAddr)
 	if err != nil {
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return buildAndSendErr(r, err, badRequestMsg...)
 	}
 
 	relayIP, relayPort, err := ipnet.AddrIPPort(a.RelayAddr)
 	if err != nil {
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return buildAndSendErr(r, err, badRequestMsg...)
 	}
 
 	responseAttrs := []stun.Setter{
@@ -169,7 +216,7 @@ func handleAllocateRequest(r Request, m *stun.Message) error {
 
 	msg := buildMsg(m.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse), append(responseAttrs, messageIntegrity)...)
 	a.SetResponseCache(m.TransactionID, responseAttrs)
-	return buildAndSend(r.Conn, r.SrcAddr, msg...)
+	return buildAndSend(r, msg...)
 }
 
 func handleRefreshRequest(r Request, m *stun.Message) error {
@@ -180,25 +227,32 @@ func handleRefreshRequest(r Request, m *stun.Message) error {
 		return err
 	}
 
-	lifetimeDuration := allocationLifeTime(m)
 	fiveTuple := &allocation.FiveTuple{
 		SrcAddr:  r.SrcAddr,
 		DstAddr:  r.Conn.LocalAddr(),
 		Protocol: allocation.UDP,
 	}
 
-	if lifetimeDuration != 0 {
-		a := r.AllocationManager.GetAllocation(fiveTuple)
+	a := r.AllocationManager.GetAllocation(fiveTuple)
+	if a != nil && a.Realm() != r.Realm {
+		return wrongCredentials(r, m, stun.MethodRefresh)
+	}
 
+	var lifetimeDuration time.Duration
+	if !deletesAllocation(m) {
 		if a == nil {
 			return fmt.Errorf("%w %v:%v", errNoAllocationFound, r.SrcAddr, r.Conn.LocalAddr())
 		}
-		a.Refresh(lifetimeDuration)
+
+		lifetimeDuration = allocationLifetime(r, m, a.Username())
+		if !a.Refresh(lifetimeDuration) {
+			return fmt.Errorf("%w %v:%v", errNoAllocationFound, r.SrcAddr, r.Conn.LocalAddr())
+		}
 	} else {
-		r.AllocationManager.DeleteAllocation(fiveTuple)
+		r.AllocationManager.DeleteAllocation(fiveTuple, allocation.DeleteReasonClientDeleted)
 	}
 
-	return buildAndSend(r.Conn, r.SrcAddr, buildMsg(m.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), []stun.Setter{
+	return buildAndSend(r, buildMsg(m.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), []stun.Setter{
 		&proto.Lifetime{
 			Duration: lifetimeDuration,
 		},
@@ -222,6 +276,9 @@ func handleCreatePermissionRequest(r Request, m *stun.Message) error {
 	if !hasAuth {
 		return err
 	}
+	if a.Realm() != r.Realm {
+		return wrongCredentials(r, m, stun.MethodCreatePermission)
+	}
 
 	addCount := 0
 
@@ -231,7 +288,12 @@ func handleCreatePermissionRequest(r Request, m *stun.Message) error {
 			return err
 		}
 
-		if err := r.AllocationManager.GrantPermission(r.SrcAddr, peerAddress.IP); err != nil {
+		if !r.AllocationManager.PeerPermitted(a, &net.UDPAddr{IP: peerAddress.IP, Port: peerAddress.Port}) {
+			r.Log.Infof("peer %s of client %s is isolated", peerAddress.String(), r.SrcAddr.String())
+			return errPeerIsolated
+		}
+
+		if err := grantPermission(r, peerAddress.IP); err != nil {
 			r.Log.Infof("permission denied for client %s to peer %s", r.SrcAddr.String(),
 				peerAddress.IP.String())
 			return err
@@ -251,6 +313,11 @@ func handleCreatePermissionRequest(r Request, m *stun.Message) error {
 		return nil
 	}); err != nil {
 		addCount = 0
+		if errors.Is(err, errPeerIsolated) {
+			return buildAndSendErr(r, err, buildMsg(m.TransactionID,
+				stun.NewType(stun.MethodCreatePermission, stun.ClassErrorResponse),
+				&stun.ErrorCodeAttribute{Code: stun.CodeForbidden}, messageIntegrity)...)
+		}
 	}
 
 	respClass := stun.ClassSuccessResponse
@@ -258,11 +325,10 @@ func handleCreatePermissionRequest(r Request, m *stun.Message) error {
 		respClass = stun.ClassErrorResponse
 	}
 
-	return buildAndSend(r.Conn, r.SrcAddr, buildMsg(m.TransactionID, stun.NewType(stun.MethodCreatePermission, respClass), []stun.Setter{messageIntegrity}...)...)
+	return buildAndSend(r, buildMsg(m.TransactionID, stun.NewType(stun.MethodCreatePermission, respClass), []stun.Setter{messageIntegrity}...)...)
 }
 
 func handleSendIndication(r Request, m *stun.Message) error {
-	r.Log.Debugf("received SendIndication from %s", r.SrcAddr.String())
 	a := r.AllocationManager.GetAllocation(&allocation.FiveTuple{
 		SrcAddr:  r.SrcAddr,
 		DstAddr:  r.Conn.LocalAddr(),
@@ -277,17 +343,19 @@ func handleSendIndication(r Request, m *stun.Message) error {
 		return err
 	}
 
-	peerAddress := proto.PeerAddress{}
+	var ip [net.IPv6len]byte
+	peerAddress := proto.PeerAddress{IP: ip[:0]}
 	if err := peerAddress.GetFrom(m); err != nil {
 		return err
 	}
 
-	msgDst := &net.UDPAddr{IP: peerAddress.IP, Port: peerAddress.Port}
-	if perm := a.GetPermission(msgDst); perm == nil {
-		return fmt.Errorf("%w: %v", errNoPermission, msgDst)
+	perm := a.GetPermission(&net.UDPAddr{IP: peerAddress.IP})
+	if perm == nil {
+		a.CountDropped(len(dataAttr))
+		return fmt.Errorf("%w: %s", errNoPermission, peerAddress.String())
 	}
 
-	l, err := a.RelaySocket.WriteTo(dataAttr, msgDst)
+	l, err := a.WriteToPeer(dataAttr, perm.PeerAddr(peerAddress.IP, peerAddress.Port), perm, nil)
 	if l != len(dataAttr) {
 		return fmt.Errorf("%w %d != %d (expected) err: %v", errShortWrite, l, len(dataAttr), err)
 	}
@@ -312,25 +380,37 @@ func handleChannelBindRequest(r Request, m *stun.Message) error {
 	if !hasAuth {
 		return err
 	}
+	if a.Realm() != r.Realm {
+		return wrongCredentials(r, m, stun.MethodChannelBind)
+	}
 
 	var channel proto.ChannelNumber
 	if err = channel.GetFrom(m); err != nil {
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return buildAndSendErr(r, err, badRequestMsg...)
 	}
 
 	peerAddr := proto.PeerAddress{}
 	if err = peerAddr.GetFrom(m); err != nil {
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return buildAndSendErr(r, err, badRequestMsg...)
 	}
 
-	if err = r.AllocationManager.GrantPermission(r.SrcAddr, peerAddr.IP); err != nil {
+	if !r.AllocationManager.PeerPermitted(a, &net.UDPAddr{IP: peerAddr.IP, Port: peerAddr.Port}) {
+		r.Log.Infof("peer %s of client %s is isolated", peerAddr.String(), r.SrcAddr.String())
+
+		forbiddenMsg := buildMsg(m.TransactionID,
+			stun.NewType(stun.MethodChannelBind, stun.ClassErrorResponse),
+			&stun.ErrorCodeAttribute{Code: stun.CodeForbidden}, messageIntegrity)
+		return buildAndSendErr(r, errPeerIsolated, forbiddenMsg...)
+	}
+
+	if err = grantPermission(r, peerAddr.IP); err != nil {
 		r.Log.Infof("permission denied for client %s to peer %s", r.SrcAddr.String(),
 			peerAddr.IP.String())
 
 		unauthorizedRequestMsg := buildMsg(m.TransactionID,
 			stun.NewType(stun.MethodChannelBind, stun.ClassErrorResponse),
 			&stun.ErrorCodeAttribute{Code: stun.CodeUnauthorized})
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, unauthorizedRequestMsg...)
+		return buildAndSendErr(r, err, unauthorizedRequestMsg...)
 	}
 
 	r.Log.Debugf("binding channel %d to %s",
@@ -342,15 +422,13 @@ func handleChannelBindRequest(r Request, m *stun.Message) error {
 		r.Log,
 	), r.ChannelBindTimeout)
 	if err != nil {
-		return buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return buildAndSendErr(r, err, badRequestMsg...)
 	}
 
-	return buildAndSend(r.Conn, r.SrcAddr, buildMsg(m.TransactionID, stun.NewType(stun.MethodChannelBind, stun.ClassSuccessResponse), []stun.Setter{messageIntegrity}...)...)
+	return buildAndSend(r, buildMsg(m.TransactionID, stun.NewType(stun.MethodChannelBind, stun.ClassSuccessResponse), []stun.Setter{messageIntegrity}...)...)
 }
 
 func handleChannelData(r Request, c *proto.ChannelData) error {
-	r.Log.Debugf("received ChannelData from %s", r.SrcAddr.String())
-
 	a := r.AllocationManager.GetAllocation(&allocation.FiveTuple{
 		SrcAddr:  r.SrcAddr,
 		DstAddr:  r.Conn.LocalAddr(),
@@ -362,10 +440,11 @@ func handleChannelData(r Request, c *proto.ChannelData) error {
 
 	channel := a.GetChannelByNumber(c.Number)
 	if channel == nil {
+		a.CountDropped(len(c.Data))
 		return fmt.Errorf("%w %x", errNoSuchChannelBind, uint16(c.Number))
 	}
 
-	l, err := a.RelaySocket.WriteTo(c.Data, channel.Peer)
+	l, err := a.WriteToPeer(c.Data, channel.Peer, nil, channel)
 	if err != nil {
 		return fmt.Errorf("%w: %s", errFailedWriteSocket, err.Error())
 	} else if l != len(c.Data) {
@@ -12,6 +12,7 @@ import (
 	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/proto"
 	"github.com/stretchr/testify/assert"
 )
@@ -19,11 +20,11 @@ import (
 func TestAllocationLifeTime(t *testing.T) {
 	t.Run("Parsing", func(t *testing.T) {
 		lifetime := proto.Lifetime{
-			Duration: 5 * time.Second,
+			Duration: 20 * time.Minute,
 		}
 
 		m := &stun.Message{}
-		lifetimeDuration := allocationLifeTime(m)
+		lifetimeDuration := allocationLifetime(Request{}, m, "user")
 
 		if lifetimeDuration != proto.DefaultLifetime {
 			t.Errorf("Allocation lifetime should be default time duration")
@@ -31,25 +32,96 @@ func TestAllocationLifeTime(t *testing.T) {
 
 		assert.NoError(t, lifetime.AddTo(m))
 
-		lifetimeDuration = allocationLifeTime(m)
+		lifetimeDuration = allocationLifetime(Request{}, m, "user")
 		if lifetimeDuration != lifetime.Duration {
 			t.Errorf("Expect lifetimeDuration is %s, but %s", lifetime.Duration, lifetimeDuration)
 		}
 	})
 
-	// If lifetime is bigger than maximumLifetime
+	// Lifetimes below the default are raised to it, RFC 8656 Section 7.2
+	t.Run("Underflow", func(t *testing.T) {
+		m := &stun.Message{}
+		assert.NoError(t, proto.Lifetime{Duration: 5 * time.Second}.AddTo(m))
+
+		assert.Equal(t, proto.DefaultLifetime, allocationLifetime(Request{}, m, "user"))
+		assert.False(t, deletesAllocation(m))
+	})
+
+	// If lifetime is bigger than maximumLifetime it is clamped to it
 	t.Run("Overflow", func(t *testing.T) {
 		lifetime := proto.Lifetime{
-			Duration: maximumAllocationLifetime * 2,
+			Duration: defaultMaxLifetime * 2,
 		}
 
 		m2 := &stun.Message{}
 		_ = lifetime.AddTo(m2)
 
-		lifetimeDuration := allocationLifeTime(m2)
-		if lifetimeDuration != proto.DefaultLifetime {
-			t.Errorf("Expect lifetimeDuration is %s, but %s", proto.DefaultLifetime, lifetimeDuration)
+		lifetimeDuration := allocationLifetime(Request{}, m2, "user")
+		if lifetimeDuration != defaultMaxLifetime {
+			t.Errorf("Expect lifetimeDuration is %s, but %s", defaultMaxLifetime, lifetimeDuration)
+		}
+	})
+
+	// the Min of a handler that only overrides Default follows it
+	t.Run("HandlerDefault", func(t *testing.T) {
+		r := Request{
+			LifetimePolicy: LifetimePolicy{Max: 2 * time.Hour},
+			LifetimePolicyHandler: func(username, realm string, srcAddr net.Addr) LifetimePolicy {
+				return LifetimePolicy{Default: 2 * time.Minute}
+			},
 		}
+
+		m := &stun.Message{}
+		assert.Equal(t, 2*time.Minute, allocationLifetime(r, m, "trial"))
+
+		assert.NoError(t, proto.Lifetime{Duration: 2 * time.Minute}.AddTo(m))
+		assert.Equal(t, 2*time.Minute, allocationLifetime(r, m, "trial"))
+	})
+
+	t.Run("Policy", func(t *testing.T) {
+		r := Request{
+			LifetimePolicy: LifetimePolicy{Default: time.Minute, Min: 10 * time.Second, Max: 2 * time.Hour},
+		}
+
+		m := &stun.Message{}
+		assert.Equal(t, time.Minute, allocationLifetime(r, m, "user"))
+
+		for requested, granted := range map[time.Duration]time.Duration{
+			time.Second:           10 * time.Second,
+			30 * time.Second:      30 * time.Second,
+			90 * time.Minute:      90 * time.Minute,
+			3 * time.Hour:         2 * time.Hour,
+			10 * 24 * time.Hour:   2 * time.Hour,
+			defaultMaxLifetime:    defaultMaxLifetime,
+			proto.DefaultLifetime: proto.DefaultLifetime,
+		} {
+			m := &stun.Message{}
+			assert.NoError(t, proto.Lifetime{Duration: requested}.AddTo(m))
+			assert.Equal(t, granted, allocationLifetime(r, m, "user"), "requested %s", requested)
+		}
+	})
+
+	// the handler overrides the policy for some users, its zero values keep the server policy
+	t.Run("PolicyHandler", func(t *testing.T) {
+		r := Request{
+			Realm:          "realm",
+			LifetimePolicy: LifetimePolicy{Max: 2 * time.Hour},
+			LifetimePolicyHandler: func(username, realm string, srcAddr net.Addr) LifetimePolicy {
+				assert.Equal(t, "realm", realm)
+				if username == "trial" {
+					return LifetimePolicy{Max: 5 * time.Minute}
+				}
+				return LifetimePolicy{}
+			},
+		}
+
+		m := &stun.Message{}
+		assert.NoError(t, proto.Lifetime{Duration: 90 * time.Minute}.AddTo(m))
+		assert.Equal(t, 90*time.Minute, allocationLifetime(r, m, "user"))
+		assert.Equal(t, 5*time.Minute, allocationLifetime(r, m, "trial"))
+
+		// the default is clamped as well
+		assert.Equal(t, 5*time.Minute, allocationLifetime(r, &stun.Message{}, "trial"))
 	})
 
 	t.Run("DeletionZeroLifetime", func(t *testing.T) {
@@ -62,8 +134,8 @@ func TestAllocationLifeTime(t *testing.T) {
 		logger := logging.NewDefaultLoggerFactory().NewLogger("turn")
 
 		allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
-			AllocatePacketConn: func(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
-				conn, listenErr := net.ListenPacket(network, "0.0.0.0:0")
+			AllocatePacketConn: func(req allocation.RelayRequest) (net.PacketConn, net.Addr, error) {
+				conn, listenErr := net.ListenPacket(req.Network, "0.0.0.0:0")
 				if err != nil {
 					return nil, nil, listenErr
 				}
@@ -81,6 +153,7 @@ func TestAllocationLifeTime(t *testing.T) {
 		r := Request{
 			AllocationManager: allocationManager,
 			Nonces:            &sync.Map{},
+			Clock:             clock.System,
 			Conn:              l,
 			SrcAddr:           &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
 			Log:               logger,
@@ -92,7 +165,7 @@ func TestAllocationLifeTime(t *testing.T) {
 
 		fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
 
-		_, err = r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour)
+		_, err = r.AllocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, "")
 		assert.NoError(t, err)
 
 		assert.NotNil(t, r.AllocationManager.GetAllocation(fiveTuple))
@@ -108,3 +181,223 @@ func TestAllocationLifeTime(t *testing.T) {
 		assert.Nil(t, r.AllocationManager.GetAllocation(fiveTuple))
 	})
 }
+
+// the allocation manager learns what the client asked for
+func TestAllocateRelayRequest(t *testing.T) {
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, l.Close())
+	}()
+
+	logger := logging.NewDefaultLoggerFactory().NewLogger("turn")
+
+	var relayRequests []allocation.RelayRequest
+	ipv6Supported := true
+	allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
+		AllocatePacketConn: func(req allocation.RelayRequest) (net.PacketConn, net.Addr, error) {
+			relayRequests = append(relayRequests, req)
+			conn, listenErr := net.ListenPacket("udp4", "127.0.0.1:0")
+			if listenErr != nil {
+				return nil, nil, listenErr
+			}
+			return conn, conn.LocalAddr(), nil
+		},
+		AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+			return nil, nil, nil
+		},
+		NetworkSupported: func(network string) bool {
+			return network != "udp6" || ipv6Supported
+		},
+		DontFragment:  true,
+		LeveledLogger: logger,
+	})
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, allocationManager.Close())
+	}()
+
+	key := []byte("key")
+	r := Request{
+		AllocationManager: allocationManager,
+		Nonces:            &sync.Map{},
+		Clock:             clock.System,
+		Conn:              l,
+		SrcAddr:           &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
+		Log:               logger,
+		Realm:             "realm",
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return key, true
+		},
+	}
+	r.Nonces.Store("nonce", time.Now())
+
+	allocate := func(family stun.Setter) (*stun.Message, error) {
+		return stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			proto.RequestedTransport{Protocol: proto.ProtoUDP},
+			family,
+			proto.EvenPort{ReservePort: true},
+			proto.DontFragment{},
+			stun.Nonce("nonce"),
+			stun.NewRealm("realm"),
+			stun.NewUsername("alice"),
+			stun.MessageIntegrity(key),
+		)
+	}
+
+	m, err := allocate(proto.RequestedFamilyIPv6)
+	assert.NoError(t, err)
+	assert.NoError(t, handleAllocateRequest(r, m))
+
+	// the even port is probed with the request, then bound
+	assert.True(t, len(relayRequests) >= 2)
+	req := relayRequests[len(relayRequests)-1]
+	assert.Equal(t, "udp6", req.Network)
+	assert.Equal(t, "alice", req.Username)
+	assert.Equal(t, "realm", req.Realm)
+	assert.True(t, req.EvenPort)
+	assert.True(t, req.ReservePort)
+	assert.True(t, req.DontFragment)
+	assert.NotZero(t, req.RequestedPort)
+	assert.Equal(t, r.SrcAddr, req.FiveTuple.SrcAddr)
+	assert.Equal(t, 1, allocationManager.AllocationCount())
+
+	// unknown families are rejected with 440
+	r.SrcAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5001}
+	m, err = allocate(stun.RawAttribute{Type: stun.AttrRequestedAddressFamily, Value: []byte{0x03, 0, 0, 0}})
+	assert.NoError(t, err)
+	assert.Error(t, handleAllocateRequest(r, m))
+	assert.Equal(t, 1, allocationManager.AllocationCount())
+
+	// so are families the relays cannot be allocated in
+	ipv6Supported = false
+	m, err = allocate(proto.RequestedFamilyIPv6)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, handleAllocateRequest(r, m), errAddressFamilyNotSupported)
+	assert.Equal(t, 1, allocationManager.AllocationCount())
+}
+
+// newBenchmarkRequest returns a Request from a client with an allocation that has a
+// permission and a channel bound for peer
+func newBenchmarkRequest(b *testing.B, peer net.Addr) (Request, func()) {
+	logger := logging.NewDefaultLoggerFactory().NewLogger("turn")
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	allocationManager, err := allocation.NewManager(allocation.ManagerConfig{
+		AllocatePacketConn: func(req allocation.RelayRequest) (net.PacketConn, net.Addr, error) {
+			conn, listenErr := net.ListenPacket(req.Network, "127.0.0.1:0")
+			if listenErr != nil {
+				return nil, nil, listenErr
+			}
+			return conn, conn.LocalAddr(), nil
+		},
+		AllocateConn: func(network string, requestedPort int) (net.Conn, net.Addr, error) {
+			return nil, nil, nil
+		},
+		LeveledLogger: logger,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	r := Request{
+		AllocationManager: allocationManager,
+		Nonces:            &sync.Map{},
+		Clock:             clock.System,
+		Conn:              l,
+		SrcAddr:           &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
+		Log:               logger,
+	}
+
+	fiveTuple := &allocation.FiveTuple{SrcAddr: r.SrcAddr, DstAddr: r.Conn.LocalAddr(), Protocol: allocation.UDP}
+	a, err := allocationManager.CreateAllocation(fiveTuple, r.Conn, 0, time.Hour, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	a.AddPermission(allocation.NewPermission(peer, logger))
+	if err = a.AddChannelBind(allocation.NewChannelBind(proto.MinChannelNumber, peer, logger), time.Hour); err != nil {
+		b.Fatal(err)
+	}
+
+	return r, func() {
+		_ = allocationManager.Close()
+		_ = l.Close()
+	}
+}
+
+func BenchmarkHandleRequest(b *testing.B) {
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer peer.Close() //nolint:errcheck
+
+	r, closeRequest := newBenchmarkRequest(b, peer.LocalAddr())
+	defer closeRequest()
+
+	data := make([]byte, 160)
+
+	b.Run("ChannelData", func(b *testing.B) {
+		channelData := &proto.ChannelData{Data: data, Number: proto.MinChannelNumber}
+		channelData.Encode()
+		r.Buff = channelData.Raw
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := HandleRequest(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("SendIndication", func(b *testing.B) {
+		peerAddr, _ := peer.LocalAddr().(*net.UDPAddr)
+		msg, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodSend, stun.ClassIndication),
+			proto.PeerAddress{IP: peerAddr.IP, Port: peerAddr.Port}, proto.Data(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		r.Buff = msg.Raw
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := HandleRequest(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// failingConn fails every write
+type failingConn struct {
+	net.PacketConn
+}
+
+func (failingConn) WriteTo([]byte, net.Addr) (int, error) {
+	return 0, errFailedToSendError
+}
+
+func TestBuildAndSendOnResponse(t *testing.T) {
+	var responses int
+	r := Request{
+		Conn:       failingConn{},
+		SrcAddr:    &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000},
+		OnResponse: func(stun.MessageType, stun.ErrorCode) { responses++ },
+	}
+	msg := buildMsg([stun.TransactionIDSize]byte{}, stun.BindingSuccess)
+
+	// responses that could not be written are not counted
+	assert.Error(t, buildAndSend(r, msg...))
+	assert.Equal(t, 0, responses)
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	r.Conn = l
+	assert.NoError(t, buildAndSend(r, msg...))
+	assert.Equal(t, 1, responses)
+	assert.NoError(t, l.Close())
+}
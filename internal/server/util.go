@@ -11,12 +11,7 @@ import (
 	"time"
 
 	"github.com/pion/stun"
-	"github.com/pion/turn/v2/internal/proto"
-)
-
-const (
-	maximumAllocationLifetime = time.Hour // https://tools.ietf.org/html/rfc5766#section-6.2 defines 3600 seconds recommendation
-	nonceLifetime             = time.Hour // https://tools.ietf.org/html/rfc5766#section-4
+	"github.com/pion/turn/v2/internal/allocation"
 )
 
 func randSeq(n int) string {
@@ -40,22 +35,31 @@ func buildNonce() (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func buildAndSend(conn net.PacketConn, dst net.Addr, attrs ...stun.Setter) error {
+func buildAndSend(r Request, attrs ...stun.Setter) error {
 	msg, err := stun.Build(attrs...)
 	if err != nil {
 		return err
 	}
-	_, err = conn.WriteTo(msg.Raw, dst)
+	_, err = r.Conn.WriteTo(msg.Raw, r.SrcAddr)
 	if errors.Is(err, net.ErrClosed) {
 		return nil
 	}
 
+	// responses that never left are not counted
+	if err == nil && r.OnResponse != nil {
+		var code stun.ErrorCodeAttribute
+		if msg.Type.Class == stun.ClassErrorResponse {
+			_ = code.GetFrom(msg)
+		}
+		r.OnResponse(msg.Type, code.Code)
+	}
+
 	return err
 }
 
 // Send a STUN packet and return the original error to the caller
-func buildAndSendErr(conn net.PacketConn, dst net.Addr, err error, attrs ...stun.Setter) error {
-	if sendErr := buildAndSend(conn, dst, attrs...); sendErr != nil {
+func buildAndSendErr(r Request, err error, attrs ...stun.Setter) error {
+	if sendErr := buildAndSend(r, attrs...); sendErr != nil {
 		err = fmt.Errorf("%w %v %v", errFailedToSendError, sendErr, err)
 	}
 	return err
@@ -73,11 +77,11 @@ func authenticateRequest(r Request, m *stun.Message, callingMethod stun.Method)
 		}
 
 		// Nonce has already been taken
-		if _, keyCollision := r.Nonces.LoadOrStore(nonce, time.Now()); keyCollision {
+		if _, keyCollision := r.Nonces.LoadOrStore(nonce, r.Clock.Now()); keyCollision {
 			return nil, false, errDuplicatedNonce
 		}
 
-		return nil, false, buildAndSend(r.Conn, r.SrcAddr, buildMsg(m.TransactionID,
+		return nil, false, buildAndSend(r, buildMsg(m.TransactionID,
 			stun.NewType(callingMethod, stun.ClassErrorResponse),
 			&stun.ErrorCodeAttribute{Code: responseCode},
 			stun.NewNonce(nonce),
@@ -95,7 +99,7 @@ func authenticateRequest(r Request, m *stun.Message, callingMethod stun.Method)
 	badRequestMsg := buildMsg(m.TransactionID, stun.NewType(callingMethod, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeBadRequest})
 
 	if err := nonceAttr.GetFrom(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return nil, false, buildAndSendErr(r, err, badRequestMsg...)
 	}
 
 	// Assert Nonce exists and is not expired
@@ -105,38 +109,65 @@ func authenticateRequest(r Request, m *stun.Message, callingMethod stun.Method)
 		return respondWithNonce(stun.CodeStaleNonce)
 	}
 
-	if timeValue, ok := nonceCreationTime.(time.Time); !ok || time.Since(timeValue) >= nonceLifetime {
+	if timeValue, ok := nonceCreationTime.(time.Time); !ok || r.Clock.Now().Sub(timeValue) >= nonceLifetime(r) {
 		r.Nonces.Delete(nonceAttr)
 		return respondWithNonce(stun.CodeStaleNonce)
 	}
 
 	if err := realmAttr.GetFrom(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return nil, false, buildAndSendErr(r, err, badRequestMsg...)
 	} else if err := usernameAttr.GetFrom(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		return nil, false, buildAndSendErr(r, err, badRequestMsg...)
+	}
+
+	// requests of realms no tenant serves reach a fallback without credentials
+	if r.AuthHandler == nil && r.AuthRequestHandler == nil {
+		err := fmt.Errorf("%w: %s", errUnknownRealm, realmAttr.String())
+		authFailed(r, usernameAttr.String(), realmAttr.String(), callingMethod, err)
+		return nil, false, buildAndSendErr(r, err, buildMsg(m.TransactionID, stun.NewType(callingMethod, stun.ClassErrorResponse), &stun.ErrorCodeAttribute{Code: stun.CodeWrongCredentials})...)
 	}
 
-	ourKey, ok := r.AuthHandler(usernameAttr.String(), realmAttr.String(), r.SrcAddr)
+	ourKey, ok := authenticate(r, usernameAttr.String(), realmAttr.String())
 	if !ok {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, fmt.Errorf("%w %s", errNoSuchUser, usernameAttr.String()), badRequestMsg...)
+		err := fmt.Errorf("%w %s", errNoSuchUser, usernameAttr.String())
+		authFailed(r, usernameAttr.String(), realmAttr.String(), callingMethod, err)
+		return nil, false, buildAndSendErr(r, err, badRequestMsg...)
 	}
 
 	if err := stun.MessageIntegrity(ourKey).Check(m); err != nil {
-		return nil, false, buildAndSendErr(r.Conn, r.SrcAddr, err, badRequestMsg...)
+		authFailed(r, usernameAttr.String(), realmAttr.String(), callingMethod, err)
+		return nil, false, buildAndSendErr(r, err, badRequestMsg...)
 	}
 
 	return stun.MessageIntegrity(ourKey), true, nil
 }
 
-func allocationLifeTime(m *stun.Message) time.Duration {
-	lifetimeDuration := proto.DefaultLifetime
+// AuthRequest describes the request the AuthRequestHandler of a Request authenticates
+type AuthRequest struct {
+	Username string
+	Realm    string
+	SrcAddr  net.Addr
 
-	var lifetime proto.Lifetime
-	if err := lifetime.GetFrom(m); err == nil {
-		if lifetime.Duration < maximumAllocationLifetime {
-			lifetimeDuration = lifetime.Duration
-		}
+	// ServerName is the TLS server name (SNI) the client connected with, it is empty
+	// for other transports
+	ServerName string
+}
+
+func authenticate(r Request, username, realm string) ([]byte, bool) {
+	if r.AuthRequestHandler != nil {
+		return r.AuthRequestHandler(AuthRequest{Username: username, Realm: realm, SrcAddr: r.SrcAddr, ServerName: r.ServerName})
+	}
+	return r.AuthHandler(username, realm, r.SrcAddr)
+}
+
+func authFailed(r Request, username, realm string, method stun.Method, err error) {
+	if r.OnAuthFailure == nil {
+		return
 	}
 
-	return lifetimeDuration
+	r.OnAuthFailure(&allocation.FiveTuple{
+		SrcAddr:  r.SrcAddr,
+		DstAddr:  r.Conn.LocalAddr(),
+		Protocol: allocation.UDP,
+	}, username, realm, method, err)
 }
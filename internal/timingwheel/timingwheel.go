@@ -0,0 +1,231 @@
+// Package timingwheel implements a hierarchical timing wheel that runs the
+// expiry callbacks of many timers from a single clock timer
+package timingwheel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2/internal/clock"
+)
+
+const (
+	slotBits   = 6
+	slotCount  = 1 << slotBits
+	slotMask   = slotCount - 1
+	levelCount = 5
+
+	// maxTicks is the longest delay the wheel can hold, longer delays are
+	// cascaded down from the last level until they expire
+	maxTicks = 1<<(slotBits*levelCount) - 1
+)
+
+// Wheel schedules timers with a resolution of one tick. Scheduling, resetting and
+// stopping a timer is O(1), timers are cascaded to the next level once for each
+// level they are scheduled above. Callbacks run one after another from the timer
+// of the current tick, they must not block and must not wait for other callbacks.
+type Wheel struct {
+	tick  time.Duration
+	clock clock.Clock
+	start time.Time
+
+	lock    sync.Mutex
+	current uint64 // ticks since start that were processed
+	levels  [levelCount][slotCount]timerList
+	ticker  clock.Timer
+	closed  bool
+
+	// tickLock is held while the expired timers of a tick run
+	tickLock sync.Mutex
+	expired  []*Timer
+}
+
+// Timer is a timer of a Wheel, see Wheel.AfterFunc
+type Timer struct {
+	wheel    *Wheel
+	f        func()
+	deadline uint64
+	list     *timerList // nil unless scheduled
+	prev     *Timer
+	next     *Timer
+}
+
+type timerList struct {
+	head *Timer
+}
+
+// New creates a Wheel that advances every tick of c until it is closed
+func New(tick time.Duration, c clock.Clock) *Wheel {
+	w := &Wheel{
+		tick:  tick,
+		clock: c,
+		start: c.Now(),
+	}
+
+	w.lock.Lock()
+	w.ticker = c.AfterFunc(tick, w.onTick)
+	w.lock.Unlock()
+	return w
+}
+
+// AfterFunc calls f from the tick of the wheel once d elapsed. The callback
+// runs in the first tick that ends after d, it never runs early.
+func (w *Wheel) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{wheel: w, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Close stops the wheel, timers that did not expire are dropped
+func (w *Wheel) Close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.closed = true
+	w.ticker.Stop()
+	w.lock.Unlock()
+
+	// wait for the callbacks of a tick that is running
+	w.tickLock.Lock()
+	w.tickLock.Unlock() //nolint:staticcheck
+}
+
+// Reset schedules the timer to expire after d. It reports whether the timer was
+// scheduled before, like time.Timer.Reset the callback may still run for the
+// previous schedule when it already started.
+func (t *Timer) Reset(d time.Duration) bool {
+	w := t.wheel
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	scheduled := t.list != nil
+	if scheduled {
+		t.list.remove(t)
+	}
+	if w.closed {
+		return scheduled
+	}
+
+	// the current tick already started, so a timer of one tick waits for the next
+	ticks := uint64((w.clock.Now().Sub(w.start) + d + w.tick - 1) / w.tick)
+	if ticks <= w.current {
+		ticks = w.current + 1
+	}
+	t.deadline = ticks
+	w.schedule(t)
+	return scheduled
+}
+
+// Stop prevents the timer from expiring, it reports whether the timer was scheduled
+func (t *Timer) Stop() bool {
+	w := t.wheel
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if t.list == nil {
+		return false
+	}
+	t.list.remove(t)
+	return true
+}
+
+// schedule puts t into the slot of the lowest level that reaches its deadline
+func (w *Wheel) schedule(t *Timer) {
+	deadline := t.deadline
+	delta := deadline - w.current
+	if delta > maxTicks {
+		deadline = w.current + maxTicks
+		delta = maxTicks
+	}
+
+	level := 0
+	for delta >= slotCount && level < levelCount-1 {
+		delta >>= slotBits
+		level++
+	}
+	w.levels[level][(deadline>>(slotBits*uint(level)))&slotMask].push(t)
+}
+
+func (w *Wheel) onTick() {
+	w.tickLock.Lock()
+	defer w.tickLock.Unlock()
+
+	w.expired = w.advance(w.expired[:0])
+	for i, t := range w.expired {
+		t.f()
+		w.expired[i] = nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.closed {
+		// the next tick is aligned to start, however late this one ran
+		next := time.Duration(w.current+1)*w.tick - w.clock.Now().Sub(w.start)
+		if next <= 0 {
+			next = w.tick
+		}
+		w.ticker.Reset(next)
+	}
+}
+
+// advance processes the ticks up to now and returns the timers that expired
+func (w *Wheel) advance(expired []*Timer) []*Timer {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return expired
+	}
+
+	now := uint64(w.clock.Now().Sub(w.start) / w.tick)
+	for w.current < now {
+		w.current++
+
+		// timers of the higher levels move down once the lower level wrapped around
+		for level := 1; level < levelCount; level++ {
+			shift := slotBits * uint(level)
+			if w.current&(1<<shift-1) != 0 {
+				break
+			}
+			w.cascade(&w.levels[level][(w.current>>shift)&slotMask])
+		}
+
+		slot := &w.levels[0][w.current&slotMask]
+		for t := slot.head; t != nil; t = slot.head {
+			slot.remove(t)
+			expired = append(expired, t)
+		}
+	}
+	return expired
+}
+
+func (w *Wheel) cascade(slot *timerList) {
+	for t := slot.head; t != nil; t = slot.head {
+		slot.remove(t)
+		w.schedule(t)
+	}
+}
+
+func (l *timerList) push(t *Timer) {
+	t.list = l
+	t.prev = nil
+	t.next = l.head
+	if l.head != nil {
+		l.head.prev = t
+	}
+	l.head = t
+}
+
+func (l *timerList) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		l.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.list, t.prev, t.next = nil, nil, nil
+}
@@ -0,0 +1,166 @@
+package timingwheel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2/internal/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTick = 10 * time.Millisecond
+
+func TestWheel(t *testing.T) {
+	t.Run("AfterFunc", func(t *testing.T) {
+		w := New(testTick, clock.System)
+		defer w.Close()
+
+		fired := make(chan time.Time, 1)
+		start := time.Now()
+		w.AfterFunc(50*time.Millisecond, func() {
+			fired <- time.Now()
+		})
+
+		select {
+		case at := <-fired:
+			assert.True(t, at.Sub(start) >= 50*time.Millisecond, "timer fired early")
+		case <-time.After(time.Second):
+			t.Fatal("timer did not fire")
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		w := New(testTick, clock.System)
+		defer w.Close()
+
+		timer := w.AfterFunc(20*time.Millisecond, func() {
+			t.Error("stopped timer fired")
+		})
+		assert.True(t, timer.Stop())
+		assert.False(t, timer.Stop())
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		w := New(testTick, clock.System)
+		defer w.Close()
+
+		fired := make(chan time.Time, 1)
+		start := time.Now()
+		timer := w.AfterFunc(20*time.Millisecond, func() {
+			fired <- time.Now()
+		})
+		assert.True(t, timer.Reset(100*time.Millisecond))
+
+		at := <-fired
+		assert.True(t, at.Sub(start) >= 100*time.Millisecond, "timer fired for the first schedule")
+
+		// a fired timer is scheduled again
+		assert.False(t, timer.Reset(testTick))
+		<-fired
+	})
+
+	// timers beyond the first level are cascaded down and fire in order
+	t.Run("Cascade", func(t *testing.T) {
+		w := New(time.Millisecond, clock.System)
+		defer w.Close()
+
+		var lock sync.Mutex
+		var order []int
+		var wg sync.WaitGroup
+		for i, d := range []time.Duration{5, 70, 300, 130} {
+			wg.Add(1)
+			i := i
+			w.AfterFunc(d*time.Millisecond, func() {
+				lock.Lock()
+				order = append(order, i)
+				lock.Unlock()
+				wg.Done()
+			})
+		}
+		wg.Wait()
+		assert.Equal(t, []int{0, 1, 3, 2}, order)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		w := New(testTick, clock.System)
+		timer := w.AfterFunc(testTick, func() {
+			t.Error("timer fired after Close")
+		})
+		w.Close()
+		w.Close()
+
+		// resetting does not schedule the timer on a closed wheel
+		timer.Reset(testTick)
+		time.Sleep(3 * testTick)
+	})
+}
+
+// a fake clock expires timers of hours in order without waiting
+func TestWheelFakeClock(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	w := New(100*time.Millisecond, c)
+	defer w.Close()
+
+	var fired []time.Duration
+	for _, d := range []time.Duration{time.Hour, 10 * time.Minute, 5 * time.Minute} {
+		d := d
+		w.AfterFunc(d, func() {
+			fired = append(fired, d)
+		})
+	}
+
+	c.Advance(6 * time.Minute)
+	assert.Equal(t, []time.Duration{5 * time.Minute}, fired)
+
+	c.Advance(2 * time.Hour)
+	assert.Equal(t, []time.Duration{5 * time.Minute, 10 * time.Minute, time.Hour}, fired)
+}
+
+func TestWheelSchedule(t *testing.T) {
+	w := &Wheel{tick: time.Millisecond, current: 1000}
+
+	for _, tc := range []struct {
+		delta uint64
+		level int
+	}{
+		{1, 0},
+		{63, 0},
+		{64, 1},
+		{64 * 64, 2},
+		{64 * 64 * 64 * 64, 4},
+		{maxTicks + 100, 4},
+	} {
+		timer := &Timer{wheel: w, deadline: w.current + tc.delta}
+		w.schedule(timer)
+
+		level := -1
+		for l := range w.levels {
+			for s := range w.levels[l] {
+				if timer.list == &w.levels[l][s] {
+					level = l
+				}
+			}
+		}
+		assert.Equal(t, tc.level, level, "delta %d", tc.delta)
+		timer.list.remove(timer)
+	}
+}
+
+// BenchmarkWheelReset measures refreshing timers like permissions and channel bindings
+func BenchmarkWheelReset(b *testing.B) {
+	w := New(100*time.Millisecond, clock.System)
+	defer w.Close()
+
+	timers := make([]*Timer, 10000)
+	for i := range timers {
+		timers[i] = w.AfterFunc(time.Minute, func() {})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		timers[i%len(timers)].Reset(5 * time.Minute)
+	}
+}
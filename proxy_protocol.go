@@ -0,0 +1,279 @@
+package turn
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/clock"
+	"github.com/pion/turn/v2/internal/ipnet"
+	"github.com/pion/turn/v2/internal/proxyproto"
+)
+
+const (
+	defaultProxyHeaderTimeout = 10 * time.Second
+
+	// clients are forgotten once they did not send through a balancer for longer than
+	// the default maximum lifetime of their allocations
+	proxyClientTimeout       = time.Hour
+	proxyClientPruneInterval = time.Minute
+)
+
+// ProxyProtocolConfig accepts HAProxy PROXY protocol headers from layer 4 load balancers,
+// so requests are handled with the address of the client instead of the one of the
+// balancer. Connections take version 1 and 2 headers, datagrams version 2 headers.
+type ProxyProtocolConfig struct {
+	// TrustedProxies are the networks of the balancers. Connections and datagrams from
+	// them must start with a header, the ones of other addresses are used as they are.
+	TrustedProxies []*net.IPNet
+
+	// HeaderTimeout bounds reading the header of a connection. Defaults to 10 seconds.
+	HeaderTimeout time.Duration
+}
+
+func (c *ProxyProtocolConfig) validate() error {
+	if c != nil && len(c.TrustedProxies) == 0 {
+		return errNoTrustedProxies
+	}
+	return nil
+}
+
+// trusts reports if addr is the address of a balancer
+func (c *ProxyProtocolConfig) trusts(addr net.Addr) bool {
+	ip, _, err := ipnet.AddrIPPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, n := range c.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProxyProtocolListener reads the headers of the connections of l. It is meant to be
+// wrapped by another listener, like the one of tls.NewListener, since a header precedes
+// the TLS handshake. ListenerConfig and TLSListenerConfig take a ProxyProtocolConfig
+// of their own.
+func NewProxyProtocolListener(l net.Listener, config ProxyProtocolConfig) net.Listener {
+	return &proxyListener{Listener: l, config: config}
+}
+
+type proxyListener struct {
+	net.Listener
+	config ProxyProtocolConfig
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newProxyConn(conn, &l.config), nil
+}
+
+// proxyConn reads the header of a connection from a balancer on its first read, its
+// RemoteAddr is the address of the client from then on
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once sync.Once
+	err  error
+
+	lock         sync.Mutex
+	remoteAddr   net.Addr
+	readDeadline time.Time
+}
+
+func newProxyConn(conn net.Conn, config *ProxyProtocolConfig) net.Conn {
+	if !config.trusts(conn.RemoteAddr()) {
+		return conn
+	}
+
+	timeout := config.HeaderTimeout
+	if timeout == 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout, remoteAddr: conn.RemoteAddr()}
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.once.Do(c.readHeader); c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// readHeader reads the header within the timeout, or the read deadline of the conn if
+// that is earlier
+func (c *proxyConn) readHeader() {
+	// socket deadlines are wall clock times, unlike the Clock of the server
+	deadline := time.Now().Add(c.timeout)
+	c.lock.Lock()
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.lock.Unlock()
+
+	if c.err = c.Conn.SetReadDeadline(deadline); c.err != nil {
+		return
+	}
+	header, err := proxyproto.Read(c.reader)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err = err; c.err != nil {
+		return
+	}
+	if c.err = c.Conn.SetReadDeadline(c.readDeadline); c.err != nil {
+		return
+	}
+	if !header.Local {
+		c.remoteAddr = &net.TCPAddr{IP: header.SourceIP, Port: header.SourcePort}
+	}
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.remoteAddr
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// proxyPacketConn strips the headers of the datagrams of balancers and returns the
+// address of the client instead. Datagrams to a client are sent to the balancer it was
+// last seen through, which knows the client by the flow.
+type proxyPacketConn struct {
+	net.PacketConn
+	config *ProxyProtocolConfig
+	log    logging.LeveledLogger
+	clock  clock.Clock
+
+	lock      sync.RWMutex
+	balancers map[proxyClientKey]*proxyBalancer
+	lastPrune time.Time
+}
+
+type proxyClientKey struct {
+	ip   [net.IPv6len]byte
+	port int
+}
+
+type proxyBalancer struct {
+	seen int64 // unix nanoseconds, accessed atomically and first for 64-bit alignment
+	addr net.Addr
+}
+
+func newProxyPacketConn(conn net.PacketConn, config *ProxyProtocolConfig, log logging.LeveledLogger, c clock.Clock) *proxyPacketConn {
+	return &proxyPacketConn{
+		PacketConn: conn,
+		config:     config,
+		log:        log,
+		clock:      c,
+		balancers:  map[proxyClientKey]*proxyBalancer{},
+		lastPrune:  c.Now(),
+	}
+}
+
+func proxyClientKeyOf(addr net.Addr) (proxyClientKey, bool) {
+	ip, port, err := ipnet.AddrIPPort(addr)
+	if err != nil {
+		return proxyClientKey{}, false
+	}
+	key := proxyClientKey{port: port}
+	copy(key.ip[:], ip.To16())
+	return key, true
+}
+
+func (c *proxyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !c.config.trusts(addr) {
+			return n, addr, err
+		}
+
+		header, headerLength, err := proxyproto.Parse(b[:n])
+		if err != nil {
+			c.log.Debugf("Dropping datagram from balancer %s: %s", addr, err)
+			continue
+		}
+		n = copy(b, b[headerLength:n])
+		if header.Local {
+			return n, addr, nil
+		}
+
+		client := &net.UDPAddr{IP: header.SourceIP, Port: header.SourcePort}
+		c.clientSeen(client, addr)
+		return n, client, nil
+	}
+}
+
+func (c *proxyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if balancer := c.balancer(addr); balancer != nil {
+		return c.PacketConn.WriteTo(b, balancer)
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *proxyPacketConn) balancer(client net.Addr) net.Addr {
+	key, ok := proxyClientKeyOf(client)
+	if !ok {
+		return nil
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if b, ok := c.balancers[key]; ok {
+		return b.addr
+	}
+	return nil
+}
+
+// clientSeen remembers the balancer of client, clients not seen for a while are pruned
+// when new ones arrive
+func (c *proxyPacketConn) clientSeen(client, balancer net.Addr) {
+	key, _ := proxyClientKeyOf(client)
+	now := c.clock.Now()
+
+	c.lock.RLock()
+	b, ok := c.balancers[key]
+	c.lock.RUnlock()
+	if ok && ipnet.AddrEqual(b.addr, balancer) {
+		atomic.StoreInt64(&b.seen, now.UnixNano())
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.balancers[key] = &proxyBalancer{addr: balancer, seen: now.UnixNano()}
+	if now.Sub(c.lastPrune) < proxyClientPruneInterval {
+		return
+	}
+	c.lastPrune = now
+	for key, b := range c.balancers {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&b.seen))) > proxyClientTimeout {
+			delete(c.balancers, key)
+		}
+	}
+}
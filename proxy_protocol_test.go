@@ -0,0 +1,202 @@
+//go:build !js
+// +build !js
+
+package turn
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/transport/v2/test"
+	"github.com/pion/turn/v2/internal/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyHeaderV2 returns a version 2 PROXY header of a datagram from client, LOCAL if nil
+func proxyHeaderV2(client *net.UDPAddr) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")
+	if client == nil {
+		return header
+	}
+
+	header[12], header[13], header[15] = 0x21, 0x12, 12
+	header = append(header, client.IP.To4()...)
+	header = append(header, 127, 0, 0, 1)
+	header = append(header, 0, 0, 0x0d, 0x96)
+	binary.BigEndian.PutUint16(header[len(header)-4:], uint16(client.Port))
+	return header
+}
+
+// bindingMappedAddress sends a Binding request after prefix on conn and returns the mapped address of the response
+func bindingMappedAddress(t *testing.T, conn net.Conn, prefix []byte) (*stun.XORMappedAddress, error) {
+	request, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	assert.NoError(t, err)
+
+	if _, err = conn.Write(append(prefix, request.Raw...)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	response := &stun.Message{Raw: buf[:n]}
+	assert.NoError(t, response.Decode())
+
+	var mapped stun.XORMappedAddress
+	assert.NoError(t, mapped.GetFrom(response))
+	return &mapped, nil
+}
+
+func TestServerProxyProtocolUDP(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	assert.NoError(t, err)
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: rejectAuthHandler,
+		PacketConnConfigs: []PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"},
+			ProxyProtocol:         &ProxyProtocolConfig{TrustedProxies: []*net.IPNet{loopback}},
+		}},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	balancer, err := net.Dial("udp4", udpListener.LocalAddr().String())
+	assert.NoError(t, err)
+
+	// the response of a client goes back through the balancer
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5000}
+	mapped, err := bindingMappedAddress(t, balancer, proxyHeaderV2(client))
+	assert.NoError(t, err)
+	assert.True(t, mapped.IP.Equal(client.IP))
+	assert.Equal(t, client.Port, mapped.Port)
+
+	// health checks of the balancer are answered directly
+	mapped, err = bindingMappedAddress(t, balancer, proxyHeaderV2(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, balancer.LocalAddr().(*net.UDPAddr).Port, mapped.Port) //nolint:forcetypeassert
+
+	// datagrams of the balancer without a header are dropped
+	assert.NoError(t, balancer.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = bindingMappedAddress(t, balancer, nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, balancer.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerProxyProtocolTCP(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	assert.NoError(t, err)
+	_, other, err := net.ParseCIDR("192.0.2.0/24")
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, (&ListenerConfig{
+		Listener:              &proxyListener{},
+		RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"},
+		ProxyProtocol:         &ProxyProtocolConfig{},
+	}).validate(), errNoTrustedProxies)
+
+	trustedListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	untrustedListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: rejectAuthHandler,
+		ListenerConfigs: []ListenerConfig{
+			{
+				Listener:              trustedListener,
+				RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"},
+				ProxyProtocol: &ProxyProtocolConfig{
+					TrustedProxies: []*net.IPNet{loopback},
+					HeaderTimeout:  100 * time.Millisecond,
+				},
+			},
+			{
+				Listener:              untrustedListener,
+				RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"},
+				ProxyProtocol:         &ProxyProtocolConfig{TrustedProxies: []*net.IPNet{other}},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.10 127.0.0.1 5000 3478\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\x00\x02\x0a\x7f\x00\x00\x01\x13\x88\x0d\x96",
+	} {
+		conn, err := net.Dial("tcp4", trustedListener.Addr().String())
+		assert.NoError(t, err)
+
+		mapped, err := bindingMappedAddress(t, conn, []byte(header))
+		assert.NoError(t, err)
+		assert.True(t, mapped.IP.Equal(net.ParseIP("192.0.2.10")))
+		assert.Equal(t, 5000, mapped.Port)
+		assert.NoError(t, conn.Close())
+	}
+
+	// connections of balancers that send no header are closed after the timeout
+	conn, err := net.Dial("tcp4", trustedListener.Addr().String())
+	assert.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, conn.Close())
+
+	// other addresses are used as they are
+	conn, err = net.Dial("tcp4", untrustedListener.Addr().String())
+	assert.NoError(t, err)
+	mapped, err := bindingMappedAddress(t, conn, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, conn.LocalAddr().(*net.TCPAddr).Port, mapped.Port) //nolint:forcetypeassert
+	assert.NoError(t, conn.Close())
+
+	assert.NoError(t, server.Close())
+}
+
+// balancers of clients are pruned by the Clock of the server
+func TestProxyPacketConnPrune(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	conn := newProxyPacketConn(nil, &ProxyProtocolConfig{}, logging.NewDefaultLoggerFactory().NewLogger("turn"), c)
+
+	balancer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}
+	idle := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5000}
+	active := &net.UDPAddr{IP: net.ParseIP("192.0.2.11"), Port: 5000}
+
+	conn.clientSeen(idle, balancer)
+	c.Advance(proxyClientTimeout / 2)
+	conn.clientSeen(active, balancer)
+	assert.Equal(t, balancer, conn.balancer(idle))
+
+	// clients are pruned when new ones arrive
+	c.Advance(proxyClientTimeout/2 + proxyClientPruneInterval)
+	conn.clientSeen(&net.UDPAddr{IP: net.ParseIP("192.0.2.12"), Port: 5000}, balancer)
+	assert.Nil(t, conn.balancer(idle))
+	assert.Equal(t, balancer, conn.balancer(active))
+}
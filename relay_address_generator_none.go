@@ -35,9 +35,13 @@ func (r *RelayAddressGeneratorNone) Validate() error {
 	}
 }
 
+func (r *RelayAddressGeneratorNone) supportsNetwork(network string) bool {
+	return addressSupportsNetwork(r.Address, nil, network)
+}
+
 // AllocatePacketConn generates a new PacketConn to receive traffic on and the IP/Port to populate the allocation response with
 func (r *RelayAddressGeneratorNone) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
-	conn, err := r.Net.ListenPacket(network, r.Address+":"+strconv.Itoa(requestedPort))
+	conn, err := r.Net.ListenPacket(network, net.JoinHostPort(r.Address, strconv.Itoa(requestedPort)))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,232 @@
+package turn
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/pion/transport/v2"
+	"github.com/pion/transport/v2/stdnet"
+)
+
+// RelayPoolStrategy picks the member of a RelayAddressGeneratorPool that relays an allocation
+type RelayPoolStrategy int
+
+const (
+	// RelayPoolRoundRobin uses the members one after another
+	RelayPoolRoundRobin RelayPoolStrategy = iota
+	// RelayPoolLeastAllocations uses the member relaying the fewest allocations
+	RelayPoolLeastAllocations
+	// RelayPoolUsernameHash uses the same member for every allocation of a username
+	RelayPoolUsernameHash
+)
+
+// RelayPoolMember is a relay address of a RelayAddressGeneratorPool
+type RelayPoolMember struct {
+	// RelayAddress is the IP returned to the user when the relay is created,
+	// it decides whether the member relays IPv4 or IPv6 allocations
+	RelayAddress net.IP
+
+	// Address is passed to ListenPacket when creating the Relay
+	Address string
+
+	// MinPort and MaxPort bound the ports of the member like RelayAddressGeneratorPortRange,
+	// any port is used if both are 0
+	MinPort uint16
+	MaxPort uint16
+}
+
+// RelayAddressGeneratorPool spreads allocations over several relay addresses, for hosts
+// with more public IPs or more relays than one port range holds. Members of the family of
+// the requested network are tried in the order of the Strategy until one of them has a
+// free port, so a full member does not fail allocations while others have room.
+type RelayAddressGeneratorPool struct {
+	Members  []RelayPoolMember
+	Strategy RelayPoolStrategy
+
+	Net transport.Net
+
+	lock    sync.Mutex
+	members []*relayPoolMember
+	next    int
+}
+
+type relayPoolMember struct {
+	generator   RelayAddressGenerator
+	ipv6        bool
+	allocations int // protected by the lock of the pool
+}
+
+// Validate is called on server startup and confirms the RelayAddressGenerator is properly configured
+func (r *RelayAddressGeneratorPool) Validate() error {
+	if r.Net == nil {
+		var err error
+		r.Net, err = stdnet.NewNet()
+		if err != nil {
+			return fmt.Errorf("failed to create network: %w", err)
+		}
+	}
+
+	switch {
+	case len(r.Members) == 0:
+		return errRelayPoolEmpty
+	case r.Strategy < RelayPoolRoundRobin || r.Strategy > RelayPoolUsernameHash:
+		return errRelayPoolStrategyInvalid
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// the generator can be shared by listeners
+	if r.members != nil {
+		return nil
+	}
+
+	members := make([]*relayPoolMember, 0, len(r.Members))
+	for _, m := range r.Members {
+		var generator RelayAddressGenerator
+		if m.MinPort == 0 && m.MaxPort == 0 {
+			generator = &RelayAddressGeneratorStatic{RelayAddress: m.RelayAddress, Address: m.Address, Net: r.Net}
+		} else {
+			generator = &RelayAddressGeneratorPortRange{
+				RelayAddress: m.RelayAddress,
+				Address:      m.Address,
+				MinPort:      m.MinPort,
+				MaxPort:      m.MaxPort,
+				Net:          r.Net,
+			}
+		}
+		if err := generator.Validate(); err != nil {
+			return fmt.Errorf("relay pool member %s: %w", m.RelayAddress, err)
+		}
+
+		members = append(members, &relayPoolMember{
+			generator: generator,
+			ipv6:      m.RelayAddress.To4() == nil,
+		})
+	}
+	r.members = members
+	return nil
+}
+
+// Allocations returns the number of relay sockets of each member, in the order of Members
+func (r *RelayAddressGeneratorPool) Allocations() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	allocations := make([]int, len(r.members))
+	for i, m := range r.members {
+		allocations[i] = m.allocations
+	}
+	return allocations
+}
+
+// Close closes the members that hold resources of their own
+func (r *RelayAddressGeneratorPool) Close() error {
+	r.lock.Lock()
+	members := r.members
+	r.lock.Unlock()
+
+	var err error
+	for _, m := range members {
+		if closer, ok := m.generator.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// AllocatePacketConn generates a new PacketConn to receive traffic on and the IP/Port to populate the allocation response with
+func (r *RelayAddressGeneratorPool) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	return r.AllocateRelayPacketConn(RelayAllocationRequest{Network: network, RequestedPort: requestedPort})
+}
+
+// AllocateRelayPacketConn allocates a PacketConn on a member picked for req, see RequestRelayAddressGenerator
+func (r *RelayAddressGeneratorPool) AllocateRelayPacketConn(req RelayAllocationRequest) (net.PacketConn, net.Addr, error) {
+	candidates := r.candidates(req.Network, req.Username)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", errRelayPoolNoMember, req.Network)
+	}
+
+	var err error
+	for _, m := range candidates {
+		memberNetwork := "udp4"
+		if m.ipv6 {
+			memberNetwork = "udp6"
+		}
+
+		var conn net.PacketConn
+		var addr net.Addr
+		if conn, addr, err = m.generator.AllocatePacketConn(memberNetwork, req.RequestedPort); err != nil {
+			continue
+		}
+
+		r.lock.Lock()
+		m.allocations++
+		r.lock.Unlock()
+		return newTrackedConn(conn, func() {
+			r.lock.Lock()
+			m.allocations--
+			r.lock.Unlock()
+		}), addr, nil
+	}
+	return nil, nil, err
+}
+
+func (r *RelayAddressGeneratorPool) supportsNetwork(network string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, m := range r.members {
+		if (network == "udp6") == m.ipv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// AllocateConn generates a new Conn to receive traffic on and the IP/Port to populate the allocation response with
+func (r *RelayAddressGeneratorPool) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errTODO
+}
+
+// candidates returns the members of the family of network in the order they are tried
+func (r *RelayAddressGeneratorPool) candidates(network, username string) []*relayPoolMember {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	eligible := make([]*relayPoolMember, 0, len(r.members))
+	for _, m := range r.members {
+		if network == "udp" || (network == "udp6") == m.ipv6 {
+			eligible = append(eligible, m)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+
+	start := 0
+	switch r.Strategy {
+	case RelayPoolRoundRobin, RelayPoolLeastAllocations:
+		start = r.next % len(eligible)
+		r.next++
+	case RelayPoolUsernameHash:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(username))
+		start = int(h.Sum32() % uint32(len(eligible)))
+	}
+
+	candidates := append(eligible[start:len(eligible):len(eligible)], eligible[:start]...)
+	if r.Strategy == RelayPoolLeastAllocations {
+		// ties are broken in round-robin order
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].allocations < candidates[j].allocations
+		})
+	}
+	return candidates
+}
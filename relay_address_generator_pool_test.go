@@ -0,0 +1,194 @@
+//go:build !js
+// +build !js
+
+package turn
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayAddressGeneratorPool(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	newPool := func(strategy RelayPoolStrategy, members ...RelayPoolMember) *RelayAddressGeneratorPool {
+		r := &RelayAddressGeneratorPool{Members: members, Strategy: strategy}
+		assert.NoError(t, r.Validate())
+		return r
+	}
+	member := func(relayIP string) RelayPoolMember {
+		return RelayPoolMember{RelayAddress: net.ParseIP(relayIP), Address: "127.0.0.1"}
+	}
+	allocate := func(r *RelayAddressGeneratorPool, username string) (net.PacketConn, string) {
+		conn, addr, err := r.AllocateRelayPacketConn(RelayAllocationRequest{Network: "udp4", Username: username})
+		assert.NoError(t, err)
+		return conn, addr.(*net.UDPAddr).IP.String() //nolint:forcetypeassert
+	}
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		r := newPool(RelayPoolRoundRobin, member("10.0.0.1"), member("10.0.0.2"), member("10.0.0.3"))
+
+		var relayIPs []string
+		for i := 0; i < 6; i++ {
+			conn, relayIP := allocate(r, "")
+			relayIPs = append(relayIPs, relayIP)
+			assert.NoError(t, conn.Close())
+		}
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.3"}, relayIPs)
+		assert.Equal(t, []int{0, 0, 0}, r.Allocations())
+	})
+
+	t.Run("LeastAllocations", func(t *testing.T) {
+		r := newPool(RelayPoolLeastAllocations, member("10.0.0.1"), member("10.0.0.2"))
+
+		var conns []net.PacketConn
+		for i := 0; i < 4; i++ {
+			conn, _ := allocate(r, "")
+			conns = append(conns, conn)
+		}
+		assert.Equal(t, []int{2, 2}, r.Allocations())
+
+		// the member that lost two allocations gets the next two
+		assert.NoError(t, conns[1].Close())
+		assert.NoError(t, conns[3].Close())
+		assert.Equal(t, []int{2, 0}, r.Allocations())
+		for i := 0; i < 2; i++ {
+			conn, relayIP := allocate(r, "")
+			assert.Equal(t, "10.0.0.2", relayIP)
+			conns[1+2*i] = conn
+		}
+
+		for _, conn := range conns {
+			assert.NoError(t, conn.Close())
+		}
+	})
+
+	t.Run("UsernameHash", func(t *testing.T) {
+		full := member("10.0.0.1")
+		full.MinPort, full.MaxPort = 47010, 47010
+		r := newPool(RelayPoolUsernameHash, full, member("10.0.0.2"), member("10.0.0.3"))
+
+		for _, username := range []string{"alice", "bob", "carol", "dave"} {
+			conn, relayIP := allocate(r, username)
+			assert.NoError(t, conn.Close())
+			for i := 0; i < 3; i++ {
+				conn, again := allocate(r, username)
+				assert.Equal(t, relayIP, again, username)
+				assert.NoError(t, conn.Close())
+			}
+		}
+
+		// users of a full member fall back to the next one
+		conn, _, err := r.members[0].generator.AllocatePacketConn("udp4", 0)
+		assert.NoError(t, err)
+		for _, username := range []string{"alice", "bob", "carol", "dave"} {
+			c, relayIP := allocate(r, username)
+			assert.NotEqual(t, "10.0.0.1", relayIP)
+			assert.NoError(t, c.Close())
+		}
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, r.Close())
+	})
+
+	t.Run("AddressFamily", func(t *testing.T) {
+		probe, err := net.ListenPacket("udp6", "[::1]:0")
+		if err != nil {
+			t.Skip("IPv6 is not available")
+		}
+		assert.NoError(t, probe.Close())
+
+		r := newPool(RelayPoolRoundRobin, member("10.0.0.1"), RelayPoolMember{RelayAddress: net.ParseIP("2001:db8::1"), Address: "::1"})
+
+		for _, network := range []string{"udp4", "udp6", "udp4", "udp6"} {
+			conn, addr, err := r.AllocatePacketConn(network, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, network == "udp6", addr.(*net.UDPAddr).IP.To4() == nil, network) //nolint:forcetypeassert
+			assert.NoError(t, conn.Close())
+		}
+
+		ipv4 := newPool(RelayPoolRoundRobin, member("10.0.0.1"))
+		_, _, err = ipv4.AllocatePacketConn("udp6", 0)
+		assert.True(t, errors.Is(err, errRelayPoolNoMember))
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		assert.ErrorIs(t, (&RelayAddressGeneratorPool{}).Validate(), errRelayPoolEmpty)
+		assert.ErrorIs(t, (&RelayAddressGeneratorPool{Members: []RelayPoolMember{member("10.0.0.1")}, Strategy: 7}).Validate(), errRelayPoolStrategyInvalid)
+		assert.ErrorIs(t, (&RelayAddressGeneratorPool{Members: []RelayPoolMember{{Address: "127.0.0.1"}}}).Validate(), errRelayAddressInvalid)
+	})
+}
+
+// the server passes the username of an allocation to the pool
+func TestServerRelayAddressGeneratorPool(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	pool := &RelayAddressGeneratorPool{
+		Members: []RelayPoolMember{
+			{RelayAddress: net.ParseIP("127.0.0.1"), Address: "127.0.0.1"},
+			{RelayAddress: net.ParseIP("127.0.0.2"), Address: "127.0.0.1"},
+		},
+		Strategy: RelayPoolUsernameHash,
+	}
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: pool,
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		expected := pool.candidates("udp4", username)[0].generator.(*RelayAddressGeneratorStatic).RelayAddress //nolint:forcetypeassert
+
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       username,
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		assert.Equal(t, expected.String(), relayConn.LocalAddr().(*net.UDPAddr).IP.String(), username) //nolint:forcetypeassert
+
+		assert.NoError(t, relayConn.Close())
+		client.Close()
+		assert.NoError(t, conn.Close())
+	}
+
+	assert.NoError(t, server.Close())
+}
@@ -2,7 +2,11 @@ package turn
 
 import (
 	"fmt"
+	"math/bits"
 	"net"
+	"strconv"
+	"sync"
+	"syscall"
 
 	"github.com/pion/randutil"
 	"github.com/pion/transport/v2"
@@ -11,6 +15,10 @@ import (
 
 // RelayAddressGeneratorPortRange can be used to only allocate connections inside a defined port range.
 // Similar to the RelayAddressGeneratorStatic a static ip address can be set.
+//
+// The generator tracks the ports of the range it handed out until their sockets are closed,
+// so allocations only fail once every port of the range is in use. It must not be copied
+// after it was validated.
 type RelayAddressGeneratorPortRange struct {
 	// RelayAddress is the IP returned to the user when the relay is created
 	RelayAddress net.IP
@@ -20,7 +28,8 @@ type RelayAddressGeneratorPortRange struct {
 	// MaxPort the maximum (inclusive) port to allocate
 	MaxPort uint16
 
-	// MaxRetries the amount of tries to allocate a random port in the defined range
+	// MaxRetries limits how many free ports that fail to bind, because sockets outside of
+	// the generator use them, are tried for an allocation. Every free port is tried if 0.
 	MaxRetries int
 
 	// Rand the random source of numbers
@@ -29,7 +38,20 @@ type RelayAddressGeneratorPortRange struct {
 	// Address is passed to Listen/ListenPacket when creating the Relay
 	Address string
 
+	// PoolSize is the number of sockets kept bound to free ports of the range for each
+	// network, so allocations do not wait for a port to be bound. The pool is filled
+	// in the background after the first allocation and closed by Close, which the
+	// Server calls once the last listener using the generator is closed.
+	PoolSize int
+
 	Net transport.Net
+
+	lock      sync.Mutex
+	ports     *portSet
+	pool      map[string][]net.PacketConn
+	refilling map[string]bool
+	closed    bool
+	wg        sync.WaitGroup
 }
 
 // Validate is called on server startup and confirms the RelayAddressGenerator is properly configured
@@ -46,60 +68,339 @@ func (r *RelayAddressGeneratorPortRange) Validate() error {
 		r.Rand = randutil.NewMathRandomGenerator()
 	}
 
-	if r.MaxRetries == 0 {
-		r.MaxRetries = 10
-	}
-
 	switch {
 	case r.MinPort == 0:
 		return errMinPortNotZero
 	case r.MaxPort == 0:
 		return errMaxPortNotZero
+	case r.MinPort > r.MaxPort:
+		return errPortRangeInvalid
 	case r.RelayAddress == nil:
 		return errRelayAddressInvalid
 	case r.Address == "":
 		return errListeningAddressInvalid
-	default:
-		return nil
+	case r.PoolSize < 0:
+		return errPoolSizeNegative
+	}
+
+	r.lock.Lock()
+	r.init()
+	r.lock.Unlock()
+	return nil
+}
+
+// init creates the port set on first use, the generator can be shared by listeners
+func (r *RelayAddressGeneratorPortRange) init() {
+	if r.ports == nil {
+		r.ports = newPortSet(r.MinPort, r.MaxPort)
+		r.pool = map[string][]net.PacketConn{}
+		r.refilling = map[string]bool{}
+	}
+}
+
+// FreePorts returns the number of ports of the range that are not used by allocations,
+// pooled sockets count as free
+func (r *RelayAddressGeneratorPortRange) FreePorts() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ports == nil {
+		return int(r.MaxPort) - int(r.MinPort) + 1
 	}
+	free := r.ports.free
+	for _, conns := range r.pool {
+		free += len(conns)
+	}
+	return free
+}
+
+// Close closes the pooled sockets and stops refilling the pool. Ports are still
+// allocated afterwards, without a pool.
+func (r *RelayAddressGeneratorPortRange) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	pool := r.pool
+	r.pool = map[string][]net.PacketConn{}
+	r.lock.Unlock()
+
+	r.wg.Wait()
+
+	var err error
+	for _, conns := range pool {
+		for _, conn := range conns {
+			if closeErr := conn.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+func (r *RelayAddressGeneratorPortRange) supportsNetwork(network string) bool {
+	return addressSupportsNetwork(r.Address, r.RelayAddress, network)
 }
 
 // AllocatePacketConn generates a new PacketConn to receive traffic on and the IP/Port to populate the allocation response with
 func (r *RelayAddressGeneratorPortRange) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
 	if requestedPort != 0 {
-		conn, err := r.Net.ListenPacket(network, fmt.Sprintf("%s:%d", r.Address, requestedPort))
-		if err != nil {
-			return nil, nil, err
+		return r.bindRequested(network, requestedPort)
+	}
+
+	if r.PoolSize > 0 {
+		r.lock.Lock()
+		r.init()
+		conns := r.pool[network]
+		var conn net.PacketConn
+		if len(conns) != 0 {
+			conn = conns[len(conns)-1]
+			conns[len(conns)-1] = nil
+			r.pool[network] = conns[:len(conns)-1]
 		}
-		relayAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+		r.startRefill(network)
+		r.lock.Unlock()
+
+		if conn != nil {
+			return r.relayAddr(conn)
+		}
+	}
+
+	conn, err := r.bind(network)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.relayAddr(conn)
+}
+
+// AllocateConn generates a new Conn to receive traffic on and the IP/Port to populate the allocation response with
+func (r *RelayAddressGeneratorPortRange) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errTODO
+}
+
+// bindRequested binds the port reserved by an earlier allocation with EVEN-PORT
+func (r *RelayAddressGeneratorPortRange) bindRequested(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	inRange := requestedPort >= int(r.MinPort) && requestedPort <= int(r.MaxPort)
+	if inRange {
+		r.lock.Lock()
+		r.init()
+		ok := r.ports.take(requestedPort)
+		r.lock.Unlock()
 		if !ok {
-			return nil, nil, errNilConn
+			return nil, nil, fmt.Errorf("%w: %d", errPortInUse, requestedPort)
 		}
+	}
 
-		relayAddr.IP = r.RelayAddress
-		return conn, relayAddr, nil
+	conn, err := r.Net.ListenPacket(network, net.JoinHostPort(r.Address, strconv.Itoa(requestedPort)))
+	if err != nil {
+		if inRange {
+			r.release(requestedPort)
+		}
+		return nil, nil, err
 	}
 
-	for try := 0; try < r.MaxRetries; try++ {
-		port := r.MinPort + uint16(r.Rand.Intn(int((r.MaxPort+1)-r.MinPort)))
-		conn, err := r.Net.ListenPacket(network, fmt.Sprintf("%s:%d", r.Address, port))
-		if err != nil {
-			continue
+	if inRange {
+		conn = r.newConn(conn, requestedPort)
+	}
+	return r.relayAddr(conn)
+}
+
+// bind binds a free port of the range, starting the search at a random port
+func (r *RelayAddressGeneratorPortRange) bind(network string) (net.PacketConn, error) {
+	r.lock.Lock()
+	r.init()
+	size := r.ports.size()
+	start := r.Rand.Intn(size)
+	r.lock.Unlock()
+
+	// ports that fail to bind are skipped until the search wrapped around
+	skipped, failures := 0, 0
+	var lastErr error
+	for {
+		r.lock.Lock()
+		index, ok := r.ports.nextFree((start + skipped) % size)
+		distance := (index - start + size) % size
+		if !ok || distance < skipped {
+			r.lock.Unlock()
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w: %v", errPortRangeExhausted, lastErr)
+			}
+			return nil, errPortRangeExhausted
 		}
+		port := r.ports.port(index)
+		r.ports.take(port)
+		r.lock.Unlock()
 
-		relayAddr, ok := conn.LocalAddr().(*net.UDPAddr)
-		if !ok {
-			return nil, nil, errNilConn
+		conn, err := r.Net.ListenPacket(network, net.JoinHostPort(r.Address, strconv.Itoa(port)))
+		if err == nil {
+			return r.newConn(conn, port), nil
+		}
+
+		r.release(port)
+		lastErr = err
+		if failures++; r.MaxRetries != 0 && failures >= r.MaxRetries {
+			return nil, fmt.Errorf("%w: %v", errMaxRetriesExceeded, err)
+		}
+		if skipped = distance + 1; skipped >= size {
+			return nil, fmt.Errorf("%w: %v", errPortRangeExhausted, err)
 		}
+	}
+}
 
-		relayAddr.IP = r.RelayAddress
-		return conn, relayAddr, nil
+// startRefill fills the pool of network in the background unless that is already
+// happening, the lock must be held
+func (r *RelayAddressGeneratorPortRange) startRefill(network string) {
+	if r.closed || r.refilling[network] || len(r.pool[network]) >= r.PoolSize {
+		return
 	}
 
-	return nil, nil, errMaxRetriesExceeded
+	r.refilling[network] = true
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			r.lock.Lock()
+			if r.closed || len(r.pool[network]) >= r.PoolSize {
+				r.refilling[network] = false
+				r.lock.Unlock()
+				return
+			}
+			r.lock.Unlock()
+
+			conn, err := r.bind(network)
+
+			r.lock.Lock()
+			if err != nil || r.closed {
+				r.refilling[network] = false
+				r.lock.Unlock()
+				if conn != nil {
+					_ = conn.Close()
+				}
+				return
+			}
+			r.pool[network] = append(r.pool[network], conn)
+			r.lock.Unlock()
+		}
+	}()
 }
 
-// AllocateConn generates a new Conn to receive traffic on and the IP/Port to populate the allocation response with
-func (r *RelayAddressGeneratorPortRange) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
-	return nil, nil, errTODO
+func (r *RelayAddressGeneratorPortRange) release(port int) {
+	r.lock.Lock()
+	r.ports.release(port)
+	r.lock.Unlock()
+}
+
+func (r *RelayAddressGeneratorPortRange) newConn(conn net.PacketConn, port int) net.PacketConn {
+	return newTrackedConn(conn, func() {
+		r.release(port)
+	})
+}
+
+func (r *RelayAddressGeneratorPortRange) relayAddr(conn net.PacketConn) (net.PacketConn, net.Addr, error) {
+	relayAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		_ = conn.Close()
+		return nil, nil, errNilConn
+	}
+
+	relayAddr.IP = r.RelayAddress
+	return conn, relayAddr, nil
+}
+
+// trackedConn calls release once it is closed, generators use it to learn when
+// allocations give back their relay sockets
+type trackedConn struct {
+	net.PacketConn
+	release func()
+	once    sync.Once
+}
+
+func newTrackedConn(conn net.PacketConn, release func()) *trackedConn {
+	return &trackedConn{PacketConn: conn, release: release}
+}
+
+func (c *trackedConn) Close() error {
+	err := c.PacketConn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// SyscallConn exposes the socket of *net.UDPConn, which batches reads and writes on Linux
+func (c *trackedConn) SyscallConn() (syscall.RawConn, error) {
+	if conn, ok := c.PacketConn.(syscall.Conn); ok {
+		return conn.SyscallConn()
+	}
+	return nil, errSyscallConnUnsupported
+}
+
+// portSet is a bitmap of the ports of a range that are in use
+type portSet struct {
+	min   int
+	count int
+	free  int
+	words []uint64
+}
+
+func newPortSet(min, max uint16) *portSet {
+	count := int(max) - int(min) + 1
+	s := &portSet{
+		min:   int(min),
+		count: count,
+		free:  count,
+		words: make([]uint64, (count+63)/64),
+	}
+
+	// the bits past the end of the range are never free
+	if tail := uint(count) % 64; tail != 0 {
+		s.words[len(s.words)-1] = ^uint64(0) << tail
+	}
+	return s
+}
+
+func (s *portSet) size() int {
+	return s.count
+}
+
+func (s *portSet) port(index int) int {
+	return s.min + index
+}
+
+// take marks port as used, it reports false if it was used already
+func (s *portSet) take(port int) bool {
+	index := port - s.min
+	word, bit := index/64, uint64(1)<<(uint(index)%64)
+	if s.words[word]&bit != 0 {
+		return false
+	}
+	s.words[word] |= bit
+	s.free--
+	return true
+}
+
+func (s *portSet) release(port int) {
+	index := port - s.min
+	word, bit := index/64, uint64(1)<<(uint(index)%64)
+	if s.words[word]&bit != 0 {
+		s.words[word] &^= bit
+		s.free++
+	}
+}
+
+// nextFree returns the index of the first free port at or after from, wrapping
+// around at the end of the range
+func (s *portSet) nextFree(from int) (int, bool) {
+	if s.free == 0 {
+		return 0, false
+	}
+
+	for i := 0; i <= len(s.words); i++ {
+		word := (from/64 + i) % len(s.words)
+		free := ^s.words[word]
+		if i == 0 {
+			// ports before from in the first word are only searched after wrapping around
+			free &= ^uint64(0) << (uint(from) % 64)
+		}
+		if free != 0 {
+			return word*64 + bits.TrailingZeros64(free), true
+		}
+	}
+	return 0, false
 }
@@ -0,0 +1,225 @@
+//go:build !js
+// +build !js
+
+package turn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortSet(t *testing.T) {
+	s := newPortSet(1000, 1069)
+	assert.Equal(t, 70, s.size())
+
+	// the search wraps around to the ports before from
+	assert.True(t, s.take(1069))
+	assert.False(t, s.take(1069))
+	index, ok := s.nextFree(69)
+	assert.True(t, ok)
+	assert.Equal(t, 0, index)
+
+	for port := 1000; port < 1069; port++ {
+		assert.True(t, s.take(port))
+	}
+	assert.Equal(t, 0, s.free)
+	_, ok = s.nextFree(0)
+	assert.False(t, ok)
+
+	s.release(1064)
+	s.release(1064)
+	assert.Equal(t, 1, s.free)
+	for _, from := range []int{0, 63, 64, 65, 69} {
+		index, ok = s.nextFree(from)
+		assert.True(t, ok)
+		assert.Equal(t, 64, index, "from %d", from)
+	}
+}
+
+func TestRelayAddressGeneratorPortRange(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	newGenerator := func(poolSize int) *RelayAddressGeneratorPortRange {
+		r := &RelayAddressGeneratorPortRange{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "127.0.0.1",
+			MinPort:      47000,
+			MaxPort:      47003,
+			PoolSize:     poolSize,
+		}
+		assert.NoError(t, r.Validate())
+		return r
+	}
+
+	t.Run("Exhausted", func(t *testing.T) {
+		r := newGenerator(0)
+		assert.Equal(t, 4, r.FreePorts())
+
+		var conns []net.PacketConn
+		ports := map[int]bool{}
+		for i := 0; i < 4; i++ {
+			conn, addr, err := r.AllocatePacketConn("udp4", 0)
+			assert.NoError(t, err)
+			conns = append(conns, conn)
+			ports[addr.(*net.UDPAddr).Port] = true //nolint:forcetypeassert
+		}
+		assert.Len(t, ports, 4)
+		assert.Equal(t, 0, r.FreePorts())
+
+		// every attempt fails once the range is full, not just some of them
+		for i := 0; i < 10; i++ {
+			_, _, err := r.AllocatePacketConn("udp4", 0)
+			assert.True(t, errors.Is(err, errPortRangeExhausted))
+		}
+
+		// closing a socket returns its port
+		released := conns[2].LocalAddr().(*net.UDPAddr).Port //nolint:forcetypeassert
+		assert.NoError(t, conns[2].Close())
+		assert.Error(t, conns[2].Close())
+		assert.Equal(t, 1, r.FreePorts())
+
+		conn, addr, err := r.AllocatePacketConn("udp4", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, released, addr.(*net.UDPAddr).Port) //nolint:forcetypeassert
+		conns[2] = conn
+
+		for _, conn := range conns {
+			assert.NoError(t, conn.Close())
+		}
+		assert.Equal(t, 4, r.FreePorts())
+		assert.NoError(t, r.Close())
+	})
+
+	// ports bound by other sockets are skipped
+	t.Run("BoundElsewhere", func(t *testing.T) {
+		r := newGenerator(0)
+
+		var others []net.PacketConn
+		for _, port := range []string{"47000", "47001", "47003"} {
+			other, err := net.ListenPacket("udp4", "127.0.0.1:"+port)
+			assert.NoError(t, err)
+			others = append(others, other)
+		}
+
+		for i := 0; i < 5; i++ {
+			conn, addr, err := r.AllocatePacketConn("udp4", 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 47002, addr.(*net.UDPAddr).Port) //nolint:forcetypeassert
+			assert.NoError(t, conn.Close())
+		}
+
+		conn, _, err := r.AllocatePacketConn("udp4", 0)
+		assert.NoError(t, err)
+		_, _, err = r.AllocatePacketConn("udp4", 0)
+		assert.True(t, errors.Is(err, errPortRangeExhausted))
+
+		assert.NoError(t, conn.Close())
+		for _, other := range others {
+			assert.NoError(t, other.Close())
+		}
+	})
+
+	t.Run("RequestedPort", func(t *testing.T) {
+		r := newGenerator(0)
+
+		conn, addr, err := r.AllocatePacketConn("udp4", 47001)
+		assert.NoError(t, err)
+		assert.Equal(t, 47001, addr.(*net.UDPAddr).Port) //nolint:forcetypeassert
+		assert.Equal(t, 3, r.FreePorts())
+
+		_, _, err = r.AllocatePacketConn("udp4", 47001)
+		assert.True(t, errors.Is(err, errPortInUse))
+
+		assert.NoError(t, conn.Close())
+		assert.Equal(t, 4, r.FreePorts())
+	})
+
+	t.Run("Pool", func(t *testing.T) {
+		r := newGenerator(2)
+
+		conn, _, err := r.AllocatePacketConn("udp4", 0)
+		assert.NoError(t, err)
+
+		// the pool is filled in the background, pooled sockets count as free
+		for {
+			r.lock.Lock()
+			pooled := len(r.pool["udp4"])
+			r.lock.Unlock()
+			if pooled == 2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, 3, r.FreePorts())
+
+		pooled, _, err := r.AllocatePacketConn("udp4", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, r.FreePorts())
+
+		assert.NoError(t, r.Close())
+		assert.Equal(t, 2, r.FreePorts())
+
+		assert.NoError(t, pooled.Close())
+		assert.NoError(t, conn.Close())
+		assert.Equal(t, 4, r.FreePorts())
+	})
+
+	t.Run("ClosedByServer", func(t *testing.T) {
+		r := newGenerator(2)
+
+		first, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		second, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: rejectAuthHandler,
+			PacketConnConfigs: []PacketConnConfig{
+				{PacketConn: first, RelayAddressGenerator: r},
+				{PacketConn: second, RelayAddressGenerator: r},
+			},
+			Realm:         "pion.ly",
+			LoggerFactory: logging.NewDefaultLoggerFactory(),
+		})
+		assert.NoError(t, err)
+
+		conn, _, err := r.AllocatePacketConn("udp4", 0)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+
+		// the generator stays open while a listener uses it
+		assert.NoError(t, server.RemovePacketConn(context.Background(), first))
+		r.lock.Lock()
+		assert.False(t, r.closed)
+		r.lock.Unlock()
+
+		// Shutdown waits until the listeners closed, Close returns before
+		assert.NoError(t, server.Shutdown(context.Background()))
+		r.lock.Lock()
+		assert.True(t, r.closed)
+		assert.Empty(t, r.pool)
+		r.lock.Unlock()
+		assert.Equal(t, 4, r.FreePorts())
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		r := &RelayAddressGeneratorPortRange{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "127.0.0.1",
+			MinPort:      47003,
+			MaxPort:      47000,
+		}
+		assert.ErrorIs(t, r.Validate(), errPortRangeInvalid)
+	})
+}
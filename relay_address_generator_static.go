@@ -41,9 +41,13 @@ func (r *RelayAddressGeneratorStatic) Validate() error {
 	}
 }
 
+func (r *RelayAddressGeneratorStatic) supportsNetwork(network string) bool {
+	return addressSupportsNetwork(r.Address, r.RelayAddress, network)
+}
+
 // AllocatePacketConn generates a new PacketConn to receive traffic on and the IP/Port to populate the allocation response with
 func (r *RelayAddressGeneratorStatic) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
-	conn, err := r.Net.ListenPacket(network, r.Address+":"+strconv.Itoa(requestedPort))
+	conn, err := r.Net.ListenPacket(network, net.JoinHostPort(r.Address, strconv.Itoa(requestedPort)))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package turn
+
+import "net"
+
+func listenReusePort(network, address string) (net.PacketConn, error) {
+	return nil, errReusePortUnsupported
+}
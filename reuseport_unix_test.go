@@ -0,0 +1,91 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package turn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerReusePort(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		ReusePortConfigs: []ReusePortConfig{{
+			Network: "udp4",
+			Address: "127.0.0.1:3478",
+			Sockets: 4,
+			RelayAddressGenerator: &RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "0.0.0.0",
+			},
+		}},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	listeners := server.listenersSnapshot()
+	assert.Len(t, listeners, 1)
+	assert.Len(t, listeners[0].packetConns, 4)
+
+	type testClient struct {
+		client    *Client
+		conn      net.PacketConn
+		relayConn net.PacketConn
+	}
+	var clients []testClient
+	for i := 0; i < 8; i++ {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       "user",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		clients = append(clients, testClient{client, conn, relayConn})
+	}
+	assert.Equal(t, 8, server.AllocationCount())
+
+	// closing sockets makes the kernel rehash their clients to the remaining one,
+	// which still finds every allocation
+	for _, conn := range listeners[0].packetConns[1:] {
+		assert.NoError(t, conn.Close())
+	}
+	for _, c := range clients {
+		assert.NoError(t, c.client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345}))
+	}
+
+	for _, c := range clients {
+		assert.NoError(t, c.relayConn.Close())
+		c.client.Close()
+		assert.NoError(t, c.conn.Close())
+	}
+	// the sockets closed above fail to close a second time
+	assert.Error(t, server.Close())
+}
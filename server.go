@@ -2,33 +2,73 @@
 package turn
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/batchconn"
+	"github.com/pion/turn/v2/internal/clock"
 	"github.com/pion/turn/v2/internal/proto"
 	"github.com/pion/turn/v2/internal/server"
+	"github.com/pion/turn/v2/internal/timingwheel"
 )
 
 const (
-	defaultInboundMTU = 1600
+	defaultInboundMTU    = 1600
+	shutdownPollInterval = 100 * time.Millisecond
 )
 
 // Server is an instance of the Pion TURN Server
 type Server struct {
 	log                logging.LeveledLogger
-	authHandler        AuthHandler
 	realm              string
 	channelBindTimeout time.Duration
+	permissionTimeout  time.Duration
+	nonceLifetime      time.Duration
+	lifetimePolicy     LifetimePolicy
+	tenants            *tenantSet
 	nonces             *sync.Map
-
-	packetConnConfigs  []PacketConnConfig
-	listenerConfigs    []ListenerConfig
-	allocationManagers []*allocation.Manager
+	revokedUsers       *sync.Map
+	eventHandlers      EventHandlers
+	onAuthFailure      func(*allocation.FiveTuple, string, string, stun.Method, error)
+	onResponse         func(stun.MessageType, stun.ErrorCode)
+	metrics            *serverMetrics
 	inboundMTU         int
+	batchSize          int
+	udpOffload         bool
+	logPackets         bool
+	buffers            sync.Pool
+	workers            *requestWorkers
+	expiryEvents       *eventQueue
+	clock              clock.Clock
+	timers             *timingwheel.Wheel
+	relays             *allocation.RelayIndex
+	isolatePeers       func(a, peer *allocation.Allocation) bool
+
+	drain          atomic.Value // *drainState
+	lock           sync.RWMutex
+	listeners      []*serverListener
+	removedTraffic allocation.Traffic
+	closed         bool
+	wg             sync.WaitGroup
+
+	// generators counts the listeners of the RelayAddressGenerators that are io.Closers,
+	// a generator is closed with the last of its listeners
+	generators map[io.Closer]int
+
+	// done is closed once the goroutines of the server exited after Close
+	done chan struct{}
+}
+
+type drainState struct {
+	alternateServer *stun.AlternateServer
 }
 
 // NewServer creates the Pion TURN server
@@ -44,6 +84,11 @@ func NewServer(config ServerConfig) (*Server, error) {
 		loggerFactory = logging.NewDefaultLoggerFactory()
 	}
 
+	c := config.Clock
+	if c == nil {
+		c = clock.System
+	}
+
 	mtu := defaultInboundMTU
 	if config.InboundMTU != 0 {
 		mtu = config.InboundMTU
@@ -51,65 +96,237 @@ func NewServer(config ServerConfig) (*Server, error) {
 
 	s := &Server{
 		log:                loggerFactory.NewLogger("turn"),
-		authHandler:        config.AuthHandler,
+		logPackets:         debugEnabled(loggerFactory, "turn"),
 		realm:              config.Realm,
 		channelBindTimeout: config.ChannelBindTimeout,
-		packetConnConfigs:  config.PacketConnConfigs,
-		listenerConfigs:    config.ListenerConfigs,
+		permissionTimeout:  config.PermissionTimeout,
+		nonceLifetime:      config.NonceLifetime,
+		lifetimePolicy:     config.AllocationLifetime,
 		nonces:             &sync.Map{},
+		revokedUsers:       &sync.Map{},
+		eventHandlers:      config.EventHandlers,
+		onAuthFailure:      config.EventHandlers.authFailureHandler(c),
 		inboundMTU:         mtu,
+		batchSize:          config.BatchSize,
+		udpOffload:         config.UDPOffload,
+		clock:              c,
+		timers:             timingwheel.New(allocation.TimerTick, c),
+		relays:             allocation.NewRelayIndex(),
+		generators:         map[io.Closer]int{},
+		done:               make(chan struct{}),
+	}
+
+	if config.TenantIsolation != nil {
+		s.isolatePeers = config.TenantIsolation.permits()
+	}
+
+	s.expiryEvents = newEventQueue()
+
+	s.tenants = newTenantSet(config, s.userRevoked)
+
+	if config.RequestWorkers > 0 {
+		queueSize := defaultRequestQueueSize
+		if config.RequestQueueSize != 0 {
+			queueSize = config.RequestQueueSize
+		}
+		s.workers = newRequestWorkers(s, config.RequestWorkers, queueSize)
 	}
 
 	if s.channelBindTimeout == 0 {
 		s.channelBindTimeout = proto.DefaultLifetime
 	}
+	if s.permissionTimeout == 0 {
+		s.permissionTimeout = allocation.DefaultPermissionTimeout
+	}
+	if s.nonceLifetime == 0 {
+		s.nonceLifetime = server.DefaultNonceLifetime
+	}
+
+	if config.EnableMetrics {
+		s.metrics = newServerMetrics(s)
+		s.onResponse = s.metrics.onResponse
+
+		onAuthFailure := s.onAuthFailure
+		s.onAuthFailure = func(fiveTuple *allocation.FiveTuple, username, realm string, method stun.Method, err error) {
+			s.metrics.authFailed()
+			if onAuthFailure != nil {
+				onAuthFailure(fiveTuple, username, realm, method, err)
+			}
+		}
+	}
+
+	// the listeners added before one fails are closed with the server
+	fail := func(err error) (*Server, error) {
+		if closeErr := s.Close(); closeErr != nil {
+			s.log.Errorf("Failed to close server: %s", closeErr)
+		}
+		return nil, err
+	}
 
-	for _, cfg := range s.packetConnConfigs {
-		am, err := s.createAllocationManager(cfg.RelayAddressGenerator, cfg.PermissionHandler)
+	for _, cfg := range config.PacketConnConfigs {
+		l, err := s.addListener([]net.PacketConn{cfg.PacketConn}, nil, cfg.RelayAddressGenerator, cfg.PermissionHandler, cfg.Tenant, cfg.ProxyProtocol)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create AllocationManager: %w", err)
+			return fail(err)
 		}
 
-		go s.readPacketConn(cfg, am)
+		go s.servePacketConn(l)
 	}
 
-	for _, cfg := range s.listenerConfigs {
-		am, err := s.createAllocationManager(cfg.RelayAddressGenerator, cfg.PermissionHandler)
+	for _, cfg := range config.ListenerConfigs {
+		l, err := s.addListener(nil, cfg.Listener, cfg.RelayAddressGenerator, cfg.PermissionHandler, cfg.Tenant, cfg.ProxyProtocol)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create AllocationManager: %w", err)
+			return fail(err)
 		}
 
-		go s.readListener(cfg, am)
+		go s.serveListener(l)
+	}
+
+	for _, cfg := range config.ReusePortConfigs {
+		conns, err := cfg.listen()
+		if err != nil {
+			return fail(err)
+		}
+
+		l, err := s.addListener(conns, nil, cfg.RelayAddressGenerator, cfg.PermissionHandler, cfg.Tenant, cfg.ProxyProtocol)
+		if err != nil {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+			return fail(err)
+		}
+
+		go s.servePacketConn(l)
 	}
 
 	return s, nil
 }
 
+// debugEnabled reports if the loggers of scope log debug messages. Loggers of other
+// factories than the default one can not tell and are assumed to.
+func debugEnabled(loggerFactory logging.LoggerFactory, scope string) bool {
+	f, ok := loggerFactory.(*logging.DefaultLoggerFactory)
+	if !ok {
+		return true
+	}
+
+	level, ok := f.ScopeLevels[scope]
+	if !ok {
+		level = f.DefaultLogLevel
+	}
+	return level >= logging.LogLevelDebug
+}
+
 // AllocationCount returns the number of active allocations. It can be used to drain the server before closing
 func (s *Server) AllocationCount() int {
 	allocs := 0
-	for _, am := range s.allocationManagers {
+	for _, am := range s.allocationManagers() {
 		allocs += am.AllocationCount()
 	}
 	return allocs
 }
 
-// Close stops the TURN Server. It cleans up any associated state and closes all connections it is managing
+// Drain stops the server from accepting new allocations while existing allocations
+// can still be refreshed and keep relaying. New Allocate requests are rejected with a
+// 300 (Try Alternate) error pointing to alternateServer, or with a 508 (Insufficient
+// Capacity) error if alternateServer is nil.
+func (s *Server) Drain(alternateServer net.Addr) error {
+	state := &drainState{}
+	if alternateServer != nil {
+		switch addr := alternateServer.(type) {
+		case *net.UDPAddr:
+			state.alternateServer = &stun.AlternateServer{IP: addr.IP, Port: addr.Port}
+		case *net.TCPAddr:
+			state.alternateServer = &stun.AlternateServer{IP: addr.IP, Port: addr.Port}
+		default:
+			return fmt.Errorf("%w: %s", errInvalidAlternateServer, alternateServer)
+		}
+	}
+
+	s.drain.Store(state)
+	return nil
+}
+
+// Shutdown gracefully stops the TURN Server. It waits until every allocation expired
+// or was deleted, closes the server like Close and waits until its goroutines exited.
+// If ctx is done first the server is closed right away and the context error is returned. Call Drain with an alternate
+// server first to redirect new allocations to it, otherwise Shutdown drains the server
+// with Drain(nil) and new Allocate requests are rejected with 508 (Insufficient Capacity).
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.drainState() == nil {
+		if err := s.Drain(nil); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	var ctxErr error
+	for ctxErr == nil && s.AllocationCount() != 0 {
+		select {
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if ctxErr != nil {
+		return ctxErr
+	}
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) drainState() *drainState {
+	return loadDrainState(&s.drain)
+}
+
+func loadDrainState(v *atomic.Value) *drainState {
+	state, _ := v.Load().(*drainState)
+	return state
+}
+
+// Close stops the TURN Server. It cleans up any associated state and closes all connections it is managing.
+// It returns once the listeners are closed, the goroutines of the server exit and close the
+// allocations in the background, so handlers may call Close as well. Shutdown waits for them.
+// Further calls return nil.
 func (s *Server) Close() error {
 	var errors []error
 
-	for _, cfg := range s.packetConnConfigs {
-		if err := cfg.PacketConn.Close(); err != nil {
-			errors = append(errors, err)
-		}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
 	}
+	s.closed = true
+	listeners := append([]*serverListener{}, s.listeners...)
+	s.lock.Unlock()
 
-	for _, cfg := range s.listenerConfigs {
-		if err := cfg.Listener.Close(); err != nil {
+	for _, l := range listeners {
+		if err := l.close(); err != nil {
 			errors = append(errors, err)
 		}
 	}
 
+	go func() {
+		defer close(s.done)
+
+		s.wg.Wait()
+		if s.workers != nil {
+			s.workers.close()
+		}
+		s.timers.Close()
+		s.expiryEvents.close()
+	}()
+
 	if len(errors) == 0 {
 		return nil
 	}
@@ -122,76 +339,116 @@ func (s *Server) Close() error {
 	return err
 }
 
-func (s *Server) readPacketConn(p PacketConnConfig, am *allocation.Manager) {
-	s.readLoop(p.PacketConn, am)
+// readLoop handles the requests received on p, c is nil unless p is a connection of a listener
+func (s *Server) readLoop(p net.PacketConn, l *serverListener, c *connContext) {
+	if s.batchSize > 1 {
+		s.batchReadLoop(p, l, c)
+		return
+	}
 
-	if err := am.Close(); err != nil {
-		s.log.Errorf("Failed to close AllocationManager: %s", err)
+	for {
+		buf := s.getBuffer()
+		n, addr, err := p.ReadFrom(*buf)
+		if err != nil {
+			s.putBuffer(buf)
+			s.log.Debugf("exit read loop on error: %s", err.Error())
+			s.metrics.readLoopError()
+			return
+		}
+
+		s.handlePacket(p, l, c, buf, n, addr)
 	}
 }
 
-func (s *Server) readListener(l ListenerConfig, am *allocation.Manager) {
+// batchReadLoop reads like readLoop, up to batchSize datagrams with one syscall
+func (s *Server) batchReadLoop(p net.PacketConn, l *serverListener, c *connContext) {
+	conn := batchconn.New(p, batchconn.Offload{})
+
+	buffers := make([]*[]byte, s.batchSize)
+	msgs := make([]batchconn.Message, s.batchSize)
+	for i := range msgs {
+		buffers[i] = s.getBuffer()
+		msgs[i].Buffer = *buffers[i]
+	}
 	defer func() {
-		if err := am.Close(); err != nil {
-			s.log.Errorf("Failed to close AllocationManager: %s", err)
+		for _, buf := range buffers {
+			s.putBuffer(buf)
 		}
 	}()
 
 	for {
-		conn, err := l.Listener.Accept()
+		n, err := conn.ReadBatch(msgs)
 		if err != nil {
-			s.log.Debugf("Failed to accept: %s", err)
+			s.log.Debugf("exit read loop on error: %s", err.Error())
+			s.metrics.readLoopError()
 			return
 		}
 
-		go s.readLoop(NewSTUNConn(conn), am)
+		for i := 0; i < n; i++ {
+			s.handlePacket(p, l, c, buffers[i], msgs[i].N, msgs[i].Addr)
+			buffers[i] = s.getBuffer()
+			msgs[i].Buffer = *buffers[i]
+		}
 	}
 }
 
-func (s *Server) createAllocationManager(addrGenerator RelayAddressGenerator, handler PermissionHandler) (*allocation.Manager, error) {
-	if handler == nil {
-		handler = DefaultPermissionHandler
+// handlePacket handles the n bytes in buf received from addr and returns buf to
+// the buffer pool once done
+func (s *Server) handlePacket(p net.PacketConn, l *serverListener, c *connContext, buf *[]byte, n int, addr net.Addr) {
+	if n >= s.inboundMTU {
+		s.log.Debugf("Read bytes exceeded MTU, packet is possibly truncated")
+		s.metrics.truncatedPacket()
 	}
 
-	am, err := allocation.NewManager(allocation.ManagerConfig{
-		AllocatePacketConn: addrGenerator.AllocatePacketConn,
-		AllocateConn:       addrGenerator.AllocateConn,
-		PermissionHandler:  handler,
-		LeveledLogger:      s.log,
-	})
-	if err != nil {
-		return am, err
+	drain := s.drainState()
+	if drain == nil {
+		drain = l.drainState()
+	}
+	var alternateServer *stun.AlternateServer
+	if drain != nil {
+		alternateServer = drain.alternateServer
 	}
 
-	s.allocationManagers = append(s.allocationManagers, am)
+	r := server.Request{
+		Conn:               p,
+		SrcAddr:            addr,
+		Buff:               (*buf)[:n],
+		Log:                s.log,
+		LogPackets:         s.logPackets,
+		AllocationManager:  l.allocationManager,
+		ChannelBindTimeout: s.channelBindTimeout,
+		NonceLifetime:      s.nonceLifetime,
+		Nonces:             s.nonces,
+		Clock:              s.clock,
+		Draining:           drain != nil,
+		AlternateServer:    alternateServer,
+		OnAuthFailure:      s.onAuthFailure,
+		OnResponse:         s.onResponse,
+	}
+	t := l.tenant
+	if c != nil {
+		t = c.tenant
+		r.ServerName = c.serverName
+	}
+	s.tenants.useTenant(&r, t)
+
+	// ChannelData is relayed right away, only requests are worth queueing
+	if s.workers == nil || proto.IsChannelData(r.Buff) {
+		s.handleRequest(r)
+		s.putBuffer(buf)
+		return
+	}
 
-	return am, err
+	if !s.workers.dispatch(r, buf, l) {
+		s.log.Debugf("Dropping request from %s, the request queue is full", addr)
+		s.metrics.droppedRequest()
+		s.putBuffer(buf)
+	}
 }
 
-func (s *Server) readLoop(p net.PacketConn, allocationManager *allocation.Manager) {
-	buf := make([]byte, s.inboundMTU)
-	for {
-		n, addr, err := p.ReadFrom(buf)
-		switch {
-		case err != nil:
-			s.log.Debugf("exit read loop on error: %s", err.Error())
-			return
-		case n >= s.inboundMTU:
-			s.log.Debugf("Read bytes exceeded MTU, packet is possibly truncated")
-		}
-
-		if err := server.HandleRequest(server.Request{
-			Conn:               p,
-			SrcAddr:            addr,
-			Buff:               buf[:n],
-			Log:                s.log,
-			AuthHandler:        s.authHandler,
-			Realm:              s.realm,
-			AllocationManager:  allocationManager,
-			ChannelBindTimeout: s.channelBindTimeout,
-			Nonces:             s.nonces,
-		}); err != nil {
-			s.log.Errorf("error when handling datagram: %v", err)
-		}
+func (s *Server) handleRequest(r server.Request) {
+	if err := server.HandleRequest(r); err != nil {
+		s.log.Errorf("error when handling datagram: %v", err)
+		s.metrics.readLoopError()
 	}
 }
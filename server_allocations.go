@@ -0,0 +1,172 @@
+package turn
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+// PermissionInfo is a snapshot of a permission installed on an allocation
+type PermissionInfo struct {
+	PeerAddr  net.Addr
+	ExpiresAt time.Time
+	Traffic   TrafficCounters
+}
+
+// ChannelInfo is a snapshot of a channel binding of an allocation
+type ChannelInfo struct {
+	Number    uint16
+	PeerAddr  net.Addr
+	ExpiresAt time.Time
+	Traffic   TrafficCounters
+}
+
+// AllocationInfo is a point in time snapshot of an allocation, as returned by Server.Allocations
+type AllocationInfo struct {
+	FiveTuple         FiveTuple
+	Username          string
+	Realm             string
+	RelayAddr         net.Addr
+	CreatedAt         time.Time
+	RemainingLifetime time.Duration
+	Permissions       []PermissionInfo
+	Channels          []ChannelInfo
+	Traffic           TrafficCounters
+}
+
+func newAllocationInfo(a *allocation.Allocation, now time.Time) AllocationInfo {
+	info := AllocationInfo{
+		FiveTuple:         newFiveTuple(a.FiveTuple()),
+		Username:          a.Username(),
+		Realm:             a.Realm(),
+		RelayAddr:         a.RelayAddr,
+		CreatedAt:         a.CreatedAt(),
+		RemainingLifetime: a.ExpiresAt().Sub(now),
+		Traffic:           newTrafficCounters(a.Traffic()),
+	}
+	if info.RemainingLifetime < 0 {
+		info.RemainingLifetime = 0
+	}
+
+	for _, p := range a.Permissions() {
+		info.Permissions = append(info.Permissions, PermissionInfo{
+			PeerAddr:  p.Addr,
+			ExpiresAt: p.ExpiresAt(),
+			Traffic:   newTrafficCounters(p.Traffic()),
+		})
+	}
+
+	for _, c := range a.ChannelBinds() {
+		info.Channels = append(info.Channels, ChannelInfo{
+			Number:    uint16(c.Number),
+			PeerAddr:  c.Peer,
+			ExpiresAt: c.ExpiresAt(),
+			Traffic:   newTrafficCounters(c.Traffic()),
+		})
+	}
+
+	return info
+}
+
+func (f FiveTuple) internal() *allocation.FiveTuple {
+	fiveTuple := &allocation.FiveTuple{
+		SrcAddr: f.SrcAddr,
+		DstAddr: f.DstAddr,
+	}
+	if f.Protocol == allocation.TCP.String() {
+		fiveTuple.Protocol = allocation.TCP
+	}
+	return fiveTuple
+}
+
+// Allocations returns a snapshot of every active allocation
+func (s *Server) Allocations() []AllocationInfo {
+	var infos []AllocationInfo
+	for _, am := range s.allocationManagers() {
+		for _, a := range am.Allocations() {
+			infos = append(infos, newAllocationInfo(a, s.clock.Now()))
+		}
+	}
+	return infos
+}
+
+// DeleteAllocation forcibly deletes the allocation identified by fiveTuple, the
+// client is not notified. It returns false if no such allocation exists.
+func (s *Server) DeleteAllocation(fiveTuple FiveTuple) bool {
+	f := fiveTuple.internal()
+	if f.SrcAddr == nil || f.DstAddr == nil {
+		return false
+	}
+
+	for _, am := range s.allocationManagers() {
+		if am.DeleteAllocation(f, allocation.DeleteReasonAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteAllocations forcibly deletes every allocation for which filter returns true
+// and returns the number of deleted allocations. A nil filter matches every allocation.
+func (s *Server) DeleteAllocations(filter func(AllocationInfo) bool) int {
+	deleted := 0
+	for _, am := range s.allocationManagers() {
+		for _, a := range am.Allocations() {
+			if filter != nil && !filter(newAllocationInfo(a, s.clock.Now())) {
+				continue
+			}
+
+			// allocations that expired or were deleted meanwhile are not counted
+			if am.DeleteAllocation(a.FiveTuple(), allocation.DeleteReasonAdmin) {
+				deleted++
+			}
+		}
+	}
+	return deleted
+}
+
+// RevokedUser is a user of a realm revoked by RevokeUser
+type RevokedUser struct {
+	Realm    string `json:"realm"`
+	Username string `json:"username"`
+}
+
+// RevokeUser rejects every further request authenticated as username in realm and
+// deletes the allocations of the user in realm. Users of the same name in other
+// realms are not affected. It returns the number of deleted allocations.
+func (s *Server) RevokeUser(realm, username string) int {
+	s.revokedUsers.Store(RevokedUser{Realm: realm, Username: username}, struct{}{})
+	return s.DeleteAllocations(func(a AllocationInfo) bool {
+		return a.Realm == realm && a.Username == username
+	})
+}
+
+// RestoreUser lifts a revocation made by RevokeUser
+func (s *Server) RestoreUser(realm, username string) {
+	s.revokedUsers.Delete(RevokedUser{Realm: realm, Username: username})
+}
+
+// RevokedUsers returns the users currently revoked by RevokeUser, sorted by realm and username
+func (s *Server) RevokedUsers() []RevokedUser {
+	users := []RevokedUser{}
+	s.revokedUsers.Range(func(key, _ interface{}) bool {
+		if user, ok := key.(RevokedUser); ok {
+			users = append(users, user)
+		}
+		return true
+	})
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Realm != users[j].Realm {
+			return users[i].Realm < users[j].Realm
+		}
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+func (s *Server) userRevoked(realm, username string) bool {
+	_, revoked := s.revokedUsers.Load(RevokedUser{Realm: realm, Username: username})
+	return revoked
+}
@@ -4,14 +4,19 @@ import (
 	"crypto/md5" //nolint:gosec,gci
 	"fmt"
 	"net"
+	"runtime"
 	"strings"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/server"
 )
 
 // RelayAddressGenerator is used to generate a RelayAddress when creating an allocation.
 // You can use one of the provided ones or provide your own.
+// Generators that implement io.Closer are closed by the Server once the last listener
+// using them is closed.
 type RelayAddressGenerator interface {
 	// Validate confirms that the RelayAddressGenerator is properly initialized
 	Validate() error
@@ -23,6 +28,114 @@ type RelayAddressGenerator interface {
 	AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error)
 }
 
+// RequestRelayAddressGenerator is a RelayAddressGenerator that places relays by the allocation
+// they are created for, e.g. on dedicated IPs for some users or on the interface the client
+// came in on. The server calls AllocateRelayPacketConn instead of AllocatePacketConn for
+// generators implementing it.
+type RequestRelayAddressGenerator interface {
+	RelayAddressGenerator
+
+	// Allocate a PacketConn (UDP) RelayAddress for req
+	AllocateRelayPacketConn(req RelayAllocationRequest) (net.PacketConn, net.Addr, error)
+}
+
+// RelayAllocationRequest describes the allocation a relay is created for
+type RelayAllocationRequest struct {
+	// FiveTuple identifies the allocation, its DstAddr is the server address the client sent to
+	FiveTuple FiveTuple
+
+	// Listener is the address of the PacketConn or Listener the request arrived on
+	Listener net.Addr
+
+	// Network is udp4, or udp6 if the client asked for an IPv6 relay with REQUESTED-ADDRESS-FAMILY
+	Network string
+
+	// RequestedPort is the port to relay on, it is set for the port reserved by an
+	// earlier allocation and 0 otherwise
+	RequestedPort int
+
+	Username string
+	Realm    string
+
+	// EvenPort is set if the client asked for an even port with EVEN-PORT, ReservePort
+	// if it asked to reserve the next higher port as well
+	EvenPort    bool
+	ReservePort bool
+
+	// DontFragment is set if the client asked for relaying without fragmentation. The
+	// server sets the DF bit on the returned PacketConn, it answers DONT-FRAGMENT with
+	// a 420 (Unknown Attribute) error on platforms it cannot set the bit on.
+	DontFragment bool
+}
+
+// AdaptRelayAddressGenerator returns g if it is a RequestRelayAddressGenerator, and otherwise
+// a RequestRelayAddressGenerator that passes the network and the requested port to g
+func AdaptRelayAddressGenerator(g RelayAddressGenerator) RequestRelayAddressGenerator {
+	if r, ok := g.(RequestRelayAddressGenerator); ok {
+		return r
+	}
+	return relayAddressGeneratorAdapter{g}
+}
+
+type relayAddressGeneratorAdapter struct {
+	RelayAddressGenerator
+}
+
+func (a relayAddressGeneratorAdapter) AllocateRelayPacketConn(req RelayAllocationRequest) (net.PacketConn, net.Addr, error) {
+	return a.AllocatePacketConn(req.Network, req.RequestedPort)
+}
+
+func newRelayAllocationRequest(req allocation.RelayRequest, listener net.Addr) RelayAllocationRequest {
+	return RelayAllocationRequest{
+		FiveTuple:     newFiveTuple(req.FiveTuple),
+		Listener:      listener,
+		Network:       req.Network,
+		RequestedPort: req.RequestedPort,
+		Username:      req.Username,
+		Realm:         req.Realm,
+		EvenPort:      req.EvenPort,
+		ReservePort:   req.ReservePort,
+		DontFragment:  req.DontFragment,
+	}
+}
+
+// relayNetworkSupporter is implemented by the generators that know which networks
+// they can allocate relays in
+type relayNetworkSupporter interface {
+	supportsNetwork(network string) bool
+}
+
+// relayNetworkSupported reports if g can allocate relays of network, udp4 or udp6.
+// Generators that do not know are assumed to support every network.
+func relayNetworkSupported(g RelayAddressGenerator, network string) bool {
+	if s, ok := g.(relayNetworkSupporter); ok {
+		return s.supportsNetwork(network)
+	}
+	return true
+}
+
+// addressSupportsNetwork reports if relays of network can be bound to address and
+// returned as relayAddress, which is nil if the bound address is returned. Host
+// names are assumed to resolve to both families and "::" binds both families.
+func addressSupportsNetwork(address string, relayAddress net.IP, network string) bool {
+	ipv6 := network == "udp6"
+	if relayAddress != nil && (relayAddress.To4() == nil) != ipv6 {
+		return false
+	}
+
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return true
+	case ip.To4() != nil:
+		return !ipv6
+	case ip.IsUnspecified():
+		return true
+	default:
+		return ipv6
+	}
+}
+
 // PermissionHandler is a callback to filter incoming CreatePermission and ChannelBindRequest
 // requests based on the client IP address and port and the peer IP address the client intends to
 // connect to. If the client is behind a NAT then the filter acts on the server reflexive
@@ -48,6 +161,13 @@ type PacketConnConfig struct {
 	// case the DefaultPermissionHandler is automatically instantiated to admit all peer
 	// connections
 	PermissionHandler PermissionHandler
+
+	// Tenant is the Realm of the Tenant handling every request of the listener, requests
+	// are assigned to tenants by TLS server name and REALM if it is empty
+	Tenant string
+
+	// ProxyProtocol strips the PROXY protocol headers of datagrams from load balancers
+	ProxyProtocol *ProxyProtocolConfig
 }
 
 func (c *PacketConnConfig) validate() error {
@@ -57,6 +177,9 @@ func (c *PacketConnConfig) validate() error {
 	if c.RelayAddressGenerator == nil {
 		return errRelayAddressGeneratorUnset
 	}
+	if err := c.ProxyProtocol.validate(); err != nil {
+		return err
+	}
 
 	return c.RelayAddressGenerator.Validate()
 }
@@ -73,6 +196,15 @@ type ListenerConfig struct {
 	// case the DefaultPermissionHandler is automatically instantiated to admit all peer
 	// connections
 	PermissionHandler PermissionHandler
+
+	// Tenant is the Realm of the Tenant handling every request of the listener, requests
+	// are assigned to tenants by TLS server name and REALM if it is empty
+	Tenant string
+
+	// ProxyProtocol reads the PROXY protocol headers of connections from load balancers.
+	// Headers precede the TLS handshake, so it must not be combined with a TLS listener,
+	// which takes it in TLSListenerConfig or wraps NewProxyProtocolListener instead.
+	ProxyProtocol *ProxyProtocolConfig
 }
 
 func (c *ListenerConfig) validate() error {
@@ -83,13 +215,94 @@ func (c *ListenerConfig) validate() error {
 	if c.RelayAddressGenerator == nil {
 		return errRelayAddressGeneratorUnset
 	}
+	if err := c.ProxyProtocol.validate(); err != nil {
+		return err
+	}
 
 	return c.RelayAddressGenerator.Validate()
 }
 
+// ReusePortConfig opens several UDP sockets bound to the same address with SO_REUSEPORT,
+// the kernel spreads clients over the sockets by their 5-tuple. Unlike separate
+// PacketConnConfigs the sockets share one allocation table, so a client rehashed to
+// another socket keeps its allocation. SO_REUSEPORT is not available on every platform.
+type ReusePortConfig struct {
+	// Network is the network passed to net.ListenPacket. Defaults to "udp".
+	Network string
+
+	// Address is the local address all sockets are bound to
+	Address string
+
+	// Sockets is the number of sockets to open. Defaults to runtime.NumCPU().
+	Sockets int
+
+	// When an allocation is generated the RelayAddressGenerator
+	// creates the net.PacketConn and returns the IP/Port it is available at
+	RelayAddressGenerator RelayAddressGenerator
+
+	// PermissionHandler is a callback to filter peer addresses. Can be set as nil, in which
+	// case the DefaultPermissionHandler is automatically instantiated to admit all peer
+	// connections
+	PermissionHandler PermissionHandler
+
+	// Tenant is the Realm of the Tenant handling every request of the listener, requests
+	// are assigned to tenants by TLS server name and REALM if it is empty
+	Tenant string
+
+	// ProxyProtocol strips the PROXY protocol headers of datagrams from load balancers
+	ProxyProtocol *ProxyProtocolConfig
+}
+
+func (c *ReusePortConfig) validate() error {
+	if c.Address == "" {
+		return errReusePortAddressUnset
+	}
+	if c.Sockets < 0 {
+		return errReusePortSocketsNegative
+	}
+	if c.RelayAddressGenerator == nil {
+		return errRelayAddressGeneratorUnset
+	}
+	if err := c.ProxyProtocol.validate(); err != nil {
+		return err
+	}
+
+	return c.RelayAddressGenerator.Validate()
+}
+
+func (c *ReusePortConfig) listen() ([]net.PacketConn, error) {
+	network, sockets := c.Network, c.Sockets
+	if network == "" {
+		network = "udp"
+	}
+	if sockets == 0 {
+		sockets = runtime.NumCPU()
+	}
+
+	conns := make([]net.PacketConn, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		conn, err := listenReusePort(network, c.Address)
+		if err != nil {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
 // AuthHandler is a callback used to handle incoming auth requests, allowing users to customize Pion TURN with custom behavior
 type AuthHandler func(username, realm string, srcAddr net.Addr) (key []byte, ok bool)
 
+// AuthRequest describes a request an AuthRequestHandler authenticates, including the
+// TLS server name (SNI) the client connected with
+type AuthRequest = server.AuthRequest
+
+// AuthRequestHandler is an AuthHandler that is told about the connection of the request
+type AuthRequestHandler func(r AuthRequest) (key []byte, ok bool)
+
 // GenerateAuthKey is a convenience function to easily generate keys in the format used by AuthHandler
 func GenerateAuthKey(username, realm, password string) []byte {
 	// #nosec
@@ -98,6 +311,43 @@ func GenerateAuthKey(username, realm, password string) []byte {
 	return h.Sum(nil)
 }
 
+// LifetimePolicy bounds the lifetime of allocations. Requested lifetimes are clamped to
+// [Min, Max] and allocations that do not request one get Default. Zero values default to
+// 10 minutes for Default, to Default for Min and to an hour for Max, RFC 8656 Section 7.2.
+type LifetimePolicy = server.LifetimePolicy
+
+// LifetimePolicyHandler returns the LifetimePolicy of a user on Allocate and Refresh
+// requests, its zero values keep the LifetimePolicy of the server. Max wins when the
+// resulting Min is above it, so returning a low Max is enough to shorten allocations.
+type LifetimePolicyHandler func(username, realm string, srcAddr net.Addr) LifetimePolicy
+
+// TenantIsolation makes the server relay only between its own clients. CreatePermission
+// and ChannelBind requests fail with 403 (Forbidden) unless the peer address is the relayed
+// transport address of another live allocation, on any listener of the server, in the realm
+// of the requesting allocation or in one of the realms it may reach. Data is only relayed
+// to such allocations, so a relayed address that was handed to an allocation of another
+// realm after the permission was granted does not receive it.
+type TenantIsolation struct {
+	// AllowedRealms maps a realm to the other realms its allocations may relay to. Each
+	// direction is checked on its own, the allocations of both realms need permissions.
+	AllowedRealms map[string][]string
+}
+
+// permits is the allocation.ManagerConfig.IsolatePeers of the isolation
+func (t *TenantIsolation) permits() func(a, peer *allocation.Allocation) bool {
+	allowed := make(map[string]map[string]bool, len(t.AllowedRealms))
+	for realm, peerRealms := range t.AllowedRealms {
+		allowed[realm] = make(map[string]bool, len(peerRealms))
+		for _, peerRealm := range peerRealms {
+			allowed[realm][peerRealm] = true
+		}
+	}
+
+	return func(a, peer *allocation.Allocation) bool {
+		return a.Realm() == peer.Realm() || allowed[a.Realm()][peer.Realm()]
+	}
+}
+
 // ServerConfig configures the Pion TURN Server
 type ServerConfig struct {
 	// PacketConnConfigs and ListenerConfigs are a list of all the turn listeners
@@ -105,6 +355,10 @@ type ServerConfig struct {
 	PacketConnConfigs []PacketConnConfig
 	ListenerConfigs   []ListenerConfig
 
+	// ReusePortConfigs are UDP listeners made of several SO_REUSEPORT sockets
+	// that share their allocations
+	ReusePortConfigs []ReusePortConfig
+
 	// LoggerFactory must be set for logging from this server.
 	LoggerFactory logging.LoggerFactory
 
@@ -114,18 +368,98 @@ type ServerConfig struct {
 	// AuthHandler is a callback used to handle incoming auth requests, allowing users to customize Pion TURN with custom behavior
 	AuthHandler AuthHandler
 
+	// AuthRequestHandler is used instead of AuthHandler if set
+	AuthRequestHandler AuthRequestHandler
+
 	// ChannelBindTimeout sets the lifetime of channel binding. Defaults to 10 minutes.
 	ChannelBindTimeout time.Duration
 
+	// PermissionTimeout sets the lifetime of permissions. Defaults to 5 minutes.
+	PermissionTimeout time.Duration
+
+	// NonceLifetime sets how long nonces are accepted before clients have to retry
+	// with a new one. Defaults to an hour.
+	NonceLifetime time.Duration
+
+	// AllocationLifetime sets the default, minimum and maximum lifetimes of allocations
+	AllocationLifetime LifetimePolicy
+
+	// LifetimePolicyHandler overrides AllocationLifetime per user if set
+	LifetimePolicyHandler LifetimePolicyHandler
+
+	// Tenants are customers with their own realms, credentials and policies, see Tenant
+	Tenants []Tenant
+
+	// TenantIsolation restricts peers to the relayed addresses of other allocations if set
+	TenantIsolation *TenantIsolation
+
 	// Sets the server inbound MTU(Maximum transmition unit). Defaults to 1600 bytes.
 	InboundMTU int
+
+	// RequestWorkers is the number of goroutines handling STUN requests off the socket
+	// read loops. ChannelData is always relayed from the read loops. Defaults to 0, which
+	// handles every request in the read loops.
+	RequestWorkers int
+
+	// RequestQueueSize is the number of requests queued per worker, requests are dropped
+	// when the queue is full. Defaults to 128.
+	RequestQueueSize int
+
+	// BatchSize is the number of datagrams read from the listeners and relay sockets,
+	// and written to the clients, with a single recvmmsg or sendmmsg syscall on Linux.
+	// Defaults to 0, which reads and writes one datagram per syscall. Batching saves
+	// syscalls when datagrams queue up on busy sockets, but adds work per datagram
+	// when they do not, so it is not enabled by default. BenchmarkServerRelay relays
+	// anywhere from 25% faster to 40% slower with a BatchSize of 32 depending on the
+	// machine, measure with the traffic of the server before enabling it.
+	BatchSize int
+
+	// UDPOffload relays the batches sent to a client with UDP GSO and reads the relay
+	// sockets with UDP GRO, on Linux kernels supporting them. It needs a BatchSize above 1,
+	// and GRO takes a 64 KiB read buffer per allocation.
+	UDPOffload bool
+
+	// EventHandlers are callbacks fired on allocation, permission, channel binding and authentication events
+	EventHandlers EventHandlers
+
+	// EnableMetrics collects server metrics that are exposed in the Prometheus
+	// text format by Server.MetricsHandler
+	EnableMetrics bool
+
+	// Clock is the time source of the lifetimes of nonces, allocations, permissions and
+	// channel bindings, and of the times reported to EventHandlers. Defaults to the system clock.
+	Clock Clock
 }
 
 func (s *ServerConfig) validate() error {
-	if len(s.PacketConnConfigs) == 0 && len(s.ListenerConfigs) == 0 {
+	if len(s.PacketConnConfigs) == 0 && len(s.ListenerConfigs) == 0 && len(s.ReusePortConfigs) == 0 {
 		return errNoAvailableConns
 	}
 
+	if s.RequestWorkers < 0 || s.RequestQueueSize < 0 {
+		return errRequestWorkersNegative
+	}
+
+	if s.BatchSize < 0 {
+		return errBatchSizeNegative
+	}
+
+	if s.ChannelBindTimeout < 0 || s.PermissionTimeout < 0 || s.NonceLifetime < 0 {
+		return errLifetimeNegative
+	}
+
+	lifetime := s.AllocationLifetime
+	if lifetime.Default < 0 || lifetime.Min < 0 || lifetime.Max < 0 {
+		return errLifetimeNegative
+	}
+	if lifetime = lifetime.WithDefaults(); lifetime.Min > lifetime.Default || lifetime.Default > lifetime.Max {
+		return errLifetimePolicyInvalid
+	}
+
+	if err := validateTenants(s); err != nil {
+		return err
+	}
+
 	for _, s := range s.PacketConnConfigs {
 		if err := s.validate(); err != nil {
 			return err
@@ -138,5 +472,11 @@ func (s *ServerConfig) validate() error {
 		}
 	}
 
+	for _, s := range s.ReusePortConfigs {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,466 @@
+package turn
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+)
+
+// serverListener is a net.Listener or one or more net.PacketConns attached to the
+// Server together with the allocations created through it. Several PacketConns are
+// SO_REUSEPORT sockets bound to the same address that share the allocations.
+type serverListener struct {
+	packetConns           []net.PacketConn
+	listener              net.Listener
+	relayAddressGenerator RelayAddressGenerator
+	allocationManager     *allocation.Manager
+	tenant                *tenant // handles every request of the listener if set
+	proxyProtocol         *ProxyProtocolConfig
+
+	drain    atomic.Value      // *drainState
+	handover *listenerHandover // set by Server.Handover, guarded by the lock of the Server
+	done     chan struct{}
+	requests sync.WaitGroup // requests queued for the request workers
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+	connsWg   sync.WaitGroup
+}
+
+func (l *serverListener) addr() net.Addr {
+	if l.listener != nil {
+		return l.listener.Addr()
+	}
+	return l.packetConns[0].LocalAddr()
+}
+
+func (l *serverListener) close() error {
+	if l.listener != nil {
+		return l.listener.Close()
+	}
+
+	var err error
+	for _, conn := range l.packetConns {
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// servesPacketConn reports if conn is one of the PacketConns of the listener
+func (l *serverListener) servesPacketConn(conn net.PacketConn) bool {
+	for _, c := range l.packetConns {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *serverListener) drainState() *drainState {
+	return loadDrainState(&l.drain)
+}
+
+func (l *serverListener) addConn(conn net.Conn) {
+	l.connsLock.Lock()
+	l.conns[conn] = struct{}{}
+	l.connsLock.Unlock()
+}
+
+// removeConn closes conn unless closeConns already did
+func (l *serverListener) removeConn(conn net.Conn) error {
+	l.connsLock.Lock()
+	_, ok := l.conns[conn]
+	delete(l.conns, conn)
+	l.connsLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (l *serverListener) closeConns() []error {
+	l.connsLock.Lock()
+	conns := l.conns
+	l.conns = map[net.Conn]struct{}{}
+	l.connsLock.Unlock()
+
+	var errors []error
+	for conn := range conns {
+		if err := conn.Close(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	return errors
+}
+
+// ServePacketConn attaches the PacketConn of cfg to the running Server and handles the
+// requests received on it. Like http.Server.Serve it blocks until the PacketConn is
+// removed with RemovePacketConn, the Server is closed or reading fails.
+func (s *Server) ServePacketConn(cfg PacketConnConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	l, err := s.addListener([]net.PacketConn{cfg.PacketConn}, nil, cfg.RelayAddressGenerator, cfg.PermissionHandler, cfg.Tenant, cfg.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+
+	s.servePacketConn(l)
+	return nil
+}
+
+// ServeListener attaches the Listener of cfg to the running Server and handles the
+// connections accepted on it. Like http.Server.Serve it blocks until the Listener is
+// removed with RemoveListener, the Server is closed or accepting fails.
+func (s *Server) ServeListener(cfg ListenerConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	l, err := s.addListener(nil, cfg.Listener, cfg.RelayAddressGenerator, cfg.PermissionHandler, cfg.Tenant, cfg.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+
+	s.serveListener(l)
+	return nil
+}
+
+// RemovePacketConn drains and detaches a PacketConn passed to NewServer or ServePacketConn,
+// or the sockets of a ReusePortConfig when conn is one of them.
+// New Allocate requests on it are rejected with a 508 (Insufficient Capacity) error while
+// existing allocations keep working. Once they all expired or ctx is done the PacketConn
+// is closed along with its remaining allocations, allocations on other listeners are untouched.
+func (s *Server) RemovePacketConn(ctx context.Context, conn net.PacketConn) error {
+	l := s.findListener(func(l *serverListener) bool {
+		return l.servesPacketConn(conn)
+	})
+	if l == nil {
+		return errListenerNotFound
+	}
+
+	return s.removeListener(ctx, l)
+}
+
+// RemoveListener drains and detaches a Listener passed to NewServer or ServeListener like
+// RemovePacketConn. Connections accepted on the Listener are closed with it.
+func (s *Server) RemoveListener(ctx context.Context, listener net.Listener) error {
+	l := s.findListener(func(l *serverListener) bool {
+		return l.listener != nil && l.listener == listener
+	})
+	if l == nil {
+		return errListenerNotFound
+	}
+
+	return s.removeListener(ctx, l)
+}
+
+func (s *Server) addListener(packetConns []net.PacketConn, listener net.Listener, addrGenerator RelayAddressGenerator, handler PermissionHandler, tenantRealm string, proxyProtocol *ProxyProtocolConfig) (*serverListener, error) {
+	if handler == nil {
+		handler = DefaultPermissionHandler
+	}
+
+	t, err := s.tenants.listenerTenant(tenantRealm)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, errServerClosed
+	}
+
+	generator := AdaptRelayAddressGenerator(addrGenerator)
+	var listenerAddr net.Addr
+	if listener != nil {
+		listenerAddr = listener.Addr()
+	} else {
+		listenerAddr = packetConns[0].LocalAddr()
+	}
+
+	events := s.eventHandlers.allocationEventHandler(s.clock, s.expiryEvents.push)
+	s.tenants.trackAllocations(&events)
+
+	am, err := allocation.NewManager(allocation.ManagerConfig{
+		AllocatePacketConn: func(req allocation.RelayRequest) (net.PacketConn, net.Addr, error) {
+			conn, addr, err := generator.AllocateRelayPacketConn(newRelayAllocationRequest(req, listenerAddr))
+			if err != nil || !req.DontFragment {
+				return conn, addr, err
+			}
+			if err = setDontFragment(conn, req.Network); err != nil {
+				_ = conn.Close()
+				return nil, nil, err
+			}
+			return conn, addr, nil
+		},
+		AllocateConn:      addrGenerator.AllocateConn,
+		PermissionHandler: handler,
+		NetworkSupported: func(network string) bool {
+			return relayNetworkSupported(addrGenerator, network)
+		},
+		DontFragment:      dontFragmentSupported,
+		EventHandler:      events,
+		LeveledLogger:     s.log,
+		BatchSize:         s.batchSize,
+		UDPOffload:        s.udpOffload,
+		PermissionTimeout: s.permissionTimeout,
+		Clock:             s.clock,
+		Timers:            s.timers,
+		Relays:            s.relays,
+		IsolatePeers:      s.isolatePeers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AllocationManager: %w", err)
+	}
+
+	l := &serverListener{
+		packetConns:           packetConns,
+		listener:              listener,
+		relayAddressGenerator: addrGenerator,
+		allocationManager:     am,
+		tenant:                t,
+		proxyProtocol:         proxyProtocol,
+		done:                  make(chan struct{}),
+		conns:                 map[net.Conn]struct{}{},
+	}
+	s.listeners = append(s.listeners, l)
+	if closer, ok := addrGenerator.(io.Closer); ok {
+		s.generators[closer]++
+	}
+	s.metrics.addListener(l.addr().String(), am)
+	s.wg.Add(1)
+
+	return l, nil
+}
+
+func (s *Server) findListener(match func(*serverListener) bool) *serverListener {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, l := range s.listeners {
+		if match(l) {
+			return l
+		}
+	}
+	return nil
+}
+
+func (s *Server) removeListener(ctx context.Context, l *serverListener) error {
+	l.drain.Store(&drainState{})
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	var ctxErr error
+	for ctxErr == nil && l.allocationManager.AllocationCount() != 0 {
+		select {
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	err := l.close()
+	<-l.done
+
+	s.lock.Lock()
+	for i := range s.listeners {
+		if s.listeners[i] == l {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			s.removedTraffic.Add(l.allocationManager.Traffic())
+			break
+		}
+	}
+	s.lock.Unlock()
+	s.metrics.removeListener(l.addr().String())
+
+	if err != nil {
+		return err
+	}
+	return ctxErr
+}
+
+func (s *Server) servePacketConn(l *serverListener) {
+	defer s.closeListener(l)
+
+	var wg sync.WaitGroup
+	for _, conn := range l.packetConns {
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			if l.proxyProtocol != nil {
+				conn = newProxyPacketConn(conn, l.proxyProtocol, s.log, s.clock)
+			}
+			s.readLoop(conn, l, nil)
+		}(conn)
+	}
+	wg.Wait()
+	l.requests.Wait()
+}
+
+func (s *Server) serveListener(l *serverListener) {
+	defer s.closeListener(l)
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			s.log.Debugf("Failed to accept: %s", err)
+			break
+		}
+		if l.proxyProtocol != nil {
+			conn = newProxyConn(conn, l.proxyProtocol)
+		}
+
+		l.addConn(conn)
+		l.connsWg.Add(1)
+		go func() {
+			defer l.connsWg.Done()
+
+			if c, err := s.newConnContext(conn, l); err != nil {
+				s.log.Debugf("Failed to handshake with %s: %s", conn.RemoteAddr(), err)
+			} else {
+				s.readLoop(NewSTUNConn(conn), l, c)
+			}
+			if err := l.removeConn(conn); err != nil {
+				s.log.Debugf("Failed to close conn: %s", err)
+			}
+		}()
+	}
+
+	for _, err := range l.closeConns() {
+		s.log.Debugf("Failed to close conn: %s", err)
+	}
+	l.connsWg.Wait()
+	l.requests.Wait()
+}
+
+// connContext is what the server learned about a connection of a listener before reading it
+type connContext struct {
+	tenant     *tenant
+	serverName string
+}
+
+// tlsHandshaker is a TLS connection, like a *tls.Conn or the connections of a TLSListener
+type tlsHandshaker interface {
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
+// newConnContext completes the TLS handshake of conn, so its server name is known to the
+// AuthRequestHandler and selects the tenant of the connection unless the listener has one
+func (s *Server) newConnContext(conn net.Conn, l *serverListener) (*connContext, error) {
+	c := &connContext{tenant: l.tenant}
+
+	tlsConn, ok := conn.(tlsHandshaker)
+	if !ok {
+		return c, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	c.serverName = tlsConn.ConnectionState().ServerName
+	if c.tenant == nil {
+		c.tenant = s.tenants.serverNameTenant(c.serverName)
+	}
+	return c, nil
+}
+
+// listenerHandover collects the allocations of a listener that are handed over to
+// another process when its read loops exited
+type listenerHandover struct {
+	detach      func(a *allocation.Allocation) bool
+	allocations []*allocation.Allocation
+}
+
+// closeListener closes the allocations of a listener once its read loops exited
+func (s *Server) closeListener(l *serverListener) {
+	s.lock.RLock()
+	h := l.handover
+	s.lock.RUnlock()
+
+	if h != nil {
+		for _, a := range l.allocationManager.Allocations() {
+			if !h.detach(a) {
+				continue
+			}
+			if detached := l.allocationManager.DetachAllocation(a.FiveTuple()); detached != nil {
+				h.allocations = append(h.allocations, detached)
+			}
+		}
+	}
+
+	if err := l.allocationManager.Close(); err != nil {
+		s.log.Errorf("Failed to close AllocationManager: %s", err)
+	}
+	if err := s.releaseGenerator(l.relayAddressGenerator); err != nil {
+		s.log.Errorf("Failed to close RelayAddressGenerator: %s", err)
+	}
+	close(l.done)
+	s.wg.Done()
+}
+
+// releaseGenerator closes g if it is an io.Closer and no other listener uses it
+func (s *Server) releaseGenerator(g RelayAddressGenerator) error {
+	closer, ok := g.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	s.lock.Lock()
+	s.generators[closer]--
+	last := s.generators[closer] == 0
+	if last {
+		delete(s.generators, closer)
+	}
+	s.lock.Unlock()
+
+	if !last {
+		return nil
+	}
+	return closer.Close()
+}
+
+func (s *Server) listenersSnapshot() []*serverListener {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]*serverListener{}, s.listeners...)
+}
+
+func (s *Server) allocationManagers() []*allocation.Manager {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	managers := make([]*allocation.Manager, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		managers = append(managers, l.allocationManager)
+	}
+	return managers
+}
+
+// traffic returns the traffic relayed by every allocation, including allocations
+// of listeners that were removed
+func (s *Server) traffic() allocation.Traffic {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	t := s.removedTraffic
+	for _, l := range s.listeners {
+		t.Add(l.allocationManager.Traffic())
+	}
+	return t
+}
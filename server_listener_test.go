@@ -0,0 +1,137 @@
+//go:build !js
+// +build !js
+
+package turn
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerListeners(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	relayAddressGenerator := &RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP("127.0.0.1"),
+		Address:      "0.0.0.0",
+	}
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:3478")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{PacketConn: udpListener, RelayAddressGenerator: relayAddressGenerator},
+		},
+		Realm:         "pion.ly",
+		EnableMetrics: true,
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	allocate := func(serverAddr string) (*Client, net.PacketConn, net.PacketConn) {
+		conn, listenErr := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, listenErr)
+
+		client, clientErr := NewClient(&ClientConfig{
+			STUNServerAddr: serverAddr,
+			TURNServerAddr: serverAddr,
+			Conn:           conn,
+			Username:       "user",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, clientErr)
+		assert.NoError(t, client.Listen())
+
+		relayConn, allocateErr := client.Allocate()
+		assert.NoError(t, allocateErr)
+		return client, conn, relayConn
+	}
+
+	t.Run("PacketConn", func(t *testing.T) {
+		addedListener, err := net.ListenPacket("udp4", "127.0.0.1:3479")
+		assert.NoError(t, err)
+
+		served := make(chan error)
+		go func() {
+			served <- server.ServePacketConn(PacketConnConfig{
+				PacketConn:            addedListener,
+				RelayAddressGenerator: relayAddressGenerator,
+			})
+		}()
+
+		client, conn, relayConn := allocate("127.0.0.1:3478")
+		addedClient, addedConn, addedRelayConn := allocate("127.0.0.1:3479")
+		assert.Equal(t, 2, server.AllocationCount())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, server.RemovePacketConn(ctx, addedListener))
+		assert.NoError(t, <-served)
+
+		// only the allocation of the removed PacketConn is gone
+		assert.Equal(t, 1, server.AllocationCount())
+		assert.Equal(t, udpListener.LocalAddr().String(), server.Allocations()[0].FiveTuple.DstAddr.String())
+		assert.Equal(t, errListenerNotFound, server.RemovePacketConn(context.Background(), addedListener))
+
+		assert.NoError(t, addedRelayConn.Close())
+		addedClient.Close()
+		assert.NoError(t, addedConn.Close())
+		assert.NoError(t, relayConn.Close())
+		client.Close()
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("Listener", func(t *testing.T) {
+		tcpListener, err := net.Listen("tcp4", "127.0.0.1:3479")
+		assert.NoError(t, err)
+
+		served := make(chan error)
+		go func() {
+			served <- server.ServeListener(ListenerConfig{
+				Listener:              tcpListener,
+				RelayAddressGenerator: relayAddressGenerator,
+			})
+		}()
+
+		var tcpConn net.Conn
+		assert.Eventually(t, func() bool {
+			tcpConn, err = net.Dial("tcp4", "127.0.0.1:3479")
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+
+		assert.NoError(t, server.RemoveListener(context.Background(), tcpListener))
+		assert.NoError(t, <-served)
+
+		// accepted connections are closed with their listener
+		_, err = tcpConn.Read(make([]byte, 1))
+		assert.Error(t, err)
+		assert.NoError(t, tcpConn.Close())
+	})
+
+	assert.NoError(t, server.Close())
+
+	addedListener, err := net.ListenPacket("udp4", "127.0.0.1:3479")
+	assert.NoError(t, err)
+	assert.Equal(t, errServerClosed, server.ServePacketConn(PacketConnConfig{
+		PacketConn:            addedListener,
+		RelayAddressGenerator: relayAddressGenerator,
+	}))
+	assert.NoError(t, addedListener.Close())
+}
@@ -0,0 +1,127 @@
+package turn
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/metrics"
+)
+
+// serverMetrics are the counters and gauges exported by Server.MetricsHandler.
+// All methods are safe to call on a nil *serverMetrics, which is used when metrics are disabled.
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	requests       *metrics.CounterVec
+	authFailures   *metrics.Counter
+	readLoopErrors *metrics.Counter
+	truncated      *metrics.Counter
+	dropped        *metrics.Counter
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:       r,
+		requests:       r.NewCounterVec("turn_requests_total", "STUN requests answered by method and response code, 200 is used for success responses.", "method", "code"),
+		authFailures:   r.NewCounter("turn_auth_failures_total", "Requests rejected by the AuthHandler or failing the MESSAGE-INTEGRITY check.", nil),
+		readLoopErrors: r.NewCounter("turn_read_loop_errors_total", "Errors returned while reading or handling inbound packets.", nil),
+		truncated:      r.NewCounter("turn_truncated_packets_total", "Inbound packets that filled the read buffer and were possibly truncated.", nil),
+		dropped:        r.NewCounter("turn_dropped_requests_total", "Requests dropped because the request queue was full.", nil),
+	}
+
+	r.NewGaugeFunc("turn_nonces", "Nonces currently stored by the server.", nil, func() int64 {
+		return int64(syncMapLen(s.nonces))
+	})
+
+	traffic := func(f func(allocation.Traffic) uint64) func() uint64 {
+		return func() uint64 {
+			return f(s.traffic())
+		}
+	}
+	r.NewCounterFunc("turn_relayed_packets_total", "Packets relayed between clients and peers.", metrics.Labels{"direction": "to_peer"},
+		traffic(func(t allocation.Traffic) uint64 { return t.PacketsToPeer }))
+	r.NewCounterFunc("turn_relayed_packets_total", "Packets relayed between clients and peers.", metrics.Labels{"direction": "to_client"},
+		traffic(func(t allocation.Traffic) uint64 { return t.PacketsToClient }))
+	r.NewCounterFunc("turn_relayed_bytes_total", "Bytes relayed between clients and peers.", metrics.Labels{"direction": "to_peer"},
+		traffic(func(t allocation.Traffic) uint64 { return t.BytesToPeer }))
+	r.NewCounterFunc("turn_relayed_bytes_total", "Bytes relayed between clients and peers.", metrics.Labels{"direction": "to_client"},
+		traffic(func(t allocation.Traffic) uint64 { return t.BytesToClient }))
+	r.NewCounterFunc("turn_dropped_packets_total", "Packets dropped because no permission or channel binding existed.", nil,
+		traffic(func(t allocation.Traffic) uint64 { return t.DroppedPackets }))
+
+	return m
+}
+
+// addListener exports the number of active allocations of the listener at addr
+func (m *serverMetrics) addListener(addr string, am *allocation.Manager) {
+	if m == nil {
+		return
+	}
+
+	m.registry.NewGaugeFunc("turn_allocations_active", "Active allocations per listener.", metrics.Labels{"listener": addr}, func() int64 {
+		return int64(am.AllocationCount())
+	})
+}
+
+// removeListener stops exporting the allocations of the listener at addr
+func (m *serverMetrics) removeListener(addr string) {
+	if m == nil {
+		return
+	}
+
+	m.registry.Unregister("turn_allocations_active", metrics.Labels{"listener": addr})
+}
+
+func (m *serverMetrics) onResponse(msgType stun.MessageType, code stun.ErrorCode) {
+	if code == 0 {
+		code = 200
+	}
+	m.requests.With(msgType.Method.String(), strconv.Itoa(int(code))).Inc()
+}
+
+func (m *serverMetrics) authFailed() {
+	if m != nil {
+		m.authFailures.Inc()
+	}
+}
+
+func (m *serverMetrics) readLoopError() {
+	if m != nil {
+		m.readLoopErrors.Inc()
+	}
+}
+
+func (m *serverMetrics) truncatedPacket() {
+	if m != nil {
+		m.truncated.Inc()
+	}
+}
+
+func (m *serverMetrics) droppedRequest() {
+	if m != nil {
+		m.dropped.Inc()
+	}
+}
+
+// MetricsHandler returns an http.Handler that serves the server metrics in the
+// Prometheus text exposition format. If ServerConfig.EnableMetrics is not set the
+// handler responds with 404 Not Found.
+func (s *Server) MetricsHandler() http.Handler {
+	if s.metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return s.metrics.registry
+}
+
+func syncMapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
@@ -0,0 +1,288 @@
+package turn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/server"
+)
+
+// Tenant is a customer with its own realm, credentials and policies on a Server shared
+// with other tenants. A request is handled by the tenant of its listener, else by the
+// tenant of the TLS server name of its connection, else by the tenant of its REALM
+// attribute. Requests of no tenant use the Realm and policies of the ServerConfig.
+type Tenant struct {
+	// Realm identifies the tenant, it is sent to the clients of the tenant in 401 responses
+	Realm string
+
+	// AuthHandler returns the keys of the users of the tenant, AuthRequestHandler is
+	// used instead if set
+	AuthHandler        AuthHandler
+	AuthRequestHandler AuthRequestHandler
+
+	// PermissionHandler filters the peers of the tenant in addition to the PermissionHandler
+	// of the listener, every peer is permitted if nil
+	PermissionHandler PermissionHandler
+
+	// AllocationLifetime and LifetimePolicyHandler work like the ones of ServerConfig
+	AllocationLifetime    LifetimePolicy
+	LifetimePolicyHandler LifetimePolicyHandler
+
+	// MaxAllocations limits the live allocations of the tenant, and MaxUserAllocations
+	// the ones of each of its users. Allocate requests beyond them fail with a 486
+	// (Allocation Quota Reached) error, requests handled concurrently may briefly exceed
+	// them. There is no limit if 0.
+	MaxAllocations     int
+	MaxUserAllocations int
+
+	// ServerNames are the TLS server names (SNI) clients of the tenant connect with
+	ServerNames []string
+}
+
+func (t *Tenant) validate() error {
+	switch {
+	case t.Realm == "":
+		return errTenantRealmUnset
+	case t.AuthHandler == nil && t.AuthRequestHandler == nil:
+		return fmt.Errorf("%w: %s", errTenantAuthHandlerUnset, t.Realm)
+	case t.MaxAllocations < 0 || t.MaxUserAllocations < 0:
+		return fmt.Errorf("%w: %s", errTenantQuotaNegative, t.Realm)
+	}
+
+	lifetime := t.AllocationLifetime
+	if lifetime.Default < 0 || lifetime.Min < 0 || lifetime.Max < 0 {
+		return errLifetimeNegative
+	}
+	return nil
+}
+
+// tenant is a Tenant or the realm of the ServerConfig, with its live allocations
+type tenant struct {
+	settings           server.Tenant
+	maxAllocations     int
+	maxUserAllocations int
+
+	lock        sync.Mutex
+	allocations int
+	users       map[string]int
+}
+
+func (t *tenant) quotaReached(username string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return (t.maxAllocations > 0 && t.allocations >= t.maxAllocations) ||
+		(t.maxUserAllocations > 0 && t.users[username] >= t.maxUserAllocations)
+}
+
+func (t *tenant) allocationCreated(username string) {
+	t.lock.Lock()
+	t.allocations++
+	t.users[username]++
+	t.lock.Unlock()
+}
+
+func (t *tenant) allocationDeleted(username string) {
+	t.lock.Lock()
+	t.allocations--
+	if t.users[username]--; t.users[username] <= 0 {
+		delete(t.users, username)
+	}
+	t.lock.Unlock()
+}
+
+// tenantSet finds the tenant of requests
+type tenantSet struct {
+	fallback     *tenant
+	byRealm      map[string]*tenant
+	byServerName map[string]*tenant
+	hasQuotas    bool
+}
+
+// newTenantSet builds the tenants of config, users revoked in a realm are rejected
+// by the tenant of the realm
+func newTenantSet(config ServerConfig, revoked func(realm, username string) bool) *tenantSet {
+	ts := &tenantSet{
+		fallback: &tenant{
+			settings: server.Tenant{
+				Realm:                 config.Realm,
+				AuthHandler:           rejectRevoked(config.AuthHandler, config.Realm, revoked),
+				AuthRequestHandler:    rejectRevokedRequests(config.AuthRequestHandler, config.Realm, revoked),
+				LifetimePolicy:        config.AllocationLifetime,
+				LifetimePolicyHandler: config.LifetimePolicyHandler,
+			},
+		},
+		byRealm:      map[string]*tenant{},
+		byServerName: map[string]*tenant{},
+	}
+
+	for i := range config.Tenants {
+		cfg := &config.Tenants[i]
+		t := &tenant{
+			settings: server.Tenant{
+				Realm:                 cfg.Realm,
+				AuthHandler:           rejectRevoked(cfg.AuthHandler, cfg.Realm, revoked),
+				AuthRequestHandler:    rejectRevokedRequests(cfg.AuthRequestHandler, cfg.Realm, revoked),
+				PermissionHandler:     cfg.PermissionHandler,
+				LifetimePolicy:        config.AllocationLifetime.Override(cfg.AllocationLifetime),
+				LifetimePolicyHandler: cfg.LifetimePolicyHandler,
+			},
+			maxAllocations:     cfg.MaxAllocations,
+			maxUserAllocations: cfg.MaxUserAllocations,
+			users:              map[string]int{},
+		}
+		if t.maxAllocations > 0 || t.maxUserAllocations > 0 {
+			t.settings.AllocationQuotaReached = t.quotaReached
+			ts.hasQuotas = true
+		}
+
+		ts.byRealm[cfg.Realm] = t
+		for _, name := range cfg.ServerNames {
+			ts.byServerName[strings.ToLower(name)] = t
+		}
+	}
+	return ts
+}
+
+// rejectRevoked rejects the users revoked in the realm of the request or in the realm
+// of the tenant, which differ for listeners pinned to a tenant
+func rejectRevoked(h AuthHandler, tenantRealm string, revoked func(realm, username string) bool) AuthHandler {
+	if h == nil {
+		return nil
+	}
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if revoked(realm, username) || revoked(tenantRealm, username) {
+			return nil, false
+		}
+		return h(username, realm, srcAddr)
+	}
+}
+
+func rejectRevokedRequests(h AuthRequestHandler, tenantRealm string, revoked func(realm, username string) bool) AuthRequestHandler {
+	if h == nil {
+		return nil
+	}
+	return func(r AuthRequest) ([]byte, bool) {
+		if revoked(r.Realm, r.Username) || revoked(tenantRealm, r.Username) {
+			return nil, false
+		}
+		return h(r)
+	}
+}
+
+// validateTenants checks that the tenants of config and the ones its listeners refer to exist
+func validateTenants(config *ServerConfig) error {
+	realms := map[string]bool{}
+	serverNames := map[string]bool{}
+	for i := range config.Tenants {
+		t := &config.Tenants[i]
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if lifetime := config.AllocationLifetime.Override(t.AllocationLifetime).WithDefaults(); lifetime.Min > lifetime.Default || lifetime.Default > lifetime.Max {
+			return fmt.Errorf("%w: %s", errLifetimePolicyInvalid, t.Realm)
+		}
+		if realms[t.Realm] || t.Realm == config.Realm {
+			return fmt.Errorf("%w: %s", errTenantRealmDuplicate, t.Realm)
+		}
+		realms[t.Realm] = true
+
+		for _, name := range t.ServerNames {
+			if serverNames[strings.ToLower(name)] {
+				return fmt.Errorf("%w: %s", errTenantServerNameDuplicate, name)
+			}
+			serverNames[strings.ToLower(name)] = true
+		}
+	}
+
+	var listenerTenants []string
+	for _, c := range config.PacketConnConfigs {
+		listenerTenants = append(listenerTenants, c.Tenant)
+	}
+	for _, c := range config.ListenerConfigs {
+		listenerTenants = append(listenerTenants, c.Tenant)
+	}
+	for _, c := range config.ReusePortConfigs {
+		listenerTenants = append(listenerTenants, c.Tenant)
+	}
+	for _, realm := range listenerTenants {
+		if realm != "" && !realms[realm] {
+			return fmt.Errorf("%w: %s", errTenantUnknown, realm)
+		}
+	}
+	return nil
+}
+
+// listenerTenant returns the tenant of the listener of a config, nil if the config does not pin one
+func (ts *tenantSet) listenerTenant(realm string) (*tenant, error) {
+	if realm == "" {
+		return nil, nil //nolint:nilnil
+	}
+	if t, ok := ts.byRealm[realm]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errTenantUnknown, realm)
+}
+
+// serverNameTenant returns the tenant of a TLS server name, nil if no tenant has it
+func (ts *tenantSet) serverNameTenant(serverName string) *tenant {
+	if serverName == "" {
+		return nil
+	}
+	return ts.byServerName[strings.ToLower(serverName)]
+}
+
+func (ts *tenantSet) tenantByRealm(realm string) *server.Tenant {
+	if t, ok := ts.byRealm[realm]; ok {
+		return &t.settings
+	}
+	return nil
+}
+
+// useTenant sets up r for the tenant t of its listener or connection, requests of
+// neither are assigned to a tenant by their REALM
+func (ts *tenantSet) useTenant(r *server.Request, t *tenant) {
+	if t != nil {
+		r.UseTenant(&t.settings)
+		return
+	}
+
+	r.UseTenant(&ts.fallback.settings)
+	if len(ts.byRealm) != 0 {
+		r.TenantByRealm = ts.tenantByRealm
+	}
+}
+
+// trackAllocations counts the allocations of the tenants with quotas in the events of a manager
+func (ts *tenantSet) trackAllocations(e *allocation.EventHandler) {
+	if !ts.hasQuotas {
+		return
+	}
+
+	onCreated, onDeleted := e.OnAllocationCreated, e.OnAllocationDeleted
+	e.OnAllocationCreated = func(a *allocation.Allocation, lifetime time.Duration) {
+		ts.allocationCreated(a)
+		if onCreated != nil {
+			onCreated(a, lifetime)
+		}
+	}
+	e.OnAllocationDeleted = func(a *allocation.Allocation, reason allocation.DeleteReason) {
+		if t, ok := ts.byRealm[a.Realm()]; ok {
+			t.allocationDeleted(a.Username())
+		}
+		if onDeleted != nil {
+			onDeleted(a, reason)
+		}
+	}
+}
+
+// allocationCreated counts a, which is also called for allocations taken over in a handover
+func (ts *tenantSet) allocationCreated(a *allocation.Allocation) {
+	if t, ok := ts.byRealm[a.Realm()]; ok && ts.hasQuotas {
+		t.allocationCreated(a.Username())
+	}
+}
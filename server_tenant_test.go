@@ -0,0 +1,374 @@
+//go:build !js
+// +build !js
+
+package turn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerTenants(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	authHandler := func(password string) AuthHandler {
+		return func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, password), true
+		}
+	}
+	relayAddressGenerator := &RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP("127.0.0.1"),
+		Address:      "0.0.0.0",
+	}
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+	globexListener, err := net.ListenPacket("udp4", "127.0.0.1:3479")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: authHandler("pass"),
+		PacketConnConfigs: []PacketConnConfig{
+			{PacketConn: udpListener, RelayAddressGenerator: relayAddressGenerator},
+			{PacketConn: globexListener, RelayAddressGenerator: relayAddressGenerator, Tenant: "globex.com"},
+		},
+		Tenants: []Tenant{
+			{
+				Realm:              "acme.io",
+				AuthHandler:        authHandler("acme"),
+				MaxUserAllocations: 1,
+			},
+			{
+				Realm:       "globex.com",
+				AuthHandler: authHandler("globex"),
+				PermissionHandler: func(clientAddr net.Addr, peerIP net.IP) bool {
+					return !peerIP.Equal(net.ParseIP("127.0.0.4"))
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	type testClient struct {
+		conn   net.PacketConn
+		client *Client
+		relay  net.PacketConn
+	}
+	var clients []testClient
+	allocate := func(serverAddr, username, password, realm string) (*Client, error) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: serverAddr,
+			TURNServerAddr: serverAddr,
+			Conn:           conn,
+			Username:       username,
+			Password:       password,
+			Realm:          realm,
+			RequestRealm:   true,
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relay, err := client.Allocate()
+		clients = append(clients, testClient{conn, client, relay})
+		return client, err
+	}
+	realmOf := func(username string) string {
+		for _, info := range server.Allocations() {
+			if info.Username == username {
+				return info.Realm
+			}
+		}
+		return ""
+	}
+
+	// the realm of the request selects the tenant and is echoed in the 401 response
+	client, err := allocate("127.0.0.1:3478", "alice", "acme", "acme.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "acme.io", client.Realm().String())
+	assert.Equal(t, "acme.io", realmOf("alice"))
+
+	_, err = allocate("127.0.0.1:3478", "alice", "acme", "acme.io")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "486")
+
+	// unknown realms are handled in the realm of the server
+	client, err = allocate("127.0.0.1:3478", "bob", "pass", "example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, "pion.ly", client.Realm().String())
+	assert.Equal(t, "pion.ly", realmOf("bob"))
+
+	// the tenant of a listener ignores the realm of the request
+	client, err = allocate("127.0.0.1:3479", "carol", "globex", "acme.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "globex.com", client.Realm().String())
+	assert.Equal(t, "globex.com", realmOf("carol"))
+	assert.Error(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345}))
+	assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.5"), Port: 12345}))
+
+	_, err = allocate("127.0.0.1:3479", "dave", "acme", "acme.io")
+	assert.Error(t, err)
+
+	for _, c := range clients {
+		if c.relay != nil {
+			assert.NoError(t, c.relay.Close())
+		}
+		c.client.Close()
+		assert.NoError(t, c.conn.Close())
+	}
+	assert.NoError(t, server.Close())
+}
+
+// without an AuthHandler of the server, realms no tenant serves are rejected
+func TestServerTenantsUnknownRealm(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		PacketConnConfigs: []PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: &RelayAddressGeneratorStatic{RelayAddress: net.ParseIP("127.0.0.1"), Address: "0.0.0.0"},
+		}},
+		Tenants: []Tenant{{
+			Realm: "acme.io",
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "acme"), true
+			},
+		}},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	allocate := func(realm string) error {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: udpListener.LocalAddr().String(),
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Conn:           conn,
+			Username:       "alice",
+			Password:       "acme",
+			Realm:          realm,
+			RequestRealm:   true,
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relay, err := client.Allocate()
+		if relay != nil {
+			assert.NoError(t, relay.Close())
+		}
+		client.Close()
+		assert.NoError(t, conn.Close())
+		return err
+	}
+
+	assert.NoError(t, allocate("acme.io"))
+
+	err = allocate("example.org")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "441")
+
+	assert.NoError(t, server.Close())
+}
+
+// revoking a user in one realm leaves the user of the same name in other realms alone
+func TestServerTenantsRevokeUser(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	authHandler := func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+		return GenerateAuthKey(username, realm, "pass"), true
+	}
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: authHandler,
+		PacketConnConfigs: []PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: &RelayAddressGeneratorStatic{RelayAddress: net.ParseIP("127.0.0.1"), Address: "0.0.0.0"},
+		}},
+		Tenants: []Tenant{
+			{Realm: "acme.io", AuthHandler: authHandler},
+			{Realm: "globex.com", AuthHandler: authHandler},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	var closers []func()
+	allocate := func(realm string) error {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: udpListener.LocalAddr().String(),
+			TURNServerAddr: udpListener.LocalAddr().String(),
+			Conn:           conn,
+			Username:       "alice",
+			Password:       "pass",
+			Realm:          realm,
+			RequestRealm:   true,
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relay, err := client.Allocate()
+		closers = append(closers, func() {
+			if relay != nil {
+				assert.NoError(t, relay.Close())
+			}
+			client.Close()
+			assert.NoError(t, conn.Close())
+		})
+		return err
+	}
+
+	assert.NoError(t, allocate("acme.io"))
+	assert.NoError(t, allocate("globex.com"))
+	assert.Equal(t, 2, server.AllocationCount())
+
+	assert.Equal(t, 1, server.RevokeUser("acme.io", "alice"))
+	assert.Equal(t, []RevokedUser{{Realm: "acme.io", Username: "alice"}}, server.RevokedUsers())
+	allocations := server.Allocations()
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "globex.com", allocations[0].Realm)
+
+	assert.Error(t, allocate("acme.io"))
+	assert.NoError(t, allocate("globex.com"))
+
+	server.RestoreUser("acme.io", "alice")
+	assert.NoError(t, allocate("acme.io"))
+
+	for _, c := range closers {
+		c()
+	}
+	assert.NoError(t, server.Close())
+}
+
+func TestTenantServerName(t *testing.T) {
+	s := &Server{tenants: newTenantSet(ServerConfig{
+		Tenants: []Tenant{{Realm: "acme.io", AuthHandler: rejectAuthHandler, ServerNames: []string{"turn.acme.io"}}},
+	}, func(string, string) bool { return false })}
+
+	for serverName, realm := range map[string]string{"TURN.acme.io": "acme.io", "turn.globex.com": ""} {
+		serverConn, clientConn := net.Pipe()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake() //nolint:gosec
+		}()
+
+		c, err := s.newConnContext(tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}), &serverListener{}) //nolint:gosec
+		assert.NoError(t, err)
+		assert.Equal(t, serverName, c.serverName)
+		if realm == "" {
+			assert.Nil(t, c.tenant)
+		} else {
+			assert.Equal(t, realm, c.tenant.settings.Realm)
+		}
+
+		<-done
+		assert.NoError(t, serverConn.Close())
+		assert.NoError(t, clientConn.Close())
+	}
+}
+
+func TestServerConfigTenants(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, conn.Close())
+	}()
+
+	validate := func(tenants []Tenant, listenerTenant string) error {
+		config := ServerConfig{
+			Realm: "pion.ly",
+			PacketConnConfigs: []PacketConnConfig{{
+				PacketConn:            conn,
+				RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"},
+				Tenant:                listenerTenant,
+			}},
+			Tenants: tenants,
+		}
+		return config.validate()
+	}
+	acme := Tenant{Realm: "acme.io", AuthHandler: rejectAuthHandler, ServerNames: []string{"turn.acme.io"}}
+
+	assert.NoError(t, validate([]Tenant{acme}, "acme.io"))
+	assert.ErrorIs(t, validate([]Tenant{acme}, "globex.com"), errTenantUnknown)
+	assert.ErrorIs(t, validate([]Tenant{{AuthHandler: rejectAuthHandler}}, ""), errTenantRealmUnset)
+	assert.ErrorIs(t, validate([]Tenant{{Realm: "acme.io"}}, ""), errTenantAuthHandlerUnset)
+	assert.ErrorIs(t, validate([]Tenant{{Realm: "acme.io", AuthHandler: rejectAuthHandler, MaxAllocations: -1}}, ""), errTenantQuotaNegative)
+	assert.ErrorIs(t, validate([]Tenant{acme, {Realm: "pion.ly", AuthHandler: rejectAuthHandler}}, ""), errTenantRealmDuplicate)
+	assert.ErrorIs(t, validate([]Tenant{acme, {Realm: "globex.com", AuthHandler: rejectAuthHandler, ServerNames: []string{"TURN.acme.io"}}}, ""), errTenantServerNameDuplicate)
+	assert.ErrorIs(t, validate([]Tenant{{Realm: "acme.io", AuthHandler: rejectAuthHandler, AllocationLifetime: LifetimePolicy{Min: 2 * time.Hour}}}, ""), errLifetimePolicyInvalid)
+}
+
+func rejectAuthHandler(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+	return nil, false
+}
+
+// newTestCertificate returns a self-signed certificate for dnsNames
+func newTestCertificate(t *testing.T, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "turn"},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
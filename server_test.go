@@ -4,12 +4,17 @@
 package turn
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/transport/v2/test"
 	"github.com/pion/transport/v2/vnet"
 	"github.com/pion/turn/v2/internal/proto"
@@ -115,37 +120,1183 @@ func TestServer(t *testing.T) {
 		assert.Equal(t, server.inboundMTU, 2000)
 		assert.NoError(t, server.Close())
 	})
+	t.Run("RequestWorkers", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				if pw, ok := credMap[username]; ok {
+					return pw, true
+				}
+				return nil, false
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "0.0.0.0",
+					},
+				},
+			},
+			RequestWorkers: 4,
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+
+		peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       "user",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		// writes are Send indications until the channel is bound, then ChannelData
+		buf := make([]byte, 1600)
+		for i := 0; i < 10; i++ {
+			_, err = relayConn.WriteTo([]byte("ping"), peer.LocalAddr())
+			assert.NoError(t, err)
+
+			n, _, err := peer.ReadFrom(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, "ping", string(buf[:n]))
+		}
+
+		assert.NoError(t, relayConn.Close())
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, peer.Close())
+
+		// closing again, like a deferred Close after Shutdown, does nothing
+		assert.NoError(t, server.Shutdown(context.Background()))
+		assert.NoError(t, server.Close())
+	})
+
+	for _, udpOffload := range []bool{false, true} {
+		udpOffload := udpOffload
+		t.Run(fmt.Sprintf("BatchSize UDPOffload %t", udpOffload), func(t *testing.T) {
+			udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+			assert.NoError(t, err)
+
+			server, err := NewServer(ServerConfig{
+				AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+					if pw, ok := credMap[username]; ok {
+						return pw, true
+					}
+					return nil, false
+				},
+				PacketConnConfigs: []PacketConnConfig{
+					{
+						PacketConn: udpListener,
+						RelayAddressGenerator: &RelayAddressGeneratorStatic{
+							RelayAddress: net.ParseIP("127.0.0.1"),
+							Address:      "0.0.0.0",
+						},
+					},
+				},
+				BatchSize:     16,
+				UDPOffload:    udpOffload,
+				Realm:         "pion.ly",
+				LoggerFactory: loggerFactory,
+			})
+			assert.NoError(t, err)
+
+			peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			assert.NoError(t, err)
+
+			conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+			assert.NoError(t, err)
+
+			client, err := NewClient(&ClientConfig{
+				STUNServerAddr: "127.0.0.1:3478",
+				TURNServerAddr: "127.0.0.1:3478",
+				Conn:           conn,
+				Username:       "user",
+				Password:       "pass",
+				Realm:          "pion.ly",
+				LoggerFactory:  loggerFactory,
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, client.Listen())
+
+			relayConn, err := client.Allocate()
+			assert.NoError(t, err)
+
+			buf := make([]byte, 1600)
+			for i := 0; i < 10; i++ {
+				_, err = relayConn.WriteTo([]byte("ping"), peer.LocalAddr())
+				assert.NoError(t, err)
+
+				n, _, err := peer.ReadFrom(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, "ping", string(buf[:n]))
+
+				_, err = peer.WriteTo([]byte("pong"), relayConn.LocalAddr())
+				assert.NoError(t, err)
+
+				n, from, err := relayConn.ReadFrom(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, "pong", string(buf[:n]))
+				assert.Equal(t, peer.LocalAddr().String(), from.String())
+			}
+
+			assert.NoError(t, relayConn.Close())
+			client.Close()
+			assert.NoError(t, conn.Close())
+			assert.NoError(t, peer.Close())
+
+			assert.NoError(t, server.Close())
+		})
+	}
+
 	t.Run("Filter on client address and peer IP", func(t *testing.T) {
 		udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
 		assert.NoError(t, err)
 
 		server, err := NewServer(ServerConfig{
 			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
-				if pw, ok := credMap[username]; ok {
-					return pw, true
-				}
-				return nil, false
+				if pw, ok := credMap[username]; ok {
+					return pw, true
+				}
+				return nil, false
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "0.0.0.0",
+					},
+					PermissionHandler: func(src net.Addr, peer net.IP) bool {
+						return src.String() == "127.0.0.1:54321" &&
+							peer.Equal(net.ParseIP("127.0.0.4"))
+					},
+				},
+			},
+			Realm:         "pion.ly",
+			LoggerFactory: loggerFactory,
+		})
+		assert.NoError(t, err)
+
+		// enforce corrent client IP and port
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:54321")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       "user",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		whiteAddr, errA := net.ResolveUDPAddr("udp", "127.0.0.4:12345")
+		assert.NoError(t, errA, "should succeed")
+		blackAddr, errB1 := net.ResolveUDPAddr("udp", "127.0.0.5:12345")
+		assert.NoError(t, errB1, "should succeed")
+
+		// explicit CreatePermission
+		err = client.CreatePermission(whiteAddr)
+		assert.NoError(t, err, "grant permission for whitelisted peer")
+
+		err = client.CreatePermission(blackAddr)
+		assert.ErrorContains(t, err, "error", "deny permission for blacklisted peer address")
+
+		err = client.CreatePermission(whiteAddr, whiteAddr)
+		assert.NoError(t, err, "grant permission for repeated whitelisted peer addresses")
+
+		err = client.CreatePermission(blackAddr)
+		assert.ErrorContains(t, err, "error", "deny permission for repeated blacklisted peer address")
+
+		// rg0now: isn't this a cornercase in the spec?
+		err = client.CreatePermission(whiteAddr, blackAddr)
+		assert.ErrorContains(t, err, "error", "deny permission for mixed whitelisted and blacklisted peers")
+
+		// implicit CreatePermission for ChannelBindRequests: WriteTo always tries to bind a channel
+		_, err = relayConn.WriteTo([]byte("Hello"), whiteAddr)
+		assert.NoError(t, err, "write to whitelisted peer address succeeds - 1")
+
+		_, err = relayConn.WriteTo([]byte("Hello"), blackAddr)
+		assert.ErrorContains(t, err, "error", "write to blacklisted peer address fails - 1")
+
+		_, err = relayConn.WriteTo([]byte("Hello"), whiteAddr)
+		assert.NoError(t, err, "write to whitelisted peer address succeeds - 2")
+
+		_, err = relayConn.WriteTo([]byte("Hello"), blackAddr)
+		assert.ErrorContains(t, err, "error", "write to blacklisted peer address fails - 2")
+
+		_, err = relayConn.WriteTo([]byte("Hello"), whiteAddr)
+		assert.NoError(t, err, "write to whitelisted peer address succeeds - 3")
+
+		_, err = relayConn.WriteTo([]byte("Hello"), blackAddr)
+		assert.ErrorContains(t, err, "error", "write to blacklisted peer address fails - 3")
+
+		// let the previous transaction terminate
+		time.Sleep(200 * time.Millisecond)
+		assert.NoError(t, relayConn.Close())
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+
+		// enforce filtered source address
+		conn2, err := net.ListenPacket("udp4", "127.0.0.133:54321")
+		assert.NoError(t, err)
+
+		client2, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn2,
+			Username:       "user",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client2.Listen())
+
+		relayConn2, err := client2.Allocate()
+		assert.NoError(t, err)
+
+		// explicit CreatePermission
+		err = client2.CreatePermission(whiteAddr)
+		assert.ErrorContains(t, err, "error", "deny permission from filtered source to whitelisted peer")
+
+		err = client2.CreatePermission(blackAddr)
+		assert.ErrorContains(t, err, "error", "deny permission from filtered source to blacklisted peer")
+
+		// implicit CreatePermission for ChannelBindRequests: WriteTo always tries to bind a channel
+		_, err = relayConn2.WriteTo([]byte("Hello"), whiteAddr)
+		assert.ErrorContains(t, err, "error", "write from filtered source to whitelisted peer fails - 1")
+
+		_, err = relayConn2.WriteTo([]byte("Hello"), blackAddr)
+		assert.ErrorContains(t, err, "error", "write from filtered source to blacklisted peer fails - 1")
+
+		_, err = relayConn2.WriteTo([]byte("Hello"), whiteAddr)
+		assert.ErrorContains(t, err, "error", "write from filtered source to whitelisted peer fails - 2")
+
+		_, err = relayConn2.WriteTo([]byte("Hello"), blackAddr)
+		assert.ErrorContains(t, err, "error", "write from filtered source to blacklisted peer fails - 2")
+
+		_, err = relayConn2.WriteTo([]byte("Hello"), whiteAddr)
+		assert.ErrorContains(t, err, "error", "write from filtered source to whitelisted peer fails - 3")
+
+		_, err = relayConn2.WriteTo([]byte("Hello"), blackAddr)
+		assert.ErrorContains(t, err, "error", "write from filtered source to blacklisted peer fails - 3")
+
+		// let the previous transaction terminate
+		time.Sleep(200 * time.Millisecond)
+		assert.NoError(t, relayConn2.Close())
+
+		client2.Close()
+		assert.NoError(t, conn2.Close())
+
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("EventHandlers", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+		assert.NoError(t, err)
+
+		events := make(chan string, 16)
+		var deleted AllocationEvent
+		var authFailure AuthFailureEvent
+		var usage UsageRecord
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				if pw, ok := credMap[username]; ok {
+					return pw, true
+				}
+				return nil, false
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "0.0.0.0",
+					},
+				},
+			},
+			EventHandlers: EventHandlers{
+				OnAllocationCreated: func(e AllocationEvent) {
+					assert.Equal(t, "user", e.Username)
+					assert.Equal(t, "udp", e.FiveTuple.Protocol)
+					assert.NotNil(t, e.RelayAddr)
+					events <- "allocation created"
+				},
+				OnAllocationDeleted: func(e AllocationEvent) {
+					deleted = e
+					events <- "allocation deleted"
+				},
+				OnPermissionCreated: func(e PermissionEvent) {
+					assert.Equal(t, "127.0.0.4:12345", e.PeerAddr.String())
+					events <- "permission created"
+				},
+				OnChannelBound: func(e ChannelEvent) {
+					assert.Equal(t, uint16(proto.MinChannelNumber), e.Number)
+					events <- "channel bound"
+				},
+				OnAuthFailure: func(e AuthFailureEvent) {
+					authFailure = e
+					events <- "auth failure"
+				},
+				OnUsageRecord: func(u UsageRecord) {
+					usage = u
+					events <- "usage record"
+				},
+			},
+			Realm:         "pion.ly",
+			LoggerFactory: loggerFactory,
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       "user",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		assert.Equal(t, "allocation created", <-events)
+
+		peerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345}
+		_, err = relayConn.WriteTo([]byte("Hello"), peerAddr)
+		assert.NoError(t, err)
+		assert.Equal(t, "permission created", <-events)
+		assert.Equal(t, "channel bound", <-events)
+
+		_, err = relayConn.WriteTo([]byte("World"), peerAddr)
+		assert.NoError(t, err)
+
+		assert.NoError(t, relayConn.Close())
+		assert.Equal(t, "allocation deleted", <-events)
+		assert.Equal(t, AllocationDeleteReasonClientDeleted, deleted.Reason)
+		assert.Equal(t, "user", deleted.Username)
+
+		assert.Equal(t, "usage record", <-events)
+		assert.Equal(t, "user", usage.Username)
+		assert.Equal(t, uint64(2), usage.Traffic.PacketsToPeer)
+		assert.Equal(t, uint64(10), usage.Traffic.BytesToPeer)
+		assert.Len(t, usage.Permissions, 1)
+		assert.Equal(t, uint64(10), usage.Permissions[0].Traffic.BytesToPeer)
+		assert.Len(t, usage.Channels, 1)
+		assert.Equal(t, uint16(proto.MinChannelNumber), usage.Channels[0].ChannelNumber)
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+
+		// a wrong password is reported as an authentication failure
+		conn, err = net.ListenPacket("udp4", "0.0.0.0:0")
+		assert.NoError(t, err)
+
+		client, err = NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       "user",
+			Password:       "wrong",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		_, err = client.Allocate()
+		assert.Error(t, err)
+		assert.Equal(t, "auth failure", <-events)
+		assert.Equal(t, "user", authFailure.Username)
+		assert.Equal(t, "pion.ly", authFailure.Realm)
+		assert.Equal(t, stun.MethodAllocate.String(), authFailure.Method)
+		assert.Error(t, authFailure.Err)
+
+		client.Close()
+		assert.NoError(t, conn.Close())
+
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				if pw, ok := credMap[username]; ok {
+					return pw, true
+				}
+				return nil, false
+			},
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "0.0.0.0",
+					},
+				},
+			},
+			Realm:         "pion.ly",
+			LoggerFactory: loggerFactory,
+			EnableMetrics: true,
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       "user",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		body := rec.Body.String()
+		assert.Contains(t, body, `turn_allocations_active{listener="0.0.0.0:3478"} 1`)
+		assert.Contains(t, body, `turn_requests_total{code="401",method="Allocate"} 1`)
+		assert.Contains(t, body, `turn_requests_total{code="200",method="Allocate"} 1`)
+		assert.Contains(t, body, `turn_nonces 1`)
+		assert.Contains(t, body, `turn_relayed_packets_total{direction="to_peer"} 0`)
+
+		assert.NoError(t, relayConn.Close())
+		client.Close()
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	})
+
+	t.Run("Metrics disabled", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			PacketConnConfigs: []PacketConnConfig{
+				{
+					PacketConn: udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorStatic{
+						RelayAddress: net.ParseIP("127.0.0.1"),
+						Address:      "0.0.0.0",
+					},
+				},
+			},
+			LoggerFactory: loggerFactory,
+		})
+		assert.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		assert.NoError(t, server.Close())
+	})
+}
+
+func TestServerAllocations(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	deleted := make(chan AllocationDeleteReason, 1)
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+		EventHandlers: EventHandlers{
+			OnAllocationDeleted: func(e AllocationEvent) {
+				deleted <- e.Reason
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: "127.0.0.1:3478",
+		TURNServerAddr: "127.0.0.1:3478",
+		Conn:           conn,
+		Username:       "alice",
+		Password:       "pass",
+		Realm:          "pion.ly",
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	peerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345}
+	assert.NoError(t, client.CreatePermission(peerAddr))
+
+	allocations := server.Allocations()
+	assert.Len(t, allocations, 1)
+
+	info := allocations[0]
+	assert.Equal(t, "alice", info.Username)
+	assert.Equal(t, "udp", info.FiveTuple.Protocol)
+	assert.Equal(t, conn.LocalAddr().String(), info.FiveTuple.SrcAddr.String())
+	assert.Equal(t, relayConn.LocalAddr().String(), info.RelayAddr.String())
+	assert.True(t, info.RemainingLifetime > 0 && info.RemainingLifetime <= proto.DefaultLifetime)
+	assert.Len(t, info.Permissions, 1)
+	assert.Equal(t, "127.0.0.4:12345", info.Permissions[0].PeerAddr.String())
+	assert.True(t, info.Permissions[0].ExpiresAt.After(time.Now()))
+
+	assert.Equal(t, 0, server.DeleteAllocations(func(a AllocationInfo) bool {
+		return a.Username == "bob"
+	}))
+	assert.Equal(t, 1, server.AllocationCount())
+
+	// allocations deleted by someone else meanwhile are not counted
+	var deletedMeanwhile bool
+	assert.Equal(t, 0, server.DeleteAllocations(func(a AllocationInfo) bool {
+		deletedMeanwhile = server.DeleteAllocation(a.FiveTuple)
+		return true
+	}))
+	assert.True(t, deletedMeanwhile)
+	assert.Equal(t, AllocationDeleteReasonAdmin, <-deleted)
+	assert.Equal(t, 0, server.AllocationCount())
+	assert.False(t, server.DeleteAllocation(info.FiveTuple))
+
+	// the allocation is already gone on the server, closing only stops the client refresh timers
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// a fake clock simulates hours of refreshes and the expiry of an allocation in milliseconds
+func TestServerFakeClock(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	clock := NewFakeClock(time.Now())
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	var lock sync.Mutex
+	var refreshed int
+	deleted := make(chan AllocationEvent, 1)
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+		EventHandlers: EventHandlers{
+			OnAllocationRefreshed: func(AllocationEvent) {
+				lock.Lock()
+				refreshed++
+				lock.Unlock()
+			},
+			OnAllocationDeleted: func(e AllocationEvent) {
+				deleted <- e
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+		Clock:         clock,
+	})
+	assert.NoError(t, err)
+
+	newClient := func(c Clock) (*Client, net.PacketConn, net.PacketConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       "alice",
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+			Clock:          c,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+		return client, conn, relayConn
+	}
+
+	// the refresh timers of the first client run on the fake clock, the second
+	// client never refreshes its allocation
+	refreshing, refreshingConn, refreshingRelayConn := newClient(clock)
+	idle, idleConn, idleRelayConn := newClient(nil)
+
+	start := clock.Now()
+	clock.Advance(proto.DefaultLifetime + time.Minute)
+
+	e := <-deleted
+	assert.Equal(t, AllocationDeleteReasonExpired, e.Reason)
+	assert.Equal(t, idleConn.LocalAddr().String(), e.FiveTuple.SrcAddr.String())
+	assert.True(t, !e.Time.Before(start.Add(proto.DefaultLifetime)))
+
+	// two hours of refreshes every 5 minutes, the nonce goes stale after an hour
+	for i := 0; i < 120; i++ {
+		clock.Advance(time.Minute)
+	}
+	assert.Equal(t, 1, server.AllocationCount())
+	lock.Lock()
+	assert.True(t, refreshed >= 24, "refreshed %d times", refreshed)
+	lock.Unlock()
+
+	assert.NoError(t, refreshingRelayConn.Close())
+	refreshing.Close()
+	assert.NoError(t, refreshingConn.Close())
+	<-deleted
+
+	assert.NoError(t, idleRelayConn.Close())
+	idle.Close()
+	assert.NoError(t, idleConn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerLifetimePolicy(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		for _, tc := range []struct {
+			policy LifetimePolicy
+			err    error
+		}{
+			{LifetimePolicy{Max: -time.Minute}, errLifetimeNegative},
+			{LifetimePolicy{Default: 2 * time.Hour}, errLifetimePolicyInvalid},
+			{LifetimePolicy{Min: 20 * time.Minute}, errLifetimePolicyInvalid},
+		} {
+			_, err := NewServer(ServerConfig{
+				PacketConnConfigs:  []PacketConnConfig{{}},
+				AllocationLifetime: tc.policy,
+			})
+			assert.ErrorIs(t, err, tc.err)
+		}
+	})
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	created := make(chan AllocationEvent, 3)
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+		AllocationLifetime: LifetimePolicy{Default: 20 * time.Minute, Max: 2 * time.Hour},
+		LifetimePolicyHandler: func(username, realm string, srcAddr net.Addr) LifetimePolicy {
+			switch username {
+			case "trial":
+				return LifetimePolicy{Max: 2 * time.Minute}
+			case "short":
+				return LifetimePolicy{Default: 3 * time.Minute}
+			}
+			return LifetimePolicy{}
+		},
+		EventHandlers: EventHandlers{
+			OnAllocationCreated: func(e AllocationEvent) {
+				created <- e
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	for username, lifetime := range map[string]time.Duration{
+		"alice": 20 * time.Minute,
+		"trial": 2 * time.Minute,
+		"short": 3 * time.Minute,
+	} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       username,
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		e := <-created
+		assert.Equal(t, username, e.Username)
+		assert.Equal(t, lifetime, e.Lifetime)
+
+		assert.NoError(t, relayConn.Close())
+		client.Close()
+		assert.NoError(t, conn.Close())
+	}
+
+	assert.NoError(t, server.Close())
+}
+
+type recordingRelayAddressGenerator struct {
+	*RelayAddressGeneratorStatic
+	requests chan RelayAllocationRequest
+}
+
+func (g *recordingRelayAddressGenerator) AllocateRelayPacketConn(req RelayAllocationRequest) (net.PacketConn, net.Addr, error) {
+	g.requests <- req
+	return g.AllocatePacketConn(req.Network, req.RequestedPort)
+}
+
+func TestServerRequestRelayAddressGenerator(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	static := &RelayAddressGeneratorStatic{RelayAddress: net.ParseIP("127.0.0.1"), Address: "0.0.0.0"}
+	generator := &recordingRelayAddressGenerator{static, make(chan RelayAllocationRequest, 1)}
+	assert.Equal(t, relayAddressGeneratorAdapter{static}, AdaptRelayAddressGenerator(static))
+	assert.Equal(t, generator, AdaptRelayAddressGenerator(generator))
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: generator,
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: "127.0.0.1:3478",
+		TURNServerAddr: "127.0.0.1:3478",
+		Conn:           conn,
+		Username:       "alice",
+		Password:       "pass",
+		Realm:          "pion.ly",
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	req := <-generator.requests
+	assert.Equal(t, "alice", req.Username)
+	assert.Equal(t, "pion.ly", req.Realm)
+	assert.Equal(t, "udp4", req.Network)
+	assert.Equal(t, conn.LocalAddr().String(), req.FiveTuple.SrcAddr.String())
+	assert.Equal(t, udpListener.LocalAddr(), req.Listener)
+	assert.False(t, req.EvenPort)
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestServerRelayAddressFamily(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	t.Run("AddressSupportsNetwork", func(t *testing.T) {
+		for _, tc := range []struct {
+			address      string
+			relayAddress net.IP
+			udp4, udp6   bool
+		}{
+			{"0.0.0.0", nil, true, false},
+			{"127.0.0.1", nil, true, false},
+			{"::", nil, true, true},
+			{"::1", nil, false, true},
+			{"localhost", nil, true, true},
+			{"::", net.ParseIP("192.0.2.1"), true, false},
+			{"::", net.ParseIP("2001:db8::1"), false, true},
+		} {
+			assert.Equal(t, tc.udp4, addressSupportsNetwork(tc.address, tc.relayAddress, "udp4"), tc.address)
+			assert.Equal(t, tc.udp6, addressSupportsNetwork(tc.address, tc.relayAddress, "udp6"), tc.address)
+		}
+	})
+
+	t.Run("Allocate", func(t *testing.T) {
+		udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
+			},
+			PacketConnConfigs: []PacketConnConfig{{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "0.0.0.0",
+				},
+			}},
+			Realm:         "pion.ly",
+			LoggerFactory: logging.NewDefaultLoggerFactory(),
+		})
+		assert.NoError(t, err)
+
+		conn, err := net.Dial("udp4", udpListener.LocalAddr().String())
+		assert.NoError(t, err)
+
+		allocate := func(setters ...stun.Setter) *stun.Message {
+			request, buildErr := stun.Build(append([]stun.Setter{
+				stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+				proto.RequestedTransport{Protocol: proto.ProtoUDP},
+			}, setters...)...)
+			assert.NoError(t, buildErr)
+			_, writeErr := conn.Write(request.Raw)
+			assert.NoError(t, writeErr)
+
+			buf := make([]byte, 1500)
+			n, readErr := conn.Read(buf)
+			assert.NoError(t, readErr)
+			response := &stun.Message{Raw: buf[:n]}
+			assert.NoError(t, response.Decode())
+			return response
+		}
+		errorCode := func(m *stun.Message) stun.ErrorCode {
+			var code stun.ErrorCodeAttribute
+			_ = code.GetFrom(m)
+			return code.Code
+		}
+
+		var nonce stun.Nonce
+		assert.NoError(t, nonce.GetFrom(allocate()))
+		credentials := []stun.Setter{
+			stun.NewUsername("alice"), stun.NewRealm("pion.ly"), nonce,
+			stun.NewLongTermIntegrity("alice", "pion.ly", "pass"),
+		}
+
+		// the relays are bound to 0.0.0.0, IPv6 relays cannot be allocated
+		response := allocate(append([]stun.Setter{proto.RequestedFamilyIPv6}, credentials...)...)
+		assert.Equal(t, stun.CodeAddrFamilyNotSupported, errorCode(response))
+
+		response = allocate(append([]stun.Setter{proto.DontFragment{}}, credentials...)...)
+		if dontFragmentSupported {
+			assert.Equal(t, stun.ClassSuccessResponse, response.Type.Class)
+		} else {
+			assert.Equal(t, stun.CodeUnknownAttribute, errorCode(response))
+		}
+
+		assert.NoError(t, conn.Close())
+		assert.NoError(t, server.Close())
+	})
+}
+
+// the relay address is not routable, only the short-circuit delivers between the allocations
+func TestServerHairpin(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("192.0.2.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	var conns []net.PacketConn
+	var clients []*Client
+	var relayConns []net.PacketConn
+	for _, username := range []string{"alice", "bob"} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       username,
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		conns = append(conns, conn)
+		clients = append(clients, client)
+		relayConns = append(relayConns, relayConn)
+	}
+	alice, bob := relayConns[0], relayConns[1]
+
+	assert.NoError(t, clients[1].CreatePermission(alice.LocalAddr()))
+	_, err = alice.WriteTo([]byte("hairpin"), bob.LocalAddr())
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	n, from, err := bob.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hairpin", string(buf[:n]))
+	assert.Equal(t, alice.LocalAddr().String(), from.String())
+
+	for i := range clients {
+		assert.NoError(t, relayConns[i].Close())
+		clients[i].Close()
+		assert.NoError(t, conns[i].Close())
+	}
+	assert.NoError(t, server.Close())
+}
+
+func TestServerTenantIsolation(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+	assert.NoError(t, err)
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+		TenantIsolation: &TenantIsolation{},
+		Realm:           "pion.ly",
+		LoggerFactory:   loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	var conns []net.PacketConn
+	var clients []*Client
+	var relayConns []net.PacketConn
+	for _, username := range []string{"alice", "bob"} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		client, err := NewClient(&ClientConfig{
+			STUNServerAddr: "127.0.0.1:3478",
+			TURNServerAddr: "127.0.0.1:3478",
+			Conn:           conn,
+			Username:       username,
+			Password:       "pass",
+			Realm:          "pion.ly",
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, client.Listen())
+
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
+
+		conns = append(conns, conn)
+		clients = append(clients, client)
+		relayConns = append(relayConns, relayConn)
+	}
+	alice, bob := relayConns[0], relayConns[1]
+
+	// hosts that are not allocations of the server are forbidden, so is the own relayed address
+	err = clients[0].CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+	assert.Error(t, clients[0].CreatePermission(alice.LocalAddr()))
+
+	assert.NoError(t, clients[0].CreatePermission(bob.LocalAddr()))
+	assert.NoError(t, clients[1].CreatePermission(alice.LocalAddr()))
+
+	_, err = alice.WriteTo([]byte("isolated"), bob.LocalAddr())
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	n, from, err := bob.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "isolated", string(buf[:n]))
+	assert.Equal(t, alice.LocalAddr().String(), from.String())
+
+	for i := range clients {
+		assert.NoError(t, relayConns[i].Close())
+		clients[i].Close()
+		assert.NoError(t, conns[i].Close())
+	}
+	assert.NoError(t, server.Close())
+}
+
+func TestServerShutdown(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	newServer := func() *Server {
+		udpListener, err := net.ListenPacket("udp4", "0.0.0.0:3478")
+		assert.NoError(t, err)
+
+		tcpListener, err := net.Listen("tcp4", "127.0.0.1:3478")
+		assert.NoError(t, err)
+
+		relayAddressGenerator := &RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "0.0.0.0",
+		}
+		server, err := NewServer(ServerConfig{
+			AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+				return GenerateAuthKey(username, realm, "pass"), true
 			},
 			PacketConnConfigs: []PacketConnConfig{
-				{
-					PacketConn: udpListener,
-					RelayAddressGenerator: &RelayAddressGeneratorStatic{
-						RelayAddress: net.ParseIP("127.0.0.1"),
-						Address:      "0.0.0.0",
-					},
-					PermissionHandler: func(src net.Addr, peer net.IP) bool {
-						return src.String() == "127.0.0.1:54321" &&
-							peer.Equal(net.ParseIP("127.0.0.4"))
-					},
-				},
+				{PacketConn: udpListener, RelayAddressGenerator: relayAddressGenerator},
+			},
+			ListenerConfigs: []ListenerConfig{
+				{Listener: tcpListener, RelayAddressGenerator: relayAddressGenerator},
 			},
 			Realm:         "pion.ly",
 			LoggerFactory: loggerFactory,
 		})
 		assert.NoError(t, err)
+		return server
+	}
 
-		// enforce corrent client IP and port
-		conn, err := net.ListenPacket("udp4", "127.0.0.1:54321")
+	newClient := func() (*Client, net.PacketConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
 		assert.NoError(t, err)
 
 		client, err := NewClient(&ClientConfig{
@@ -159,112 +1310,237 @@ func TestServer(t *testing.T) {
 		})
 		assert.NoError(t, err)
 		assert.NoError(t, client.Listen())
+		return client, conn
+	}
+
+	t.Run("Drain", func(t *testing.T) {
+		server := newServer()
 
+		client, conn := newClient()
 		relayConn, err := client.Allocate()
 		assert.NoError(t, err)
 
-		whiteAddr, errA := net.ResolveUDPAddr("udp", "127.0.0.4:12345")
-		assert.NoError(t, errA, "should succeed")
-		blackAddr, errB1 := net.ResolveUDPAddr("udp", "127.0.0.5:12345")
-		assert.NoError(t, errB1, "should succeed")
+		assert.Error(t, server.Drain(&net.IPAddr{IP: net.ParseIP("127.0.0.2")}))
+		assert.NoError(t, server.Drain(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 3478}))
 
-		// explicit CreatePermission
-		err = client.CreatePermission(whiteAddr)
-		assert.NoError(t, err, "grant permission for whitelisted peer")
+		// existing allocations keep working
+		assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 12345}))
 
-		err = client.CreatePermission(blackAddr)
-		assert.ErrorContains(t, err, "error", "deny permission for blacklisted peer address")
+		drainedClient, drainedConn := newClient()
+		_, err = drainedClient.Allocate()
+		assert.Contains(t, fmt.Sprint(err), "300")
 
-		err = client.CreatePermission(whiteAddr, whiteAddr)
-		assert.NoError(t, err, "grant permission for repeated whitelisted peer addresses")
+		assert.NoError(t, server.Drain(nil))
+		_, err = drainedClient.Allocate()
+		assert.Contains(t, fmt.Sprint(err), "508")
+		assert.Equal(t, 1, server.AllocationCount())
 
-		err = client.CreatePermission(blackAddr)
-		assert.ErrorContains(t, err, "error", "deny permission for repeated blacklisted peer address")
+		drainedClient.Close()
+		assert.NoError(t, drainedConn.Close())
 
-		// rg0now: isn't this a cornercase in the spec?
-		err = client.CreatePermission(whiteAddr, blackAddr)
-		assert.ErrorContains(t, err, "error", "deny permission for mixed whitelisted and blacklisted peers")
+		// the client deletes its allocation on close, which completes the shutdown
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			assert.NoError(t, relayConn.Close())
+		}()
+		assert.NoError(t, server.Shutdown(context.Background()))
+		assert.Equal(t, 0, server.AllocationCount())
 
-		// implicit CreatePermission for ChannelBindRequests: WriteTo always tries to bind a channel
-		_, err = relayConn.WriteTo([]byte("Hello"), whiteAddr)
-		assert.NoError(t, err, "write to whitelisted peer address succeeds - 1")
+		client.Close()
+		assert.NoError(t, conn.Close())
+	})
 
-		_, err = relayConn.WriteTo([]byte("Hello"), blackAddr)
-		assert.ErrorContains(t, err, "error", "write to blacklisted peer address fails - 1")
+	t.Run("Context done", func(t *testing.T) {
+		server := newServer()
 
-		_, err = relayConn.WriteTo([]byte("Hello"), whiteAddr)
-		assert.NoError(t, err, "write to whitelisted peer address succeeds - 2")
+		client, conn := newClient()
+		relayConn, err := client.Allocate()
+		assert.NoError(t, err)
 
-		_, err = relayConn.WriteTo([]byte("Hello"), blackAddr)
-		assert.ErrorContains(t, err, "error", "write to blacklisted peer address fails - 2")
+		tcpConn, err := net.Dial("tcp4", "127.0.0.1:3478")
+		assert.NoError(t, err)
 
-		_, err = relayConn.WriteTo([]byte("Hello"), whiteAddr)
-		assert.NoError(t, err, "write to whitelisted peer address succeeds - 3")
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+		assert.Equal(t, 0, server.AllocationCount())
 
-		_, err = relayConn.WriteTo([]byte("Hello"), blackAddr)
-		assert.ErrorContains(t, err, "error", "write to blacklisted peer address fails - 3")
+		// accepted connections are closed by the server
+		_, err = tcpConn.Read(make([]byte, 1))
+		assert.Error(t, err)
+		assert.NoError(t, tcpConn.Close())
 
-		// let the previous transaction terminate
-		time.Sleep(200 * time.Millisecond)
 		assert.NoError(t, relayConn.Close())
-
 		client.Close()
 		assert.NoError(t, conn.Close())
+	})
+}
 
-		// enforce filtered source address
-		conn2, err := net.ListenPacket("udp4", "127.0.0.133:54321")
-		assert.NoError(t, err)
+func TestNewServerListenerError(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
 
-		client2, err := NewClient(&ClientConfig{
-			STUNServerAddr: "127.0.0.1:3478",
-			TURNServerAddr: "127.0.0.1:3478",
-			Conn:           conn2,
-			Username:       "user",
-			Password:       "pass",
-			Realm:          "pion.ly",
-			LoggerFactory:  loggerFactory,
-		})
-		assert.NoError(t, err)
-		assert.NoError(t, client2.Listen())
+	report := test.CheckRoutines(t)
+	defer report()
 
-		relayConn2, err := client2.Allocate()
-		assert.NoError(t, err)
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
 
-		// explicit CreatePermission
-		err = client2.CreatePermission(whiteAddr)
-		assert.ErrorContains(t, err, "error", "deny permission from filtered source to whitelisted peer")
+	relayAddressGenerator := &RelayAddressGeneratorNone{Address: "127.0.0.1"}
+	_, err = NewServer(ServerConfig{
+		AuthHandler: rejectAuthHandler,
+		PacketConnConfigs: []PacketConnConfig{
+			{PacketConn: udpListener, RelayAddressGenerator: relayAddressGenerator},
+		},
+		ListenerConfigs: []ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: relayAddressGenerator},
+		},
+		ReusePortConfigs: []ReusePortConfig{
+			{Address: "invalid address", RelayAddressGenerator: relayAddressGenerator},
+		},
+		Realm:          "pion.ly",
+		RequestWorkers: 2,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.Error(t, err)
 
-		err = client2.CreatePermission(blackAddr)
-		assert.ErrorContains(t, err, "error", "deny permission from filtered source to blacklisted peer")
+	// the listeners added before are closed
+	_, err = udpListener.WriteTo([]byte("ping"), udpListener.LocalAddr())
+	assert.Error(t, err)
+	_, err = tcpListener.Accept()
+	assert.Error(t, err)
+}
 
-		// implicit CreatePermission for ChannelBindRequests: WriteTo always tries to bind a channel
-		_, err = relayConn2.WriteTo([]byte("Hello"), whiteAddr)
-		assert.ErrorContains(t, err, "error", "write from filtered source to whitelisted peer fails - 1")
+func TestServerCloseFromHandler(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
 
-		_, err = relayConn2.WriteTo([]byte("Hello"), blackAddr)
-		assert.ErrorContains(t, err, "error", "write from filtered source to blacklisted peer fails - 1")
+	report := test.CheckRoutines(t)
+	defer report()
 
-		_, err = relayConn2.WriteTo([]byte("Hello"), whiteAddr)
-		assert.ErrorContains(t, err, "error", "write from filtered source to whitelisted peer fails - 2")
+	for _, workers := range []int{0, 2} {
+		workers := workers
+		t.Run(fmt.Sprintf("RequestWorkers %d", workers), func(t *testing.T) {
+			udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			assert.NoError(t, err)
 
-		_, err = relayConn2.WriteTo([]byte("Hello"), blackAddr)
-		assert.ErrorContains(t, err, "error", "write from filtered source to blacklisted peer fails - 2")
+			servers := make(chan *Server, 1)
+			closed := make(chan error, 1)
+			server, err := NewServer(ServerConfig{
+				AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+					closed <- (<-servers).Close()
+					return nil, false
+				},
+				PacketConnConfigs: []PacketConnConfig{{
+					PacketConn:            udpListener,
+					RelayAddressGenerator: &RelayAddressGeneratorNone{Address: "127.0.0.1"},
+				}},
+				Realm:          "pion.ly",
+				RequestWorkers: workers,
+				LoggerFactory:  logging.NewDefaultLoggerFactory(),
+			})
+			assert.NoError(t, err)
+			servers <- server
 
-		_, err = relayConn2.WriteTo([]byte("Hello"), whiteAddr)
-		assert.ErrorContains(t, err, "error", "write from filtered source to whitelisted peer fails - 3")
+			conn, err := net.Dial("udp4", udpListener.LocalAddr().String())
+			assert.NoError(t, err)
 
-		_, err = relayConn2.WriteTo([]byte("Hello"), blackAddr)
-		assert.ErrorContains(t, err, "error", "write from filtered source to blacklisted peer fails - 3")
+			// the handler runs for a request with credentials and the nonce of the server
+			allocate := func(setters ...stun.Setter) {
+				request, buildErr := stun.Build(append([]stun.Setter{
+					stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+					proto.RequestedTransport{Protocol: proto.ProtoUDP},
+				}, setters...)...)
+				assert.NoError(t, buildErr)
+				_, writeErr := conn.Write(request.Raw)
+				assert.NoError(t, writeErr)
+			}
+			allocate()
 
-		// let the previous transaction terminate
-		time.Sleep(200 * time.Millisecond)
-		assert.NoError(t, relayConn2.Close())
+			buf := make([]byte, 1500)
+			n, err := conn.Read(buf)
+			assert.NoError(t, err)
+			response := &stun.Message{Raw: buf[:n]}
+			assert.NoError(t, response.Decode())
+			var nonce stun.Nonce
+			assert.NoError(t, nonce.GetFrom(response))
 
-		client2.Close()
-		assert.NoError(t, conn2.Close())
+			allocate(stun.NewUsername("user"), stun.NewRealm("pion.ly"), nonce, stun.NewShortTermIntegrity("pass"))
 
-		assert.NoError(t, server.Close())
+			assert.NoError(t, <-closed)
+			assert.NoError(t, conn.Close())
+		})
+	}
+}
+
+func TestServerCloseOnExpiry(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	clock := NewFakeClock(time.Now())
+
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	servers := make(chan *Server, 1)
+	closed := make(chan error, 1)
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{{
+			PacketConn: udpListener,
+			RelayAddressGenerator: &RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+		EventHandlers: EventHandlers{
+			// Close waits for the timers, the handler must not run on their tick
+			OnAllocationDeleted: func(e AllocationEvent) {
+				if e.Reason == AllocationDeleteReasonExpired {
+					closed <- (<-servers).Close()
+				}
+			},
+		},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+		Clock:         clock,
 	})
+	assert.NoError(t, err)
+	servers <- server
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: udpListener.LocalAddr().String(),
+		TURNServerAddr: udpListener.LocalAddr().String(),
+		Conn:           conn,
+		Username:       "alice",
+		Password:       "pass",
+		Realm:          "pion.ly",
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+
+	clock.Advance(proto.DefaultLifetime + time.Minute)
+	assert.NoError(t, <-closed)
+	assert.Equal(t, 0, server.AllocationCount())
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
 }
 
 type VNet struct {
@@ -671,3 +1947,146 @@ func BenchmarkServer(b *testing.B) {
 		})
 	}
 }
+
+func runBenchmarkServerRelay(b *testing.B, batchSize int, udpOffload bool) {
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.DefaultLogLevel = logging.LogLevelWarn
+
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:3478")
+	if err != nil {
+		b.Fatalf("Failed to allocate server listener: %s", err)
+	}
+
+	server, err := NewServer(ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+			return GenerateAuthKey(username, realm, "pass"), true
+		},
+		PacketConnConfigs: []PacketConnConfig{{
+			PacketConn: serverConn,
+			RelayAddressGenerator: &RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+		BatchSize:     batchSize,
+		UDPOffload:    udpOffload,
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		b.Fatalf("Failed to start server: %s", err)
+	}
+	defer server.Close() //nolint:errcheck
+
+	clientConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to allocate client socket: %s", err)
+	}
+	defer clientConn.Close() //nolint:errcheck
+
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: "127.0.0.1:3478",
+		TURNServerAddr: "127.0.0.1:3478",
+		Conn:           clientConn,
+		Username:       "user",
+		Password:       "pass",
+		Realm:          "pion.ly",
+		LoggerFactory:  loggerFactory,
+	})
+	if err != nil {
+		b.Fatalf("Failed to start client: %s", err)
+	}
+	defer client.Close()
+
+	if err = client.Listen(); err != nil {
+		b.Fatalf("Client cannot listen: %s", err)
+	}
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		b.Fatalf("Client cannot create allocation: %s", err)
+	}
+	defer relayConn.Close() //nolint:errcheck
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to allocate peer socket: %s", err)
+	}
+	defer peer.Close() //nolint:errcheck
+
+	// creates the permission for the peer
+	if _, err = relayConn.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+		b.Fatalf("Client cannot send to peer: %s", err)
+	}
+	if _, _, err = peer.ReadFrom(make([]byte, 1600)); err != nil {
+		b.Fatalf("Peer cannot receive: %s", err)
+	}
+
+	received := make(chan struct{}, 1024)
+	go func() {
+		buf := make([]byte, 1600)
+		for {
+			if _, _, readErr := relayConn.ReadFrom(buf); readErr != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	payload := make([]byte, 160)
+	b.ResetTimer()
+	start := time.Now()
+
+	// packets are sent in windows, lost packets are waited for until a timeout
+	const window = 64
+	count := 0
+	for sent := 0; sent < b.N; {
+		n := window
+		if b.N-sent < n {
+			n = b.N - sent
+		}
+		for i := 0; i < n; i++ {
+			if _, err = peer.WriteTo(payload, relayConn.LocalAddr()); err != nil {
+				b.Fatalf("Peer cannot send to relay: %s", err)
+			}
+		}
+		sent += n
+
+		timeout := time.After(100 * time.Millisecond)
+	wait:
+		for i := 0; i < n; i++ {
+			select {
+			case <-received:
+				count++
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+
+	b.ReportMetric(float64(count)/time.Since(start).Seconds(), "packets/s")
+}
+
+// BenchmarkServerRelay benchmarks relaying packets from a peer to a client with and without
+// batching and UDP offloads
+func BenchmarkServerRelay(b *testing.B) {
+	for _, c := range []struct {
+		batchSize  int
+		udpOffload bool
+	}{{0, false}, {32, false}, {32, true}} {
+		c := c
+		b.Run(fmt.Sprintf("batch_size_%d_udp_offload_%t", c.batchSize, c.udpOffload), func(b *testing.B) {
+			runBenchmarkServerRelay(b, c.batchSize, c.udpOffload)
+		})
+	}
+}
+
+func TestDebugEnabled(t *testing.T) {
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.DefaultLogLevel = logging.LogLevelWarn
+	assert.False(t, debugEnabled(loggerFactory, "turn"))
+
+	loggerFactory.ScopeLevels["turn"] = logging.LogLevelDebug
+	assert.True(t, debugEnabled(loggerFactory, "turn"))
+	assert.False(t, debugEnabled(loggerFactory, "other"))
+}
@@ -0,0 +1,109 @@
+package turn
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pion/turn/v2/internal/server"
+)
+
+const defaultRequestQueueSize = 128
+
+// requestWorkers handle STUN requests off the socket read loops, so slow requests
+// do not stop the sockets from being read. Requests from the same source address
+// always go to the same worker, which keeps the requests of a five-tuple in order.
+type requestWorkers struct {
+	queues []chan queuedRequest
+	wg     sync.WaitGroup
+}
+
+type queuedRequest struct {
+	request  server.Request
+	buf      *[]byte
+	listener *serverListener
+}
+
+func newRequestWorkers(s *Server, workers, queueSize int) *requestWorkers {
+	w := &requestWorkers{queues: make([]chan queuedRequest, workers)}
+	for i := range w.queues {
+		queue := make(chan queuedRequest, queueSize)
+		w.queues[i] = queue
+
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+
+			for q := range queue {
+				s.handleRequest(q.request)
+				s.putBuffer(q.buf)
+				q.listener.requests.Done()
+			}
+		}()
+	}
+	return w
+}
+
+// dispatch queues r for a worker and reports false if the queue of the worker is full.
+// buf is returned to the buffer pool once r was handled.
+func (w *requestWorkers) dispatch(r server.Request, buf *[]byte, l *serverListener) bool {
+	queue := w.queues[addrHash(r.SrcAddr)%uint32(len(w.queues))]
+
+	l.requests.Add(1)
+	select {
+	case queue <- queuedRequest{request: r, buf: buf, listener: l}:
+		return true
+	default:
+		l.requests.Done()
+		return false
+	}
+}
+
+// close stops the workers once all queued requests were handled
+func (w *requestWorkers) close() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
+
+// addrHash is the FNV-1a hash of the IP and port of addr
+func addrHash(addr net.Addr) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		ip = net.IP(addr.String())
+	}
+
+	h := uint32(offset32)
+	for _, b := range ip {
+		h ^= uint32(b)
+		h *= prime32
+	}
+	h ^= uint32(port >> 8)
+	h *= prime32
+	h ^= uint32(port & 0xff)
+	h *= prime32
+	return h
+}
+
+func (s *Server) getBuffer() *[]byte {
+	if buf, ok := s.buffers.Get().(*[]byte); ok {
+		return buf
+	}
+	buf := make([]byte, s.inboundMTU)
+	return &buf
+}
+
+func (s *Server) putBuffer(buf *[]byte) {
+	s.buffers.Put(buf)
+}
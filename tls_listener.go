@@ -0,0 +1,329 @@
+package turn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+const (
+	defaultCertificateReloadInterval = time.Minute
+	defaultTLSHandshakeTimeout       = 10 * time.Second
+)
+
+// TLSListenerConfig configures a TLSListener
+type TLSListenerConfig struct {
+	// Listener accepts the TCP connections TLS is terminated on
+	Listener net.Listener
+
+	// CertificateDir holds PEM certificate chains and their keys as pairs of files named
+	// <name>.crt and <name>.key. Clients get the certificate valid for their server name
+	// (SNI), wildcard certificates included. The pair named default is used for clients
+	// of other or no server names.
+	CertificateDir string
+
+	// ReloadInterval is how often CertificateDir is checked for changed files, which are
+	// then reloaded without interrupting established connections. Defaults to a minute.
+	ReloadInterval time.Duration
+
+	// GetCertificate returns the certificate of a client, CertificateDir is used if it
+	// returns neither a certificate nor an error
+	GetCertificate func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// TLSConfig is the base of the configuration of the connections, its Certificates
+	// are used if no other certificate matches
+	TLSConfig *tls.Config
+
+	// ProxyProtocol reads the PROXY protocol headers load balancers send ahead of the
+	// TLS handshake
+	ProxyProtocol *ProxyProtocolConfig
+
+	// HandshakeTimeout bounds the TLS handshake of connections, so clients that stop
+	// halfway do not hold on to the server. Defaults to 10 seconds.
+	HandshakeTimeout time.Duration
+
+	// RelayAddressGenerator, PermissionHandler and Tenant are copied to the ListenerConfig
+	RelayAddressGenerator RelayAddressGenerator
+	PermissionHandler     PermissionHandler
+	Tenant                string
+
+	LoggerFactory logging.LoggerFactory
+}
+
+// TLSListener is a net.Listener terminating TLS with certificates picked by the server
+// name of the client and reloaded when they change on disk. The Server completes the
+// handshake of its connections with a timeout before reading them, the server name is
+// passed to AuthRequestHandler and selects the Tenant of the connection.
+type TLSListener struct {
+	listener         net.Listener
+	config           *tls.Config
+	handshakeTimeout time.Duration
+	getCertificate   func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	listenerConfig   ListenerConfig
+	log              logging.LeveledLogger
+
+	dir          string
+	certificates atomic.Value // *certificateSet
+	reloadLock   sync.Mutex
+	dirState     string
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewTLSListener loads the certificates of config and starts watching CertificateDir
+func NewTLSListener(config TLSListenerConfig) (*TLSListener, error) {
+	if config.Listener == nil {
+		return nil, errTLSListenerUnset
+	}
+	if err := config.ProxyProtocol.validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	if config.CertificateDir == "" && config.GetCertificate == nil && len(tlsConfig.Certificates) == 0 {
+		return nil, errNoCertificates
+	}
+
+	loggerFactory := config.LoggerFactory
+	if loggerFactory == nil {
+		loggerFactory = logging.NewDefaultLoggerFactory()
+	}
+
+	l := &TLSListener{
+		listener:         config.Listener,
+		config:           tlsConfig,
+		handshakeTimeout: config.HandshakeTimeout,
+		getCertificate:   config.GetCertificate,
+		log:              loggerFactory.NewLogger("turn"),
+		dir:              config.CertificateDir,
+		done:             make(chan struct{}),
+	}
+	if config.ProxyProtocol != nil {
+		l.listener = NewProxyProtocolListener(l.listener, *config.ProxyProtocol)
+	}
+	if l.handshakeTimeout == 0 {
+		l.handshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	l.config.GetCertificate = l.certificate
+	l.listenerConfig = ListenerConfig{
+		Listener:              l,
+		RelayAddressGenerator: config.RelayAddressGenerator,
+		PermissionHandler:     config.PermissionHandler,
+		Tenant:                config.Tenant,
+	}
+
+	if l.dir != "" {
+		if err := l.Reload(); err != nil {
+			return nil, err
+		}
+
+		reloadInterval := config.ReloadInterval
+		if reloadInterval == 0 {
+			reloadInterval = defaultCertificateReloadInterval
+		}
+		l.wg.Add(1)
+		go l.watch(reloadInterval)
+	}
+	return l, nil
+}
+
+// ListenerConfig returns the ListenerConfig serving l in a ServerConfig
+func (l *TLSListener) ListenerConfig() ListenerConfig {
+	return l.listenerConfig
+}
+
+// Accept waits for the next connection, its handshake is done on the first read or write
+func (l *TLSListener) Accept() (net.Conn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsServerConn{Conn: tls.Server(conn, l.config), timeout: l.handshakeTimeout}, nil
+}
+
+// Close stops watching the certificates and closes the listener
+func (l *TLSListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	l.wg.Wait()
+	return l.listener.Close()
+}
+
+// Addr returns the address of the listener
+func (l *TLSListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Reload reads the certificates of CertificateDir, for example on SIGHUP. The ones
+// loaded before are kept if it fails.
+func (l *TLSListener) Reload() error {
+	l.reloadLock.Lock()
+	defer l.reloadLock.Unlock()
+
+	state, err := certificateDirState(l.dir)
+	if err != nil {
+		return err
+	}
+	certificates, err := loadCertificateDir(l.dir)
+	if err != nil {
+		return err
+	}
+	l.certificates.Store(certificates)
+	l.dirState = state
+	return nil
+}
+
+// watch reloads the certificates when files of the directory change
+func (l *TLSListener) watch(interval time.Duration) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		state, err := certificateDirState(l.dir)
+		if err != nil {
+			l.log.Warnf("Failed to check certificates in %s: %s", l.dir, err)
+			continue
+		}
+
+		l.reloadLock.Lock()
+		changed := state != l.dirState
+		l.reloadLock.Unlock()
+		if !changed {
+			continue
+		}
+
+		// a certificate and its key are rarely replaced at once, a mismatch is retried
+		if err := l.Reload(); err != nil {
+			l.log.Warnf("Failed to reload certificates in %s: %s", l.dir, err)
+		} else {
+			l.log.Infof("Reloaded certificates in %s", l.dir)
+		}
+	}
+}
+
+func (l *TLSListener) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if l.getCertificate != nil {
+		if cert, err := l.getCertificate(hello); cert != nil || err != nil {
+			return cert, err
+		}
+	}
+
+	// crypto/tls falls back to the Certificates of the config if this returns nil
+	if certificates, ok := l.certificates.Load().(*certificateSet); ok {
+		return certificates.lookup(hello.ServerName), nil
+	}
+	return nil, nil //nolint:nilnil
+}
+
+// tlsServerConn is a connection of a TLSListener, its handshake fails after a timeout
+type tlsServerConn struct {
+	*tls.Conn
+	timeout time.Duration
+}
+
+func (c *tlsServerConn) Handshake() error {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	if err := c.Conn.Handshake(); err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+// certificateSet is the certificates of a directory by the names they are valid for
+type certificateSet struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func (c *certificateSet) lookup(serverName string) *tls.Certificate {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if cert, ok := c.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := c.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return c.fallback
+}
+
+func loadCertificateDir(dir string) (*certificateSet, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &certificateSet{byName: map[string]*tls.Certificate{}}
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".crt")
+		if file.IsDir() || name == file.Name() {
+			continue
+		}
+
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, n := range names {
+			c.byName[strings.ToLower(n)] = &cert
+		}
+		if name == "default" || c.fallback == nil {
+			c.fallback = &cert
+		}
+	}
+
+	if len(c.byName) == 0 && c.fallback == nil {
+		return nil, fmt.Errorf("%w: %s", errNoCertificates, dir)
+	}
+	return c, nil
+}
+
+// certificateDirState changes when a certificate or key of dir is written
+func certificateDirState(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var state strings.Builder
+	for _, file := range files {
+		if ext := filepath.Ext(file.Name()); ext == ".crt" || ext == ".key" {
+			fmt.Fprintf(&state, "%s %d %d\n", file.Name(), file.Size(), file.ModTime().UnixNano())
+		}
+	}
+	return state.String(), nil
+}
@@ -0,0 +1,226 @@
+//go:build !js
+// +build !js
+
+package turn
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSListenerCertificates(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	dir, err := ioutil.TempDir("", "turn-certificates")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	acme := writeTestCertificate(t, dir, "acme", "turn.acme.io")
+	globex := writeTestCertificate(t, dir, "globex", "*.globex.com")
+	fallback := writeTestCertificate(t, dir, "default")
+
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	listener, err := NewTLSListener(TLSListenerConfig{
+		Listener:       tcpListener,
+		CertificateDir: dir,
+		ReloadInterval: 10 * time.Millisecond,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(tlsHandshaker).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	served := func(serverName string) []byte {
+		conn, err := tls.Dial("tcp4", tcpListener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true}) //nolint:gosec
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	assert.Equal(t, acme, served("turn.acme.io"))
+	assert.Equal(t, acme, served("TURN.acme.io"))
+	assert.Equal(t, globex, served("turn.globex.com"))
+	assert.Equal(t, fallback, served("turn.example.org"))
+	assert.Equal(t, fallback, served(""))
+
+	// rotated certificates are picked up without a restart
+	rotated := writeTestCertificate(t, dir, "acme", "turn.acme.io")
+	assert.Eventually(t, func() bool {
+		return bytes.Equal(rotated, served("turn.acme.io"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// broken files keep the certificates loaded before
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "broken.crt"), []byte("broken"), 0o600))
+	assert.Error(t, listener.Reload())
+	assert.Equal(t, rotated, served("turn.acme.io"))
+
+	assert.NoError(t, listener.Close())
+	wg.Wait()
+}
+
+func TestTLSListenerGetCertificate(t *testing.T) {
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, tcpListener.Close())
+	}()
+
+	_, err = NewTLSListener(TLSListenerConfig{})
+	assert.ErrorIs(t, err, errTLSListenerUnset)
+	_, err = NewTLSListener(TLSListenerConfig{Listener: tcpListener})
+	assert.ErrorIs(t, err, errNoCertificates)
+
+	acme := newTestCertificate(t, "turn.acme.io")
+	fallback := newTestCertificate(t)
+	listener, err := NewTLSListener(TLSListenerConfig{
+		Listener: tcpListener,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "turn.acme.io" {
+				return &acme, nil
+			}
+			return nil, nil //nolint:nilnil
+		},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{fallback}}, //nolint:gosec
+	})
+	assert.NoError(t, err)
+
+	for serverName, cert := range map[string]tls.Certificate{"turn.acme.io": acme, "turn.example.org": fallback} {
+		hello := &tls.ClientHelloInfo{ServerName: serverName}
+		selected, err := listener.certificate(hello)
+		assert.NoError(t, err)
+		if serverName == "turn.acme.io" {
+			assert.Equal(t, &cert, selected)
+		} else {
+			// crypto/tls picks the Certificates of the config
+			assert.Nil(t, selected)
+		}
+	}
+}
+
+func TestServerTLSListener(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	listener, err := NewTLSListener(TLSListenerConfig{
+		Listener:         tcpListener,
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}, //nolint:gosec
+		HandshakeTimeout: 100 * time.Millisecond,
+		RelayAddressGenerator: &RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP("127.0.0.1"),
+			Address:      "0.0.0.0",
+		},
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	serverNames := make(chan string, 10)
+	server, err := NewServer(ServerConfig{
+		AuthHandler:     rejectAuthHandler,
+		ListenerConfigs: []ListenerConfig{listener.ListenerConfig()},
+		Tenants: []Tenant{{
+			Realm: "acme.io",
+			AuthRequestHandler: func(r AuthRequest) ([]byte, bool) {
+				serverNames <- r.ServerName
+				return GenerateAuthKey(r.Username, r.Realm, "acme"), true
+			},
+			ServerNames: []string{"turn.acme.io"},
+		}},
+		Realm:         "pion.ly",
+		LoggerFactory: loggerFactory,
+	})
+	assert.NoError(t, err)
+
+	serverAddr := tcpListener.Addr().String()
+
+	// connections without a handshake are closed after the timeout
+	halfOpen, err := net.Dial("tcp4", serverAddr)
+	assert.NoError(t, err)
+	assert.NoError(t, halfOpen.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = halfOpen.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, halfOpen.Close())
+
+	// the server name selects the tenant and is passed to its AuthRequestHandler
+	conn, err := tls.Dial("tcp4", serverAddr, &tls.Config{ServerName: "turn.acme.io", InsecureSkipVerify: true}) //nolint:gosec
+	assert.NoError(t, err)
+
+	client, err := NewClient(&ClientConfig{
+		STUNServerAddr: serverAddr,
+		TURNServerAddr: serverAddr,
+		Conn:           NewSTUNConn(conn),
+		Username:       "alice",
+		Password:       "acme",
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Listen())
+
+	relayConn, err := client.Allocate()
+	assert.NoError(t, err)
+	assert.Equal(t, "acme.io", client.Realm().String())
+	assert.Equal(t, "turn.acme.io", <-serverNames)
+
+	assert.NoError(t, relayConn.Close())
+	client.Close()
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, server.Close())
+}
+
+// writeTestCertificate writes a self-signed certificate for dnsNames and its key to dir
+// as <name>.crt and <name>.key, it returns the certificate
+func writeTestCertificate(t *testing.T, dir, name string, dnsNames ...string) []byte {
+	cert := newTestCertificate(t, dnsNames...)
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	return cert.Certificate[0]
+}
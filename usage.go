@@ -0,0 +1,135 @@
+package turn
+
+import (
+	"net"
+	"time"
+
+	"github.com/pion/turn/v2/internal/allocation"
+	"github.com/pion/turn/v2/internal/ipnet"
+)
+
+// TrafficCounters count the traffic relayed by an allocation, a permission or a channel binding.
+// ToPeer is traffic received from the client and relayed to a peer, ToClient is traffic received
+// from a peer and relayed to the client. Dropped counts packets in either direction that had no
+// permission or channel binding, it is only tracked per allocation.
+type TrafficCounters struct {
+	PacketsToPeer   uint64
+	BytesToPeer     uint64
+	PacketsToClient uint64
+	BytesToClient   uint64
+	DroppedPackets  uint64
+	DroppedBytes    uint64
+}
+
+func (c *TrafficCounters) add(t TrafficCounters) {
+	c.PacketsToPeer += t.PacketsToPeer
+	c.BytesToPeer += t.BytesToPeer
+	c.PacketsToClient += t.PacketsToClient
+	c.BytesToClient += t.BytesToClient
+	c.DroppedPackets += t.DroppedPackets
+	c.DroppedBytes += t.DroppedBytes
+}
+
+func newTrafficCounters(t allocation.Traffic) TrafficCounters {
+	return TrafficCounters{
+		PacketsToPeer:   t.PacketsToPeer,
+		BytesToPeer:     t.BytesToPeer,
+		PacketsToClient: t.PacketsToClient,
+		BytesToClient:   t.BytesToClient,
+		DroppedPackets:  t.DroppedPackets,
+		DroppedBytes:    t.DroppedBytes,
+	}
+}
+
+// PeerUsage is the traffic exchanged with a single peer, either through a
+// permission or, if ChannelNumber is not zero, through a channel binding. It
+// includes the traffic of earlier permissions or bindings of the peer that expired.
+type PeerUsage struct {
+	PeerAddr      net.Addr
+	ChannelNumber uint16
+	Traffic       TrafficCounters
+}
+
+// UsageRecord summarizes the traffic relayed by an allocation. It is emitted through
+// EventHandlers.OnUsageRecord when the allocation is deleted and can be polled for
+// live allocations with Server.Usage.
+type UsageRecord struct {
+	FiveTuple FiveTuple
+	Username  string
+	RelayAddr net.Addr
+	CreatedAt time.Time
+	Duration  time.Duration
+	Traffic   TrafficCounters
+
+	Permissions []PeerUsage
+	Channels    []PeerUsage
+}
+
+func newUsageRecord(a *allocation.Allocation, now time.Time) UsageRecord {
+	u := UsageRecord{
+		FiveTuple: newFiveTuple(a.FiveTuple()),
+		Username:  a.Username(),
+		RelayAddr: a.RelayAddr,
+		CreatedAt: a.CreatedAt(),
+		Duration:  now.Sub(a.CreatedAt()),
+		Traffic:   newTrafficCounters(a.Traffic()),
+	}
+
+	for _, p := range a.Permissions() {
+		u.Permissions = append(u.Permissions, PeerUsage{
+			PeerAddr: p.Addr,
+			Traffic:  newTrafficCounters(p.Traffic()),
+		})
+	}
+
+	for _, c := range a.ChannelBinds() {
+		u.Channels = append(u.Channels, PeerUsage{
+			PeerAddr:      c.Peer,
+			ChannelNumber: uint16(c.Number),
+			Traffic:       newTrafficCounters(c.Traffic()),
+		})
+	}
+
+	for _, r := range a.RemovedTraffic() {
+		usage := &u.Permissions
+		if r.Number != 0 {
+			usage = &u.Channels
+		}
+		addPeerUsage(usage, PeerUsage{
+			PeerAddr:      r.Peer,
+			ChannelNumber: uint16(r.Number),
+			Traffic:       newTrafficCounters(r.Traffic),
+		})
+	}
+
+	return u
+}
+
+// addPeerUsage adds the traffic of a removed permission or channel binding to the
+// entry of the same peer, permissions are compared by IP
+func addPeerUsage(usage *[]PeerUsage, removed PeerUsage) {
+	for i := range *usage {
+		if u := &(*usage)[i]; u.ChannelNumber == removed.ChannelNumber && samePeerUsage(u.PeerAddr, removed.PeerAddr, removed.ChannelNumber == 0) {
+			u.Traffic.add(removed.Traffic)
+			return
+		}
+	}
+	*usage = append(*usage, removed)
+}
+
+func samePeerUsage(a, b net.Addr, ipOnly bool) bool {
+	aIP, aPort, aErr := ipnet.AddrIPPort(a)
+	bIP, bPort, bErr := ipnet.AddrIPPort(b)
+	return aErr == nil && bErr == nil && aIP.Equal(bIP) && (ipOnly || aPort == bPort)
+}
+
+// Usage returns a UsageRecord with the live counters of every active allocation
+func (s *Server) Usage() []UsageRecord {
+	var records []UsageRecord
+	for _, am := range s.allocationManagers() {
+		for _, a := range am.Allocations() {
+			records = append(records, newUsageRecord(a, s.clock.Now()))
+		}
+	}
+	return records
+}